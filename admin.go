@@ -0,0 +1,162 @@
+package catalogue
+
+// admin.go contains the /admin/cache routes operators use to look at and
+// invalidate the cache.
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrUnauthenticated is returned to admin requests without a valid token.
+var ErrUnauthenticated = NewError(CodeUnauthenticated, "admin token required")
+
+// DefaultInspectSample is the number of keys per namespace sampled by
+// GET /admin/cache/keys unless the sample parameter says otherwise.
+const DefaultInspectSample = 20
+
+// DefaultHotKeys is the number of keys listed by GET /admin/cache/hot unless
+// the n parameter says otherwise.
+const DefaultHotKeys = 20
+
+// AdminConfig wires the /admin/cache routes to the cache they manage.
+type AdminConfig struct {
+	// Token must be presented as "Authorization: Bearer <token>" or in the
+	// X-Admin-Token header. Every admin request is refused when it is empty.
+	Token string
+
+	// Metrics is reported by GET /admin/cache.
+	Metrics *CacheMetrics
+
+	// Cache receives the invalidation requests.
+	Cache CatalogueCache
+
+	// Inspector answers GET /admin/cache/keys. It may be nil.
+	Inspector CacheInspector
+
+	// HotKeys answers GET /admin/cache/hot. It may be nil.
+	HotKeys *AccessTracker
+
+	// Warmer runs POST /admin/cache/warm. It may be nil.
+	Warmer *CacheWarmer
+}
+
+// WithAdmin mounts the /admin routes.
+func WithAdmin(config AdminConfig) HandlerOption {
+	return func(c *handlerConfig) {
+		c.admin = &config
+	}
+}
+
+// mountAdmin adds the admin routes to r, all of which require the token:
+//
+// GET  /admin/breakers                       Circuit breaker states
+// GET  /admin/cache                          Metrics snapshot
+// GET  /admin/cache/keys?sample=N            Keys, memory and TTLs per namespace
+// GET  /admin/cache/hot?n=N                  Most requested keys
+// POST /admin/cache/warm                     Warm now and return the WarmReport
+// POST /admin/cache/invalidate/product/{id}  Invalidate one sock
+// POST /admin/cache/invalidate/tag/{tag}     Invalidate a tag and its lists
+// POST /admin/cache/invalidate/all           Invalidate everything but the stale copies
+func mountAdmin(r *mux.Router, config AdminConfig) {
+	a := r.PathPrefix("/admin").Subrouter()
+	a.Use(requireToken(config.Token))
+	a.Methods("GET").Path("/breakers").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encodeResponse(req.Context(), w, BreakerStates())
+	})
+
+	s := a.PathPrefix("/cache").Subrouter()
+
+	s.Methods("GET").Path("").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if config.Metrics == nil {
+			encodeError(req.Context(), NewError(CodeFailedPrecondition, "cache metrics are not enabled"), w)
+			return
+		}
+		encodeResponse(req.Context(), w, config.Metrics.GetMetrics())
+	})
+	s.Methods("GET").Path("/keys").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if config.Inspector == nil {
+			encodeError(req.Context(), NewError(CodeFailedPrecondition, "cache inspection is not available"), w)
+			return
+		}
+		sample := DefaultInspectSample
+		if v := req.FormValue("sample"); v != "" {
+			n, err := parsePositiveInt("sample", v)
+			if err != nil {
+				encodeError(req.Context(), err, w)
+				return
+			}
+			sample = n
+		}
+		stats, err := config.Inspector.Inspect(req.Context(), sample)
+		if err != nil {
+			encodeError(req.Context(), ErrCacheUnavailable.WithCause(err), w)
+			return
+		}
+		encodeResponse(req.Context(), w, stats)
+	})
+	s.Methods("GET").Path("/hot").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if config.HotKeys == nil {
+			encodeError(req.Context(), NewError(CodeFailedPrecondition, "hot key tracking is not enabled"), w)
+			return
+		}
+		n := DefaultHotKeys
+		if v := req.FormValue("n"); v != "" {
+			var err error
+			if n, err = parsePositiveInt("n", v); err != nil {
+				encodeError(req.Context(), err, w)
+				return
+			}
+		}
+		encodeResponse(req.Context(), w, config.HotKeys.HotKeys(n))
+	})
+	s.Methods("POST").Path("/warm").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if config.Warmer == nil {
+			encodeError(req.Context(), NewError(CodeFailedPrecondition, "cache warming is not enabled"), w)
+			return
+		}
+		report, err := config.Warmer.WarmCache(req.Context())
+		if err != nil {
+			encodeError(req.Context(), err, w)
+			return
+		}
+		encodeResponse(req.Context(), w, report)
+	})
+
+	invalidate := func(w http.ResponseWriter, req *http.Request, err error) {
+		if err != nil {
+			encodeError(req.Context(), ErrCacheUnavailable.WithCause(err), w)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	s.Methods("POST").Path("/invalidate/product/{id}").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		invalidate(w, req, config.Cache.InvalidateProduct(req.Context(), mux.Vars(req)["id"]))
+	})
+	s.Methods("POST").Path("/invalidate/tag/{tag}").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		invalidate(w, req, config.Cache.InvalidateTag(req.Context(), mux.Vars(req)["tag"]))
+	})
+	s.Methods("POST").Path("/invalidate/all").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		invalidate(w, req, config.Cache.InvalidateAll(req.Context()))
+	})
+}
+
+// requireToken refuses requests that do not carry the admin token.
+func requireToken(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			have := req.Header.Get("X-Admin-Token")
+			if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				have = strings.TrimPrefix(auth, "Bearer ")
+			}
+			if token == "" || subtle.ConstantTimeCompare([]byte(have), []byte(token)) != 1 {
+				encodeError(req.Context(), ErrUnauthenticated, w)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package catalogue
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+)
+
+func TestAdminCache(t *testing.T) {
+	cache := newFakeCache()
+	cache.products[s1.ID] = s1
+	metrics := NewCacheMetrics(log.NewNopLogger())
+	metrics.RecordCacheHit("Get", 0)
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(&stubService{}), "", log.NewNopLogger(),
+		WithAdmin(AdminConfig{Token: "s3cret", Metrics: metrics, Cache: cache}))
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if w := do("POST", "/admin/cache/invalidate/all", token); w.Code != 401 {
+			t.Errorf("POST with token %q: want 401, have %d", token, w.Code)
+		}
+		if w := do("GET", "/admin/breakers", token); w.Code != 401 {
+			t.Errorf("GET /admin/breakers with token %q: want 401, have %d", token, w.Code)
+		}
+	}
+	if _, ok := cache.products[s1.ID]; !ok {
+		t.Fatalf("unauthenticated request invalidated the cache")
+	}
+
+	if w := do("GET", "/admin/breakers", "s3cret"); w.Code != 200 {
+		t.Errorf("GET /admin/breakers: want 200, have %d", w.Code)
+	}
+
+	w := do("GET", "/admin/cache", "s3cret")
+	var snapshot MetricsSnapshot
+	if err := json.NewDecoder(w.Body).Decode(&snapshot); err != nil {
+		t.Fatalf("GET /admin/cache: %v", err)
+	}
+	if snapshot.CacheHits != 1 {
+		t.Errorf("GET /admin/cache: want 1 hit, have %d", snapshot.CacheHits)
+	}
+
+	if w := do("GET", "/admin/cache/keys", "s3cret"); w.Code != 412 {
+		t.Errorf("GET /admin/cache/keys without an inspector: want 412, have %d", w.Code)
+	}
+
+	if w := do("POST", "/admin/cache/invalidate/product/"+s1.ID, "s3cret"); w.Code != 204 {
+		t.Errorf("invalidate product: want 204, have %d", w.Code)
+	}
+	if _, ok := cache.products[s1.ID]; ok {
+		t.Errorf("invalidate product: %s still cached", s1.ID)
+	}
+	if w := do("POST", "/admin/cache/invalidate/tag/brown", "s3cret"); w.Code != 204 {
+		t.Errorf("invalidate tag: want 204, have %d", w.Code)
+	}
+	if want := []string{"brown"}; !reflect.DeepEqual(cache.invalidatedTags, want) {
+		t.Errorf("invalidate tag: want %v, have %v", want, cache.invalidatedTags)
+	}
+
+	// A warmer that cannot run says so rather than reporting nothing warmed
+	warmer := NewCacheWarmer(&stubService{}, cache, log.NewNopLogger())
+	warmer.Stop()
+	router = MakeHTTPHandler(context.Background(), MakeEndpoints(&stubService{}), "", log.NewNopLogger(),
+		WithAdmin(AdminConfig{Token: "s3cret", Cache: cache, Warmer: warmer}))
+	if w := do("POST", "/admin/cache/warm", "s3cret"); w.Code != 503 {
+		t.Errorf("warm with the warmer stopped: want 503, have %d", w.Code)
+	}
+}
+
+func TestKeyNamespaceAndTags(t *testing.T) {
+	for key, want := range map[string]string{
+		"catalogue:products:brown:order:id:page:1:size:6":      "catalogue:products:*",
+		"catalogue:product:a0a4f044":                           "catalogue:product:*",
+		"catalogue:stale:count:all":                            "catalogue:stale:count:*",
+		"catalogue:tags":                                       "catalogue:tags",
+		"catalogue:stale:products:all:order:id:page:1:size:10": "catalogue:stale:products:*",
+	} {
+		if have := keyNamespace(key); have != want {
+			t.Errorf("keyNamespace(%q): want %q, have %q", key, want, have)
+		}
+	}
+	if tags, ok := keyTags("catalogue:products:blue,brown:order:id:page:1:size:6"); !ok || !reflect.DeepEqual(tags, []string{"blue", "brown"}) {
+		t.Errorf("keyTags: want [blue brown], have %v (%v)", tags, ok)
+	}
+	if _, ok := keyTags("catalogue:product:1"); ok {
+		t.Errorf("keyTags(product key): want no tag filter")
+	}
+}
@@ -0,0 +1,188 @@
+package catalogue
+
+// blobstore.go contains the stores of the files the catalogue serves, such as
+// uploaded images: a directory on local disk, or a bucket of an S3
+// compatible object store.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// BlobStore stores files by key, a slash separated path such as
+// "uploads/3395a43e-.../5c1d....jpg".
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Open returns the file with the given key, or ErrBlobNotFound.
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// BlobInfo describes a stored file.
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// ErrBlobNotFound is returned when opening a file that is not in the store.
+var ErrBlobNotFound = NewError(CodeNotFound, "file not found")
+
+// cleanKey returns key without dot segments, so that it cannot leave the
+// store, and without a leading slash.
+func cleanKey(key string) string {
+	return path.Clean("/" + key)[1:]
+}
+
+// FileBlobStore stores files in a directory.
+type FileBlobStore struct {
+	root string
+}
+
+// NewFileBlobStore returns a store of the files in root.
+func NewFileBlobStore(root string) *FileBlobStore {
+	return &FileBlobStore{root: root}
+}
+
+func (s *FileBlobStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(cleanKey(key)))
+}
+
+// Put writes the file with the given key, creating its directories.
+func (s *FileBlobStore) Put(_ context.Context, key string, r io.Reader, _ int64, _ string) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// Written aside and renamed, so that readers never see half a file
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Open opens the file with the given key. Directories are not found.
+func (s *FileBlobStore) Open(_ context.Context, key string) (io.ReadSeekCloser, BlobInfo, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = ErrBlobNotFound
+	}
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, err
+	}
+	return f, BlobInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the file with the given key, if it is there.
+func (s *FileBlobStore) Delete(_ context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// S3Config locates a bucket of an S3 compatible store, such as AWS S3 or
+// MinIO.
+type S3Config struct {
+	Endpoint  string // host[:port], without scheme
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Secure    bool // HTTPS
+	// PathStyle addresses the bucket in the path rather than the host name,
+	// as MinIO and most stand-ins expect.
+	PathStyle bool
+}
+
+// S3BlobStore stores files as the objects of a bucket.
+type S3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3BlobStore returns a store of the objects in the bucket of config. It
+// does not check that the bucket exists.
+func NewS3BlobStore(config S3Config) (*S3BlobStore, error) {
+	lookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       config.Secure,
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3BlobStore{client: client, bucket: config.Bucket}, nil
+}
+
+// Put uploads the object with the given key.
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, cleanKey(key), r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+// Open returns the object with the given key, which is read lazily.
+func (s *S3BlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, cleanKey(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, BlobInfo{}, s3Error(err)
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, BlobInfo{}, s3Error(err)
+	}
+	return obj, BlobInfo{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+// Delete removes the object with the given key, if it is there.
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	return s3Error(s.client.RemoveObject(ctx, s.bucket, cleanKey(key), minio.RemoveObjectOptions{}))
+}
+
+// s3Error turns the error responses for missing objects into ErrBlobNotFound.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrBlobNotFound
+	}
+	return err
+}
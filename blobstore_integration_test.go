@@ -0,0 +1,40 @@
+//go:build integration
+
+package catalogue
+
+// Run against a MinIO server with a catalogue-images bucket:
+//
+//	docker run -d -p 9000:9000 minio/minio server /data
+//	mc alias set local http://localhost:9000 minioadmin minioadmin
+//	mc mb local/catalogue-images
+//	CATALOGUE_TEST_S3=localhost:9000 go test -tags integration -run Integration .
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIntegrationS3BlobStore(t *testing.T) {
+	endpoint := os.Getenv("CATALOGUE_TEST_S3")
+	if endpoint == "" {
+		t.Skip("CATALOGUE_TEST_S3 is not set")
+	}
+	store, err := NewS3BlobStore(S3Config{
+		Endpoint:  endpoint,
+		Bucket:    "catalogue-images",
+		AccessKey: envOr("S3_ACCESS_KEY", "minioadmin"),
+		SecretKey: envOr("S3_SECRET_KEY", "minioadmin"),
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+}
+
+func envOr(name, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return value
+}
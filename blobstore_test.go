@@ -0,0 +1,146 @@
+package catalogue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBlobStore puts, opens and deletes a file in store.
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	data := []byte("not really a jpeg")
+	if err := store.Put(ctx, "uploads/a.jpg", bytes.NewReader(data), int64(len(data)), "image/jpeg"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	f, info, err := store.Open(ctx, "uploads/a.jpg")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	have, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || !bytes.Equal(have, data) || info.Size != int64(len(data)) || info.ModTime.IsZero() {
+		t.Errorf("Open: want %q, have %q, %+v (%v)", data, have, info, err)
+	}
+	if _, _, err := store.Open(ctx, "uploads/missing.jpg"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Open of a missing file: want %v, have %v", ErrBlobNotFound, err)
+	}
+	if err := store.Delete(ctx, "uploads/a.jpg"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := store.Open(ctx, "uploads/a.jpg"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Open after Delete: want %v, have %v", ErrBlobNotFound, err)
+	}
+}
+
+func TestFileBlobStore(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "images")
+	store := NewFileBlobStore(root)
+	testBlobStore(t, store)
+
+	// Keys cannot leave the directory
+	ctx := context.Background()
+	if err := store.Put(ctx, "../escaped.jpg", strings.NewReader("x"), 1, "image/jpeg"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped.jpg")); err != nil {
+		t.Errorf("Put of ../escaped.jpg: want it in the directory, %v", err)
+	}
+	if _, _, err := store.Open(ctx, "uploads"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Open of a directory: want %v, have %v", ErrBlobNotFound, err)
+	}
+}
+
+// fakeS3 is an S3 compatible server keeping objects in memory. It answers the
+// requests of path-style clients and does not check their signatures.
+type fakeS3 struct {
+	mtx     sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case "PUT":
+		body, err := io.ReadAll(r.Body)
+		if err == nil && strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body, err = decodeAWSChunked(body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = body
+		w.Header().Set("ETag", `"fake"`)
+	case "GET", "HEAD":
+		data, ok := s.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			return
+		}
+		w.Header().Set("ETag", `"fake"`)
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(data))
+	case "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// decodeAWSChunked decodes a body sent with aws-chunked content encoding.
+func decodeAWSChunked(body []byte) ([]byte, error) {
+	var data []byte
+	r := bufio.NewReader(bytes.NewReader(body))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2) // and its CRLF
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+	store, err := NewS3BlobStore(S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Bucket:    "images",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+}
@@ -0,0 +1,326 @@
+package catalogue
+
+// breaker.go contains the shared circuit breaker plumbing: settings, state
+// change logging and the Prometheus gauges that expose breaker state.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sony/gobreaker"
+)
+
+var (
+	// BreakerState reports the current state of each named circuit breaker:
+	// 0 closed, 1 half-open, 2 open.
+	BreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "catalogue_circuit_breaker_state",
+		Help: "Current circuit breaker state (0 closed, 1 half-open, 2 open).",
+	}, []string{"name"})
+
+	// BreakerTransitions counts circuit breaker state changes.
+	BreakerTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "catalogue_circuit_breaker_transitions_total",
+		Help: "Number of circuit breaker state transitions.",
+	}, []string{"name", "from", "to"})
+)
+
+func init() {
+	prometheus.MustRegister(BreakerState, BreakerTransitions)
+}
+
+// BreakerSettings configures a circuit breaker.
+type BreakerSettings struct {
+	// ConsecutiveFailures trips the breaker after this many failures in a row.
+	ConsecutiveFailures uint32
+	// FailureRatio, when non-zero, also trips the breaker once at least
+	// MinRequests have been seen in the current interval and this fraction of
+	// them failed.
+	FailureRatio float64
+	MinRequests  uint32
+	// Interval is the cyclic period of the closed state after which the
+	// failure counts are cleared. Zero never clears them while closed.
+	Interval time.Duration
+	// Timeout is how long the breaker stays open before going half-open.
+	Timeout time.Duration
+	// MaxRequests is the number of probe requests allowed while half-open.
+	MaxRequests uint32
+}
+
+// DefaultCacheBreakerSettings trips the Redis breaker quickly and probes again
+// soon afterwards: the database is always there to fall back to.
+var DefaultCacheBreakerSettings = BreakerSettings{
+	ConsecutiveFailures: 5,
+	Timeout:             10 * time.Second,
+	MaxRequests:         1,
+}
+
+// withDefaults returns s with the fields it leaves zero taken from defaults,
+// the settings of the kind of breaker s configures.
+func (s BreakerSettings) withDefaults(defaults BreakerSettings) BreakerSettings {
+	if s.ConsecutiveFailures == 0 {
+		s.ConsecutiveFailures = defaults.ConsecutiveFailures
+	}
+	if s.Timeout == 0 {
+		s.Timeout = defaults.Timeout
+	}
+	if s.MaxRequests == 0 {
+		s.MaxRequests = defaults.MaxRequests
+	}
+	return s
+}
+
+// NewCircuitBreaker returns a gobreaker circuit breaker built from the given
+// settings, which are used as they are: callers fill in the defaults of
+// their kind of breaker first, see withDefaults. State changes are logged and
+// exported as Prometheus metrics. isSuccessful may be nil, in which case
+// every non-nil error is a failure.
+func NewCircuitBreaker(name string, settings BreakerSettings, isSuccessful func(error) bool, logger log.Logger) *gobreaker.CircuitBreaker {
+	BreakerState.WithLabelValues(name).Set(float64(gobreaker.StateClosed))
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        name,
+		MaxRequests: settings.MaxRequests,
+		Interval:    settings.Interval,
+		Timeout:     settings.Timeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			if counts.ConsecutiveFailures >= settings.ConsecutiveFailures {
+				return true
+			}
+			if settings.FailureRatio <= 0 || counts.Requests < settings.MinRequests || counts.Requests == 0 {
+				return false
+			}
+			return float64(counts.TotalFailures)/float64(counts.Requests) >= settings.FailureRatio
+		},
+		IsSuccessful: isSuccessful,
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			logger.Log("circuit_breaker", name, "from", from.String(), "to", to.String())
+			BreakerState.WithLabelValues(name).Set(float64(to))
+			BreakerTransitions.WithLabelValues(name, from.String(), to.String()).Inc()
+		},
+	})
+	breakers.add(cb)
+	return cb
+}
+
+// breakers remembers every breaker created by NewCircuitBreaker so that
+// their state can be listed by the admin endpoint.
+var breakers = &breakerRegistry{byName: map[string]*gobreaker.CircuitBreaker{}}
+
+type breakerRegistry struct {
+	mu     sync.RWMutex
+	byName map[string]*gobreaker.CircuitBreaker
+}
+
+func (r *breakerRegistry) add(cb *gobreaker.CircuitBreaker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byName[cb.Name()] = cb
+}
+
+// BreakerStatus is a point-in-time view of a circuit breaker.
+type BreakerStatus struct {
+	Name                 string `json:"name"`
+	State                string `json:"state"`
+	Requests             uint32 `json:"requests"`
+	TotalSuccesses       uint32 `json:"totalSuccesses"`
+	TotalFailures        uint32 `json:"totalFailures"`
+	ConsecutiveSuccesses uint32 `json:"consecutiveSuccesses"`
+	ConsecutiveFailures  uint32 `json:"consecutiveFailures"`
+}
+
+// BreakerStates returns the status of every known circuit breaker, sorted by
+// name.
+func BreakerStates() []BreakerStatus {
+	breakers.mu.RLock()
+	defer breakers.mu.RUnlock()
+	states := make([]BreakerStatus, 0, len(breakers.byName))
+	for name, cb := range breakers.byName {
+		counts := cb.Counts()
+		states = append(states, BreakerStatus{
+			Name:                 name,
+			State:                cb.State().String(),
+			Requests:             counts.Requests,
+			TotalSuccesses:       counts.TotalSuccesses,
+			TotalFailures:        counts.TotalFailures,
+			ConsecutiveSuccesses: counts.ConsecutiveSuccesses,
+			ConsecutiveFailures:  counts.ConsecutiveFailures,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// DefaultRouteBreakerSettings matches gobreaker's defaults, which is what the
+// HTTP routes used before their breakers became configurable.
+var DefaultRouteBreakerSettings = BreakerSettings{
+	ConsecutiveFailures: 6,
+	Timeout:             30 * time.Second,
+	MaxRequests:         1,
+}
+
+// breakerConfig is the JSON form of BreakerSettings, with durations written
+// as strings such as "30s".
+type breakerConfig struct {
+	ConsecutiveFailures uint32  `json:"consecutiveFailures"`
+	FailureRatio        float64 `json:"failureRatio"`
+	MinRequests         uint32  `json:"minRequests"`
+	Interval            string  `json:"interval"`
+	Timeout             string  `json:"timeout"`
+	MaxRequests         uint32  `json:"maxRequests"`
+}
+
+// LoadBreakerSettings reads per-route breaker settings from a JSON file
+// keyed by route name (List, Count, Get, Tags, Health), with "*" applying to
+// every route that has no entry of its own:
+//
+//	{"*": {"timeout": "30s"}, "List": {"consecutiveFailures": 3, "interval": "1m"}}
+//
+// Fields left out of a route's entry are taken from "*", and fields left out
+// of "*" from DefaultRouteBreakerSettings.
+func LoadBreakerSettings(path string) (map[string]BreakerSettings, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var raw map[string]breakerConfig
+	if err := json.NewDecoder(f).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	base := DefaultRouteBreakerSettings
+	if c, ok := raw["*"]; ok {
+		if base, err = c.apply(base); err != nil {
+			return nil, fmt.Errorf("%s: *: %v", path, err)
+		}
+	}
+	settings := map[string]BreakerSettings{"*": base}
+	for route, c := range raw {
+		if route == "*" {
+			continue
+		}
+		if settings[route], err = c.apply(base); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, route, err)
+		}
+	}
+	return settings, nil
+}
+
+// apply returns base overridden by every field set in c.
+func (c breakerConfig) apply(base BreakerSettings) (BreakerSettings, error) {
+	s := base
+	if c.ConsecutiveFailures > 0 {
+		s.ConsecutiveFailures = c.ConsecutiveFailures
+	}
+	if c.FailureRatio > 0 {
+		s.FailureRatio = c.FailureRatio
+	}
+	if c.MinRequests > 0 {
+		s.MinRequests = c.MinRequests
+	}
+	if c.MaxRequests > 0 {
+		s.MaxRequests = c.MaxRequests
+	}
+	var err error
+	if c.Interval != "" {
+		if s.Interval, err = time.ParseDuration(c.Interval); err != nil {
+			return s, fmt.Errorf("interval: %v", err)
+		}
+	}
+	if c.Timeout != "" {
+		if s.Timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return s, fmt.Errorf("timeout: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// DefaultDBBreakerSettings gives MySQL a little more room than Redis before
+// tripping, since there is nothing behind it except stale copies.
+var DefaultDBBreakerSettings = BreakerSettings{
+	ConsecutiveFailures: 5,
+	Timeout:             15 * time.Second,
+	MaxRequests:         1,
+}
+
+// CircuitBreakerMiddleware guards the database-backed service with a
+// circuit breaker named "catalogue-db". Only database failures count against
+// the breaker; a sock that doesn't exist is a perfectly healthy answer. While
+// the breaker is open, calls fail fast with ErrDBConnection. Settings left
+// zero are those of DefaultDBBreakerSettings.
+func CircuitBreakerMiddleware(settings BreakerSettings, logger log.Logger) Middleware {
+	return func(next Service) Service {
+		return &breakerMiddleware{
+			next: next,
+			cb: NewCircuitBreaker("catalogue-db", settings.withDefaults(DefaultDBBreakerSettings), func(err error) bool {
+				return err == nil || !errors.Is(err, ErrDBConnection)
+			}, logger),
+		}
+	}
+}
+
+type breakerMiddleware struct {
+	next Service
+	cb   *gobreaker.CircuitBreaker
+}
+
+func (mw *breakerMiddleware) do(fn func() error) error {
+	_, err := mw.cb.Execute(func() (interface{}, error) {
+		return nil, fn()
+	})
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return ErrDBConnection.WithCause(err)
+	}
+	return err
+}
+
+func (mw *breakerMiddleware) List(filter Filter, order string, pageNum, pageSize int) (socks []Sock, err error) {
+	err = mw.do(func() error {
+		socks, err = mw.next.List(filter, order, pageNum, pageSize)
+		return err
+	})
+	return socks, err
+}
+
+func (mw *breakerMiddleware) Count(filter Filter) (n int, err error) {
+	err = mw.do(func() error {
+		n, err = mw.next.Count(filter)
+		return err
+	})
+	return n, err
+}
+
+func (mw *breakerMiddleware) Get(id string) (sock Sock, err error) {
+	err = mw.do(func() error {
+		sock, err = mw.next.Get(id)
+		return err
+	})
+	return sock, err
+}
+
+func (mw *breakerMiddleware) GetMany(ids []string) (socks []Sock, err error) {
+	err = mw.do(func() error {
+		socks, err = GetSocks(mw.next, ids)
+		return err
+	})
+	return socks, err
+}
+
+func (mw *breakerMiddleware) Tags() (tags []string, err error) {
+	err = mw.do(func() error {
+		tags, err = mw.next.Tags()
+		return err
+	})
+	return tags, err
+}
+
+func (mw *breakerMiddleware) Health() []Health {
+	return mw.next.Health()
+}
@@ -0,0 +1,110 @@
+package catalogue
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+)
+
+func TestLoadBreakerSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breakers.json")
+	config := `{
+		"*":    {"timeout": "5s", "maxRequests": 2},
+		"List": {"consecutiveFailures": 3, "failureRatio": 0.5, "minRequests": 10, "interval": "1m"}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := LoadBreakerSettings(path)
+	if err != nil {
+		t.Fatalf("LoadBreakerSettings: %v", err)
+	}
+	want := BreakerSettings{
+		ConsecutiveFailures: 3,
+		FailureRatio:        0.5,
+		MinRequests:         10,
+		Interval:            time.Minute,
+		Timeout:             5 * time.Second,
+		MaxRequests:         2,
+	}
+	if have := settings["List"]; have != want {
+		t.Errorf("List: want %+v, have %+v", want, have)
+	}
+	want = DefaultRouteBreakerSettings
+	want.Timeout = 5 * time.Second
+	want.MaxRequests = 2
+	if have := settings["*"]; have != want {
+		t.Errorf("*: want %+v, have %+v", want, have)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"Get": {"timeout": "soon"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBreakerSettings(path); err == nil {
+		t.Errorf("LoadBreakerSettings with a bad duration: want error, have nil")
+	}
+}
+
+func TestRouteBreakerIgnoresClientErrors(t *testing.T) {
+	next := &stubService{socks: map[string]Sock{}}
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(next), "", log.NewNopLogger(),
+		WithBreakerSettings(map[string]BreakerSettings{"Get": {ConsecutiveFailures: 2, Timeout: time.Minute}}))
+
+	get := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/catalogue/missing", nil))
+		return w.Code
+	}
+	for i := 0; i < 5; i++ {
+		if code := get(); code != 404 {
+			t.Fatalf("GET /catalogue/missing #%d: want 404, have %d", i, code)
+		}
+	}
+
+	next.err = ErrDBConnection
+	get()
+	get()
+	next.err = nil
+	if code := get(); code != 503 {
+		t.Errorf("GET after two database errors: want 503 from the open breaker, have %d", code)
+	}
+	for _, b := range BreakerStates() {
+		if b.Name == "Get" && b.State != "open" {
+			t.Errorf("BreakerStates: want Get open, have %s", b.State)
+		}
+	}
+}
+
+func TestBreakerDefaults(t *testing.T) {
+	// Each kind of breaker falls back to its own defaults
+	if s := routeBreakerSettings(map[string]BreakerSettings{"Get": {Timeout: time.Minute}}, "Get"); s.ConsecutiveFailures != DefaultRouteBreakerSettings.ConsecutiveFailures || s.Timeout != time.Minute {
+		t.Errorf("route breaker: want %d failures and the timeout set, have %+v", DefaultRouteBreakerSettings.ConsecutiveFailures, s)
+	}
+	if s := (BreakerSettings{ConsecutiveFailures: 2}).withDefaults(DefaultDBBreakerSettings); s.ConsecutiveFailures != 2 || s.Timeout != DefaultDBBreakerSettings.Timeout {
+		t.Errorf("database breaker: want 2 failures and the default timeout, have %+v", s)
+	}
+
+	// A 500 while the breaker is closed, a 503 once it is open
+	next := &stubService{err: errors.New("boom")}
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(next), "", log.NewNopLogger(),
+		WithBreakerSettings(map[string]BreakerSettings{"Tags": {Timeout: time.Minute}}))
+	get := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/tags", nil))
+		return w.Code
+	}
+	for i := uint32(0); i < DefaultRouteBreakerSettings.ConsecutiveFailures; i++ {
+		if code := get(); code != 500 {
+			t.Fatalf("GET /tags #%d: want 500 with the breaker closed, have %d", i, code)
+		}
+	}
+	if code := get(); code != 503 {
+		t.Errorf("GET /tags after %d errors: want 503 from the open breaker, have %d", DefaultRouteBreakerSettings.ConsecutiveFailures, code)
+	}
+}
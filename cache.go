@@ -15,37 +15,116 @@ import (
 // CatalogueCache defines the interface for Redis caching operations
 type CatalogueCache interface {
 	// Product caching
-	GetProducts(ctx context.Context, tags []string, order string, pageNum, pageSize int) ([]Sock, bool, error)
-	SetProducts(ctx context.Context, tags []string, order string, pageNum, pageSize int, products []Sock) error
+	GetProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int) ([]Sock, bool, error)
+	SetProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int, products []Sock) error
 	
 	// Individual product caching
 	GetProduct(ctx context.Context, id string) (Sock, bool, error)
+	// The socks of ids that are cached, by id, in one round trip
+	GetProductsByID(ctx context.Context, ids []string) (map[string]Sock, error)
 	SetProduct(ctx context.Context, id string, product Sock) error
 	
 	// Count caching
-	GetCount(ctx context.Context, tags []string) (int, bool, error)
-	SetCount(ctx context.Context, tags []string, count int) error
+	GetCount(ctx context.Context, filter Filter) (int, bool, error)
+	SetCount(ctx context.Context, filter Filter, count int) error
 	
 	// Tags caching
 	GetTags(ctx context.Context) ([]string, bool, error)
 	SetTags(ctx context.Context, tags []string) error
 	
+	// Last-known-good copies, kept for much longer than the regular entries
+	// and served when the database is unavailable
+	GetStaleProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int) ([]Sock, bool, error)
+	GetStaleProduct(ctx context.Context, id string) (Sock, bool, error)
+	GetStaleProductsByID(ctx context.Context, ids []string) (map[string]Sock, error)
+	GetStaleCount(ctx context.Context, filter Filter) (int, bool, error)
+	GetStaleTags(ctx context.Context) ([]string, bool, error)
+	
+	// Bulk writes, in as few round trips as possible
+	SetMany(ctx context.Context, entries []CacheEntry) error
+	
+	// Any entry written by SetMany, decoded into value, which must be a
+	// pointer
+	GetEntry(ctx context.Context, r WarmRequest, value interface{}) (bool, error)
+	
+	// Any entry as it is stored, without decoding it, with the ETag stored
+	// next to listings and socks and the time it has left
+	GetRaw(ctx context.Context, r WarmRequest) (RawEntry, bool, error)
+	
 	// Cache invalidation
 	InvalidateProduct(ctx context.Context, id string) error
+	InvalidateTag(ctx context.Context, tag string) error
 	InvalidateAll(ctx context.Context) error
+	Invalidate(ctx context.Context, inv Invalidation) error
 	
 	// Health check
 	Ping(ctx context.Context) error
 }
 
+// CacheEntry is a value to store under the cache key of Request: []Sock for
+// List, Sock for Get, int for Count and []string for Tags
+type CacheEntry struct {
+	Request WarmRequest
+	Value   interface{}
+}
+
+// RawEntry is a cache entry as it is stored: its JSON, not decoded, the
+// ETag of that JSON sent as a response, when it was stored with one, and how
+// long it had left before it expired when it was read.
+type RawEntry struct {
+	JSON []byte
+	ETag string
+	TTL  time.Duration
+}
+
+// Invalidation describes the cache entries made stale by changes to the
+// catalogue. Listings and counts are matched by filter: the unfiltered ones
+// and those filtering on any of Tags.
+type Invalidation struct {
+	Products []string // socks whose own entries changed
+	Tags     []string // tags whose listings or counts changed
+	Listings bool     // invalidate the matching listings
+	Counts   bool     // invalidate the matching counts
+	TagList  bool     // invalidate the list of tags
+}
+
+// matches reports whether a listing or count with the given filter is stale
+func (inv Invalidation) matches(filter []string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, t := range filter {
+		if contains(inv.Tags, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultCacheTTL is how long NewCatalogueCache keeps entries.
+const DefaultCacheTTL = 30 * time.Minute
+
 type catalogueCache struct {
-	client *redis.Client
-	logger log.Logger
-	ttl    time.Duration
+	client   *redis.Client
+	logger   log.Logger
+	ttl      time.Duration
+	staleTTL time.Duration
+}
+
+// CacheOption configures a Redis cache created by NewCatalogueCache
+type CacheOption func(*catalogueCache)
+
+// WithStaleTTL makes every Set also write a last-known-good copy of the entry
+// that lives for ttl, for use when the database is unavailable. A zero ttl
+// (the default) disables stale copies.
+func WithStaleTTL(ttl time.Duration) CacheOption {
+	return func(c *catalogueCache) {
+		c.staleTTL = ttl
+	}
 }
 
 // NewCatalogueCache creates a new Redis cache instance
-func NewCatalogueCache(redisAddr string, logger log.Logger) CatalogueCache {
+func NewCatalogueCache(redisAddr string, logger log.Logger, opts ...CacheOption) CatalogueCache {
 	rdb := redis.NewClient(&redis.Options{
 		Addr:         redisAddr,
 		Password:     "", // no password
@@ -57,66 +136,128 @@ func NewCatalogueCache(redisAddr string, logger log.Logger) CatalogueCache {
 		PoolTimeout:  5 * time.Second,
 	})
 
-	return &catalogueCache{
+	c := &catalogueCache{
 		client: rdb,
 		logger: logger,
-		ttl:    30 * time.Minute, // 30 minutes cache TTL
+		ttl:    DefaultCacheTTL,
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
 // Cache key generators
-func (c *catalogueCache) productListKey(tags []string, order string, pageNum, pageSize int) string {
-	tagsStr := strings.Join(tags, ",")
+func productListKey(filter Filter, order string, pageNum, pageSize int) string {
+	tagsStr := strings.Join(filter.Tags, ",")
 	if tagsStr == "" {
 		tagsStr = "all"
 	}
-	return fmt.Sprintf("catalogue:products:%s:order:%s:page:%d:size:%d", tagsStr, order, pageNum, pageSize)
+	return fmt.Sprintf("catalogue:products:%s:order:%s:page:%d:size:%d", tagsStr, order, pageNum, pageSize) + variantSuffix(filter.VariantSize)
 }
 
-func (c *catalogueCache) productKey(id string) string {
+func productKey(id string) string {
 	return fmt.Sprintf("catalogue:product:%s", id)
 }
 
-func (c *catalogueCache) countKey(tags []string) string {
-	tagsStr := strings.Join(tags, ",")
+// currenciesKey is the set of the keys of the converted entries of a sock,
+// see ConvertEndpoints, so that they are invalidated with it
+func currenciesKey(id string) string {
+	return "catalogue:currencies:" + id
+}
+
+func countKey(filter Filter) string {
+	tagsStr := strings.Join(filter.Tags, ",")
 	if tagsStr == "" {
 		tagsStr = "all"
 	}
-	return fmt.Sprintf("catalogue:count:%s", tagsStr)
+	return fmt.Sprintf("catalogue:count:%s", tagsStr) + variantSuffix(filter.VariantSize)
 }
 
-func (c *catalogueCache) tagsKey() string {
+// etagKey is the key of the ETag stored next to the listing or sock under
+// key, so that hits are sent without hashing them again
+func etagKey(key string) string {
+	return key + ":etag"
+}
+
+// withETag reports whether entries of r are stored with their ETag: those
+// sent as they are stored, see RawService
+func withETag(r WarmRequest) bool {
+	return r.Currency == "" && (r.Operation == "List" || r.Operation == "Get")
+}
+
+// variantSuffix is appended to the keys of listings and counts filtered by
+// variant size
+func variantSuffix(size string) string {
+	if size == "" {
+		return ""
+	}
+	return ":variant:" + size
+}
+
+func tagsKey() string {
 	return "catalogue:tags:all"
 }
 
+// staleKey maps a regular cache key to the key of its last-known-good copy
+func (c *catalogueCache) staleKey(key string) string {
+	return "catalogue:stale:" + strings.TrimPrefix(key, "catalogue:")
+}
+
+// set writes value under key and, when stale copies are enabled, under its
+// stale key in the same round trip. Values with an etag have it written in
+// the same transaction, so that readers never see one without the other.
+func (c *catalogueCache) set(ctx context.Context, key string, value interface{}, etag string) error {
+	if c.staleTTL <= 0 && etag == "" {
+		return c.client.Set(ctx, key, value, c.ttl).Err()
+	}
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, value, c.ttl)
+		if etag != "" {
+			pipe.Set(ctx, etagKey(key), etag, c.ttl)
+		}
+		if c.staleTTL > 0 {
+			pipe.Set(ctx, c.staleKey(key), value, c.staleTTL)
+		}
+		return nil
+	})
+	return err
+}
+
 // Product list operations
-func (c *catalogueCache) GetProducts(ctx context.Context, tags []string, order string, pageNum, pageSize int) ([]Sock, bool, error) {
-	key := c.productListKey(tags, order, pageNum, pageSize)
-	
+func (c *catalogueCache) GetProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int) ([]Sock, bool, error) {
+	return c.getProducts(ctx, productListKey(filter, order, pageNum, pageSize), "GetProducts")
+}
+
+func (c *catalogueCache) GetStaleProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int) ([]Sock, bool, error) {
+	return c.getProducts(ctx, c.staleKey(productListKey(filter, order, pageNum, pageSize)), "GetStaleProducts")
+}
+
+func (c *catalogueCache) getProducts(ctx context.Context, key, operation string) ([]Sock, bool, error) {
 	val, err := c.client.Get(ctx, key).Result()
 	if err == redis.Nil {
-		c.logger.Log("cache", "miss", "key", key, "operation", "GetProducts")
+		c.logger.Log("cache", "miss", "key", key, "operation", operation)
 		return nil, false, nil
 	}
 	if err != nil {
-		c.logger.Log("cache", "error", "operation", "GetProducts", "key", key, "error", err)
+		c.logger.Log("cache", "error", "operation", operation, "key", key, "error", err)
 		return nil, false, err
 	}
 
 	var products []Sock
 	if err := json.Unmarshal([]byte(val), &products); err != nil {
-		c.logger.Log("cache", "unmarshal_error", "operation", "GetProducts", "key", key, "error", err)
+		c.logger.Log("cache", "unmarshal_error", "operation", operation, "key", key, "error", err)
 		// Delete corrupted cache entry
 		c.client.Del(ctx, key)
 		return nil, false, nil
 	}
 
-	c.logger.Log("cache", "hit", "key", key, "operation", "GetProducts", "count", len(products))
+	c.logger.Log("cache", "hit", "key", key, "operation", operation, "count", len(products))
 	return products, true, nil
 }
 
-func (c *catalogueCache) SetProducts(ctx context.Context, tags []string, order string, pageNum, pageSize int, products []Sock) error {
-	key := c.productListKey(tags, order, pageNum, pageSize)
+func (c *catalogueCache) SetProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int, products []Sock) error {
+	key := productListKey(filter, order, pageNum, pageSize)
 	
 	data, err := json.Marshal(products)
 	if err != nil {
@@ -124,7 +265,7 @@ func (c *catalogueCache) SetProducts(ctx context.Context, tags []string, order s
 		return err
 	}
 
-	err = c.client.Set(ctx, key, data, c.ttl).Err()
+	err = c.set(ctx, key, data, jsonETag(data))
 	if err != nil {
 		c.logger.Log("cache", "error", "operation", "SetProducts", "key", key, "error", err)
 		return err
@@ -136,32 +277,90 @@ func (c *catalogueCache) SetProducts(ctx context.Context, tags []string, order s
 
 // Individual product operations
 func (c *catalogueCache) GetProduct(ctx context.Context, id string) (Sock, bool, error) {
-	key := c.productKey(id)
-	
+	return c.getProduct(ctx, productKey(id), id, "GetProduct")
+}
+
+func (c *catalogueCache) GetStaleProduct(ctx context.Context, id string) (Sock, bool, error) {
+	return c.getProduct(ctx, c.staleKey(productKey(id)), id, "GetStaleProduct")
+}
+
+func (c *catalogueCache) getProduct(ctx context.Context, key, id, operation string) (Sock, bool, error) {
 	val, err := c.client.Get(ctx, key).Result()
 	if err == redis.Nil {
-		c.logger.Log("cache", "miss", "key", key, "operation", "GetProduct")
+		c.logger.Log("cache", "miss", "key", key, "operation", operation)
 		return Sock{}, false, nil
 	}
 	if err != nil {
-		c.logger.Log("cache", "error", "operation", "GetProduct", "key", key, "error", err)
+		c.logger.Log("cache", "error", "operation", operation, "key", key, "error", err)
 		return Sock{}, false, err
 	}
 
 	var product Sock
 	if err := json.Unmarshal([]byte(val), &product); err != nil {
-		c.logger.Log("cache", "unmarshal_error", "operation", "GetProduct", "key", key, "error", err)
+		c.logger.Log("cache", "unmarshal_error", "operation", operation, "key", key, "error", err)
 		// Delete corrupted cache entry
 		c.client.Del(ctx, key)
 		return Sock{}, false, nil
 	}
 
-	c.logger.Log("cache", "hit", "key", key, "operation", "GetProduct", "product_id", id)
+	c.logger.Log("cache", "hit", "key", key, "operation", operation, "product_id", id)
 	return product, true, nil
 }
 
+func (c *catalogueCache) GetProductsByID(ctx context.Context, ids []string) (map[string]Sock, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = productKey(id)
+	}
+	return c.getProductsByID(ctx, ids, keys, "GetProductsByID")
+}
+
+func (c *catalogueCache) GetStaleProductsByID(ctx context.Context, ids []string) (map[string]Sock, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = c.staleKey(productKey(id))
+	}
+	return c.getProductsByID(ctx, ids, keys, "GetStaleProductsByID")
+}
+
+// getProductsByID is getProduct for the socks of ids, under keys, with one
+// MGET.
+func (c *catalogueCache) getProductsByID(ctx context.Context, ids, keys []string, operation string) (map[string]Sock, error) {
+	products := make(map[string]Sock, len(ids))
+	if len(keys) == 0 {
+		return products, nil
+	}
+	vals, err := c.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		c.logger.Log("cache", "error", "operation", operation, "keys", len(keys), "error", err)
+		return nil, err
+	}
+
+	var corrupted []string
+	for i, val := range vals {
+		data, ok := val.(string)
+		if !ok {
+			continue
+		}
+		var product Sock
+		if err := json.Unmarshal([]byte(data), &product); err != nil {
+			c.logger.Log("cache", "unmarshal_error", "operation", operation, "key", keys[i], "error", err)
+			corrupted = append(corrupted, keys[i])
+			continue
+		}
+		products[ids[i]] = product
+	}
+	if len(corrupted) > 0 {
+		// Delete corrupted cache entries
+		c.client.Del(ctx, corrupted...)
+	}
+
+	c.logger.Log("cache", "mget", "operation", operation, "keys", len(keys), "hits", len(products))
+	return products, nil
+}
+
 func (c *catalogueCache) SetProduct(ctx context.Context, id string, product Sock) error {
-	key := c.productKey(id)
+	key := productKey(id)
 	
 	data, err := json.Marshal(product)
 	if err != nil {
@@ -169,7 +368,7 @@ func (c *catalogueCache) SetProduct(ctx context.Context, id string, product Sock
 		return err
 	}
 
-	err = c.client.Set(ctx, key, data, c.ttl).Err()
+	err = c.set(ctx, key, data, jsonETag(data))
 	if err != nil {
 		c.logger.Log("cache", "error", "operation", "SetProduct", "key", key, "error", err)
 		return err
@@ -180,35 +379,41 @@ func (c *catalogueCache) SetProduct(ctx context.Context, id string, product Sock
 }
 
 // Count operations
-func (c *catalogueCache) GetCount(ctx context.Context, tags []string) (int, bool, error) {
-	key := c.countKey(tags)
-	
+func (c *catalogueCache) GetCount(ctx context.Context, filter Filter) (int, bool, error) {
+	return c.getCount(ctx, countKey(filter), "GetCount")
+}
+
+func (c *catalogueCache) GetStaleCount(ctx context.Context, filter Filter) (int, bool, error) {
+	return c.getCount(ctx, c.staleKey(countKey(filter)), "GetStaleCount")
+}
+
+func (c *catalogueCache) getCount(ctx context.Context, key, operation string) (int, bool, error) {
 	val, err := c.client.Get(ctx, key).Result()
 	if err == redis.Nil {
-		c.logger.Log("cache", "miss", "key", key, "operation", "GetCount")
+		c.logger.Log("cache", "miss", "key", key, "operation", operation)
 		return 0, false, nil
 	}
 	if err != nil {
-		c.logger.Log("cache", "error", "operation", "GetCount", "key", key, "error", err)
+		c.logger.Log("cache", "error", "operation", operation, "key", key, "error", err)
 		return 0, false, err
 	}
 
 	count, err := strconv.Atoi(val)
 	if err != nil {
-		c.logger.Log("cache", "parse_error", "operation", "GetCount", "key", key, "error", err)
+		c.logger.Log("cache", "parse_error", "operation", operation, "key", key, "error", err)
 		// Delete corrupted cache entry
 		c.client.Del(ctx, key)
 		return 0, false, nil
 	}
 
-	c.logger.Log("cache", "hit", "key", key, "operation", "GetCount", "count", count)
+	c.logger.Log("cache", "hit", "key", key, "operation", operation, "count", count)
 	return count, true, nil
 }
 
-func (c *catalogueCache) SetCount(ctx context.Context, tags []string, count int) error {
-	key := c.countKey(tags)
+func (c *catalogueCache) SetCount(ctx context.Context, filter Filter, count int) error {
+	key := countKey(filter)
 	
-	err := c.client.Set(ctx, key, count, c.ttl).Err()
+	err := c.set(ctx, key, count, "")
 	if err != nil {
 		c.logger.Log("cache", "error", "operation", "SetCount", "key", key, "error", err)
 		return err
@@ -220,32 +425,38 @@ func (c *catalogueCache) SetCount(ctx context.Context, tags []string, count int)
 
 // Tags operations
 func (c *catalogueCache) GetTags(ctx context.Context) ([]string, bool, error) {
-	key := c.tagsKey()
-	
+	return c.getTags(ctx, tagsKey(), "GetTags")
+}
+
+func (c *catalogueCache) GetStaleTags(ctx context.Context) ([]string, bool, error) {
+	return c.getTags(ctx, c.staleKey(tagsKey()), "GetStaleTags")
+}
+
+func (c *catalogueCache) getTags(ctx context.Context, key, operation string) ([]string, bool, error) {
 	val, err := c.client.Get(ctx, key).Result()
 	if err == redis.Nil {
-		c.logger.Log("cache", "miss", "key", key, "operation", "GetTags")
+		c.logger.Log("cache", "miss", "key", key, "operation", operation)
 		return nil, false, nil
 	}
 	if err != nil {
-		c.logger.Log("cache", "error", "operation", "GetTags", "key", key, "error", err)
+		c.logger.Log("cache", "error", "operation", operation, "key", key, "error", err)
 		return nil, false, err
 	}
 
 	var tags []string
 	if err := json.Unmarshal([]byte(val), &tags); err != nil {
-		c.logger.Log("cache", "unmarshal_error", "operation", "GetTags", "key", key, "error", err)
+		c.logger.Log("cache", "unmarshal_error", "operation", operation, "key", key, "error", err)
 		// Delete corrupted cache entry
 		c.client.Del(ctx, key)
 		return nil, false, nil
 	}
 
-	c.logger.Log("cache", "hit", "key", key, "operation", "GetTags", "count", len(tags))
+	c.logger.Log("cache", "hit", "key", key, "operation", operation, "count", len(tags))
 	return tags, true, nil
 }
 
 func (c *catalogueCache) SetTags(ctx context.Context, tags []string) error {
-	key := c.tagsKey()
+	key := tagsKey()
 	
 	data, err := json.Marshal(tags)
 	if err != nil {
@@ -253,7 +464,7 @@ func (c *catalogueCache) SetTags(ctx context.Context, tags []string) error {
 		return err
 	}
 
-	err = c.client.Set(ctx, key, data, c.ttl).Err()
+	err = c.set(ctx, key, data, "")
 	if err != nil {
 		c.logger.Log("cache", "error", "operation", "SetTags", "key", key, "error", err)
 		return err
@@ -263,20 +474,304 @@ func (c *catalogueCache) SetTags(ctx context.Context, tags []string) error {
 	return nil
 }
 
+// SetMany writes all entries, and their stale copies, in one pipeline
+func (c *catalogueCache) SetMany(ctx context.Context, entries []CacheEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, e := range entries {
+			key := e.Request.Key()
+			data, err := json.Marshal(e.Value)
+			if err != nil {
+				c.logger.Log("cache", "marshal_error", "operation", "SetMany", "key", key, "error", err)
+				return err
+			}
+			pipe.Set(ctx, key, data, c.ttl)
+			if withETag(e.Request) {
+				pipe.Set(ctx, etagKey(key), jsonETag(data), c.ttl)
+			}
+			if c.staleTTL > 0 {
+				pipe.Set(ctx, c.staleKey(key), data, c.staleTTL)
+			}
+			if e.Request.Operation == "Get" && e.Request.Currency != "" {
+				pipe.SAdd(ctx, currenciesKey(e.Request.ID), key)
+				pipe.Expire(ctx, currenciesKey(e.Request.ID), c.ttl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.logger.Log("cache", "error", "operation", "SetMany", "entries", len(entries), "error", err)
+		return err
+	}
+
+	c.logger.Log("cache", "set", "operation", "SetMany", "entries", len(entries), "ttl", c.ttl)
+	return nil
+}
+
+// GetEntry reads the entry of r into value.
+func (c *catalogueCache) GetEntry(ctx context.Context, r WarmRequest, value interface{}) (bool, error) {
+	key := r.Key()
+	val, found, err := c.getRaw(ctx, key, "GetEntry")
+	if !found || err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(val, value); err != nil {
+		c.logger.Log("cache", "unmarshal_error", "operation", "GetEntry", "key", key, "error", err)
+		c.client.Del(ctx, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+// GetRaw returns the entry of r as it is stored, JSON that has not been
+// decoded, with its ETag if it was stored with one and its time to live. All
+// three are read in one transaction.
+func (c *catalogueCache) GetRaw(ctx context.Context, r WarmRequest) (RawEntry, bool, error) {
+	key := r.Key()
+	var data, etag *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		data = pipe.Get(ctx, key)
+		etag = pipe.Get(ctx, etagKey(key))
+		ttl = pipe.PTTL(ctx, key)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		c.logger.Log("cache", "error", "operation", "GetRaw", "key", key, "error", err)
+		return RawEntry{}, false, err
+	}
+	val, err := data.Bytes()
+	if err == redis.Nil {
+		c.logger.Log("cache", "miss", "key", key, "operation", "GetRaw")
+		return RawEntry{}, false, nil
+	}
+	if err != nil {
+		c.logger.Log("cache", "error", "operation", "GetRaw", "key", key, "error", err)
+		return RawEntry{}, false, err
+	}
+
+	c.logger.Log("cache", "hit", "key", key, "operation", "GetRaw")
+	// PTTL is negative for keys without an expiry, which we never write
+	entry := RawEntry{JSON: val, ETag: etag.Val()}
+	if ttl.Val() > 0 {
+		entry.TTL = ttl.Val()
+	}
+	return entry, true, nil
+}
+
+func (c *catalogueCache) getRaw(ctx context.Context, key, operation string) ([]byte, bool, error) {
+	val, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		c.logger.Log("cache", "miss", "key", key, "operation", operation)
+		return nil, false, nil
+	}
+	if err != nil {
+		c.logger.Log("cache", "error", "operation", operation, "key", key, "error", err)
+		return nil, false, err
+	}
+
+	c.logger.Log("cache", "hit", "key", key, "operation", operation)
+	return val, true, nil
+}
+
+// compressedKey is the key of the body with the given ETag compressed with
+// encoding, see CompressedStore. Compressed bodies are found by their ETag,
+// which changes with the body, so they are never invalidated, and expire
+// with the entries they were compressed from.
+func compressedKey(etag, encoding string) string {
+	return "catalogue:compressed:" + encoding + ":" + strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+}
+
+func (c *catalogueCache) GetCompressed(ctx context.Context, etag, encoding string) ([]byte, bool, error) {
+	key := compressedKey(etag, encoding)
+	data, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		c.logger.Log("cache", "error", "operation", "GetCompressed", "key", key, "error", err)
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (c *catalogueCache) SetCompressed(ctx context.Context, etag, encoding string, data []byte) error {
+	key := compressedKey(etag, encoding)
+	if err := c.client.Set(ctx, key, data, c.ttl).Err(); err != nil {
+		c.logger.Log("cache", "error", "operation", "SetCompressed", "key", key, "error", err)
+		return err
+	}
+	return nil
+}
+
 // Cache invalidation
 func (c *catalogueCache) InvalidateProduct(ctx context.Context, id string) error {
-	key := c.productKey(id)
-	
-	err := c.client.Del(ctx, key).Err()
+	key := productKey(id)
+
+	converted, err := c.productVariants(ctx, []string{id})
 	if err != nil {
 		c.logger.Log("cache", "error", "operation", "InvalidateProduct", "key", key, "error", err)
 		return err
 	}
+	if err := c.del(ctx, []string{key, etagKey(key)}, converted); err != nil {
+		c.logger.Log("cache", "error", "operation", "InvalidateProduct", "key", key, "error", err)
+		return err
+	}
 
 	c.logger.Log("cache", "invalidate", "key", key, "operation", "InvalidateProduct", "product_id", id)
 	return nil
 }
 
+// InvalidateTag removes every listing and count filtered by tag, along with
+// the tag list itself. Individual products are left alone.
+func (c *catalogueCache) InvalidateTag(ctx context.Context, tag string) error {
+	keys := []string{tagsKey()}
+	for _, pattern := range []string{"catalogue:products:*", "catalogue:count:*"} {
+		iter := c.client.Scan(ctx, 0, pattern, 0).Iterator()
+		for iter.Next(ctx) {
+			if tags, ok := keyTags(iter.Val()); ok && contains(tags, tag) {
+				keys = append(keys, iter.Val())
+			}
+		}
+		if err := iter.Err(); err != nil {
+			c.logger.Log("cache", "error", "operation", "InvalidateTag", "tag", tag, "error", err)
+			return err
+		}
+	}
+
+	if err := c.client.Del(ctx, keys...).Err(); err != nil {
+		c.logger.Log("cache", "error", "operation", "InvalidateTag", "tag", tag, "error", err)
+		return err
+	}
+
+	c.logger.Log("cache", "invalidate", "operation", "InvalidateTag", "tag", tag, "keys_deleted", len(keys))
+	return nil
+}
+
+// productVariants returns the keys of the converted entries of the socks
+// with the given IDs, see ConvertEndpoints, by the set that tracks them.
+func (c *catalogueCache) productVariants(ctx context.Context, ids []string) (map[string][]string, error) {
+	cmds := make(map[string]*redis.StringSliceCmd, len(ids))
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			cmds[currenciesKey(id)] = pipe.SMembers(ctx, currenciesKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	converted := make(map[string][]string, len(cmds))
+	for set, cmd := range cmds {
+		if keys := cmd.Val(); len(keys) > 0 {
+			converted[set] = keys
+		}
+	}
+	return converted, nil
+}
+
+// del deletes keys and the converted entries returned by productVariants.
+// The entries are taken out of their sets rather than the sets deleted, so
+// that conversions cached in the meantime stay tracked.
+func (c *catalogueCache) del(ctx context.Context, keys []string, converted map[string][]string) error {
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(keys) > 0 {
+			pipe.Del(ctx, keys...)
+		}
+		for set, members := range converted {
+			pipe.Del(ctx, members...)
+			args := make([]interface{}, len(members))
+			for i, m := range members {
+				args[i] = m
+			}
+			pipe.SRem(ctx, set, args...)
+		}
+		return nil
+	})
+	return err
+}
+
+// keyTags returns the tag filter encoded in a product listing or count key
+func keyTags(key string) ([]string, bool) {
+	var tagsStr string
+	switch {
+	case strings.HasPrefix(key, "catalogue:products:"):
+		rest := strings.TrimPrefix(key, "catalogue:products:")
+		i := strings.Index(rest, ":order:")
+		if i < 0 {
+			return nil, false
+		}
+		tagsStr = rest[:i]
+	case strings.HasPrefix(key, "catalogue:count:"):
+		tagsStr = strings.TrimPrefix(key, "catalogue:count:")
+		if i := strings.Index(tagsStr, ":variant:"); i >= 0 {
+			tagsStr = tagsStr[:i]
+		}
+	default:
+		return nil, false
+	}
+	if tagsStr == "all" {
+		return []string{}, true
+	}
+	return strings.Split(tagsStr, ","), true
+}
+
+// Invalidate deletes the entries described by inv. Stale copies are kept, as
+// they are meant to outlive the regular entries.
+func (c *catalogueCache) Invalidate(ctx context.Context, inv Invalidation) error {
+	var keys []string
+	for _, id := range inv.Products {
+		keys = append(keys, productKey(id), etagKey(productKey(id)))
+	}
+	var converted map[string][]string
+	if len(inv.Products) > 0 {
+		var err error
+		if converted, err = c.productVariants(ctx, inv.Products); err != nil {
+			c.logger.Log("cache", "error", "operation", "Invalidate", "error", err)
+			return err
+		}
+	}
+	if inv.TagList {
+		keys = append(keys, tagsKey())
+	}
+
+	var patterns []string
+	if inv.Listings {
+		patterns = append(patterns, "catalogue:products:*")
+	}
+	if inv.Counts {
+		patterns = append(patterns, "catalogue:count:*")
+	}
+	for _, pattern := range patterns {
+		iter := c.client.Scan(ctx, 0, pattern, 0).Iterator()
+		for iter.Next(ctx) {
+			if filter, ok := keyTags(iter.Val()); ok && inv.matches(filter) {
+				keys = append(keys, iter.Val())
+			}
+		}
+		if err := iter.Err(); err != nil {
+			c.logger.Log("cache", "error", "operation", "Invalidate", "error", err)
+			return err
+		}
+	}
+
+	if err := c.del(ctx, keys, converted); err != nil {
+		c.logger.Log("cache", "error", "operation", "Invalidate", "error", err)
+		return err
+	}
+	for _, members := range converted {
+		keys = append(keys, members...)
+	}
+
+	c.logger.Log("cache", "invalidate", "operation", "Invalidate", "products", len(inv.Products), "tags", strings.Join(inv.Tags, ","), "keys_deleted", len(keys))
+	return nil
+}
+
+// InvalidateAll removes every cache entry. The last-known-good copies under
+// catalogue:stale:* are kept: they are what is served while MySQL is down,
+// and expire on their own.
 func (c *catalogueCache) InvalidateAll(ctx context.Context) error {
 	pattern := "catalogue:*"
 	
@@ -284,6 +779,9 @@ func (c *catalogueCache) InvalidateAll(ctx context.Context) error {
 	keys := []string{}
 	
 	for iter.Next(ctx) {
+		if strings.HasPrefix(iter.Val(), c.staleKey("")) {
+			continue
+		}
 		keys = append(keys, iter.Val())
 	}
 	
@@ -306,6 +804,11 @@ func (c *catalogueCache) InvalidateAll(ctx context.Context) error {
 	return nil
 }
 
+// PoolStats returns the Redis connection pool statistics
+func (c *catalogueCache) PoolStats() *redis.PoolStats {
+	return c.client.PoolStats()
+}
+
 // Health check
 func (c *catalogueCache) Ping(ctx context.Context) error {
 	err := c.client.Ping(ctx).Err()
@@ -0,0 +1,321 @@
+package catalogue
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/sony/gobreaker"
+)
+
+// ErrCacheUnavailable is returned by CircuitBreakerCache while its breaker is
+// open (or saturated with half-open probes) and Redis is not being called.
+var ErrCacheUnavailable = NewError(CodeUnavailable, "cache unavailable")
+
+// CircuitBreakerCache decorates a CatalogueCache with a circuit breaker. After
+// a run of consecutive Redis errors the breaker opens and every call fails
+// fast with ErrCacheUnavailable, so callers fall back to the database without
+// waiting for Redis timeouts. Once the breaker's timeout elapses a limited
+// number of probe calls are let through to test whether Redis has recovered.
+//
+// Invalidations that fail, whether the breaker is open or Redis errs, are
+// kept and replayed before any other call once Redis answers again, so that
+// entries made stale while it was away are not served until their TTL runs
+// out.
+type CircuitBreakerCache struct {
+	next CatalogueCache
+	cb   *gobreaker.CircuitBreaker
+
+	flushing sync.Mutex // held while pending is replayed
+	mu       sync.Mutex
+	pending  []func(context.Context) error
+	all      bool // too many were pending; invalidate everything instead
+}
+
+// maxPendingInvalidations is how many failed invalidations are kept before
+// they are given up for a single InvalidateAll.
+const maxPendingInvalidations = 1000
+
+// NewCircuitBreakerCache wraps next with a circuit breaker named
+// "catalogue-redis". Settings left zero are those of
+// DefaultCacheBreakerSettings.
+func NewCircuitBreakerCache(next CatalogueCache, settings BreakerSettings, logger log.Logger) *CircuitBreakerCache {
+	return &CircuitBreakerCache{
+		next: next,
+		cb:   NewCircuitBreaker("catalogue-redis", settings.withDefaults(DefaultCacheBreakerSettings), nil, logger),
+	}
+}
+
+// State returns the current state of the breaker.
+func (c *CircuitBreakerCache) State() gobreaker.State {
+	return c.cb.State()
+}
+
+// Pending reports how many failed invalidations wait to be replayed.
+func (c *CircuitBreakerCache) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.all {
+		return 1
+	}
+	return len(c.pending)
+}
+
+func (c *CircuitBreakerCache) do(ctx context.Context, fn func() error) error {
+	if c.Pending() > 0 {
+		if err := c.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return c.execute(fn)
+}
+
+func (c *CircuitBreakerCache) execute(fn func() error) error {
+	_, err := c.cb.Execute(func() (interface{}, error) {
+		return nil, fn()
+	})
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return ErrCacheUnavailable.WithCause(err)
+	}
+	return err
+}
+
+// invalidate runs fn, and keeps it to be replayed if it fails.
+func (c *CircuitBreakerCache) invalidate(ctx context.Context, fn func(context.Context) error) error {
+	err := c.do(ctx, func() error {
+		return fn(ctx)
+	})
+	if err != nil {
+		c.mu.Lock()
+		if len(c.pending) < maxPendingInvalidations {
+			c.pending = append(c.pending, fn)
+		} else {
+			c.pending, c.all = nil, true
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// flush replays the pending invalidations in the order they were made. Calls
+// made meanwhile wait for it, so that none of them reads an entry that is
+// still to be invalidated. Those not replayed stay pending.
+func (c *CircuitBreakerCache) flush(ctx context.Context) error {
+	c.flushing.Lock()
+	defer c.flushing.Unlock()
+
+	c.mu.Lock()
+	pending, all := c.pending, c.all
+	c.mu.Unlock()
+	if all {
+		pending = []func(context.Context) error{c.next.InvalidateAll}
+	}
+	if len(pending) == 0 {
+		// Flushed while this call waited
+		return nil
+	}
+
+	done := 0
+	err := c.execute(func() error {
+		for _, fn := range pending {
+			if err := fn(ctx); err != nil {
+				return err
+			}
+			done++
+		}
+		return nil
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if all && done > 0 {
+		c.all = false
+	} else if !all {
+		// Invalidations that failed during the flush were appended after
+		// those being replayed
+		c.pending = c.pending[done:]
+	}
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+	return err
+}
+
+func (c *CircuitBreakerCache) GetProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int) (products []Sock, found bool, err error) {
+	err = c.do(ctx, func() error {
+		products, found, err = c.next.GetProducts(ctx, filter, order, pageNum, pageSize)
+		return err
+	})
+	return products, found, err
+}
+
+func (c *CircuitBreakerCache) SetProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int, products []Sock) error {
+	return c.do(ctx, func() error {
+		return c.next.SetProducts(ctx, filter, order, pageNum, pageSize, products)
+	})
+}
+
+func (c *CircuitBreakerCache) GetProduct(ctx context.Context, id string) (product Sock, found bool, err error) {
+	err = c.do(ctx, func() error {
+		product, found, err = c.next.GetProduct(ctx, id)
+		return err
+	})
+	return product, found, err
+}
+
+func (c *CircuitBreakerCache) GetProductsByID(ctx context.Context, ids []string) (products map[string]Sock, err error) {
+	err = c.do(ctx, func() error {
+		products, err = c.next.GetProductsByID(ctx, ids)
+		return err
+	})
+	return products, err
+}
+
+func (c *CircuitBreakerCache) SetProduct(ctx context.Context, id string, product Sock) error {
+	return c.do(ctx, func() error {
+		return c.next.SetProduct(ctx, id, product)
+	})
+}
+
+func (c *CircuitBreakerCache) GetCount(ctx context.Context, filter Filter) (count int, found bool, err error) {
+	err = c.do(ctx, func() error {
+		count, found, err = c.next.GetCount(ctx, filter)
+		return err
+	})
+	return count, found, err
+}
+
+func (c *CircuitBreakerCache) SetCount(ctx context.Context, filter Filter, count int) error {
+	return c.do(ctx, func() error {
+		return c.next.SetCount(ctx, filter, count)
+	})
+}
+
+func (c *CircuitBreakerCache) GetTags(ctx context.Context) (tags []string, found bool, err error) {
+	err = c.do(ctx, func() error {
+		tags, found, err = c.next.GetTags(ctx)
+		return err
+	})
+	return tags, found, err
+}
+
+func (c *CircuitBreakerCache) SetTags(ctx context.Context, tags []string) error {
+	return c.do(ctx, func() error {
+		return c.next.SetTags(ctx, tags)
+	})
+}
+
+func (c *CircuitBreakerCache) GetStaleProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int) (products []Sock, found bool, err error) {
+	err = c.do(ctx, func() error {
+		products, found, err = c.next.GetStaleProducts(ctx, filter, order, pageNum, pageSize)
+		return err
+	})
+	return products, found, err
+}
+
+func (c *CircuitBreakerCache) GetStaleProduct(ctx context.Context, id string) (product Sock, found bool, err error) {
+	err = c.do(ctx, func() error {
+		product, found, err = c.next.GetStaleProduct(ctx, id)
+		return err
+	})
+	return product, found, err
+}
+
+func (c *CircuitBreakerCache) GetStaleProductsByID(ctx context.Context, ids []string) (products map[string]Sock, err error) {
+	err = c.do(ctx, func() error {
+		products, err = c.next.GetStaleProductsByID(ctx, ids)
+		return err
+	})
+	return products, err
+}
+
+// GetCompressed is that of the cache guarded, if it is a CompressedStore.
+func (c *CircuitBreakerCache) GetCompressed(ctx context.Context, etag, encoding string) (data []byte, found bool, err error) {
+	store, ok := c.next.(CompressedStore)
+	if !ok {
+		return nil, false, nil
+	}
+	err = c.do(ctx, func() error {
+		data, found, err = store.GetCompressed(ctx, etag, encoding)
+		return err
+	})
+	return data, found, err
+}
+
+// SetCompressed is that of the cache guarded, if it is a CompressedStore.
+func (c *CircuitBreakerCache) SetCompressed(ctx context.Context, etag, encoding string, data []byte) error {
+	store, ok := c.next.(CompressedStore)
+	if !ok {
+		return nil
+	}
+	return c.do(ctx, func() error {
+		return store.SetCompressed(ctx, etag, encoding, data)
+	})
+}
+
+func (c *CircuitBreakerCache) GetStaleCount(ctx context.Context, filter Filter) (count int, found bool, err error) {
+	err = c.do(ctx, func() error {
+		count, found, err = c.next.GetStaleCount(ctx, filter)
+		return err
+	})
+	return count, found, err
+}
+
+func (c *CircuitBreakerCache) GetStaleTags(ctx context.Context) (tags []string, found bool, err error) {
+	err = c.do(ctx, func() error {
+		tags, found, err = c.next.GetStaleTags(ctx)
+		return err
+	})
+	return tags, found, err
+}
+
+func (c *CircuitBreakerCache) SetMany(ctx context.Context, entries []CacheEntry) error {
+	return c.do(ctx, func() error {
+		return c.next.SetMany(ctx, entries)
+	})
+}
+
+func (c *CircuitBreakerCache) GetEntry(ctx context.Context, r WarmRequest, value interface{}) (found bool, err error) {
+	err = c.do(ctx, func() error {
+		found, err = c.next.GetEntry(ctx, r, value)
+		return err
+	})
+	return found, err
+}
+
+func (c *CircuitBreakerCache) GetRaw(ctx context.Context, r WarmRequest) (entry RawEntry, found bool, err error) {
+	err = c.do(ctx, func() error {
+		entry, found, err = c.next.GetRaw(ctx, r)
+		return err
+	})
+	return entry, found, err
+}
+
+func (c *CircuitBreakerCache) InvalidateProduct(ctx context.Context, id string) error {
+	return c.invalidate(ctx, func(ctx context.Context) error {
+		return c.next.InvalidateProduct(ctx, id)
+	})
+}
+
+func (c *CircuitBreakerCache) InvalidateTag(ctx context.Context, tag string) error {
+	return c.invalidate(ctx, func(ctx context.Context) error {
+		return c.next.InvalidateTag(ctx, tag)
+	})
+}
+
+func (c *CircuitBreakerCache) Invalidate(ctx context.Context, inv Invalidation) error {
+	return c.invalidate(ctx, func(ctx context.Context) error {
+		return c.next.Invalidate(ctx, inv)
+	})
+}
+
+func (c *CircuitBreakerCache) InvalidateAll(ctx context.Context) error {
+	return c.invalidate(ctx, c.next.InvalidateAll)
+}
+
+func (c *CircuitBreakerCache) Ping(ctx context.Context) error {
+	return c.do(ctx, func() error {
+		return c.next.Ping(ctx)
+	})
+}
@@ -0,0 +1,349 @@
+package catalogue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/sony/gobreaker"
+)
+
+// fakeCache is an in-memory CatalogueCache. When err is set every call fails
+// with it.
+type fakeCache struct {
+	mu       sync.Mutex
+	err      error
+	calls    int
+	products map[string]Sock
+	stale    map[string]Sock
+
+	invalidatedTags []string
+	batches         int             // SetMany calls
+	keys            map[string]bool // keys written by SetMany
+	values          map[string][]byte
+	invalidations   []Invalidation
+	ttls            map[string]time.Duration
+}
+
+func newFakeCache() *fakeCache {
+	return &fakeCache{products: map[string]Sock{}, stale: map[string]Sock{}, keys: map[string]bool{}, values: map[string][]byte{}, ttls: map[string]time.Duration{}}
+}
+
+func (c *fakeCache) GetProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int) ([]Sock, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return nil, false, c.err
+}
+
+func (c *fakeCache) SetProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int, products []Sock) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return c.err
+}
+
+func (c *fakeCache) GetProduct(ctx context.Context, id string) (Sock, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return Sock{}, false, c.err
+	}
+	sock, ok := c.products[id]
+	return sock, ok, nil
+}
+
+func (c *fakeCache) GetProductsByID(ctx context.Context, ids []string) (map[string]Sock, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return pick(c.products, ids), c.err
+}
+
+func (c *fakeCache) SetProduct(ctx context.Context, id string, product Sock) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return c.err
+	}
+	c.products[id] = product
+	c.stale[id] = product
+	return nil
+}
+
+func (c *fakeCache) GetCount(ctx context.Context, filter Filter) (int, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return 0, false, c.err
+}
+
+func (c *fakeCache) SetCount(ctx context.Context, filter Filter, count int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return c.err
+}
+
+func (c *fakeCache) GetTags(ctx context.Context) ([]string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return nil, false, c.err
+}
+
+func (c *fakeCache) SetTags(ctx context.Context, tags []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return c.err
+}
+
+func (c *fakeCache) GetStaleProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int) ([]Sock, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return nil, false, c.err
+}
+
+func (c *fakeCache) GetStaleProduct(ctx context.Context, id string) (Sock, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return Sock{}, false, c.err
+	}
+	sock, ok := c.stale[id]
+	return sock, ok, nil
+}
+
+func (c *fakeCache) GetStaleProductsByID(ctx context.Context, ids []string) (map[string]Sock, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return pick(c.stale, ids), c.err
+}
+
+// pick returns those of socks whose ids are among ids.
+func pick(socks map[string]Sock, ids []string) map[string]Sock {
+	picked := map[string]Sock{}
+	for _, id := range ids {
+		if sock, ok := socks[id]; ok {
+			picked[id] = sock
+		}
+	}
+	return picked
+}
+
+func (c *fakeCache) GetStaleCount(ctx context.Context, filter Filter) (int, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return 0, false, c.err
+}
+
+func (c *fakeCache) GetStaleTags(ctx context.Context) ([]string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return nil, false, c.err
+}
+
+func (c *fakeCache) SetMany(ctx context.Context, entries []CacheEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	c.batches++
+	if c.err != nil {
+		return c.err
+	}
+	for _, e := range entries {
+		if sock, ok := e.Value.(Sock); ok {
+			c.products[e.Request.ID] = sock
+		}
+		c.keys[e.Request.Key()] = true
+		c.values[e.Request.Key()], _ = json.Marshal(e.Value)
+	}
+	return nil
+}
+
+func (c *fakeCache) GetEntry(ctx context.Context, r WarmRequest, value interface{}) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	data, ok := c.values[r.Key()]
+	if c.err != nil || !ok {
+		return false, c.err
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+func (c *fakeCache) GetRaw(ctx context.Context, r WarmRequest) (RawEntry, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	data, ok := c.values[r.Key()]
+	if c.err != nil {
+		return RawEntry{}, false, c.err
+	}
+	return RawEntry{JSON: data, TTL: c.ttls[r.Key()]}, ok, nil
+}
+
+func (c *fakeCache) InvalidateProduct(ctx context.Context, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	delete(c.products, id)
+	return c.err
+}
+
+func (c *fakeCache) InvalidateTag(ctx context.Context, tag string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	c.invalidatedTags = append(c.invalidatedTags, tag)
+	return c.err
+}
+
+func (c *fakeCache) InvalidateAll(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	c.products = map[string]Sock{}
+	return c.err
+}
+
+func (c *fakeCache) Invalidate(ctx context.Context, inv Invalidation) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return c.err
+	}
+	c.invalidations = append(c.invalidations, inv)
+	for _, id := range inv.Products {
+		delete(c.products, id)
+	}
+	return nil
+}
+
+func (c *fakeCache) Ping(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return c.err
+}
+
+func TestCircuitBreakerCache(t *testing.T) {
+	ctx := context.Background()
+	next := newFakeCache()
+	next.err = errors.New("dial tcp: connection refused")
+	c := NewCircuitBreakerCache(next, BreakerSettings{
+		ConsecutiveFailures: 3,
+		Timeout:             50 * time.Millisecond,
+		MaxRequests:         1,
+	}, log.NewNopLogger())
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := c.GetProduct(ctx, "1"); err != next.err {
+			t.Fatalf("GetProduct #%d: want %v, have %v", i, next.err, err)
+		}
+	}
+	if have := c.State(); have != gobreaker.StateOpen {
+		t.Fatalf("State(): want %s, have %s", gobreaker.StateOpen, have)
+	}
+
+	// While open, Redis must not be called at all
+	calls := next.calls
+	if _, _, err := c.GetProduct(ctx, "1"); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("GetProduct while open: want %v, have %v", ErrCacheUnavailable, err)
+	}
+	if next.calls != calls {
+		t.Errorf("GetProduct while open: Redis was called")
+	}
+
+	// After the timeout a successful probe closes the breaker again
+	time.Sleep(60 * time.Millisecond)
+	next.err = nil
+	if err := c.SetProduct(ctx, "1", s1); err != nil {
+		t.Fatalf("SetProduct probe: %v", err)
+	}
+	if have := c.State(); have != gobreaker.StateClosed {
+		t.Errorf("State(): want %s, have %s", gobreaker.StateClosed, have)
+	}
+	if have, found, err := c.GetProduct(ctx, "1"); err != nil || !found || have.ID != s1.ID {
+		t.Errorf("GetProduct after recovery: have %v, %t, %v", have.ID, found, err)
+	}
+}
+
+func TestCircuitBreakerCacheReplaysInvalidations(t *testing.T) {
+	ctx := context.Background()
+	next := newFakeCache()
+	next.products["3"] = s3
+	next.err = errors.New("dial tcp: connection refused")
+	c := NewCircuitBreakerCache(next, BreakerSettings{ConsecutiveFailures: 1, Timeout: 20 * time.Millisecond, MaxRequests: 1}, log.NewNopLogger())
+
+	// The first fails in Redis, the second fast while the breaker is open
+	if err := c.Invalidate(ctx, Invalidation{Products: []string{"1"}}); err != next.err {
+		t.Fatalf("Invalidate: want %v, have %v", next.err, err)
+	}
+	if err := c.Invalidate(ctx, Invalidation{Products: []string{"2"}}); !errors.Is(err, ErrCacheUnavailable) {
+		t.Fatalf("Invalidate while open: want %v, have %v", ErrCacheUnavailable, err)
+	}
+	if have := c.Pending(); have != 2 {
+		t.Fatalf("Pending(): want 2, have %d", have)
+	}
+
+	// Both are made, in order, before Redis is read again
+	time.Sleep(30 * time.Millisecond)
+	next.err = nil
+	if _, _, err := c.GetProduct(ctx, "3"); err != nil {
+		t.Fatalf("GetProduct after recovery: %v", err)
+	}
+	want := []Invalidation{{Products: []string{"1"}}, {Products: []string{"2"}}}
+	if !reflect.DeepEqual(next.invalidations, want) || c.Pending() != 0 {
+		t.Errorf("after recovery: want %v replayed, have %v and %d pending", want, next.invalidations, c.Pending())
+	}
+
+	// Too many to keep are made as one InvalidateAll
+	next.err = errors.New("timeout")
+	for i := 0; i <= maxPendingInvalidations; i++ {
+		c.InvalidateProduct(ctx, "1")
+	}
+	if have := c.Pending(); have != 1 {
+		t.Fatalf("Pending() after %d: want 1, have %d", maxPendingInvalidations+1, have)
+	}
+	time.Sleep(30 * time.Millisecond)
+	next.err = nil
+	if err := c.Ping(ctx); err != nil || len(next.products) != 0 || c.Pending() != 0 {
+		t.Errorf("after recovery: want everything invalidated, have %v, %d products and %d pending", err, len(next.products), c.Pending())
+	}
+}
+
+func TestCachedServiceHealthDegraded(t *testing.T) {
+	next := newFakeCache()
+	next.err = errors.New("timeout")
+	cache := NewCircuitBreakerCache(next, BreakerSettings{ConsecutiveFailures: 1, Timeout: time.Minute}, log.NewNopLogger())
+	cache.Ping(context.Background())
+
+	s := NewCachedService(healthOnlyService{}, cache, log.NewNopLogger())
+	for _, h := range s.Health() {
+		if h.Service == "catalogue-redis" && h.Status != "degraded" {
+			t.Errorf("Health(): want catalogue-redis degraded, have %s", h.Status)
+		}
+	}
+}
+
+// healthOnlyService is a Service that only answers health checks.
+type healthOnlyService struct{ Service }
+
+func (healthOnlyService) Health() []Health {
+	return []Health{{Service: "catalogue", Status: "OK"}}
+}
@@ -0,0 +1,136 @@
+package catalogue
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// CacheInspector reports what is currently held in the cache.
+type CacheInspector interface {
+	// Inspect counts the cache keys per namespace and samples up to
+	// sampleSize keys of each namespace for memory usage and TTL.
+	Inspect(ctx context.Context, sampleSize int) (CacheStats, error)
+}
+
+// CacheStats describes the contents of the cache.
+type CacheStats struct {
+	Keys       int              `json:"keys"`
+	Namespaces []NamespaceStats `json:"namespaces"`
+}
+
+// NamespaceStats describes the keys matching one pattern, such as
+// catalogue:product:*. Memory and TTL figures come from a sample of the keys;
+// EstimatedBytes extrapolates the sample to every key in the namespace.
+type NamespaceStats struct {
+	Pattern        string         `json:"pattern"`
+	Keys           int            `json:"keys"`
+	SampledKeys    int            `json:"sampledKeys"`
+	AvgBytes       int64          `json:"avgBytes"`
+	EstimatedBytes int64          `json:"estimatedBytes"`
+	TTL            map[string]int `json:"ttl"`
+}
+
+// ttlBuckets are the upper bounds of the TTL distribution buckets.
+var ttlBuckets = []struct {
+	name  string
+	upper time.Duration
+}{
+	{"<1m", time.Minute},
+	{"1m-5m", 5 * time.Minute},
+	{"5m-15m", 15 * time.Minute},
+	{"15m-30m", 30 * time.Minute},
+	{"30m-1h", time.Hour},
+	{"1h-24h", 24 * time.Hour},
+	{">24h", 1<<63 - 1},
+}
+
+func ttlBucket(ttl time.Duration) string {
+	if ttl < 0 {
+		return "none"
+	}
+	for _, b := range ttlBuckets {
+		if ttl < b.upper {
+			return b.name
+		}
+	}
+	return ttlBuckets[len(ttlBuckets)-1].name
+}
+
+// keyNamespace returns the namespace pattern of a cache key:
+// catalogue:products:brown:order:id:page:1:size:6 belongs to
+// catalogue:products:*, and its stale copy to catalogue:stale:products:*.
+func keyNamespace(key string) string {
+	parts := strings.SplitN(key, ":", 4)
+	n := 2
+	if len(parts) > 2 && parts[1] == "stale" {
+		n = 3
+	}
+	if len(parts) <= n {
+		return key
+	}
+	return strings.Join(parts[:n], ":") + ":*"
+}
+
+// Inspect implements CacheInspector.
+func (c *catalogueCache) Inspect(ctx context.Context, sampleSize int) (CacheStats, error) {
+	counts := map[string]int{}
+	samples := map[string][]string{}
+
+	var stats CacheStats
+	iter := c.client.Scan(ctx, 0, "catalogue:*", 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		ns := keyNamespace(key)
+		counts[ns]++
+		stats.Keys++
+		if len(samples[ns]) < sampleSize {
+			samples[ns] = append(samples[ns], key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		c.logger.Log("cache", "error", "operation", "Inspect", "error", err)
+		return CacheStats{}, err
+	}
+
+	for ns, n := range counts {
+		nsStats := NamespaceStats{Pattern: ns, Keys: n, TTL: map[string]int{}}
+
+		var usage []*redis.IntCmd
+		var ttls []*redis.DurationCmd
+		_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range samples[ns] {
+				usage = append(usage, pipe.MemoryUsage(ctx, key))
+				ttls = append(ttls, pipe.TTL(ctx, key))
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			c.logger.Log("cache", "error", "operation", "Inspect", "pattern", ns, "error", err)
+			return CacheStats{}, err
+		}
+
+		var total int64
+		for i := range samples[ns] {
+			bytes, err := usage[i].Result()
+			if err != nil {
+				continue // expired between SCAN and MEMORY USAGE
+			}
+			total += bytes
+			nsStats.SampledKeys++
+			nsStats.TTL[ttlBucket(ttls[i].Val())]++
+		}
+		if nsStats.SampledKeys > 0 {
+			nsStats.AvgBytes = total / int64(nsStats.SampledKeys)
+			nsStats.EstimatedBytes = nsStats.AvgBytes * int64(n)
+		}
+		stats.Namespaces = append(stats.Namespaces, nsStats)
+	}
+	sort.Slice(stats.Namespaces, func(i, j int) bool {
+		return stats.Namespaces[i].Pattern < stats.Namespaces[j].Pattern
+	})
+	return stats, nil
+}
@@ -0,0 +1,164 @@
+package catalogue
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestCatalogueCacheInvalidatesConversions(t *testing.T) {
+	ctx := context.Background()
+	mr, _ := newMiniredis(t)
+	cache := NewCatalogueCache(mr.Addr(), log.NewNopLogger())
+
+	eur := WarmRequest{Operation: "Get", ID: s1.ID, Currency: "EUR"}
+	gbp := WarmRequest{Operation: "Get", ID: s1.ID, Currency: "GBP"}
+	other := WarmRequest{Operation: "Get", ID: s2.ID, Currency: "EUR"}
+	if err := cache.SetMany(ctx, []CacheEntry{
+		{Request: WarmRequest{Operation: "Get", ID: s1.ID}, Value: s1},
+		{Request: eur, Value: convertedEntry{Rate: "1/2", Socks: json.RawMessage(`[{"id":"` + s1.ID + `"}]`)}},
+		{Request: gbp, Value: convertedEntry{Rate: "4/5", Socks: json.RawMessage(`[{"id":"` + s1.ID + `"}]`)}},
+		{Request: other, Value: convertedEntry{Rate: "1/2", Socks: json.RawMessage(`[{"id":"` + s2.ID + `"}]`)}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if members, _ := mr.Members(currenciesKey(s1.ID)); len(members) != 2 {
+		t.Fatalf("SetMany: want both conversions of %s tracked, have %v", s1.ID, members)
+	}
+
+	if err := cache.InvalidateProduct(ctx, s1.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{productKey(s1.ID), eur.Key(), gbp.Key()} {
+		if mr.Exists(key) {
+			t.Errorf("InvalidateProduct: want %s deleted", key)
+		}
+	}
+	if !mr.Exists(other.Key()) {
+		t.Errorf("InvalidateProduct: want %s kept", other.Key())
+	}
+
+	if err := cache.Invalidate(ctx, Invalidation{Products: []string{s2.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(other.Key()) || mr.Exists(currenciesKey(s2.ID)) {
+		t.Errorf("Invalidate: want %s and its set deleted, have %v", other.Key(), mr.Keys())
+	}
+}
+
+func TestCatalogueCacheStoresETags(t *testing.T) {
+	ctx := context.Background()
+	mr, _ := newMiniredis(t)
+	cache := NewCatalogueCache(mr.Addr(), log.NewNopLogger())
+
+	if err := cache.SetProduct(ctx, s1.ID, s1); err != nil {
+		t.Fatal(err)
+	}
+	raw, found, err := cache.GetRaw(ctx, WarmRequest{Operation: "Get", ID: s1.ID})
+	if err != nil || !found {
+		t.Fatalf("GetRaw: want a hit, have %v, %v", found, err)
+	}
+	// The ETag the sock would have had decoded and encoded again
+	rec := httptest.NewRecorder()
+	if err := encodeConditional(ctx, rec, getResponse{}, s1); err != nil {
+		t.Fatal(err)
+	}
+	if want := rec.Header().Get("ETag"); raw.ETag != want {
+		t.Errorf("GetRaw: want ETag %s, have %q", want, raw.ETag)
+	}
+	// and the time it has left, read with it
+	if raw.TTL != DefaultCacheTTL {
+		t.Errorf("GetRaw: want TTL %v, have %v", DefaultCacheTTL, raw.TTL)
+	}
+
+	// A client that has it gets neither the body nor its Content-Type
+	rec = httptest.NewRecorder()
+	ctx = context.WithValue(ctx, conditionsKey{}, http.Header{"If-None-Match": {raw.ETag}})
+	if err := encodeRaw(ctx, rec, getResponse{}, raw.JSON, raw.ETag); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "" {
+		t.Errorf("encodeRaw: want a bare 304, have %d %v", rec.Code, rec.Header())
+	}
+
+	if err := cache.InvalidateProduct(ctx, s1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if key := etagKey(productKey(s1.ID)); mr.Exists(key) {
+		t.Errorf("InvalidateProduct: want %s deleted", key)
+	}
+}
+
+func TestCatalogueCacheGetProductsByID(t *testing.T) {
+	ctx := context.Background()
+	mr, _ := newMiniredis(t)
+	cache := NewCatalogueCache(mr.Addr(), log.NewNopLogger())
+
+	for _, sock := range []Sock{s1, s2} {
+		if err := cache.SetProduct(ctx, sock.ID, sock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mr.Set(productKey(s3.ID), "{not json")
+
+	socks, err := cache.GetProductsByID(ctx, []string{s2.ID, s3.ID, "missing", s1.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(socks) != 2 || socks[s1.ID].ID != s1.ID || socks[s2.ID].ID != s2.ID {
+		t.Errorf("GetProductsByID: want %s and %s, have %+v", s1.ID, s2.ID, socks)
+	}
+	if mr.Exists(productKey(s3.ID)) {
+		t.Errorf("GetProductsByID: want the corrupted entry of %s deleted", s3.ID)
+	}
+	if stale, err := cache.GetStaleProductsByID(ctx, []string{s1.ID, s3.ID}); err != nil || len(stale) != 0 {
+		t.Errorf("GetStaleProductsByID without stale copies: want none, have %+v (%v)", stale, err)
+	}
+}
+
+func TestCatalogueCacheInvalidateAllKeepsStaleCopies(t *testing.T) {
+	ctx := context.Background()
+	mr, _ := newMiniredis(t)
+	cache := NewCatalogueCache(mr.Addr(), log.NewNopLogger(), WithStaleTTL(time.Hour))
+
+	if err := cache.SetProduct(ctx, s1.ID, s1); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.InvalidateAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := cache.GetProduct(ctx, s1.ID); found {
+		t.Errorf("InvalidateAll: want %s gone", s1.ID)
+	}
+	if sock, found, err := cache.GetStaleProduct(ctx, s1.ID); err != nil || !found || sock.ID != s1.ID {
+		t.Errorf("InvalidateAll: want the stale copy of %s kept, have %v, %v", s1.ID, found, err)
+	}
+}
+
+func TestCatalogueCacheCompressed(t *testing.T) {
+	ctx := context.Background()
+	mr, _ := newMiniredis(t)
+	cache := NewCatalogueCache(mr.Addr(), log.NewNopLogger()).(CompressedStore)
+
+	if _, found, err := cache.GetCompressed(ctx, `"abc"`, EncodingGzip); found || err != nil {
+		t.Fatalf("GetCompressed of nothing: want a miss, have %v, %v", found, err)
+	}
+	if err := cache.SetCompressed(ctx, `"abc"`, EncodingGzip, []byte("gz")); err != nil {
+		t.Fatal(err)
+	}
+	// Weak or strong, the ETag is that of the same body
+	if data, found, err := cache.GetCompressed(ctx, `W/"abc"`, EncodingGzip); !found || err != nil || string(data) != "gz" {
+		t.Errorf("GetCompressed: want gz, have %q, %v, %v", data, found, err)
+	}
+	if _, found, _ := cache.GetCompressed(ctx, `"abc"`, EncodingBrotli); found {
+		t.Errorf("GetCompressed in another encoding: want a miss")
+	}
+	if ttl := mr.TTL(compressedKey(`"abc"`, EncodingGzip)); ttl <= 0 {
+		t.Errorf("SetCompressed: want the key to expire, have TTL %v", ttl)
+	}
+}
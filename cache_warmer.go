@@ -2,166 +2,459 @@ package catalogue
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"golang.org/x/time/rate"
 )
 
+// ErrWarmingInProgress is returned by WarmCache while another run is going on
+var ErrWarmingInProgress = NewError(CodeConflict, "cache warming already in progress")
+
+// DefaultWarmBatchSize is the number of entries written to the cache per
+// round trip unless configured otherwise
+const DefaultWarmBatchSize = 100
+
 // CacheWarmer handles cache pre-population strategies
 type CacheWarmer struct {
-	service Service
-	cache   CatalogueCache
-	logger  log.Logger
+	service     Service
+	cache       CatalogueCache
+	logger      log.Logger
+	sources     []WarmSource
+	concurrency int
+	timeout     time.Duration
+	batchSize   int
+	limiter     *rate.Limiter // database queries, nil when unlimited
+	pageSizes   []int         // full catalogue mode when not empty
+
+	running int32         // 1 while a run is in progress
+	ready   chan struct{} // closed once the first run has finished
+
+	ctx    context.Context // cancelled by Stop
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // runs and the periodic loop
+}
+
+// CacheWarmerOption configures a CacheWarmer
+type CacheWarmerOption func(*CacheWarmer)
+
+// WithWarmSource makes the warmer warm the requests supplied by source in
+// place of the built-in popular listings. When every source comes back empty,
+// as the hot keys do right after startup, the built-in listings are used.
+func WithWarmSource(source WarmSource) CacheWarmerOption {
+	return func(w *CacheWarmer) {
+		w.sources = append(w.sources, source)
+	}
+}
+
+// WithWarmConcurrency sets how many requests are warmed at once
+func WithWarmConcurrency(n int) CacheWarmerOption {
+	return func(w *CacheWarmer) {
+		if n > 0 {
+			w.concurrency = n
+		}
+	}
+}
+
+// WithWarmTimeout bounds the duration of a whole warming run. Requests not
+// warmed by then are reported as failed.
+func WithWarmTimeout(d time.Duration) CacheWarmerOption {
+	return func(w *CacheWarmer) {
+		w.timeout = d
+	}
+}
+
+// WithWarmBatchSize sets how many entries are written to the cache per round
+// trip
+func WithWarmBatchSize(n int) CacheWarmerOption {
+	return func(w *CacheWarmer) {
+		if n > 0 {
+			w.batchSize = n
+		}
+	}
+}
+
+// WithWarmRateLimit limits the database queries of a run to perSecond, so
+// that warming the full catalogue does not starve live traffic
+func WithWarmRateLimit(perSecond float64) CacheWarmerOption {
+	return func(w *CacheWarmer) {
+		if perSecond > 0 {
+			w.limiter = rate.NewLimiter(rate.Limit(perSecond), 1)
+		}
+	}
+}
+
+// WithFullCatalogue makes every run warm the whole catalogue in place of the
+// built-in popular listings and the first page of products: every sock, and every page of the unfiltered and of
+// each single-tag listing in the default order, for each of pageSizes. The
+// number of pages is computed from Count.
+func WithFullCatalogue(pageSizes ...int) CacheWarmerOption {
+	return func(w *CacheWarmer) {
+		w.pageSizes = pageSizes
+	}
 }
 
 // NewCacheWarmer creates a new cache warming utility
-func NewCacheWarmer(service Service, cache CatalogueCache, logger log.Logger) *CacheWarmer {
-	return &CacheWarmer{
-		service: service,
-		cache:   cache,
-		logger:  logger,
+func NewCacheWarmer(service Service, cache CatalogueCache, logger log.Logger, opts ...CacheWarmerOption) *CacheWarmer {
+	w := &CacheWarmer{
+		service:     service,
+		cache:       cache,
+		logger:      logger,
+		concurrency: 1,
+		batchSize:   DefaultWarmBatchSize,
+		ready:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
 	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return w
 }
 
-// WarmCache pre-populates the cache with commonly accessed data
-func (w *CacheWarmer) WarmCache() {
-	ctx := context.Background()
-	start := time.Now()
-	
-	w.logger.Log("cache_warming", "started")
+// WarmItem is the outcome of warming one request
+type WarmItem struct {
+	Key      string        `json:"key"`
+	Request  WarmRequest   `json:"request"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
 
-	// Warm tags cache
-	go w.warmTags(ctx)
-	
-	// Warm popular product listings
-	go w.warmProductListings(ctx)
-	
-	// Warm individual products (first page of all products)
-	go w.warmIndividualProducts(ctx)
+// WarmReport describes a warming run
+type WarmReport struct {
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Warmed   int           `json:"warmed"`
+	Failed   int           `json:"failed"`
+	Items    []WarmItem    `json:"items"`
+}
 
-	w.logger.Log("cache_warming", "initiated", "duration_ms", time.Since(start).Milliseconds())
+// defaultListings are the popular product listings warmed when no source
+// supplies requests
+var defaultListings = []struct {
+	tags     []string
+	order    string
+	pageNum  int
+	pageSize int
+}{
+	{[]string{}, "", 1, 6},        // First page, no filters
+	{[]string{}, "", 1, 12},       // First page, larger size
+	{[]string{}, "price", 1, 6},   // Sorted by price
+	{[]string{}, "name", 1, 6},    // Sorted by name
+	{[]string{"brown"}, "", 1, 6}, // Filtered by popular tag
+	{[]string{"blue"}, "", 1, 6},  // Filtered by popular tag
+	{[]string{"geek"}, "", 1, 6},  // Filtered by popular tag
 }
 
-func (w *CacheWarmer) warmTags(ctx context.Context) {
-	start := time.Now()
-	
-	tags, err := w.service.Tags()
-	if err != nil {
-		w.logger.Log("cache_warming", "tags_error", "error", err)
-		return
-	}
-
-	if err := w.cache.SetTags(ctx, tags); err != nil {
-		w.logger.Log("cache_warming", "tags_cache_error", "error", err)
-		return
-	}
-
-	w.logger.Log("cache_warming", "tags_completed", "count", len(tags), "duration_ms", time.Since(start).Milliseconds())
-}
-
-func (w *CacheWarmer) warmProductListings(ctx context.Context) {
-	start := time.Now()
-	
-	// Common listing patterns to warm
-	listings := []struct {
-		tags     []string
-		order    string
-		pageNum  int
-		pageSize int
-	}{
-		{[]string{}, "", 1, 6},     // First page, no filters
-		{[]string{}, "", 1, 12},    // First page, larger size
-		{[]string{}, "price", 1, 6}, // Sorted by price
-		{[]string{}, "name", 1, 6},  // Sorted by name
-		{[]string{"brown"}, "", 1, 6}, // Filtered by popular tag
-		{[]string{"blue"}, "", 1, 6},  // Filtered by popular tag
-		{[]string{"geek"}, "", 1, 6},  // Filtered by popular tag
-	}
-
-	for _, listing := range listings {
-		func(l struct {
-			tags     []string
-			order    string
-			pageNum  int
-			pageSize int
-		}) {
-			listStart := time.Now()
-			
-			products, err := w.service.List(l.tags, l.order, l.pageNum, l.pageSize)
-			if err != nil {
-				w.logger.Log("cache_warming", "listing_error", "error", err, "tags", l.tags)
-				return
+// WarmCache pre-populates the cache and reports how every request fared. It
+// returns once all requests have been warmed, ctx is done, the warm timeout
+// has passed or the warmer is stopped, and fails with ErrWarmingInProgress
+// instead of running alongside another run.
+func (w *CacheWarmer) WarmCache(ctx context.Context) (WarmReport, error) {
+	if err := w.ctx.Err(); err != nil {
+		return WarmReport{}, err
+	}
+	if !atomic.CompareAndSwapInt32(&w.running, 0, 1) {
+		return WarmReport{}, ErrWarmingInProgress
+	}
+	w.wg.Add(1)
+	defer func() {
+		atomic.StoreInt32(&w.running, 0)
+		w.wg.Done()
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(w.ctx, cancel)
+	defer stop()
+	if w.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+
+	report := WarmReport{Started: time.Now()}
+	w.logger.Log("cache_warming", "started")
+
+	for _, r := range w.plan(ctx, &report) {
+		report.Items = append(report.Items, WarmItem{Key: r.Key(), Request: r})
+	}
+
+	// Requests are loaded from the database concurrently, and their answers
+	// written to the cache in batches of batchSize by a single writer
+	type loaded struct {
+		item  *WarmItem
+		value interface{}
+	}
+	results := make(chan loaded)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		batch := make([]loaded, 0, w.batchSize)
+		flush := func() {
+			entries := make([]CacheEntry, len(batch))
+			for i, l := range batch {
+				entries[i] = CacheEntry{Request: l.item.Request, Value: l.value}
+			}
+			if err := w.cache.SetMany(ctx, entries); err != nil {
+				for _, l := range batch {
+					l.item.Error = err.Error()
+				}
 			}
+			batch = batch[:0]
+		}
+		for l := range results {
+			if batch = append(batch, l); len(batch) == w.batchSize {
+				flush()
+			}
+		}
+		if len(batch) > 0 {
+			flush()
+		}
+	}()
 
-			if err := w.cache.SetProducts(ctx, l.tags, l.order, l.pageNum, l.pageSize, products); err != nil {
-				w.logger.Log("cache_warming", "listing_cache_error", "error", err, "tags", l.tags)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, w.concurrency)
+	for i := range report.Items {
+		item := &report.Items[i]
+		if item.Error != "" {
+			continue
+		}
+		// Checked first, as select picks at random when a slot is free too
+		if err := ctx.Err(); err != nil {
+			item.Error = err.Error()
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			item.Error = ctx.Err().Error()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			start := time.Now()
+			value, err := w.load(ctx, item.Request)
+			item.Duration = time.Since(start)
+			if err != nil {
+				item.Error = err.Error()
 				return
 			}
+			results <- loaded{item: item, value: value}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	<-written
 
-			// Also warm the count for this filter
-			count, err := w.service.Count(l.tags)
-			if err == nil {
-				w.cache.SetCount(ctx, l.tags, count)
-			}
+	for _, item := range report.Items {
+		if item.Error != "" {
+			report.Failed++
+			w.logger.Log("cache_warming", "request_error", "key", item.Key, "error", item.Error)
+			continue
+		}
+		report.Warmed++
+	}
+	report.Duration = time.Since(report.Started)
+	w.logger.Log("cache_warming", "completed", "warmed", report.Warmed, "failed", report.Failed, "duration_ms", report.Duration.Milliseconds())
+
+	w.markReady()
+	return report, ctx.Err()
+}
+
+// plan lists the requests to warm: the tags, the requests supplied by the
+// sources (or the popular listings and their counts) and the socks of the
+// first page of products, or the full catalogue in place of the last two.
+// Failures to plan are recorded in report.
+func (w *CacheWarmer) plan(ctx context.Context, report *WarmReport) []WarmRequest {
+	requests := []WarmRequest{{Operation: "Tags"}}
 
-			w.logger.Log(
-				"cache_warming", "listing_completed",
-				"tags", l.tags,
-				"order", l.order,
-				"pageNum", l.pageNum,
-				"pageSize", l.pageSize,
-				"count", len(products),
-				"duration_ms", time.Since(listStart).Milliseconds(),
+	var sourced []WarmRequest
+	for _, source := range w.sources {
+		if ctx.Err() != nil {
+			break
+		}
+		r, err := source.Requests(ctx)
+		if err != nil {
+			w.logger.Log("cache_warming", "source_error", "error", err)
+			continue
+		}
+		sourced = append(sourced, r...)
+	}
+	if len(sourced) == 0 && len(w.pageSizes) == 0 {
+		for _, l := range defaultListings {
+			sourced = append(sourced,
+				WarmRequest{Operation: "List", Tags: l.tags, Order: l.order, PageNum: l.pageNum, PageSize: l.pageSize},
+				WarmRequest{Operation: "Count", Tags: l.tags},
 			)
-		}(listing)
+		}
+	}
+	requests = append(requests, sourced...)
+
+	if len(w.pageSizes) > 0 {
+		requests = append(requests, w.planFullCatalogue(ctx, report)...)
+	} else {
+		// Individual products from the first page of all products
+		first := WarmRequest{Operation: "List", Tags: []string{}, PageNum: 1, PageSize: 10}
+		socks, err := w.list(ctx, first)
+		if err != nil {
+			report.Items = append(report.Items, WarmItem{Key: first.Key(), Request: first, Error: err.Error()})
+		}
+		for _, sock := range socks {
+			requests = append(requests, WarmRequest{Operation: "Get", ID: sock.ID})
+		}
 	}
 
-	w.logger.Log("cache_warming", "listings_completed", "duration_ms", time.Since(start).Milliseconds())
+	// Several sources may ask for the same key
+	seen := map[string]bool{}
+	unique := requests[:0]
+	for _, r := range requests {
+		if key := r.Key(); !seen[key] {
+			seen[key] = true
+			unique = append(unique, r)
+		}
+	}
+	return unique
 }
 
-func (w *CacheWarmer) warmIndividualProducts(ctx context.Context) {
-	start := time.Now()
-	
-	// Get first page of products to warm individual product cache
-	products, err := w.service.List([]string{}, "", 1, 10) // Get first 10 products
+// planFullCatalogue lists every page of the unfiltered and single-tag
+// listings for the configured page sizes, their counts, and every sock
+func (w *CacheWarmer) planFullCatalogue(ctx context.Context, report *WarmReport) []WarmRequest {
+	fail := func(r WarmRequest, err error) {
+		report.Items = append(report.Items, WarmItem{Key: r.Key(), Request: r, Error: err.Error()})
+	}
+
+	filters := [][]string{{}}
+	tags, err := w.load(ctx, WarmRequest{Operation: "Tags"})
 	if err != nil {
-		w.logger.Log("cache_warming", "products_list_error", "error", err)
-		return
+		fail(WarmRequest{Operation: "Tags"}, err)
+	} else {
+		for _, tag := range tags.([]string) {
+			filters = append(filters, []string{tag})
+		}
 	}
 
-	warmed := 0
-	for _, product := range products {
-		// Get full product details to ensure proper caching
-		fullProduct, err := w.service.Get(product.ID)
+	var requests []WarmRequest
+	for _, filter := range filters {
+		if ctx.Err() != nil {
+			break
+		}
+		count := WarmRequest{Operation: "Count", Tags: filter}
+		n, err := w.load(ctx, count)
 		if err != nil {
-			w.logger.Log("cache_warming", "product_error", "error", err, "id", product.ID)
+			fail(count, err)
 			continue
 		}
+		requests = append(requests, count)
+		for _, size := range w.pageSizes {
+			for page := 1; page == 1 || (page-1)*size < n.(int); page++ {
+				requests = append(requests, WarmRequest{Operation: "List", Tags: filter, Order: "id", PageNum: page, PageSize: size})
+			}
+		}
 
-		if err := w.cache.SetProduct(ctx, product.ID, fullProduct); err != nil {
-			w.logger.Log("cache_warming", "product_cache_error", "error", err, "id", product.ID)
-			continue
+		if len(filter) == 0 && n.(int) > 0 {
+			all := WarmRequest{Operation: "List", Tags: filter, Order: "id", PageNum: 1, PageSize: n.(int)}
+			socks, err := w.list(ctx, all)
+			if err != nil {
+				fail(all, err)
+			}
+			for _, sock := range socks {
+				requests = append(requests, WarmRequest{Operation: "Get", ID: sock.ID})
+			}
 		}
+	}
+	return requests
+}
 
-		warmed++
+func (w *CacheWarmer) list(ctx context.Context, r WarmRequest) ([]Sock, error) {
+	socks, err := w.load(ctx, r)
+	if err != nil {
+		return nil, err
 	}
+	return socks.([]Sock), nil
+}
 
-	w.logger.Log("cache_warming", "products_completed", "warmed", warmed, "total", len(products), "duration_ms", time.Since(start).Milliseconds())
+// load fetches the answer to r from the service, waiting for the rate limit.
+// The service cannot be cancelled, so ctx is only checked before asking it.
+func (w *CacheWarmer) load(ctx context.Context, r WarmRequest) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if w.limiter != nil {
+		if err := w.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	switch r.Operation {
+	case "List":
+		return w.service.List(r.Filter(), r.Order, r.PageNum, r.PageSize)
+	case "Count":
+		return w.service.Count(r.Filter())
+	case "Get":
+		return w.service.Get(r.ID)
+	case "Tags":
+		return w.service.Tags()
+	}
+	return nil, fmt.Errorf("unknown operation %q", r.Operation)
+}
+
+func (w *CacheWarmer) markReady() {
+	select {
+	case <-w.ready:
+	default:
+		close(w.ready)
+	}
+}
+
+// Ready returns nil once the first warming run has finished, successfully or
+// not. It is meant to gate readiness, so that traffic is only sent to an
+// instance once its cache is warm.
+func (w *CacheWarmer) Ready() error {
+	select {
+	case <-w.ready:
+		return nil
+	default:
+		return NewError(CodeUnavailable, "cache warming in progress")
+	}
 }
 
 // WarmCacheAsync starts cache warming in the background
 func (w *CacheWarmer) WarmCacheAsync() {
-	go w.WarmCache()
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.WarmCache(w.ctx)
+	}()
 }
 
-// SchedulePeriodicWarming sets up periodic cache warming (useful for long-running services)
+// SchedulePeriodicWarming sets up periodic cache warming (useful for long-running services).
+// A tick that comes while the previous run is still going is skipped.
 func (w *CacheWarmer) SchedulePeriodicWarming(interval time.Duration) {
 	ticker := time.NewTicker(interval)
+	w.wg.Add(1)
 	go func() {
-		for range ticker.C {
-			w.WarmCache()
+		defer w.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := w.WarmCache(w.ctx); err == ErrWarmingInProgress {
+					w.logger.Log("cache_warming", "skipped", "reason", err)
+				}
+			case <-w.ctx.Done():
+				return
+			}
 		}
 	}()
-	
+
 	w.logger.Log("cache_warming", "scheduled", "interval_minutes", interval.Minutes())
 }
+
+// Stop cancels the run in progress and periodic warming, and waits for them
+// to finish. The warmer cannot be used afterwards.
+func (w *CacheWarmer) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
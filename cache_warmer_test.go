@@ -0,0 +1,258 @@
+package catalogue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// slowService takes delay to answer Get and tracks how many Gets run at once.
+// Once gated, Gets also wait for release to be closed, and started is closed
+// by the first of them.
+type slowService struct {
+	stubService
+	delay    time.Duration
+	inflight int32
+	max      int32
+	gets     int32
+
+	started chan struct{}
+	once    sync.Once
+	release chan struct{}
+}
+
+func (s *slowService) Get(id string) (Sock, error) {
+	atomic.AddInt32(&s.gets, 1)
+	n := atomic.AddInt32(&s.inflight, 1)
+	defer atomic.AddInt32(&s.inflight, -1)
+	for {
+		max := atomic.LoadInt32(&s.max)
+		if n <= max || atomic.CompareAndSwapInt32(&s.max, max, n) {
+			break
+		}
+	}
+	if s.release != nil {
+		s.once.Do(func() { close(s.started) })
+		<-s.release
+	}
+	time.Sleep(s.delay)
+	return s.stubService.Get(id)
+}
+
+// gate makes Gets wait for release.
+func (s *slowService) gate() *slowService {
+	s.started, s.release = make(chan struct{}), make(chan struct{})
+	return s
+}
+
+func newSlowService(n int, delay time.Duration) *slowService {
+	s := &slowService{stubService: stubService{socks: map[string]Sock{}}, delay: delay}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("sock-%d", i)
+		s.socks[id] = Sock{ID: id}
+	}
+	return s
+}
+
+func TestCacheWarmerReport(t *testing.T) {
+	cache := newFakeCache()
+	w := NewCacheWarmer(newSlowService(2, 0), cache, log.NewNopLogger())
+	if err := w.Ready(); err == nil {
+		t.Errorf("Ready before warming: want error, have nil")
+	}
+
+	report, err := w.WarmCache(context.Background())
+	if err != nil {
+		t.Fatalf("WarmCache: %v", err)
+	}
+	// The tags, the 7 default listings, the counts of their 4 tag filters and
+	// both socks
+	if want := 1 + 7 + 4 + 2; report.Warmed != want || report.Failed != 0 {
+		t.Errorf("WarmCache: want %d warmed, have %d warmed and %d failed", want, report.Warmed, report.Failed)
+	}
+	if len(cache.products) != 2 {
+		t.Errorf("WarmCache: want both socks cached, have %d", len(cache.products))
+	}
+	if err := w.Ready(); err != nil {
+		t.Errorf("Ready after warming: %v", err)
+	}
+
+	cache.err = errors.New("connection refused")
+	report, _ = w.WarmCache(context.Background())
+	if report.Warmed != 0 || report.Failed != len(report.Items) {
+		t.Errorf("WarmCache with a failing cache: want every item failed, have %+v", report)
+	}
+	for _, item := range report.Items {
+		if item.Error == "" {
+			t.Errorf("%s: want error, have none", item.Key)
+		}
+	}
+}
+
+func TestCacheWarmerBoundedAndExclusive(t *testing.T) {
+	next := newSlowService(6, 0).gate()
+	w := NewCacheWarmer(next, newFakeCache(), log.NewNopLogger(), WithWarmConcurrency(2))
+
+	done := make(chan error)
+	go func() {
+		_, err := w.WarmCache(context.Background())
+		done <- err
+	}()
+	<-next.started
+	if _, err := w.WarmCache(context.Background()); err != ErrWarmingInProgress {
+		t.Errorf("overlapping WarmCache: want %v, have %v", ErrWarmingInProgress, err)
+	}
+	close(next.release)
+	if err := <-done; err != nil {
+		t.Fatalf("WarmCache: %v", err)
+	}
+	if max := atomic.LoadInt32(&next.max); max > 2 {
+		t.Errorf("WarmCache: want at most 2 concurrent requests, have %d", max)
+	}
+}
+
+func TestCacheWarmerTimeout(t *testing.T) {
+	w := NewCacheWarmer(newSlowService(20, 20*time.Millisecond), newFakeCache(), log.NewNopLogger(),
+		WithWarmTimeout(100*time.Millisecond))
+	report, err := w.WarmCache(context.Background())
+	if err != context.DeadlineExceeded {
+		t.Errorf("WarmCache past its timeout: want %v, have %v", context.DeadlineExceeded, err)
+	}
+	if report.Warmed == 0 || report.Failed == 0 {
+		t.Errorf("WarmCache past its timeout: want some items warmed and some failed, have %d and %d", report.Warmed, report.Failed)
+	}
+	if report.Duration > time.Second {
+		t.Errorf("WarmCache past its timeout: took %v", report.Duration)
+	}
+}
+
+func TestCacheWarmerStop(t *testing.T) {
+	next := newSlowService(20, 0).gate()
+	w := NewCacheWarmer(next, newFakeCache(), log.NewNopLogger())
+	w.WarmCacheAsync()
+	w.SchedulePeriodicWarming(time.Hour)
+	<-next.started
+
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	// Stop waits for the Get in flight, which cannot be cancelled, and for
+	// nothing after it
+	<-w.ctx.Done()
+	close(next.release)
+	<-stopped
+	if gets := atomic.LoadInt32(&next.gets); gets != 1 {
+		t.Errorf("Stop: want the run to stop after the Get in flight, have %d Gets", gets)
+	}
+	if _, err := w.WarmCache(context.Background()); err == nil {
+		t.Errorf("WarmCache after Stop: want error, have nil")
+	}
+}
+
+func TestCacheWarmerCancel(t *testing.T) {
+	next := newSlowService(20, 0).gate()
+	w := NewCacheWarmer(next, newFakeCache(), log.NewNopLogger(), WithWarmConcurrency(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	type result struct {
+		report WarmReport
+		err    error
+	}
+	done := make(chan result)
+	go func() {
+		report, err := w.WarmCache(ctx)
+		done <- result{report, err}
+	}()
+	<-next.started
+	cancel()
+	close(next.release)
+	r := <-done
+
+	if r.err != context.Canceled {
+		t.Errorf("WarmCache cancelled: want %v, have %v", context.Canceled, r.err)
+	}
+	// Only the Gets in flight when it was cancelled were made
+	gets := int(atomic.LoadInt32(&next.gets))
+	if gets > 2 {
+		t.Errorf("WarmCache cancelled: want at most 2 Gets, have %d", gets)
+	}
+	failed := 0
+	for _, item := range r.report.Items {
+		if item.Request.Operation == "Get" && item.Error == context.Canceled.Error() {
+			failed++
+		}
+	}
+	if failed != 20-gets {
+		t.Errorf("WarmCache cancelled: want %d Gets failed, have %d", 20-gets, failed)
+	}
+}
+
+func TestReadinessGate(t *testing.T) {
+	w := NewCacheWarmer(newSlowService(1, 0), newFakeCache(), log.NewNopLogger())
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(&stubService{}), "", log.NewNopLogger(),
+		WithReadiness(w.Ready))
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+		return rec.Code
+	}
+	if code := ready(); code != 503 {
+		t.Errorf("GET /ready before warming: want 503, have %d", code)
+	}
+	w.WarmCache(context.Background())
+	if code := ready(); code != 200 {
+		t.Errorf("GET /ready after warming: want 200, have %d", code)
+	}
+}
+
+func TestCacheWarmerFullCatalogue(t *testing.T) {
+	cache := newFakeCache()
+	w := NewCacheWarmer(newSlowService(5, 0), cache, log.NewNopLogger(),
+		WithFullCatalogue(2, 10), WithWarmBatchSize(4), WithWarmConcurrency(3), WithWarmRateLimit(200))
+
+	report, err := w.WarmCache(context.Background())
+	if err != nil {
+		t.Fatalf("WarmCache: %v", err)
+	}
+	if report.Failed != 0 {
+		t.Errorf("WarmCache: want no failures, have %+v", report)
+	}
+	// stubService counts 5 socks for every filter: 3 pages of 2 and 1 page of
+	// 10 for the unfiltered and the brown listings
+	for _, filter := range [][]string{{}, {"brown"}} {
+		for _, want := range []WarmRequest{
+			{Operation: "Count", Tags: filter},
+			{Operation: "List", Tags: filter, Order: "id", PageNum: 3, PageSize: 2},
+			{Operation: "List", Tags: filter, Order: "id", PageNum: 1, PageSize: 10},
+		} {
+			if !cache.keys[want.Key()] {
+				t.Errorf("WarmCache: want %s warmed", want.Key())
+			}
+		}
+		if unwanted := (WarmRequest{Operation: "List", Tags: filter, Order: "id", PageNum: 4, PageSize: 2}); cache.keys[unwanted.Key()] {
+			t.Errorf("WarmCache: want no page past the last, have %s", unwanted.Key())
+		}
+	}
+	if len(cache.products) != 5 {
+		t.Errorf("WarmCache: want all 5 socks warmed, have %d", len(cache.products))
+	}
+	// Tags, 2 counts, 2x(3+1) pages and 5 socks in batches of 4
+	if want := (1 + 2 + 8 + 5 + 3) / 4; cache.batches != want {
+		t.Errorf("WarmCache: want %d batches, have %d", want, cache.batches)
+	}
+	// 1 Tags, 2 Counts and the full listing to plan, then 16 loads, at most
+	// one every 5ms
+	if min := 19 * 5 * time.Millisecond; report.Duration < min {
+		t.Errorf("WarmCache with a rate limit: want at least %v, have %v", min, report.Duration)
+	}
+}
@@ -2,27 +2,97 @@ package catalogue
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/sony/gobreaker"
 )
 
+// ErrStale is returned together with a usable result when CachedService
+// served a last-known-good copy because the database could not be reached.
+// Callers that understand it should treat the result as valid and tell their
+// clients it may be out of date; callers that don't will see a 503.
+var ErrStale = NewError(CodeUnavailable, "serving stale data")
+
+// RawService is implemented by services that can answer List and Get with
+// the JSON of their answer, when they have it ready, rather than with socks:
+// the transport then writes it as it is, with its ETag if that is known,
+// instead of decoding and encoding it again. Either the JSON or the socks is
+// returned. The TTL of the entry, and those CountTTL and TagsTTL return, is
+// what the cache entry they were answered from had left, zero if they were
+// not; it becomes the max-age of the response.
+type RawService interface {
+	ListRaw(filter Filter, order string, pageNum, pageSize int) (RawEntry, []Sock, error)
+	GetRaw(id string) (RawEntry, Sock, error)
+	CountTTL(filter Filter) (int, time.Duration, error)
+	TagsTTL() ([]string, time.Duration, error)
+}
+
 // CachedService wraps the original catalogue service with Redis caching
 type CachedService struct {
-	next    Service
-	cache   CatalogueCache
-	logger  log.Logger
-	metrics *CacheMetrics
+	next       Service
+	cache      CatalogueCache
+	logger     log.Logger
+	metrics    *CacheMetrics
+	serveStale bool
+	tracker    *AccessTracker
+}
+
+// CachedServiceOption configures a CachedService
+type CachedServiceOption func(*CachedService)
+
+// WithServeStale makes the service answer from the cache's last-known-good
+// copies when the database fails. The cache must be created with
+// WithStaleTTL for those copies to exist.
+func WithServeStale() CachedServiceOption {
+	return func(s *CachedService) {
+		s.serveStale = true
+	}
+}
+
+// WithMetrics makes the service record into the given metrics tracker
+// instead of a default one
+func WithMetrics(metrics *CacheMetrics) CachedServiceOption {
+	return func(s *CachedService) {
+		s.metrics = metrics
+	}
+}
+
+// WithAccessTracker makes the service count the requests for every cache key,
+// so that the hottest ones can be listed and warmed
+func WithAccessTracker(tracker *AccessTracker) CachedServiceOption {
+	return func(s *CachedService) {
+		s.tracker = tracker
+	}
 }
 
 // NewCachedService creates a new cached catalogue service
-func NewCachedService(next Service, cache CatalogueCache, logger log.Logger) *CachedService {
-	return &CachedService{
+func NewCachedService(next Service, cache CatalogueCache, logger log.Logger, opts ...CachedServiceOption) *CachedService {
+	s := &CachedService{
 		next:    next,
 		cache:   cache,
 		logger:  logger,
 		metrics: NewCacheMetrics(logger),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// canServeStale reports whether a failed database call should be answered
+// from a stale copy
+func (s *CachedService) canServeStale(err error) bool {
+	return s.serveStale && errors.Is(err, ErrDBConnection)
+}
+
+// recordAccess counts a request towards the hot keys
+func (s *CachedService) recordAccess(r WarmRequest) {
+	if s.tracker != nil {
+		s.tracker.Record(r.Key())
+	}
 }
 
 // GetMetrics returns the metrics tracker for external access
@@ -30,13 +100,17 @@ func (s *CachedService) GetMetrics() *CacheMetrics {
 	return s.metrics
 }
 
-func (s *CachedService) List(tags []string, order string, pageNum, pageSize int) ([]Sock, error) {
+func (s *CachedService) List(filter Filter, order string, pageNum, pageSize int) ([]Sock, error) {
 	ctx := context.Background()
+	s.recordAccess(WarmRequest{Operation: "List", Tags: filter.Tags, VariantSize: filter.VariantSize, Order: order, PageNum: pageNum, PageSize: pageSize})
 	start := time.Now()
 
 	// Try to get from cache first
-	socks, found, err := s.cache.GetProducts(ctx, tags, order, pageNum, pageSize)
-	if err != nil {
+	socks, found, err := s.cache.GetProducts(ctx, filter, order, pageNum, pageSize)
+	if errors.Is(err, ErrCacheUnavailable) {
+		// Breaker is open; go straight to the database without logging noise
+		s.metrics.RecordCacheBypass("List", time.Since(start))
+	} else if err != nil {
 		s.logger.Log("cache_error", err, "operation", "List", "fallback", "database")
 		s.metrics.RecordCacheError("List", time.Since(start))
 		// On cache error, fall back to database
@@ -46,7 +120,8 @@ func (s *CachedService) List(tags []string, order string, pageNum, pageSize int)
 		s.logger.Log(
 			"cache_hit", "true",
 			"operation", "List",
-			"tags", tags,
+			"tags", filter.Tags,
+			"variantSize", filter.VariantSize,
 			"order", order,
 			"pageNum", pageNum,
 			"pageSize", pageSize,
@@ -56,9 +131,52 @@ func (s *CachedService) List(tags []string, order string, pageNum, pageSize int)
 		return socks, nil
 	}
 
+	return s.listFromDatabase(ctx, filter, order, pageNum, pageSize, start)
+}
+
+// ListRaw is List answering cache hits with the JSON of the socks as it is
+// cached, see RawService
+func (s *CachedService) ListRaw(filter Filter, order string, pageNum, pageSize int) (RawEntry, []Sock, error) {
+	ctx := context.Background()
+	r := WarmRequest{Operation: "List", Tags: filter.Tags, VariantSize: filter.VariantSize, Order: order, PageNum: pageNum, PageSize: pageSize}
+	s.recordAccess(r)
+	start := time.Now()
+
+	// Try to get from cache first
+	raw, found, err := s.cache.GetRaw(ctx, r)
+	if errors.Is(err, ErrCacheUnavailable) {
+		// Breaker is open; go straight to the database without logging noise
+		s.metrics.RecordCacheBypass("List", time.Since(start))
+	} else if err != nil {
+		s.logger.Log("cache_error", err, "operation", "List", "fallback", "database")
+		s.metrics.RecordCacheError("List", time.Since(start))
+		// On cache error, fall back to database
+	} else if found && (raw.ETag != "" || json.Valid(raw.JSON)) {
+		duration := time.Since(start)
+		s.metrics.RecordCacheHit("List", duration)
+		s.logger.Log(
+			"cache_hit", "true",
+			"operation", "List",
+			"tags", filter.Tags,
+			"variantSize", filter.VariantSize,
+			"order", order,
+			"pageNum", pageNum,
+			"pageSize", pageSize,
+			"bytes", len(raw.JSON),
+			"duration_ms", duration.Milliseconds(),
+		)
+		return raw, nil, nil
+	}
+
+	socks, err := s.listFromDatabase(ctx, filter, order, pageNum, pageSize, start)
+	return RawEntry{}, socks, err
+}
+
+// listFromDatabase answers a List the cache could not, and caches the answer
+func (s *CachedService) listFromDatabase(ctx context.Context, filter Filter, order string, pageNum, pageSize int, start time.Time) ([]Sock, error) {
 	// Cache miss - get from database
 	s.logger.Log("cache_hit", "false", "operation", "List", "source", "database")
-	socks, err = s.next.List(tags, order, pageNum, pageSize)
+	socks, err := s.next.List(filter, order, pageNum, pageSize)
 	duration := time.Since(start)
 	
 	if err != nil {
@@ -68,6 +186,13 @@ func (s *CachedService) List(tags []string, order string, pageNum, pageSize int)
 			"error", err,
 			"duration_ms", duration.Milliseconds(),
 		)
+		if s.canServeStale(err) {
+			if stale, found, staleErr := s.cache.GetStaleProducts(ctx, filter, order, pageNum, pageSize); staleErr == nil && found {
+				s.metrics.RecordStaleServed("List")
+				s.logger.Log("operation", "List", "source", "stale")
+				return stale, ErrStale.WithCause(err)
+			}
+		}
 		return socks, err
 	}
 
@@ -78,7 +203,7 @@ func (s *CachedService) List(tags []string, order string, pageNum, pageSize int)
 		cacheCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		
-		if cacheErr := s.cache.SetProducts(cacheCtx, tags, order, pageNum, pageSize, socks); cacheErr != nil {
+		if cacheErr := s.cache.SetProducts(cacheCtx, filter, order, pageNum, pageSize, socks); cacheErr != nil && !errors.Is(cacheErr, ErrCacheUnavailable) {
 			s.logger.Log("cache_set_error", cacheErr, "operation", "List")
 		}
 	}()
@@ -94,32 +219,45 @@ func (s *CachedService) List(tags []string, order string, pageNum, pageSize int)
 	return socks, nil
 }
 
-func (s *CachedService) Count(tags []string) (int, error) {
+func (s *CachedService) Count(filter Filter) (int, error) {
+	count, _, err := s.CountTTL(filter)
+	return count, err
+}
+
+// CountTTL is Count with the time its cache entry has left, see RawService
+func (s *CachedService) CountTTL(filter Filter) (int, time.Duration, error) {
 	ctx := context.Background()
+	r := WarmRequest{Operation: "Count", Tags: filter.Tags, VariantSize: filter.VariantSize}
+	s.recordAccess(r)
 	start := time.Now()
 
-	// Try to get from cache first
-	count, found, err := s.cache.GetCount(ctx, tags)
-	if err != nil {
+	// Try to get from cache first, with the time the entry has left
+	var count int
+	raw, found, err := s.cache.GetRaw(ctx, r)
+	if errors.Is(err, ErrCacheUnavailable) {
+		// Breaker is open; go straight to the database without logging noise
+		s.metrics.RecordCacheBypass("Count", time.Since(start))
+	} else if err != nil {
 		s.logger.Log("cache_error", err, "operation", "Count", "fallback", "database")
 		s.metrics.RecordCacheError("Count", time.Since(start))
 		// On cache error, fall back to database
-	} else if found {
+	} else if found && json.Unmarshal(raw.JSON, &count) == nil {
 		duration := time.Since(start)
 		s.metrics.RecordCacheHit("Count", duration)
 		s.logger.Log(
 			"cache_hit", "true",
 			"operation", "Count",
-			"tags", tags,
+			"tags", filter.Tags,
+			"variantSize", filter.VariantSize,
 			"count", count,
 			"duration_ms", duration.Milliseconds(),
 		)
-		return count, nil
+		return count, raw.TTL, nil
 	}
 
 	// Cache miss - get from database
 	s.logger.Log("cache_hit", "false", "operation", "Count", "source", "database")
-	count, err = s.next.Count(tags)
+	count, err = s.next.Count(filter)
 	duration := time.Since(start)
 	
 	if err != nil {
@@ -129,7 +267,14 @@ func (s *CachedService) Count(tags []string) (int, error) {
 			"error", err,
 			"duration_ms", duration.Milliseconds(),
 		)
-		return count, err
+		if s.canServeStale(err) {
+			if stale, found, staleErr := s.cache.GetStaleCount(ctx, filter); staleErr == nil && found {
+				s.metrics.RecordStaleServed("Count")
+				s.logger.Log("operation", "Count", "source", "stale")
+				return stale, 0, ErrStale.WithCause(err)
+			}
+		}
+		return count, 0, err
 	}
 
 	s.metrics.RecordCacheMiss("Count", duration)
@@ -139,7 +284,7 @@ func (s *CachedService) Count(tags []string) (int, error) {
 		cacheCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		
-		if cacheErr := s.cache.SetCount(cacheCtx, tags, count); cacheErr != nil {
+		if cacheErr := s.cache.SetCount(cacheCtx, filter, count); cacheErr != nil && !errors.Is(cacheErr, ErrCacheUnavailable) {
 			s.logger.Log("cache_set_error", cacheErr, "operation", "Count")
 		}
 	}()
@@ -152,16 +297,20 @@ func (s *CachedService) Count(tags []string) (int, error) {
 		"duration_ms", duration.Milliseconds(),
 	)
 
-	return count, nil
+	return count, 0, nil
 }
 
 func (s *CachedService) Get(id string) (Sock, error) {
 	ctx := context.Background()
+	s.recordAccess(WarmRequest{Operation: "Get", ID: id})
 	start := time.Now()
 
 	// Try to get from cache first
 	sock, found, err := s.cache.GetProduct(ctx, id)
-	if err != nil {
+	if errors.Is(err, ErrCacheUnavailable) {
+		// Breaker is open; go straight to the database without logging noise
+		s.metrics.RecordCacheBypass("Get", time.Since(start))
+	} else if err != nil {
 		s.logger.Log("cache_error", err, "operation", "Get", "id", id, "fallback", "database")
 		s.metrics.RecordCacheError("Get", time.Since(start))
 		// On cache error, fall back to database
@@ -178,9 +327,48 @@ func (s *CachedService) Get(id string) (Sock, error) {
 		return sock, nil
 	}
 
+	return s.getFromDatabase(ctx, id, start)
+}
+
+// GetRaw is Get answering cache hits with the JSON of the sock as it is
+// cached, see RawService
+func (s *CachedService) GetRaw(id string) (RawEntry, Sock, error) {
+	ctx := context.Background()
+	r := WarmRequest{Operation: "Get", ID: id}
+	s.recordAccess(r)
+	start := time.Now()
+
+	// Try to get from cache first
+	raw, found, err := s.cache.GetRaw(ctx, r)
+	if errors.Is(err, ErrCacheUnavailable) {
+		// Breaker is open; go straight to the database without logging noise
+		s.metrics.RecordCacheBypass("Get", time.Since(start))
+	} else if err != nil {
+		s.logger.Log("cache_error", err, "operation", "Get", "id", id, "fallback", "database")
+		s.metrics.RecordCacheError("Get", time.Since(start))
+		// On cache error, fall back to database
+	} else if found && (raw.ETag != "" || json.Valid(raw.JSON)) {
+		duration := time.Since(start)
+		s.metrics.RecordCacheHit("Get", duration)
+		s.logger.Log(
+			"cache_hit", "true",
+			"operation", "Get",
+			"id", id,
+			"bytes", len(raw.JSON),
+			"duration_ms", duration.Milliseconds(),
+		)
+		return raw, Sock{}, nil
+	}
+
+	sock, err := s.getFromDatabase(ctx, id, start)
+	return RawEntry{}, sock, err
+}
+
+// getFromDatabase answers a Get the cache could not, and caches the answer
+func (s *CachedService) getFromDatabase(ctx context.Context, id string, start time.Time) (Sock, error) {
 	// Cache miss - get from database
 	s.logger.Log("cache_hit", "false", "operation", "Get", "id", id, "source", "database")
-	sock, err = s.next.Get(id)
+	sock, err := s.next.Get(id)
 	duration := time.Since(start)
 	
 	if err != nil {
@@ -191,6 +379,13 @@ func (s *CachedService) Get(id string) (Sock, error) {
 			"error", err,
 			"duration_ms", duration.Milliseconds(),
 		)
+		if s.canServeStale(err) {
+			if stale, found, staleErr := s.cache.GetStaleProduct(ctx, id); staleErr == nil && found {
+				s.metrics.RecordStaleServed("Get")
+				s.logger.Log("operation", "Get", "id", id, "source", "stale")
+				return stale, ErrStale.WithCause(err)
+			}
+		}
 		return sock, err
 	}
 
@@ -201,7 +396,7 @@ func (s *CachedService) Get(id string) (Sock, error) {
 		cacheCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		
-		if cacheErr := s.cache.SetProduct(cacheCtx, id, sock); cacheErr != nil {
+		if cacheErr := s.cache.SetProduct(cacheCtx, id, sock); cacheErr != nil && !errors.Is(cacheErr, ErrCacheUnavailable) {
 			s.logger.Log("cache_set_error", cacheErr, "operation", "Get", "id", id)
 		}
 	}()
@@ -218,17 +413,144 @@ func (s *CachedService) Get(id string) (Sock, error) {
 	return sock, nil
 }
 
-func (s *CachedService) Tags() ([]string, error) {
+// GetMany gets the socks of ids that are cached from the cache and the rest
+// from the database at once, see MultiGetter. Each sock counts as a Get in
+// the metrics.
+func (s *CachedService) GetMany(ids []string) ([]Sock, error) {
 	ctx := context.Background()
+	seen := make(map[string]bool, len(ids))
+	var unique []string
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+			s.recordAccess(WarmRequest{Operation: "Get", ID: id})
+		}
+	}
+
+	// The cached ones in one round trip
 	start := time.Now()
+	found, err := s.cache.GetProductsByID(ctx, unique)
+	duration := time.Since(start)
+	if errors.Is(err, ErrCacheUnavailable) {
+		// Breaker is open; go straight to the database
+		s.metrics.RecordCacheBypass("Get", duration)
+	} else if err != nil {
+		s.logger.Log("cache_error", err, "operation", "GetMany", "ids", len(unique), "fallback", "database")
+		s.metrics.RecordCacheError("Get", duration)
+	}
+	if err != nil || found == nil {
+		found = make(map[string]Sock, len(unique))
+	}
+	var missing []string
+	for _, id := range unique {
+		if _, hit := found[id]; hit {
+			s.metrics.RecordCacheHit("Get", duration)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	s.logger.Log("operation", "GetMany", "ids", len(found)+len(missing), "cache_hits", len(found))
+	if len(missing) == 0 {
+		return orderSocks(ids, found), nil
+	}
 
-	// Try to get from cache first
-	tags, found, err := s.cache.GetTags(ctx)
+	// Cache misses - get them all from the database
+	start = time.Now()
+	socks, err := GetSocks(s.next, missing)
+	duration = time.Since(start)
+	for range missing {
+		s.metrics.RecordCacheMiss("Get", duration)
+	}
+	if err != nil && !errors.Is(err, ErrStale) {
+		s.logger.Log(
+			"operation", "GetMany",
+			"error", err,
+			"duration_ms", duration.Milliseconds(),
+		)
+		if !s.canServeStale(err) {
+			return nil, err
+		}
+		// The socks without a stale copy are left out, as if they were
+		// not found
+		if stale, staleErr := s.cache.GetStaleProductsByID(ctx, missing); staleErr == nil {
+			for id, sock := range stale {
+				s.metrics.RecordStaleServed("Get")
+				found[id] = sock
+			}
+		}
+		s.logger.Log("operation", "GetMany", "source", "stale")
+		return orderSocks(ids, found), ErrStale.WithCause(err)
+	}
+	for _, sock := range socks {
+		found[sock.ID] = sock
+	}
 	if err != nil {
+		// Stale copies from further down are not cached
+		return orderSocks(ids, found), err
+	}
+
+	// Cache the result (fire-and-forget)
+	go func() {
+		cacheCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		entries := make([]CacheEntry, len(socks))
+		for i, sock := range socks {
+			entries[i] = CacheEntry{Request: WarmRequest{Operation: "Get", ID: sock.ID}, Value: sock}
+		}
+		if cacheErr := s.cache.SetMany(cacheCtx, entries); cacheErr != nil && !errors.Is(cacheErr, ErrCacheUnavailable) {
+			s.logger.Log("cache_set_error", cacheErr, "operation", "GetMany")
+		}
+	}()
+
+	s.logger.Log(
+		"operation", "GetMany",
+		"source", "database",
+		"cached", "true",
+		"count", len(socks),
+		"duration_ms", duration.Milliseconds(),
+	)
+
+	return orderSocks(ids, found), nil
+}
+
+// orderSocks returns the socks of ids that are in found, once each, in the
+// order of ids
+func orderSocks(ids []string, found map[string]Sock) []Sock {
+	socks := make([]Sock, 0, len(found))
+	for _, id := range ids {
+		if sock, ok := found[id]; ok {
+			socks = append(socks, sock)
+			delete(found, id)
+		}
+	}
+	return socks
+}
+
+func (s *CachedService) Tags() ([]string, error) {
+	tags, _, err := s.TagsTTL()
+	return tags, err
+}
+
+// TagsTTL is Tags with the time its cache entry has left, see RawService
+func (s *CachedService) TagsTTL() ([]string, time.Duration, error) {
+	ctx := context.Background()
+	r := WarmRequest{Operation: "Tags"}
+	s.recordAccess(r)
+	start := time.Now()
+
+	// Try to get from cache first, with the time the entry has left
+	var tags []string
+	raw, found, err := s.cache.GetRaw(ctx, r)
+	if errors.Is(err, ErrCacheUnavailable) {
+		// Breaker is open; go straight to the database without logging noise
+		s.metrics.RecordCacheBypass("Tags", time.Since(start))
+	} else if err != nil {
 		s.logger.Log("cache_error", err, "operation", "Tags", "fallback", "database")
 		s.metrics.RecordCacheError("Tags", time.Since(start))
 		// On cache error, fall back to database
-	} else if found {
+	} else if found && json.Unmarshal(raw.JSON, &tags) == nil {
 		duration := time.Since(start)
 		s.metrics.RecordCacheHit("Tags", duration)
 		s.logger.Log(
@@ -237,7 +559,7 @@ func (s *CachedService) Tags() ([]string, error) {
 			"count", len(tags),
 			"duration_ms", duration.Milliseconds(),
 		)
-		return tags, nil
+		return tags, raw.TTL, nil
 	}
 
 	// Cache miss - get from database
@@ -252,7 +574,14 @@ func (s *CachedService) Tags() ([]string, error) {
 			"error", err,
 			"duration_ms", duration.Milliseconds(),
 		)
-		return tags, err
+		if s.canServeStale(err) {
+			if stale, found, staleErr := s.cache.GetStaleTags(ctx); staleErr == nil && found {
+				s.metrics.RecordStaleServed("Tags")
+				s.logger.Log("operation", "Tags", "source", "stale")
+				return stale, 0, ErrStale.WithCause(err)
+			}
+		}
+		return tags, 0, err
 	}
 
 	s.metrics.RecordCacheMiss("Tags", duration)
@@ -262,7 +591,7 @@ func (s *CachedService) Tags() ([]string, error) {
 		cacheCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		
-		if cacheErr := s.cache.SetTags(cacheCtx, tags); cacheErr != nil {
+		if cacheErr := s.cache.SetTags(cacheCtx, tags); cacheErr != nil && !errors.Is(cacheErr, ErrCacheUnavailable) {
 			s.logger.Log("cache_set_error", cacheErr, "operation", "Tags")
 		}
 	}()
@@ -275,7 +604,7 @@ func (s *CachedService) Tags() ([]string, error) {
 		"duration_ms", duration.Milliseconds(),
 	)
 
-	return tags, nil
+	return tags, 0, nil
 }
 
 func (s *CachedService) Health() []Health {
@@ -289,7 +618,10 @@ func (s *CachedService) Health() []Health {
 	defer cancel()
 	
 	redisStatus := "OK"
-	if err := s.cache.Ping(ctx); err != nil {
+	if b, ok := s.cache.(interface{ State() gobreaker.State }); ok && b.State() != gobreaker.StateClosed {
+		// Requests are being served from the database while Redis recovers
+		redisStatus = "degraded"
+	} else if err := s.cache.Ping(ctx); err != nil {
 		redisStatus = "err"
 		s.logger.Log("redis_health_error", err)
 	}
@@ -0,0 +1,292 @@
+package catalogue
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+)
+
+// stubService answers from a map and fails every call with err when set.
+type stubService struct {
+	Service
+	err   error
+	socks map[string]Sock
+}
+
+func (s *stubService) List(filter Filter, order string, pageNum, pageSize int) ([]Sock, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	socks := []Sock{}
+	for _, sock := range s.socks {
+		socks = append(socks, sock)
+	}
+	return socks, nil
+}
+
+func (s *stubService) Count(filter Filter) (int, error) {
+	return len(s.socks), s.err
+}
+
+func (s *stubService) Tags() ([]string, error) {
+	return []string{"brown"}, s.err
+}
+
+func (s *stubService) Get(id string) (Sock, error) {
+	if s.err != nil {
+		return Sock{}, s.err
+	}
+	sock, ok := s.socks[id]
+	if !ok {
+		return Sock{}, ErrNotFound
+	}
+	return sock, nil
+}
+
+// multiGetService is a stubService that gets several socks at once, and
+// records the ids it is asked for.
+type multiGetService struct {
+	*stubService
+	gets    int
+	batches [][]string
+}
+
+func (s *multiGetService) Get(id string) (Sock, error) {
+	s.gets++
+	return s.stubService.Get(id)
+}
+
+func (s *multiGetService) GetMany(ids []string) ([]Sock, error) {
+	s.batches = append(s.batches, ids)
+	if s.err != nil {
+		return nil, s.err
+	}
+	socks := []Sock{}
+	for _, id := range ids {
+		if sock, ok := s.socks[id]; ok {
+			socks = append(socks, sock)
+		}
+	}
+	return socks, nil
+}
+
+func TestCachedServiceGetMany(t *testing.T) {
+	cache := newFakeCache()
+	cache.products[s1.ID] = s1
+	cache.stale[s3.ID] = s3
+	next := &multiGetService{stubService: &stubService{socks: map[string]Sock{s1.ID: s1, s2.ID: s2}}}
+	s := NewCachedService(next, cache, log.NewNopLogger(), WithServeStale())
+
+	// The cached sock from the cache, the others from the database at once
+	have, err := s.GetMany([]string{s2.ID, s1.ID, "missing", s2.ID})
+	if err != nil || len(have) != 2 || have[0].ID != s2.ID || have[1].ID != s1.ID {
+		t.Fatalf("GetMany: want %s and %s, have %+v (%v)", s2.ID, s1.ID, have, err)
+	}
+	if want := [][]string{{s2.ID, "missing"}}; !reflect.DeepEqual(next.batches, want) || next.gets != 0 {
+		t.Errorf("GetMany: want the database asked for %v at once, have %v and %d Gets", want, next.batches, next.gets)
+	}
+	if m := s.GetMetrics().GetMetrics(); m.CacheHits != 1 || m.CacheMisses != 2 {
+		t.Errorf("GetMany: want 1 hit and 2 misses, have %d and %d", m.CacheHits, m.CacheMisses)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		cache.mu.Lock()
+		_, cached := cache.products[s2.ID]
+		cache.mu.Unlock()
+		if cached {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GetMany: want %s cached", s2.ID)
+		}
+	}
+
+	// Stale copies of those the database cannot be asked for
+	next.err = ErrDBConnection
+	have, err = s.GetMany([]string{s1.ID, s3.ID, "missing"})
+	if !errors.Is(err, ErrStale) || len(have) != 2 || have[1].ID != s3.ID {
+		t.Errorf("GetMany without a database: want %s cached and %s stale, have %+v (%v)", s1.ID, s3.ID, have, err)
+	}
+	s = NewCachedService(next, cache, log.NewNopLogger())
+	if _, err := s.GetMany([]string{s3.ID}); err != ErrDBConnection {
+		t.Errorf("GetMany without a database or WithServeStale: want %v, have %v", ErrDBConnection, err)
+	}
+}
+
+func TestCachedServiceServeStale(t *testing.T) {
+	cache := newFakeCache()
+	cache.stale[s1.ID] = s1
+	next := &stubService{err: ErrDBConnection}
+
+	s := NewCachedService(next, cache, log.NewNopLogger(), WithServeStale())
+	have, err := s.Get(s1.ID)
+	if !errors.Is(err, ErrStale) {
+		t.Fatalf("Get(%s): want %v, have %v", s1.ID, ErrStale, err)
+	}
+	if have.ID != s1.ID {
+		t.Errorf("Get(%s): want stale copy, have %q", s1.ID, have.ID)
+	}
+	if have := s.GetMetrics().GetMetrics().StaleServed; have != 1 {
+		t.Errorf("StaleServed: want 1, have %d", have)
+	}
+
+	// Not found is an answer, not an outage: no stale copy for it
+	next.err = ErrNotFound
+	if _, err := s.Get(s1.ID); err != ErrNotFound {
+		t.Errorf("Get(%s): want %v, have %v", s1.ID, ErrNotFound, err)
+	}
+
+	// Without the option the database error is returned as-is
+	next.err = ErrDBConnection
+	s = NewCachedService(next, cache, log.NewNopLogger())
+	if _, err := s.Get(s1.ID); err != ErrDBConnection {
+		t.Errorf("Get(%s) without WithServeStale: want %v, have %v", s1.ID, ErrDBConnection, err)
+	}
+}
+
+func TestStaleResponseHeaders(t *testing.T) {
+	cache := newFakeCache()
+	cache.stale[s1.ID] = s1
+	s := NewCachedService(&stubService{err: ErrDBConnection}, cache, log.NewNopLogger(), WithServeStale())
+
+	response, err := MakeGetEndpoint(s)(context.Background(), getRequest{ID: s1.ID})
+	if err != nil {
+		t.Fatalf("GetEndpoint: %v", err)
+	}
+	w := httptest.NewRecorder()
+	if err := encodeGetResponse(context.Background(), w, response); err != nil {
+		t.Fatalf("encodeGetResponse: %v", err)
+	}
+	if w.Code != 200 {
+		t.Errorf("status: want 200, have %d", w.Code)
+	}
+	if have := w.Header().Get("X-Cache"); have != "STALE" {
+		t.Errorf("X-Cache: want STALE, have %q", have)
+	}
+	if have := w.Header().Get("Warning"); have == "" {
+		t.Errorf("Warning: want a stale warning, have none")
+	}
+}
+
+// byteCache is a fakeCache keeping listings and socks as the JSON they are
+// in Redis.
+type byteCache struct {
+	*fakeCache
+}
+
+func (c byteCache) GetProducts(ctx context.Context, filter Filter, order string, pageNum, pageSize int) ([]Sock, bool, error) {
+	var socks []Sock
+	found, err := c.GetEntry(ctx, WarmRequest{Operation: "List", Tags: filter.Tags, VariantSize: filter.VariantSize, Order: order, PageNum: pageNum, PageSize: pageSize}, &socks)
+	return socks, found, err
+}
+
+func (c byteCache) GetProduct(ctx context.Context, id string) (Sock, bool, error) {
+	var sock Sock
+	found, err := c.GetEntry(ctx, WarmRequest{Operation: "Get", ID: id}, &sock)
+	return sock, found, err
+}
+
+func (c byteCache) put(r WarmRequest, value interface{}) {
+	c.values[r.Key()], _ = json.Marshal(value)
+}
+
+func TestCachedServiceRaw(t *testing.T) {
+	updated := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	sock := s1
+	sock.UpdatedAt = &updated
+	next := &stubService{socks: map[string]Sock{sock.ID: sock}}
+	cache := byteCache{newFakeCache()}
+	s := NewCachedService(next, cache, log.NewNopLogger())
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(LoggingMiddleware(log.NewNopLogger())(s)), "", log.NewNopLogger())
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	list := WarmRequest{Operation: "List", Tags: []string{}, Order: "id", PageNum: 1, PageSize: 10}
+	product := WarmRequest{Operation: "Get", ID: sock.ID}
+	fromDB := map[string]*httptest.ResponseRecorder{"/catalogue": get("/catalogue"), "/catalogue/" + sock.ID: get("/catalogue/" + sock.ID)}
+
+	// Sent as cached, without the database
+	cache.put(list, []Sock{sock})
+	cache.put(product, sock)
+	delete(next.socks, sock.ID)
+	for path, want := range fromDB {
+		rec := get(path)
+		if rec.Code != 200 || !bytes.Equal(rec.Body.Bytes(), want.Body.Bytes()) {
+			t.Errorf("%s from the cache: want %s, have %d %s", path, want.Body, rec.Code, rec.Body)
+		}
+		for _, header := range []string{"ETag", "Last-Modified", "Content-Type"} {
+			if rec.Header().Get(header) != want.Header().Get(header) {
+				t.Errorf("%s from the cache: want %s %q, have %q", path, header, want.Header().Get(header), rec.Header().Get(header))
+			}
+		}
+	}
+	if hits := s.GetMetrics().GetMetrics().CacheHits; hits != 2 {
+		t.Errorf("CacheHits: want 2, have %d", hits)
+	}
+
+	// Corrupted entries are not sent
+	cache.values[product.Key()] = []byte(`{"id":`)
+	if rec := get("/catalogue/" + sock.ID); rec.Code != 404 {
+		t.Errorf("corrupted entry: want the database's 404, have %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestLastModifiedJSON(t *testing.T) {
+	early, late := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 2, 8, 30, 0, 0, time.UTC)
+	a, b, c := s1, s1, s1
+	a.UpdatedAt, b.UpdatedAt = &late, &early
+	c.Description = `"updatedAt":"2099-01-01T00:00:00Z"`
+	for _, socks := range [][]Sock{{a, b, c}, {b}, {c}, nil} {
+		data, _ := json.Marshal(socks)
+		if want, have := LastModified(socks...), lastModifiedJSON(data); !have.Equal(want) {
+			t.Errorf("lastModifiedJSON(%s): want %v, have %v", data, want, have)
+		}
+	}
+}
+
+// BenchmarkCachedService compares cache hits decoded into socks and encoded
+// again with cache hits sent as they are cached.
+func BenchmarkCachedService(b *testing.B) {
+	socks := manySocks(20)
+	cache := byteCache{newFakeCache()}
+	cache.put(WarmRequest{Operation: "List", Tags: []string{}, Order: "id", PageNum: 1, PageSize: 20}, socks)
+	cache.put(WarmRequest{Operation: "Get", ID: socks[0].ID}, socks[0])
+	s := NewCachedService(&stubService{}, cache, log.NewNopLogger())
+	// As the service is run, with its prices in the base currency
+	rates, err := NewRateTable("USD", map[string]string{"EUR": "0.5"})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, svc := range []struct {
+		name string
+		s    Service
+	}{
+		{"decoded", struct{ Service }{s}}, // hides RawService
+		{"raw", s},
+	} {
+		router := MakeHTTPHandler(context.Background(), ConvertEndpoints(MakeEndpoints(svc.s), rates, cache, log.NewNopLogger()), "", log.NewNopLogger(), WithCompression(nil, 0))
+		for name, path := range map[string]string{"List": "/catalogue?size=20", "Get": "/catalogue/" + socks[0].ID} {
+			req := httptest.NewRequest("GET", path, nil)
+			b.Run(name+"/"+svc.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					rec := httptest.NewRecorder()
+					router.ServeHTTP(rec, req)
+					if rec.Code != 200 {
+						b.Fatalf("GET %s: %d %s", path, rec.Code, rec.Body)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package catalogue
+
+// cdc.go keeps the cache coherent with writes made to the database behind
+// the service's back, by polling the sock_change table that the triggers in
+// dump.sql fill.
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+)
+
+// ChangeEvent is a row written to one of the catalogue tables.
+type ChangeEvent struct {
+	ID        int64
+	Table     string   // sock, sock_tag, sock_image, sock_variant or tag
+	Operation string   // insert, update or delete
+	SockID    string   // the sock written, or linked to or unlinked from a tag
+	Tags      []string // the tags of the sock, or the tag written or (un)linked
+}
+
+// ChangeSource reads the catalogue change log.
+type ChangeSource interface {
+	// Changes returns up to limit changes recorded after the change with ID
+	// after, oldest first.
+	Changes(ctx context.Context, after int64, limit int) ([]ChangeEvent, error)
+
+	// Position returns the ID of the last change recorded more than lookback
+	// ago, from which Changes should be read to see everything since.
+	Position(ctx context.Context, lookback time.Duration) (int64, error)
+}
+
+// NewSQLChangeSource reads the sock_change table of db.
+func NewSQLChangeSource(db *sqlx.DB) ChangeSource {
+	return &sqlChangeSource{db: db}
+}
+
+type sqlChangeSource struct {
+	db *sqlx.DB
+}
+
+func (s *sqlChangeSource) Changes(ctx context.Context, after int64, limit int) ([]ChangeEvent, error) {
+	var rows []struct {
+		ID        int64          `db:"change_id"`
+		Table     string         `db:"table_name"`
+		Operation string         `db:"operation"`
+		SockID    sql.NullString `db:"sock_id"`
+		Tags      sql.NullString `db:"tags"`
+	}
+	query := "SELECT change_id, table_name, operation, sock_id, tags FROM sock_change WHERE change_id > ? ORDER BY change_id LIMIT ?;"
+	if err := s.db.SelectContext(ctx, &rows, query, after, limit); err != nil {
+		return nil, err
+	}
+	events := make([]ChangeEvent, len(rows))
+	for i, r := range rows {
+		events[i] = ChangeEvent{ID: r.ID, Table: r.Table, Operation: r.Operation, SockID: r.SockID.String}
+		if r.Tags.String != "" {
+			events[i].Tags = strings.Split(r.Tags.String, ",")
+		}
+	}
+	return events, nil
+}
+
+func (s *sqlChangeSource) Position(ctx context.Context, lookback time.Duration) (int64, error) {
+	var id sql.NullInt64
+	query := "SELECT MAX(change_id) FROM sock_change WHERE changed_at < NOW(6) - INTERVAL ? SECOND;"
+	if err := s.db.GetContext(ctx, &id, query, int64(lookback/time.Second)); err != nil {
+		return 0, err
+	}
+	return id.Int64, nil
+}
+
+// Invalidations returns the cache entries made stale by events.
+//
+// A change to a sock row changes its own entry and the listings it appears
+// in: the unfiltered ones and those of its tags. Creating or deleting it also
+// changes the matching counts. Linking or unlinking a tag changes the sock's
+// entry, which lists its tags, and the listings and counts of the tag and the
+// unfiltered ones, since untagged socks are not listed. Changing the images
+// of a sock is like updating its row. Changing its variants also changes the
+// counts, which may be filtered by variant size. Changing a tag changes the
+// tag list, and renaming it every listing of both names.
+func Invalidations(events []ChangeEvent) Invalidation {
+	var inv Invalidation
+	products := map[string]bool{}
+	tags := map[string]bool{}
+	for _, e := range events {
+		if e.SockID != "" {
+			products[e.SockID] = true
+		}
+		for _, t := range e.Tags {
+			tags[t] = true
+		}
+		switch e.Table {
+		case "sock":
+			inv.Listings = true
+			if e.Operation != "update" {
+				inv.Counts = true
+			}
+		case "sock_tag":
+			inv.Listings = true
+			inv.Counts = true
+		case "sock_image":
+			inv.Listings = true
+		case "sock_variant":
+			inv.Listings = true
+			inv.Counts = true
+		case "tag":
+			inv.TagList = true
+			if e.Operation == "update" {
+				inv.Listings = true
+				inv.Counts = true
+			}
+		}
+	}
+	for id := range products {
+		inv.Products = append(inv.Products, id)
+	}
+	for t := range tags {
+		inv.Tags = append(inv.Tags, t)
+	}
+	sort.Strings(inv.Products)
+	sort.Strings(inv.Tags)
+	return inv
+}
+
+// Defaults for NewCacheInvalidator.
+const (
+	DefaultChangePollInterval = 2 * time.Second
+	DefaultChangeBatch        = 500
+	DefaultChangeLookback     = 30 * time.Minute
+	DefaultChangeGapWait      = time.Minute
+)
+
+// CacheInvalidator polls a ChangeSource and invalidates the cache entries
+// made stale by each batch of changes. Every replica can run one: the
+// invalidations are idempotent.
+//
+// Change IDs are handed out when a change is written, not when its
+// transaction commits, so a poll can read a change before one with a lower
+// ID is committed. The IDs a poll skips over are read again by every poll
+// until their change turns up or gapWait has passed, after which they are
+// taken to be rolled back.
+type CacheInvalidator struct {
+	source   ChangeSource
+	cache    CatalogueCache
+	logger   log.Logger
+	interval time.Duration
+	batch    int
+	lookback time.Duration
+	gapWait  time.Duration
+	position int64
+	gaps     map[int64]time.Time // IDs below position not read yet, and since when
+}
+
+// CacheInvalidatorOption configures a CacheInvalidator.
+type CacheInvalidatorOption func(*CacheInvalidator)
+
+// WithPollInterval sets how often the change log is polled.
+func WithPollInterval(d time.Duration) CacheInvalidatorOption {
+	return func(i *CacheInvalidator) {
+		i.interval = d
+	}
+}
+
+// WithLookback sets how far back Run starts reading the change log. It should
+// be the cache TTL, so that changes made while the service was down are
+// applied to entries cached before.
+func WithLookback(d time.Duration) CacheInvalidatorOption {
+	return func(i *CacheInvalidator) {
+		i.lookback = d
+	}
+}
+
+// NewCacheInvalidator creates a CacheInvalidator reading changes from source.
+func NewCacheInvalidator(source ChangeSource, cache CatalogueCache, logger log.Logger, opts ...CacheInvalidatorOption) *CacheInvalidator {
+	i := &CacheInvalidator{
+		source:   source,
+		cache:    cache,
+		logger:   logger,
+		interval: DefaultChangePollInterval,
+		batch:    DefaultChangeBatch,
+		lookback: DefaultChangeLookback,
+		gapWait:  DefaultChangeGapWait,
+		gaps:     map[int64]time.Time{},
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// Run polls for changes until ctx is done.
+func (i *CacheInvalidator) Run(ctx context.Context) error {
+	for {
+		position, err := i.source.Position(ctx, i.lookback)
+		if err == nil {
+			i.position = position
+			break
+		}
+		i.logger.Log("cdc", "error", "operation", "Position", "error", err)
+		select {
+		case <-time.After(i.interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	i.logger.Log("cdc", "started", "position", i.position, "interval", i.interval)
+
+	ticker := time.NewTicker(i.interval)
+	defer ticker.Stop()
+	for {
+		// Keep polling while full batches come back
+		for {
+			n, err := i.Poll(ctx)
+			if err != nil {
+				i.logger.Log("cdc", "error", "operation", "Poll", "position", i.position, "error", err)
+			}
+			if err != nil || n < i.batch {
+				break
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Poll applies the next batch of changes, and those skipped over by earlier
+// polls that have been committed since, and reports how many new ones there
+// were. The position only moves past changes whose invalidations succeeded,
+// so a failed batch is retried by the next Poll.
+func (i *CacheInvalidator) Poll(ctx context.Context) (int, error) {
+	events, err := i.source.Changes(ctx, i.position, i.batch)
+	if err != nil {
+		return 0, err
+	}
+	late, err := i.lateChanges(ctx)
+	if err != nil || len(events)+len(late) == 0 {
+		return 0, err
+	}
+	inv := Invalidations(append(late, events...))
+	if err := i.cache.Invalidate(ctx, inv); err != nil {
+		return 0, err
+	}
+	for _, e := range late {
+		delete(i.gaps, e.ID)
+	}
+	now := time.Now()
+	for _, e := range events {
+		// A run of missing IDs longer than a batch is a jump of the counter
+		// rather than changes still being written
+		if e.ID-i.position-1 <= int64(i.batch) {
+			for id := i.position + 1; id < e.ID; id++ {
+				i.gaps[id] = now
+			}
+		}
+		i.position = e.ID
+	}
+	i.logger.Log("cdc", "invalidated", "changes", len(events), "late", len(late), "gaps", len(i.gaps), "position", i.position, "products", len(inv.Products), "tags", strings.Join(inv.Tags, ","))
+	return len(events), nil
+}
+
+// lateChanges returns the changes with the IDs earlier polls skipped over
+// that have been committed since, and forgets the IDs waited for longer than
+// gapWait.
+func (i *CacheInvalidator) lateChanges(ctx context.Context) ([]ChangeEvent, error) {
+	var first, last int64
+	for id, since := range i.gaps {
+		if time.Since(since) > i.gapWait {
+			delete(i.gaps, id)
+			continue
+		}
+		if first == 0 || id < first {
+			first = id
+		}
+		if id > last {
+			last = id
+		}
+	}
+	if first == 0 {
+		return nil, nil
+	}
+	events, err := i.source.Changes(ctx, first-1, int(last-first+1))
+	if err != nil {
+		return nil, err
+	}
+	var late []ChangeEvent
+	for _, e := range events {
+		if _, ok := i.gaps[e.ID]; ok {
+			late = append(late, e)
+		}
+	}
+	return late, nil
+}
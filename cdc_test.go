@@ -0,0 +1,182 @@
+package catalogue
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// fakeChangeSource serves changes from a slice.
+type fakeChangeSource struct {
+	events []ChangeEvent
+}
+
+func (s *fakeChangeSource) Changes(ctx context.Context, after int64, limit int) ([]ChangeEvent, error) {
+	var events []ChangeEvent
+	for _, e := range s.events {
+		if e.ID > after && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (s *fakeChangeSource) Position(ctx context.Context, lookback time.Duration) (int64, error) {
+	return 0, nil
+}
+
+func TestInvalidations(t *testing.T) {
+	for _, testcase := range []struct {
+		name   string
+		events []ChangeEvent
+		want   Invalidation
+	}{
+		{
+			name:   "price change",
+			events: []ChangeEvent{{Table: "sock", Operation: "update", SockID: "1", Tags: []string{"odd", "prime"}}},
+			want:   Invalidation{Products: []string{"1"}, Tags: []string{"odd", "prime"}, Listings: true},
+		},
+		{
+			name:   "tag linked",
+			events: []ChangeEvent{{Table: "sock_tag", Operation: "insert", SockID: "4", Tags: []string{"prime"}}},
+			want:   Invalidation{Products: []string{"4"}, Tags: []string{"prime"}, Listings: true, Counts: true},
+		},
+		{
+			name:   "image added",
+			events: []ChangeEvent{{Table: "sock_image", Operation: "insert", SockID: "3", Tags: []string{"odd", "prime"}}},
+			want:   Invalidation{Products: []string{"3"}, Tags: []string{"odd", "prime"}, Listings: true},
+		},
+		{
+			name:   "variant resized",
+			events: []ChangeEvent{{Table: "sock_variant", Operation: "update", SockID: "3", Tags: []string{"odd", "prime"}}},
+			want:   Invalidation{Products: []string{"3"}, Tags: []string{"odd", "prime"}, Listings: true, Counts: true},
+		},
+		{
+			name:   "tag created",
+			events: []ChangeEvent{{Table: "tag", Operation: "insert", Tags: []string{"square"}}},
+			want:   Invalidation{Tags: []string{"square"}, TagList: true},
+		},
+		{
+			name: "sock deleted with its tags",
+			events: []ChangeEvent{
+				{Table: "sock_tag", Operation: "delete", SockID: "2", Tags: []string{"even"}},
+				{Table: "sock_tag", Operation: "delete", SockID: "2", Tags: []string{"prime"}},
+				{Table: "sock", Operation: "delete", SockID: "2"},
+			},
+			want: Invalidation{Products: []string{"2"}, Tags: []string{"even", "prime"}, Listings: true, Counts: true},
+		},
+	} {
+		if have := Invalidations(testcase.events); !reflect.DeepEqual(have, testcase.want) {
+			t.Errorf("%s: want %+v, have %+v", testcase.name, testcase.want, have)
+		}
+	}
+}
+
+func TestInvalidationMatches(t *testing.T) {
+	inv := Invalidation{Tags: []string{"brown"}, Listings: true}
+	for filter, want := range map[string]bool{"": true, "brown": true, "blue,brown": true, "blue": false} {
+		key := WarmRequest{Operation: "List", Tags: splitTags(filter), Order: "id", PageNum: 1, PageSize: 6}.Key()
+		tags, _ := keyTags(key)
+		if have := inv.matches(tags); have != want {
+			t.Errorf("matches(%s): want %v, have %v", key, want, have)
+		}
+	}
+}
+
+func splitTags(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+func TestCacheInvalidatorPoll(t *testing.T) {
+	source := &fakeChangeSource{events: []ChangeEvent{
+		{ID: 1, Table: "sock", Operation: "update", SockID: s1.ID, Tags: s1.Tags},
+		{ID: 2, Table: "sock", Operation: "update", SockID: s2.ID, Tags: s2.Tags},
+	}}
+	cache := newFakeCache()
+	cache.products[s1.ID] = s1
+	i := NewCacheInvalidator(source, cache, log.NewNopLogger())
+
+	cache.err = errors.New("connection refused")
+	if _, err := i.Poll(context.Background()); err == nil {
+		t.Fatalf("Poll with a failing cache: want error, have nil")
+	}
+	cache.err = nil
+	if n, err := i.Poll(context.Background()); err != nil || n != 2 {
+		t.Fatalf("Poll after the cache recovered: want the 2 changes retried, have %d, %v", n, err)
+	}
+	if _, ok := cache.products[s1.ID]; ok {
+		t.Errorf("Poll: want %s invalidated", s1.ID)
+	}
+	if want := []string{s1.ID, s2.ID}; len(cache.invalidations) != 1 || !reflect.DeepEqual(cache.invalidations[0].Products, want) {
+		t.Errorf("Poll: want one invalidation of %v, have %+v", want, cache.invalidations)
+	}
+	if n, _ := i.Poll(context.Background()); n != 0 {
+		t.Errorf("Poll with nothing new: want 0 changes, have %d", n)
+	}
+}
+
+func TestCacheInvalidatorLateChanges(t *testing.T) {
+	source := &fakeChangeSource{events: []ChangeEvent{
+		{ID: 1, Table: "sock", Operation: "update", SockID: s1.ID},
+		{ID: 4, Table: "sock", Operation: "update", SockID: s2.ID},
+	}}
+	cache := newFakeCache()
+	i := NewCacheInvalidator(source, cache, log.NewNopLogger())
+	ctx := context.Background()
+
+	if n, err := i.Poll(ctx); err != nil || n != 2 {
+		t.Fatalf("Poll: want 2 changes, have %d, %v", n, err)
+	}
+	// Changes 2 and 3 were still being written; 3 commits after 4 was read
+	source.events = append(source.events, ChangeEvent{ID: 3, Table: "sock", Operation: "update", SockID: s3.ID})
+	if n, err := i.Poll(ctx); err != nil || n != 0 {
+		t.Fatalf("Poll after a late commit: want no new changes, have %d, %v", n, err)
+	}
+	if len(cache.invalidations) != 2 || !reflect.DeepEqual(cache.invalidations[1].Products, []string{s3.ID}) {
+		t.Errorf("Poll after a late commit: want %s invalidated, have %+v", s3.ID, cache.invalidations)
+	}
+	// Change 2 never turns up: it was rolled back
+	i.gapWait = 0
+	if _, err := i.Poll(ctx); err != nil || len(i.gaps) != 0 || len(cache.invalidations) != 2 {
+		t.Errorf("Poll past the gap wait: want the gaps given up and nothing invalidated, have %v and %d invalidations (%v)", i.gaps, len(cache.invalidations), err)
+	}
+}
+
+func TestSQLChangeSource(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening stub database connection", err)
+	}
+	defer db.Close()
+	source := NewSQLChangeSource(sqlx.NewDb(db, "sqlmock"))
+
+	cols := []string{"change_id", "table_name", "operation", "sock_id", "tags"}
+	mock.ExpectQuery("SELECT change_id").WithArgs(7, 100).WillReturnRows(sqlmock.NewRows(cols).
+		AddRow(8, "sock", "update", s1.ID, "odd,prime").
+		AddRow(9, "tag", "insert", nil, "square"))
+
+	have, err := source.Changes(context.Background(), 7, 100)
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	want := []ChangeEvent{
+		{ID: 8, Table: "sock", Operation: "update", SockID: s1.ID, Tags: []string{"odd", "prime"}},
+		{ID: 9, Table: "tag", Operation: "insert", Tags: []string{"square"}},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("Changes: want %+v, have %+v", want, have)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,12 +18,15 @@ import (
 
 	"path/filepath"
 
+	"github.com/go-redis/redis/v8"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/microservices-demo/catalogue"
+	"github.com/microservices-demo/catalogue/pb"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/weaveworks/common/middleware"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -43,10 +48,60 @@ func init() {
 func main() {
 	var (
 		port      = flag.String("port", "80", "Port to bind HTTP listener") // TODO(pb): should be -addr, default ":80"
+		grpcPort  = flag.String("grpc-port", "", "Port to bind the gRPC listener (empty disables)")
 		images    = flag.String("images", "./images/", "Image path")
 		dsn       = flag.String("DSN", "catalogue_user:default_password@tcp(catalogue-db:3306)/socksdb", "Data Source Name: [username[:password]@][protocol[(address)]]/dbname")
 		zip       = flag.String("zipkin", os.Getenv("ZIPKIN"), "Zipkin address")
 		redisAddr = flag.String("redis", "redis:6379", "Redis address for caching")
+
+		redisBreakerFailures = flag.Uint("redis-breaker-failures", uint(catalogue.DefaultCacheBreakerSettings.ConsecutiveFailures), "Consecutive Redis errors before the cache circuit breaker opens")
+		redisBreakerTimeout  = flag.Duration("redis-breaker-timeout", catalogue.DefaultCacheBreakerSettings.Timeout, "How long the cache circuit breaker stays open before probing Redis again")
+		dbBreakerFailures    = flag.Uint("db-breaker-failures", uint(catalogue.DefaultDBBreakerSettings.ConsecutiveFailures), "Consecutive database errors before the database circuit breaker opens")
+		dbBreakerTimeout     = flag.Duration("db-breaker-timeout", catalogue.DefaultDBBreakerSettings.Timeout, "How long the database circuit breaker stays open before probing MySQL again")
+		breakerConfig        = flag.String("breakers", "", "JSON file with per-route HTTP and gRPC circuit breaker settings")
+		latencyWindows       = flag.String("latency-windows", "1m,5m,1h", "Comma separated sliding windows to report cache latency percentiles over")
+		staleTTL             = flag.Duration("stale-ttl", 0, "Keep last-known-good copies of cached responses for this long and serve them when the database fails (0 disables)")
+		warmInterval         = flag.Duration("warm-interval", 0, "Re-warm the cache this often (0 warms only at startup)")
+		hotKeys              = flag.Int("warm-hot-keys", 50, "Number of most requested keys to warm, in place of the built-in popular listings once traffic has been seen (0 disables)")
+		warmLog              = flag.String("warm-log", "", "JSONL request log (see cmd/requestlog) whose most frequent requests are warmed")
+		warmLogLimit         = flag.Int("warm-log-limit", 100, "Number of distinct requests to warm from -warm-log (0 warms all)")
+		warmConcurrency      = flag.Int("warm-concurrency", 4, "Requests warmed at once from -warm-log and the hot keys")
+		warmTimeout          = flag.Duration("warm-timeout", 2*time.Minute, "Give up on a warming run after this long (0 never gives up)")
+		warmFull             = flag.String("warm-full", "", "Comma separated page sizes to warm every page of every tag filter for, along with every sock (empty warms popular listings only)")
+		warmRate             = flag.Float64("warm-rate", 0, "Maximum database queries per second while warming (0 is unlimited)")
+		warmBatch            = flag.Int("warm-batch", catalogue.DefaultWarmBatchSize, "Cache entries written per Redis round trip while warming")
+		warmBeforeReady      = flag.Bool("warm-before-ready", false, "Report not ready on /ready until the initial cache warm has completed")
+		cdcInterval          = flag.Duration("cdc-interval", 0, "Poll the sock_change table this often and invalidate the cache entries of changed socks and tags (0 disables)")
+		adminToken           = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token required by the /admin/cache API and the write routes (empty disables both)")
+		outboxInterval       = flag.Duration("outbox-interval", catalogue.DefaultRelayInterval, "Publish the events of the outbox table this often (0 disables)")
+		outboxRetention      = flag.Duration("outbox-retention", catalogue.DefaultOutboxRetention, "Delete published events from the outbox table after this long (0 keeps them)")
+		eventStream          = flag.String("event-stream", catalogue.DefaultEventStream, "Redis Stream the catalogue events are published to")
+		eventStreamMaxLen    = flag.Int64("event-stream-maxlen", 100000, "Trim the event stream to about this many events (0 never trims)")
+		reservationTTL       = flag.Duration("reservation-ttl", catalogue.DefaultReservationTTL, "How long stock reservations last unless committed")
+		reapInterval         = flag.Duration("reap-interval", catalogue.DefaultReapInterval, "Return the stock of expired reservations this often (0 disables)")
+		eventFeed            = flag.Bool("event-feed", true, "Stream the events of -event-stream to clients of /catalogue/events")
+		currency             = flag.String("currency", catalogue.DefaultCurrency, "ISO 4217 code of the currency the prices in the database are in")
+		ratesFile            = flag.String("rates-file", "", "JSON file with the exchange rates for ?currency= (see README_REDIS.md)")
+		ratesDB              = flag.Bool("rates-db", false, "Read the exchange rates for ?currency= from the exchange_rate table")
+		ratesInterval        = flag.Duration("rates-interval", 10*time.Minute, "Reload the exchange rates of -rates-db this often (0 loads them once)")
+		imageCache           = flag.String("image-cache", "disk", "Where to keep resized images: disk, redis or none")
+		imageCacheDir        = flag.String("image-cache-dir", filepath.Join(os.TempDir(), "catalogue-images"), "Directory of the disk image cache")
+		imageCacheSize       = flag.Int64("image-cache-size", 256<<20, "Most bytes of resized images kept by the disk image cache")
+		blobStore            = flag.String("blob-store", "file", "Where uploaded images are stored: file (in -upload-dir) or s3")
+		uploadDir            = flag.String("upload-dir", "", "Directory uploaded images are stored in with -blob-store=file (default: -images)")
+		s3Endpoint           = flag.String("s3-endpoint", "", "host:port of the S3 compatible store of -blob-store=s3")
+		s3Bucket             = flag.String("s3-bucket", "catalogue-images", "Bucket of -blob-store=s3")
+		s3Region             = flag.String("s3-region", "", "Region of the bucket of -blob-store=s3")
+		s3AccessKey          = flag.String("s3-access-key", os.Getenv("S3_ACCESS_KEY"), "Access key of -blob-store=s3")
+		s3SecretKey          = flag.String("s3-secret-key", os.Getenv("S3_SECRET_KEY"), "Secret key of -blob-store=s3")
+		s3Secure             = flag.Bool("s3-secure", true, "Use HTTPS with -blob-store=s3")
+		s3PathStyle          = flag.Bool("s3-path-style", false, "Address the bucket in the path, as MinIO expects, with -blob-store=s3")
+		imageMaxAge          = flag.Duration("image-max-age", catalogue.DefaultImageMaxAge, "How long clients may use an image before revalidating it")
+		compress             = flag.String("compress", strings.Join(catalogue.DefaultEncodings, ","), "Comma separated encodings to compress responses with, preferred first (zstd, br, gzip; empty disables)")
+		compressMinSize      = flag.Int("compress-min-size", catalogue.DefaultCompressMinSize, "Smallest response to compress, in bytes")
+		graphQL              = flag.Bool("graphql", true, "Answer GraphQL queries of the catalogue on /graphql")
+		graphQLMaxDepth      = flag.Int("graphql-max-depth", catalogue.DefaultGraphQLMaxDepth, "Deepest nesting of fields a GraphQL query may have")
+		graphQLMaxComplexity = flag.Int("graphql-max-complexity", catalogue.DefaultGraphQLMaxComplexity, "Most fields a GraphQL query may resolve, those of lists counted for every element")
 	)
 	flag.Parse()
 
@@ -108,23 +163,135 @@ func main() {
 	// Service domain.
 	var service catalogue.Service
 	var cacheMetrics *catalogue.CacheMetrics
+	admin := catalogue.AdminConfig{Token: *adminToken}
+	var warmer *catalogue.CacheWarmer
+	var writer catalogue.Writer
+	var inventory catalogue.Inventory
+	var feed *catalogue.EventFeed
+	var cache catalogue.CatalogueCache
 	{
-		// Create base catalogue service
+		// Create base catalogue service, failing fast while MySQL is down
 		baseService := catalogue.NewCatalogueService(db, logger)
+		baseService = catalogue.CircuitBreakerMiddleware(catalogue.BreakerSettings{
+			ConsecutiveFailures: uint32(*dbBreakerFailures),
+			Timeout:             *dbBreakerTimeout,
+			MaxRequests:         catalogue.DefaultDBBreakerSettings.MaxRequests,
+		}, logger)(baseService)
 		
-		// Create Redis cache
-		cache := catalogue.NewCatalogueCache(*redisAddr, logger)
+		// Create Redis cache, guarded by a circuit breaker so that an
+		// unavailable Redis costs nothing once the breaker has opened
+		cache = catalogue.NewCatalogueCache(*redisAddr, logger, catalogue.WithStaleTTL(*staleTTL))
+		if pool, ok := cache.(interface{ PoolStats() *redis.PoolStats }); ok {
+			prometheus.MustRegister(catalogue.NewRedisPoolCollector(pool.PoolStats))
+		}
+		if inspector, ok := cache.(catalogue.CacheInspector); ok {
+			admin.Inspector = inspector
+		}
+		cache = catalogue.NewCircuitBreakerCache(cache, catalogue.BreakerSettings{
+			ConsecutiveFailures: uint32(*redisBreakerFailures),
+			Timeout:             *redisBreakerTimeout,
+			MaxRequests:         catalogue.DefaultCacheBreakerSettings.MaxRequests,
+		}, logger)
 		
 		// Wrap with caching
-		cachedSvc := catalogue.NewCachedService(baseService, cache, logger)
+		var windows []time.Duration
+		for _, w := range strings.Split(*latencyWindows, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(w))
+			if err != nil {
+				logger.Log("err", fmt.Sprintf("latency-windows: %v", err))
+				os.Exit(1)
+			}
+			windows = append(windows, d)
+		}
+		tracker := catalogue.NewAccessTracker()
+		admin.HotKeys = tracker
+		cacheOpts := []catalogue.CachedServiceOption{
+			catalogue.WithMetrics(catalogue.NewCacheMetrics(logger, catalogue.WithLatencyWindows(windows...))),
+			catalogue.WithAccessTracker(tracker),
+		}
+		if *staleTTL > 0 {
+			cacheOpts = append(cacheOpts, catalogue.WithServeStale())
+		}
+		cachedSvc := catalogue.NewCachedService(baseService, cache, logger, cacheOpts...)
 		cacheMetrics = cachedSvc.GetMetrics()
+		prometheus.MustRegister(cacheMetrics)
+		admin.Cache = cache
+		admin.Metrics = cacheMetrics
 		
 		service = cachedSvc
 		service = catalogue.LoggingMiddleware(logger)(service)
 		
 		// Initialize cache warming
-		warmer := catalogue.NewCacheWarmer(baseService, cache, logger)
+		warmOpts := []catalogue.CacheWarmerOption{
+			catalogue.WithWarmConcurrency(*warmConcurrency),
+			catalogue.WithWarmTimeout(*warmTimeout),
+			catalogue.WithWarmRateLimit(*warmRate),
+			catalogue.WithWarmBatchSize(*warmBatch),
+		}
+		if *warmFull != "" {
+			var sizes []int
+			for _, v := range strings.Split(*warmFull, ",") {
+				n, err := strconv.Atoi(strings.TrimSpace(v))
+				if err != nil || n < 1 {
+					logger.Log("err", fmt.Sprintf("warm-full: invalid page size %q", v))
+					os.Exit(1)
+				}
+				sizes = append(sizes, n)
+			}
+			warmOpts = append(warmOpts, catalogue.WithFullCatalogue(sizes...))
+		}
+		if *warmLog != "" {
+			warmOpts = append(warmOpts, catalogue.WithWarmSource(catalogue.RequestLogSource(*warmLog, *warmLogLimit)))
+		}
+		if *hotKeys > 0 {
+			warmOpts = append(warmOpts, catalogue.WithWarmSource(catalogue.HotKeySource(tracker, *hotKeys)))
+		}
+		warmer = catalogue.NewCacheWarmer(baseService, cache, logger, warmOpts...)
+		admin.Warmer = warmer
 		warmer.WarmCacheAsync() // Start cache warming in background
+		if *warmInterval > 0 {
+			warmer.SchedulePeriodicWarming(*warmInterval)
+		}
+		
+		// Invalidate entries made stale by writes to the database
+		if *cdcInterval > 0 {
+			invalidator := catalogue.NewCacheInvalidator(catalogue.NewSQLChangeSource(db), cache, logger,
+				catalogue.WithPollInterval(*cdcInterval))
+			go invalidator.Run(ctx)
+		}
+		
+		// Record writes with their events, and invalidate what they change
+		// as soon as they commit
+		writeOpts := []catalogue.WriterOption{
+			catalogue.WithReservationTTL(*reservationTTL),
+			catalogue.WithCommitHook(func(events []catalogue.Event) {
+				if err := cache.Invalidate(context.Background(), catalogue.EventInvalidations(events)); err != nil {
+					logger.Log("cache", "error", "operation", "Invalidate", "error", err)
+				}
+			}),
+		}
+		if admin.Token != "" {
+			writer = catalogue.NewCatalogueWriter(db, logger, writeOpts...)
+		}
+		inventory = catalogue.NewCatalogueInventory(db, logger, writeOpts...)
+		if *reapInterval > 0 {
+			go catalogue.NewReservationReaper(inventory, logger, *reapInterval).Run(ctx)
+		}
+		
+		// Publish the events recorded by writes to the event stream, and
+		// stream them to the clients of this replica
+		events := redis.NewClient(&redis.Options{Addr: *redisAddr})
+		if *outboxInterval > 0 {
+			sink := catalogue.NewRedisStreamSink(events, *eventStream, *eventStreamMaxLen)
+			relay := catalogue.NewOutboxRelay(db, sink, logger,
+				catalogue.WithRelayInterval(*outboxInterval),
+				catalogue.WithOutboxRetention(*outboxRetention))
+			go relay.Run(ctx)
+		}
+		if *eventFeed {
+			feed = catalogue.NewEventFeed(catalogue.NewRedisStreamReader(events, *eventStream), logger)
+			go feed.Run(ctx)
+		}
 		
 		// Start periodic metrics logging (every 5 minutes)
 		cacheMetrics.StartPeriodicLogging(5 * time.Minute)
@@ -132,11 +299,129 @@ func main() {
 		logger.Log("redis_addr", *redisAddr, "cache_enabled", "true", "cache_warming", "enabled", "metrics", "enabled")
 	}
 
+	// Exchange rates, from the file, the database, or none at all so that
+	// only -currency is accepted
+	var rates *catalogue.RateTable
+	switch {
+	case *ratesFile != "":
+		rates, err = catalogue.LoadRatesFile(*ratesFile)
+		if err == nil && rates.Base() != *currency {
+			err = fmt.Errorf("rates-file: rates are for %s, prices are in %s", rates.Base(), *currency)
+		}
+	case *ratesDB:
+		rates, err = catalogue.LoadRatesDB(db, *currency)
+		if err == nil && *ratesInterval > 0 {
+			go func() {
+				for range time.Tick(*ratesInterval) {
+					if err := rates.LoadDB(db); err != nil {
+						logger.Log("rates", "error", "error", err)
+					}
+				}
+			}()
+		}
+	default:
+		rates, err = catalogue.NewRateTable(*currency, nil)
+	}
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+
 	// Endpoint domain.
 	endpoints := catalogue.MakeEndpoints(service)
+	endpoints = catalogue.ConvertEndpoints(endpoints, rates, cache, logger)
+
+	// Uploaded images, served along with those of -images
+	var store catalogue.BlobStore
+	switch *blobStore {
+	case "file":
+		if *uploadDir == "" {
+			*uploadDir = *images
+		}
+		store = catalogue.NewFileBlobStore(*uploadDir)
+	case "s3":
+		store, err = catalogue.NewS3BlobStore(catalogue.S3Config{
+			Endpoint:  *s3Endpoint,
+			Bucket:    *s3Bucket,
+			Region:    *s3Region,
+			AccessKey: *s3AccessKey,
+			SecretKey: *s3SecretKey,
+			Secure:    *s3Secure,
+			PathStyle: *s3PathStyle,
+		})
+		if err != nil {
+			logger.Log("err", fmt.Sprintf("s3-endpoint: %v", err))
+			os.Exit(1)
+		}
+	default:
+		logger.Log("err", fmt.Sprintf("blob-store: unknown store %q", *blobStore))
+		os.Exit(1)
+	}
 
 	// HTTP router
-	router := catalogue.MakeHTTPHandler(ctx, endpoints, *images, logger)
+	var handlerOpts []catalogue.HandlerOption
+	var grpcOpts []catalogue.GRPCOption
+	if *breakerConfig != "" {
+		settings, err := catalogue.LoadBreakerSettings(*breakerConfig)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		handlerOpts = append(handlerOpts, catalogue.WithBreakerSettings(settings))
+		grpcOpts = append(grpcOpts, catalogue.WithGRPCBreakerSettings(settings))
+	}
+	if *warmBeforeReady {
+		handlerOpts = append(handlerOpts, catalogue.WithReadiness(warmer.Ready))
+	}
+	if feed != nil {
+		handlerOpts = append(handlerOpts, catalogue.WithEventFeed(feed))
+	}
+	if admin.Token != "" {
+		handlerOpts = append(handlerOpts, catalogue.WithAdmin(admin))
+		writeEndpoints := catalogue.MakeWriteEndpoints(writer)
+		writeEndpoints.UploadImageEndpoint = catalogue.MakeUploadImageEndpoint(catalogue.NewImageUploader(store, writer, logger))
+		handlerOpts = append(handlerOpts, catalogue.WithWriter(writeEndpoints, admin.Token))
+		handlerOpts = append(handlerOpts, catalogue.WithInventory(catalogue.MakeInventoryEndpoints(inventory), admin.Token))
+	}
+	imageOpts := []catalogue.ImageOption{catalogue.WithImageMaxAge(*imageMaxAge), catalogue.WithImageStore(store)}
+	switch *imageCache {
+	case "disk":
+		renditions, err := catalogue.NewDiskRenditionCache(*imageCacheDir, *imageCacheSize)
+		if err != nil {
+			logger.Log("err", fmt.Sprintf("image-cache-dir: %v", err))
+			os.Exit(1)
+		}
+		imageOpts = append(imageOpts, catalogue.WithRenditionCache(renditions))
+	case "redis":
+		client := redis.NewClient(&redis.Options{Addr: *redisAddr})
+		imageOpts = append(imageOpts, catalogue.WithRenditionCache(catalogue.NewRedisRenditionCache(client, catalogue.DefaultRenditionTTL, catalogue.DefaultMaxRenditionBytes)))
+	case "none":
+	default:
+		logger.Log("err", fmt.Sprintf("image-cache: unknown cache %q", *imageCache))
+		os.Exit(1)
+	}
+	handlerOpts = append(handlerOpts, catalogue.WithImageOptions(imageOpts...))
+	var encodings []string
+	for _, e := range strings.Split(*compress, ",") {
+		switch e = strings.TrimSpace(e); e {
+		case "":
+		case catalogue.EncodingZstd, catalogue.EncodingBrotli, catalogue.EncodingGzip:
+			encodings = append(encodings, e)
+		default:
+			logger.Log("err", fmt.Sprintf("compress: unknown encoding %q", e))
+			os.Exit(1)
+		}
+	}
+	handlerOpts = append(handlerOpts, catalogue.WithCompression(encodings, *compressMinSize))
+	if store, ok := cache.(catalogue.CompressedStore); ok {
+		handlerOpts = append(handlerOpts, catalogue.WithCompressedStore(store))
+	}
+	if *graphQL {
+		handlerOpts = append(handlerOpts, catalogue.WithGraphQL(catalogue.MakeGraphQLEndpoint(service,
+			catalogue.WithGraphQLMaxDepth(*graphQLMaxDepth),
+			catalogue.WithGraphQLMaxComplexity(*graphQLMaxComplexity))))
+	}
+	router := catalogue.MakeHTTPHandler(ctx, endpoints, *images, logger, handlerOpts...)
 
 	httpMiddleware := []middleware.Interface{
 		middleware.Instrument{
@@ -145,8 +430,12 @@ func main() {
 		},
 	}
 
-	// Handler
-	handler := middleware.Merge(httpMiddleware...).Wrap(router)
+	// Handler. The event feed bypasses the instrumentation, whose response
+	// writer cannot flush, and would only record how long clients listened.
+	handler := http.NewServeMux()
+	handler.Handle("/", middleware.Merge(httpMiddleware...).Wrap(router))
+	handler.Handle("/catalogue/events", router)
+	handler.Handle("/catalogue/events/ws", router)
 
 	// Create and launch the HTTP server.
 	go func() {
@@ -154,12 +443,31 @@ func main() {
 		errc <- http.ListenAndServe(":"+*port, handler)
 	}()
 
+	// Create and launch the gRPC server, on a port of its own.
+	if *grpcPort != "" {
+		ln, err := net.Listen("tcp", ":"+*grpcPort)
+		if err != nil {
+			logger.Log("err", fmt.Sprintf("grpc-port: %v", err))
+			os.Exit(1)
+		}
+		// Instrumented into the histogram of the HTTP requests, with gRPC as
+		// their method
+		grpcServer := grpc.NewServer(grpc.UnaryInterceptor(middleware.UnaryServerInstrumentInterceptor(HTTPLatency)))
+		pb.RegisterCatalogueServer(grpcServer, catalogue.MakeGRPCServer(endpoints, logger, grpcOpts...))
+		go func() {
+			logger.Log("transport", "gRPC", "port", *grpcPort)
+			errc <- grpcServer.Serve(ln)
+		}()
+		defer grpcServer.GracefulStop()
+	}
+
 	// Capture interrupts.
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errc <- fmt.Errorf("%s", <-c)
 	}()
 
 	logger.Log("exit", <-errc)
+	warmer.Stop()
 }
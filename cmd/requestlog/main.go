@@ -0,0 +1,103 @@
+// Command requestlog turns HTTP access logs in Common or Combined Log Format,
+// as written by nginx, Apache and most ingress controllers, into the JSONL
+// request log that cataloguesvc -warm-log replays to warm its cache.
+//
+//	requestlog access.log access.log.1 > requests.log.jsonl
+//	kubectl logs deploy/ingress | requestlog -o requests.log.jsonl
+//
+// Only successful GET requests for catalogue resources are kept.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/microservices-demo/catalogue"
+)
+
+// requestLine matches `"GET /catalogue?tags=brown HTTP/1.1" 200` in a log line
+var requestLine = regexp.MustCompile(`"([A-Z]+) ([^ "]+) HTTP/[0-9.]+" ([0-9]{3})`)
+
+func main() {
+	out := flag.String("o", "", "Write the request log to this file instead of stdout")
+	flag.Parse()
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	var total, kept int
+	run := func(r io.Reader) error {
+		t, k, err := convert(r, bw)
+		total += t
+		kept += k
+		return err
+	}
+	if flag.NArg() == 0 {
+		if err := run(os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		err = run(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "kept %d of %d requests\n", kept, total)
+}
+
+// convert writes a RequestLogEntry for every cacheable request in the access
+// log r and reports how many requests it read and kept.
+func convert(r io.Reader, w io.Writer) (total, kept int, err error) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		m := requestLine.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		total++
+		if status, _ := strconv.Atoi(m[3]); status != 304 && (status < 200 || status > 299) {
+			continue
+		}
+		e := catalogue.RequestLogEntry{Method: m[1], Path: m[2]}
+		if i := strings.IndexByte(e.Path, '?'); i >= 0 {
+			e.Path, e.Query = e.Path[:i], e.Path[i+1:]
+		}
+		if _, ok := e.WarmRequest(); !ok {
+			continue
+		}
+		if err := enc.Encode(e); err != nil {
+			return total, kept, err
+		}
+		kept++
+	}
+	return total, kept, scanner.Err()
+}
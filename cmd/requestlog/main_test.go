@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	const combined = `10.0.0.1 - - [18/Oct/2026:13:20:03 +0000] `
+	for name, c := range map[string]struct {
+		line  string
+		want  string // the entry written, if any
+		total int
+	}{
+		"common": {
+			line:  combined + `"GET /catalogue?tags=brown&page=2 HTTP/1.1" 200 1024`,
+			want:  `{"method":"GET","path":"/catalogue","query":"tags=brown&page=2"}`,
+			total: 1,
+		},
+		"combined": {
+			line:  combined + `"GET /catalogue/3395a43e HTTP/2.0" 200 512 "https://shop/" "Mozilla/5.0 (X11)"`,
+			want:  `{"method":"GET","path":"/catalogue/3395a43e"}`,
+			total: 1,
+		},
+		"not modified": {
+			line:  combined + `"GET /tags HTTP/1.1" 304 0`,
+			want:  `{"method":"GET","path":"/tags"}`,
+			total: 1,
+		},
+		"count": {
+			line:  combined + `"GET /catalogue/size?tags=blue HTTP/1.0" 200 12`,
+			want:  `{"method":"GET","path":"/catalogue/size","query":"tags=blue"}`,
+			total: 1,
+		},
+		"failed":         {line: combined + `"GET /catalogue HTTP/1.1" 503 80`, total: 1},
+		"not found":      {line: combined + `"GET /catalogue/missing HTTP/1.1" 404 80`, total: 1},
+		"redirect":       {line: combined + `"GET /catalogue HTTP/1.1" 301 0`, total: 1},
+		"write":          {line: combined + `"POST /catalogue HTTP/1.1" 201 80`, total: 1},
+		"image":          {line: combined + `"GET /catalogue/images/holy_1.jpeg HTTP/1.1" 200 9000`, total: 1},
+		"not catalogue":  {line: combined + `"GET /orders HTTP/1.1" 200 80`, total: 1},
+		"rejected":       {line: combined + `"GET /catalogue?page=zero HTTP/1.1" 200 80`, total: 1},
+		"no protocol":    {line: combined + `"GET /catalogue" 200 80`},
+		"no status":      {line: combined + `"GET /catalogue HTTP/1.1" - 80`},
+		"lowercase verb": {line: combined + `"get /catalogue HTTP/1.1" 200 80`},
+		"garbage":        {line: `\x00\x01 not a log line`},
+		"empty":          {line: ``},
+	} {
+		var out bytes.Buffer
+		total, kept, err := convert(strings.NewReader(c.line+"\n"), &out)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		wantKept := 0
+		if c.want != "" {
+			wantKept = 1
+		}
+		if have := strings.TrimSpace(out.String()); have != c.want || total != c.total || kept != wantKept {
+			t.Errorf("%s: want %q, %d read and %d kept, have %q, %d and %d", name, c.want, c.total, wantKept, have, total, kept)
+		}
+	}
+}
+
+func TestConvertMany(t *testing.T) {
+	log := strings.Join([]string{
+		`10.0.0.1 - - [18/Oct/2026:13:20:03 +0000] "GET /tags HTTP/1.1" 200 40`,
+		`a line of something else entirely`,
+		`10.0.0.2 - - [18/Oct/2026:13:20:04 +0000] "GET /catalogue HTTP/1.1" 500 40`,
+		`10.0.0.3 - - [18/Oct/2026:13:20:05 +0000] "GET /catalogue/size HTTP/1.1" 200 12`,
+	}, "\n")
+	var out bytes.Buffer
+	total, kept, err := convert(strings.NewReader(log), &out)
+	if err != nil || total != 3 || kept != 2 {
+		t.Fatalf("want 3 read and 2 kept, have %d, %d, %v", total, kept, err)
+	}
+	want := `{"method":"GET","path":"/tags"}` + "\n" + `{"method":"GET","path":"/catalogue/size"}` + "\n"
+	if have := out.String(); have != want {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	// Lines longer than the scanner takes are an error
+	long := `"GET /catalogue?tags=` + strings.Repeat("a", 2<<20) + ` HTTP/1.1" 200 0`
+	if _, _, err := convert(strings.NewReader(long), &out); err == nil {
+		t.Errorf("2MiB line: want an error")
+	}
+}
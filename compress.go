@@ -0,0 +1,444 @@
+package catalogue
+
+// compress.go contains the compression of HTTP responses: the encoding is
+// negotiated from Accept-Encoding, and JSON and text responses of at least a
+// minimum size are compressed with it as they are written. Whole bodies
+// written with writeBody are compressed once and the compressed bytes kept,
+// in memory and in a CompressedStore if there is one, so that the same
+// response is not compressed again.
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/context"
+)
+
+// Content codings of compressed responses.
+const (
+	EncodingZstd   = "zstd"
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+)
+
+// Defaults of the compression of responses.
+var (
+	// DefaultEncodings are the encodings offered, the preferred one first.
+	DefaultEncodings = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+	// DefaultCompressMinSize is the size under which responses are sent as
+	// they are: a few hundred bytes take longer to compress than to send.
+	DefaultCompressMinSize = 1024
+	// DefaultCompressedBodies is how many bytes of compressed bodies are
+	// kept for writeBody.
+	DefaultCompressedBodies = 16 << 20
+)
+
+// CompressedStore keeps compressed bodies by the ETag of the uncompressed
+// body and their encoding, where every replica of the service finds them and
+// a restart does not lose them, see WithCompressedStore. The Redis cache of
+// NewCatalogueCache is one.
+type CompressedStore interface {
+	GetCompressed(ctx context.Context, etag, encoding string) ([]byte, bool, error)
+	SetCompressed(ctx context.Context, etag, encoding string, data []byte) error
+}
+
+// encoder is a compressing writer that can be reused for another response.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// encoders are pools of encoders by content coding.
+var encoders = map[string]*sync.Pool{
+	EncodingZstd: {New: func() interface{} {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return e
+	}},
+	EncodingBrotli: {New: func() interface{} {
+		// Level 4 compresses better than gzip at about its speed; the
+		// default of 6 is too slow for responses made on request
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	EncodingGzip: {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+func getEncoder(encoding string, w io.Writer) encoder {
+	e := encoders[encoding].Get().(encoder)
+	e.Reset(w)
+	return e
+}
+
+func putEncoder(encoding string, e encoder) {
+	e.Reset(nil)
+	encoders[encoding].Put(e)
+}
+
+// compressor is the compression middleware of MakeHTTPHandler.
+type compressor struct {
+	encodings []string
+	minSize   int
+	bodies    *bodyCache
+	store     CompressedStore // nil for none
+}
+
+func newCompressor(encodings []string, minSize, maxBodies int) *compressor {
+	var supported []string
+	for _, e := range encodings {
+		if _, ok := encoders[e]; ok {
+			supported = append(supported, e)
+		}
+	}
+	return &compressor{encodings: supported, minSize: minSize, bodies: newBodyCache(maxBodies)}
+}
+
+func (c *compressor) middleware(next http.Handler) http.Handler {
+	if len(c.encodings) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// WebSockets hijack the connection
+		if r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, ctx: r.Context(), c: c, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding"), c.encodings), ifNoneMatch: r.Header.Get("If-None-Match"), status: http.StatusOK}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the encoding of offered, in order of preference,
+// that the Accept-Encoding header accepts with the highest weight, or "" for
+// none.
+func negotiateEncoding(header string, offered []string) string {
+	weights := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			weights[name] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, e := range offered {
+		q, ok := weights[e]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether responses of the given Content-Type are worth
+// compressing. Event streams are not, as they are flushed an event at a time.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "image/svg+xml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "/json") || strings.HasSuffix(mediaType, "+json")
+}
+
+// compressWriter compresses a response once it knows it is compressible and
+// at least minSize bytes long, holding back its header and first bytes until
+// then.
+type compressWriter struct {
+	http.ResponseWriter
+	ctx      context.Context // of the request
+	c        *compressor
+	encoding string // negotiated, "" for none
+	// The If-None-Match of the request, whose ETags are those of the
+	// responses the client has
+	ifNoneMatch string
+	status      int
+	buf         []byte
+	checked     bool // whether want has been worked out
+	want        bool
+	decided     bool    // the header has been written
+	enc         encoder // when compressing
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided || status < 200 {
+		return
+	}
+	w.status = status
+	// Responses without a body, and parts of one
+	switch status {
+	case http.StatusNotModified:
+		// With the validators of the response the client has. A 304 has no
+		// body to tell whether that was compressed, so its ETag is weak if
+		// the client has it weak, or, without If-None-Match to tell, if an
+		// encoding was negotiated
+		if w.encoding != "" {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if weak, ok := clientETagWeak(w.ifNoneMatch, w.Header().Get("ETag")); weak || !ok {
+				weakenETag(w.Header())
+			}
+		}
+		w.passthrough()
+	case http.StatusNoContent, http.StatusPartialContent:
+		w.passthrough()
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	if !w.wantsCompression() {
+		w.passthrough()
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.c.minSize {
+		if err := w.compress(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeWhole writes body, the whole of the response with the given ETag,
+// compressing it with the compressed bytes kept for etag, if any: in memory,
+// or else in the CompressedStore.
+func (w *compressWriter) writeWhole(etag string, body []byte) error {
+	if w.decided || len(w.buf) > 0 || !w.wantsCompression() || len(body) < w.c.minSize {
+		_, err := w.Write(body)
+		return err
+	}
+	key := etag + ";" + w.encoding
+	data, ok := w.c.bodies.get(key)
+	if !ok && w.c.store != nil {
+		if data, ok, _ = w.c.store.GetCompressed(w.ctx, etag, w.encoding); ok {
+			w.c.bodies.set(key, data)
+		}
+	}
+	if !ok {
+		var buf bytes.Buffer
+		e := getEncoder(w.encoding, &buf)
+		_, err := e.Write(body)
+		if closeErr := e.Close(); err == nil {
+			err = closeErr
+		}
+		putEncoder(w.encoding, e)
+		if err != nil {
+			return err
+		}
+		data = buf.Bytes()
+		w.c.bodies.set(key, data)
+		if w.c.store != nil {
+			// Fire-and-forget, as the cache entries are set
+			go func(encoding string) {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				w.c.store.SetCompressed(ctx, etag, encoding, data)
+			}(w.encoding)
+		}
+	}
+	w.setEncodingHeaders()
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(data)
+	return err
+}
+
+// wantsCompression reports whether the response is to be compressed if it
+// is long enough. It is worked out from the header the first time it is
+// asked, when the header must be complete.
+func (w *compressWriter) wantsCompression() bool {
+	if !w.checked {
+		w.checked = true
+		h := w.Header()
+		if h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+			h.Add("Vary", "Accept-Encoding")
+			w.want = w.encoding != ""
+		}
+	}
+	return w.want
+}
+
+func (w *compressWriter) passthrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *compressWriter) compress() error {
+	w.setEncodingHeaders()
+	w.Header().Del("Content-Length")
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+	w.enc = getEncoder(w.encoding, w.ResponseWriter)
+	_, err := w.enc.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// setEncodingHeaders marks the response as compressed.
+func (w *compressWriter) setEncodingHeaders() {
+	w.Header().Set("Content-Encoding", w.encoding)
+	weakenETag(w.Header())
+}
+
+// weakenETag makes the ETag of a compressed response, that of its
+// uncompressed body, weak: the bytes sent differ from one encoding to another.
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+// clientETagWeak reports whether the If-None-Match header has etag weak, and
+// whether it has etag at all.
+func clientETagWeak(header, etag string) (weak, ok bool) {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return strings.HasPrefix(candidate, "W/"), true
+		}
+	}
+	return false, false
+}
+
+// Flush sends what has been written so far, compressing it if it is to be
+// compressed whatever its length.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.wantsCompression() {
+			w.compress()
+		} else {
+			w.passthrough()
+			w.ResponseWriter.Write(w.buf)
+			w.buf = nil
+		}
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the ResponseWriter of the client, for http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close finishes the response: the bytes held back because there were too
+// few of them are written as they are.
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		w.passthrough()
+		_, err := w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+		return err
+	}
+	if w.enc != nil {
+		err := w.enc.Close()
+		putEncoder(w.encoding, w.enc)
+		w.enc = nil
+		return err
+	}
+	return nil
+}
+
+// bodyCache keeps compressed bodies up to a number of bytes, evicting the
+// least recently used first.
+type bodyCache struct {
+	mtx      sync.Mutex
+	maxBytes int
+	size     int
+	order    *list.List // of *cachedBody, most recently used first
+	bodies   map[string]*list.Element
+}
+
+type cachedBody struct {
+	key  string
+	data []byte
+}
+
+func newBodyCache(maxBytes int) *bodyCache {
+	return &bodyCache{maxBytes: maxBytes, order: list.New(), bodies: map[string]*list.Element{}}
+}
+
+func (c *bodyCache) get(key string) ([]byte, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.bodies[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedBody).data, true
+}
+
+func (c *bodyCache) set(key string, data []byte) {
+	if len(data) > c.maxBytes {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.bodies[key]; ok {
+		return
+	}
+	c.bodies[key] = c.order.PushFront(&cachedBody{key: key, data: data})
+	c.size += len(data)
+	for c.size > c.maxBytes {
+		e := c.order.Back()
+		body := c.order.Remove(e).(*cachedBody)
+		delete(c.bodies, body.key)
+		c.size -= len(body.data)
+	}
+}
+
+// writeBody writes body, the whole of a response with the given ETag,
+// through the compression middleware's kept bodies when there is one.
+func writeBody(w http.ResponseWriter, etag string, body []byte) error {
+	if cw, ok := w.(*compressWriter); ok {
+		return cw.writeWhole(etag, body)
+	}
+	_, err := w.Write(body)
+	return err
+}
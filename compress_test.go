@@ -0,0 +1,327 @@
+package catalogue
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/go-kit/kit/log"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// listService lists the same socks whatever it is asked.
+type listService struct {
+	Service
+	socks []Sock
+}
+
+func (s listService) List(filter Filter, order string, pageNum, pageSize int) ([]Sock, error) {
+	return s.socks, nil
+}
+
+func (s listService) Tags() ([]string, error) {
+	return []string{"brown"}, nil
+}
+
+// manySocks returns n socks.
+func manySocks(n int) []Sock {
+	socks := make([]Sock, n)
+	for i := range socks {
+		socks[i] = s1
+		socks[i].ID = fmt.Sprintf("sock-%d", i)
+		socks[i].Description = strings.Repeat("Warm and woolly. ", 4)
+	}
+	return socks
+}
+
+// decompress returns body decoded from encoding.
+func decompress(t *testing.T, encoding string, body []byte) []byte {
+	var r io.Reader
+	switch encoding {
+	case EncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case EncodingBrotli:
+		r = brotli.NewReader(bytes.NewReader(body))
+	case EncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return body
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %v", encoding, err)
+	}
+	return data
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                           "",
+		"identity":                   "",
+		"gzip":                       "gzip",
+		"gzip, deflate, br":          "br",
+		"gzip, deflate, br, zstd":    "zstd",
+		"br;q=0.5, gzip":             "gzip",
+		"zstd;q=0, gzip;q=0.1":       "gzip",
+		"*":                          "zstd",
+		"*;q=0.5, br":                "br",
+		"*, zstd;q=0":                "br",
+		"GZIP":                       "gzip",
+		"gzip;q=nonsense, br;q=0.2":  "br",
+		"compress, deflate":          "",
+		"br;q=0.8, gzip;q=0.8, zstd": "zstd",
+	} {
+		if have := negotiateEncoding(header, DefaultEncodings); have != want {
+			t.Errorf("negotiateEncoding(%q): want %q, have %q", header, want, have)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	socks := manySocks(20)
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(listService{socks: socks}), "", log.NewNopLogger())
+	want, _ := json.Marshal(socks)
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	plain := get("/catalogue")
+	etag := plain.Header().Get("ETag")
+	if ce := plain.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("without Accept-Encoding: want no Content-Encoding, have %q", ce)
+	}
+	for _, encoding := range DefaultEncodings {
+		for i := 0; i < 2; i++ { // compressed, then from the kept bodies
+			rec := get("/catalogue", "Accept-Encoding", encoding)
+			if ce := rec.Header().Get("Content-Encoding"); ce != encoding {
+				t.Errorf("%s: want Content-Encoding %s, have %q", encoding, encoding, ce)
+				continue
+			}
+			if rec.Body.Len() >= len(want) {
+				t.Errorf("%s: want fewer than %d bytes, have %d", encoding, len(want), rec.Body.Len())
+			}
+			if have := bytes.TrimSpace(decompress(t, encoding, rec.Body.Bytes())); !bytes.Equal(have, want) {
+				t.Errorf("%s: want %s, have %s", encoding, want, have)
+			}
+			if vary := rec.Header().Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("%s: want Vary Accept-Encoding, have %q", encoding, vary)
+			}
+			if have := rec.Header().Get("ETag"); have != "W/"+etag {
+				t.Errorf("%s: want the weak ETag W/%s, have %s", encoding, etag, have)
+			}
+		}
+	}
+
+	// Revalidating a compressed response
+	rec := get("/catalogue", "Accept-Encoding", "gzip", "If-None-Match", "W/"+etag)
+	if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != "W/"+etag || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("If-None-Match of a compressed response: want a 304 with its ETag, have %d %v", rec.Code, rec.Header())
+	}
+
+	// Too short to be worth it
+	rec = get("/tags", "Accept-Encoding", "gzip")
+	if ce := rec.Header().Get("Content-Encoding"); ce != "" || !strings.Contains(rec.Body.String(), "brown") {
+		t.Errorf("short response: want it uncompressed, have %q %s", ce, rec.Body)
+	}
+	if vary := rec.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("short response: want Vary Accept-Encoding, have %q", vary)
+	}
+	// and revalidated with the strong ETag it was sent with
+	short := rec.Header().Get("ETag")
+	if strings.HasPrefix(short, "W/") {
+		t.Errorf("short response: want a strong ETag, have %s", short)
+	}
+	rec = get("/tags", "Accept-Encoding", "gzip", "If-None-Match", short)
+	if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != short {
+		t.Errorf("If-None-Match of a short response: want a 304 with %s, have %d %v", short, rec.Code, rec.Header())
+	}
+
+	// Turned off
+	router = MakeHTTPHandler(context.Background(), MakeEndpoints(listService{socks: socks}), "", log.NewNopLogger(), WithCompression(nil, 0))
+	if rec := get("/catalogue", "Accept-Encoding", "gzip"); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("without compression: want no Content-Encoding, have %q", rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestCompressWriter(t *testing.T) {
+	c := newCompressor([]string{EncodingGzip}, 10, 1<<20)
+	serve := func(h http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		c.middleware(h).ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Written a little at a time, past the minimum size
+	rec := serve(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTeapot)
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "abcd")
+		}
+	})
+	if rec.Code != http.StatusTeapot || rec.Header().Get("Content-Encoding") != "gzip" || string(decompress(t, "gzip", rec.Body.Bytes())) != strings.Repeat("abcd", 5) {
+		t.Errorf("streamed: want 20 bytes compressed with status 418, have %d %v", rec.Code, rec.Header())
+	}
+
+	for name, h := range map[string]http.HandlerFunc{
+		"images": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(bytes.Repeat([]byte("x"), 100))
+		},
+		"compressed already": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(bytes.Repeat([]byte("x"), 100))
+		},
+		"event streams": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write(bytes.Repeat([]byte("x"), 100))
+			w.(http.Flusher).Flush()
+		},
+		"ranges": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(bytes.Repeat([]byte("x"), 100))
+		},
+	} {
+		rec := serve(h)
+		if rec.Body.Len() != 100 || rec.Header().Get("Content-Encoding") == "gzip" && name != "compressed already" {
+			t.Errorf("%s: want 100 bytes as written, have %d %v", name, rec.Body.Len(), rec.Header())
+		}
+	}
+}
+
+func TestBodyCache(t *testing.T) {
+	c := newBodyCache(10)
+	c.set("a", []byte("aaaa"))
+	c.set("b", []byte("bbbb"))
+	c.get("a") // b is the least recently used
+	c.set("c", []byte("cccc"))
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, found := c.get(key); found != want {
+			t.Errorf("get(%s): want found %v, have %v", key, want, found)
+		}
+	}
+	c.set("d", make([]byte, 11))
+	if _, found := c.get("d"); found {
+		t.Errorf("get of a body over the limit: want it not kept")
+	}
+}
+
+// mapStore is a CompressedStore in a map.
+type mapStore struct {
+	mu     sync.Mutex
+	bodies map[string][]byte
+	hits   int
+}
+
+func (s *mapStore) GetCompressed(ctx context.Context, etag, encoding string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.bodies[etag+";"+encoding]
+	if ok {
+		s.hits++
+	}
+	return data, ok, nil
+}
+
+func (s *mapStore) SetCompressed(ctx context.Context, etag, encoding string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies[etag+";"+encoding] = data
+	return nil
+}
+
+func TestCompressedStore(t *testing.T) {
+	store := &mapStore{bodies: map[string][]byte{}}
+	svc := listService{socks: manySocks(20)}
+	get := func() *httptest.ResponseRecorder {
+		// A replica of its own every time, with nothing in memory
+		router := MakeHTTPHandler(context.Background(), MakeEndpoints(svc), "", log.NewNopLogger(), WithCompressedStore(store))
+		req := httptest.NewRequest("GET", "/catalogue", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get()
+	etag := strings.TrimPrefix(first.Header().Get("ETag"), "W/")
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if _, ok, _ := store.GetCompressed(context.Background(), etag, EncodingGzip); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want the compressed body of %s stored", etag)
+		}
+	}
+	// Sent as stored, rather than compressed again
+	store.SetCompressed(context.Background(), etag, EncodingGzip, []byte("stored"))
+	store.hits = 0
+	if rec := get(); rec.Body.String() != "stored" || store.hits != 1 || rec.Header().Get("Content-Encoding") != EncodingGzip {
+		t.Errorf("another replica: want the stored body, have %q %v after %d hits", rec.Body, rec.Header(), store.hits)
+	}
+}
+
+func TestStreamedListing(t *testing.T) {
+	socks := manySocks(streamListSize + 1)
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(listService{socks: socks}), "", log.NewNopLogger())
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(socks)
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/catalogue", nil))
+	if !bytes.Equal(rec.Body.Bytes(), buf.Bytes()) {
+		t.Errorf("streamed listing: want the bytes json.Encoder writes")
+	}
+	if have := rec.Header().Get("ETag"); have != etag {
+		t.Errorf("streamed listing: want ETag %s, have %s", etag, have)
+	}
+	req := httptest.NewRequest("GET", "/catalogue", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("streamed listing with its ETag: want 304, have %d", rec.Code)
+	}
+	for _, socks := range [][]Sock{nil, {}} {
+		var want, have bytes.Buffer
+		json.NewEncoder(&want).Encode(socks)
+		encodeSocks(&have, socks)
+		if want.String() != have.String() {
+			t.Errorf("encodeSocks(%#v): want %q, have %q", socks, want.String(), have.String())
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package catalogue
+
+// conditional.go contains the HTTP caching of the read routes: every response
+// carries an ETag of its body and a Cache-Control max-age of what is left of
+// its time in the cache, as read with it (see RawService), socks a
+// Last-Modified, and requests whose copy is still current are answered with a
+// 304. Stale responses are not to be stored at all.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type conditionsKey struct{}
+
+// requestConditions keeps the conditional headers of r for
+// encodeConditional.
+func requestConditions(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, conditionsKey{}, r.Header)
+}
+
+// encodeConditional encodes body as JSON with the caching headers of
+// response, or answers 304 Not Modified if the client's copy matches it.
+func encodeConditional(ctx context.Context, w http.ResponseWriter, response, body interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+	etag := etagOf(buf.Bytes())
+	if setCachingHeaders(ctx, w, response, etag) {
+		return nil
+	}
+	return writeBody(w, etag, buf.Bytes())
+}
+
+// encodeRaw is encodeConditional for a body that is JSON already, see
+// RawService, whose ETag is etag if it is known. It is sent with the newline
+// json.Encoder ends with, so that it has the ETag it would have had decoded
+// and encoded again.
+func encodeRaw(ctx context.Context, w http.ResponseWriter, response interface{}, raw []byte, etag string) error {
+	if etag == "" {
+		etag = jsonETag(raw)
+	}
+	if setCachingHeaders(ctx, w, response, etag) {
+		return nil
+	}
+	body := make([]byte, len(raw)+1)
+	copy(body, raw)
+	body[len(raw)] = '\n'
+	return writeBody(w, etag, body)
+}
+
+// etagOf returns the strong ETag of body.
+func etagOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// jsonETag returns the ETag of the JSON data sent as a response, with the
+// newline json.Encoder ends it with, as it is stored next to cache entries.
+func jsonETag(data []byte) string {
+	h := sha256.New()
+	h.Write(data)
+	h.Write([]byte("\n"))
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// streamListSize is the number of socks from which listings are streamed
+// rather than encoded into a buffer first, see encodeSocks.
+const streamListSize = 100
+
+// encodeStreaming is encodeConditional for long listings. They are encoded a
+// sock at a time twice, once for their ETag and once for the client, so that
+// the memory they take does not grow with their length; a 304 skips the
+// second time.
+func encodeStreaming(ctx context.Context, w http.ResponseWriter, response interface{}, socks []Sock) error {
+	hash := sha256.New()
+	if err := encodeSocks(hash, socks); err != nil {
+		return err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	if setCachingHeaders(ctx, w, response, etag) {
+		return nil
+	}
+	bw := bufio.NewWriterSize(w, 32<<10)
+	if err := encodeSocks(bw, socks); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// encodeSocks writes socks as a JSON array, byte for byte as json.Encoder
+// writes the slice, so that streamed and buffered listings have the same
+// ETag.
+func encodeSocks(w io.Writer, socks []Sock) error {
+	if socks == nil {
+		_, err := io.WriteString(w, "null\n")
+		return err
+	}
+	sep := "["
+	for _, sock := range socks {
+		data, err := json.Marshal(sock)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		sep = ","
+	}
+	if sep == "[" {
+		_, err := io.WriteString(w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+// setCachingHeaders sets the caching headers of response, whose body has
+// etag, and answers 304 Not Modified if the client's copy matches it, in
+// which case it reports true and nothing more is to be written.
+func setCachingHeaders(ctx context.Context, w http.ResponseWriter, response interface{}, etag string) bool {
+	setStaleHeaders(w, response)
+	w.Header().Set("ETag", etag)
+	maxAge := time.Duration(0)
+	if r, ok := response.(interface{ maxAge() time.Duration }); ok {
+		maxAge = r.maxAge()
+	}
+	if r, ok := response.(interface{ stale() bool }); ok && r.stale() {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	}
+	var modified time.Time
+	if r, ok := response.(interface{ lastModified() time.Time }); ok {
+		modified = r.lastModified()
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(ctx, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return false
+}
+
+// notModified reports whether the conditional headers of the request say
+// that the client has the response with etag, last modified at modified.
+// If-Modified-Since only counts without If-None-Match, as RFC 9110 asks.
+func notModified(ctx context.Context, etag string, modified time.Time) bool {
+	header, _ := ctx.Value(conditionsKey{}).(http.Header)
+	if inm := header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+	if modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,165 @@
+package catalogue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	updated := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	sock := s1
+	sock.UpdatedAt = &updated
+	cache := newFakeCache()
+	list := WarmRequest{Operation: "List", Tags: []string{}, Order: "id", PageNum: 1, PageSize: 10}.Key()
+	cache.values[list], _ = json.Marshal([]Sock{sock})
+	cache.ttls[list] = 90 * time.Second
+	service := NewCachedService(&stubService{socks: map[string]Sock{sock.ID: sock}}, cache, log.NewNopLogger())
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(service), "", log.NewNopLogger())
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for path, cacheControl := range map[string]string{
+		"/catalogue":          "public, max-age=90", // what is left in the cache
+		"/catalogue/" + s1.ID: "public, max-age=0",  // not cached
+		"/catalogue/size":     "public, max-age=0",
+		"/tags":               "public, max-age=0",
+	} {
+		rec := get(path)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: want 200, have %d", path, rec.Code)
+			continue
+		}
+		etag := rec.Header().Get("ETag")
+		if len(etag) != 34 {
+			t.Errorf("%s: want a strong ETag, have %q", path, etag)
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != cacheControl {
+			t.Errorf("%s: want Cache-Control %q, have %q", path, cacheControl, cc)
+		}
+		if again := get(path); again.Header().Get("ETag") != etag {
+			t.Errorf("%s: want the same ETag for the same body, have %s and %s", path, etag, again.Header().Get("ETag"))
+		}
+		for _, header := range [][]string{
+			{"If-None-Match", etag},
+			{"If-None-Match", `"other", W/` + etag},
+			{"If-None-Match", "*"},
+		} {
+			if rec := get(path, header...); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+				t.Errorf("%s with %s: want an empty 304 with the ETag, have %d, %q", path, header[1], rec.Code, rec.Body)
+			}
+		}
+		if rec := get(path, "If-None-Match", `"other"`); rec.Code != http.StatusOK {
+			t.Errorf("%s with another ETag: want 200, have %d", path, rec.Code)
+		}
+	}
+
+	for _, path := range []string{"/catalogue/" + s1.ID} {
+		if lm := get(path).Header().Get("Last-Modified"); lm != "Fri, 01 Mar 2024 12:00:00 GMT" {
+			t.Errorf("%s: want Last-Modified of the sock, have %q", path, lm)
+		}
+		for since, code := range map[time.Time]int{
+			updated:                   http.StatusNotModified,
+			updated.Add(time.Hour):    http.StatusNotModified,
+			updated.Add(-time.Second): http.StatusOK,
+		} {
+			if rec := get(path, "If-Modified-Since", since.Format(http.TimeFormat)); rec.Code != code {
+				t.Errorf("%s modified since %s: want %d, have %d", path, since, code, rec.Code)
+			}
+		}
+		// If-None-Match wins
+		if rec := get(path, "If-None-Match", `"other"`, "If-Modified-Since", updated.Format(http.TimeFormat)); rec.Code != http.StatusOK {
+			t.Errorf("%s with another ETag, not modified since: want 200, have %d", path, rec.Code)
+		}
+	}
+	// Listings rely on their ETag
+	for _, path := range []string{"/catalogue", "/tags"} {
+		if lm := get(path).Header().Get("Last-Modified"); lm != "" {
+			t.Errorf("%s: want no Last-Modified, have %q", path, lm)
+		}
+	}
+	if rec := get("/catalogue/missing", "If-None-Match", "*"); rec.Code != http.StatusNotFound || rec.Header().Get("ETag") != "" {
+		t.Errorf("missing sock: want a 404 without an ETag, have %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	// Without a cache responses are revalidated on every use
+	router = MakeHTTPHandler(context.Background(), MakeEndpoints(&stubService{socks: map[string]Sock{sock.ID: sock}}), "", log.NewNopLogger())
+	if cc := get("/catalogue").Header().Get("Cache-Control"); cc != "public, max-age=0" {
+		t.Errorf("without a cache: want Cache-Control max-age=0, have %q", cc)
+	}
+	router = MakeHTTPHandler(context.Background(), MakeEndpoints(&staleService{}), "", log.NewNopLogger())
+	if cc := get("/catalogue").Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("stale listing: want Cache-Control no-store, have %q", cc)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	cache := newFakeCache()
+	for _, r := range []WarmRequest{{Operation: "Get", ID: s1.ID}, {Operation: "Count"}, {Operation: "Tags"}} {
+		cache.ttls[r.Key()] = 10 * time.Minute
+	}
+	cache.values[productKey(s1.ID)], _ = json.Marshal(s1)
+	cache.values[countKey(Filter{})] = []byte("1")
+	cache.values[tagsKey()] = []byte(`["brown"]`)
+	e := MakeEndpoints(NewCachedService(&stubService{socks: map[string]Sock{s1.ID: s1, s2.ID: s2}}, cache, log.NewNopLogger()))
+	ctx := context.Background()
+
+	// The time left is read with the entry
+	response, _ := e.GetEndpoint(ctx, getRequest{ID: s1.ID})
+	if resp := response.(getResponse); resp.MaxAge != 10*time.Minute {
+		t.Errorf("cached sock: want max-age 10m, have %v", resp.MaxAge)
+	}
+	response, _ = e.GetEndpoint(ctx, getRequest{ID: s1.ID, VariantSize: "M"})
+	if resp := response.(getResponse); resp.MaxAge != 10*time.Minute || resp.Raw != nil {
+		t.Errorf("variants of a cached sock: want max-age 10m, have %+v", resp)
+	}
+	response, _ = e.CountEndpoint(ctx, countRequest{})
+	if resp := response.(countResponse); resp.N != 1 || resp.MaxAge != 10*time.Minute {
+		t.Errorf("cached count: want 1 with max-age 10m, have %+v", resp)
+	}
+	response, _ = e.TagsEndpoint(ctx, tagsRequest{})
+	if resp := response.(tagsResponse); resp.MaxAge != 10*time.Minute {
+		t.Errorf("cached tags: want max-age 10m, have %v", resp.MaxAge)
+	}
+	response, _ = e.GetEndpoint(ctx, getRequest{ID: s2.ID})
+	if resp := response.(getResponse); resp.MaxAge != 0 {
+		t.Errorf("sock not cached: want no max-age, have %v", resp.MaxAge)
+	}
+
+	cache.err = errors.New("connection refused")
+	response, _ = e.GetEndpoint(ctx, getRequest{ID: s1.ID})
+	if resp := response.(getResponse); resp.MaxAge != 0 {
+		t.Errorf("cache unavailable: want no max-age, have %v", resp.MaxAge)
+	}
+	cache.err = nil
+
+	// Stale answers are not fresh for any time
+	e = MakeEndpoints(&staleService{})
+	response, _ = e.ListEndpoint(ctx, listRequest{})
+	if resp := response.(listResponse); !resp.Stale || resp.MaxAge != 0 {
+		t.Errorf("stale listing: want no max-age, have %+v", resp)
+	}
+}
+
+// staleService answers every List with ErrStale.
+type staleService struct {
+	Service
+}
+
+func (staleService) List(filter Filter, order string, pageNum, pageSize int) ([]Sock, error) {
+	return []Sock{s1}, ErrStale
+}
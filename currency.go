@@ -0,0 +1,211 @@
+package catalogue
+
+// currency.go contains the endpoint middleware that prices List and Get
+// responses in the currency a client asks for.
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+)
+
+// ConvertEndpoints returns e with List and Get answering in the currency of
+// the request, converted from the base currency of rates. Every converted
+// sock gets its price as Money; the price field stays a number in major
+// units of the currency asked for, so clients that ignore currencies see
+// what they saw before. Requests in the base currency, or in none, are
+// passed to e untouched, raw cache hits included.
+//
+// Converted responses are cached under the key of the request with its
+// currency when cache is not nil, and only served while the rate they were
+// converted at is current. They are served as the JSON they are cached as,
+// unless variants are to be filtered out of them.
+func ConvertEndpoints(e Endpoints, rates *RateTable, cache CatalogueCache, logger log.Logger) Endpoints {
+	c := &converter{rates: rates, cache: cache, logger: logger}
+	e.ListEndpoint = c.list(e.ListEndpoint)
+	e.GetEndpoint = c.get(e.GetEndpoint)
+	return e
+}
+
+type converter struct {
+	rates  *RateTable
+	cache  CatalogueCache
+	logger log.Logger
+}
+
+// convertedEntry is a converted response as cached, with the ETag of the
+// response so that hits are sent without hashing them again. Get responses
+// hold a single sock.
+type convertedEntry struct {
+	Rate  string          `json:"rate"`
+	ETag  string          `json:"etag"`
+	Socks json.RawMessage `json:"socks"`
+}
+
+func (c *converter) list(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listRequest)
+		if c.isBase(req.Currency) {
+			return next(ctx, request)
+		}
+		key := WarmRequest{Operation: "List", Tags: req.Tags, VariantSize: req.VariantSize, Order: req.Order, PageNum: req.PageNum, PageSize: req.PageSize, Currency: req.Currency}
+		return c.convert(ctx, key, true, func() ([]Sock, bool, error) {
+			response, err := next(ctx, request)
+			if err != nil {
+				return nil, false, err
+			}
+			resp := response.(listResponse)
+			socks, err := resp.sockList()
+			return socks, resp.Stale, err
+		}, func(socks []Sock, raw RawEntry, stale bool, err error) interface{} {
+			return listResponse{Socks: socks, Raw: raw.JSON, ETag: raw.ETag, MaxAge: raw.TTL, Stale: stale, Err: err}
+		})
+	}
+}
+
+func (c *converter) get(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		// The conversion of the whole sock is cached, and its variants
+		// filtered afterwards
+		req := request.(getRequest)
+		if c.isBase(req.Currency) {
+			return next(ctx, request)
+		}
+		variantSize := req.VariantSize
+		req.VariantSize = ""
+		key := WarmRequest{Operation: "Get", ID: req.ID, Currency: req.Currency}
+		return c.convert(ctx, key, variantSize == "", func() ([]Sock, bool, error) {
+			response, err := next(ctx, req)
+			if err != nil {
+				return nil, false, err
+			}
+			resp := response.(getResponse)
+			sock, err := resp.sock()
+			return []Sock{sock}, resp.Stale, err
+		}, func(socks []Sock, raw RawEntry, stale bool, err error) interface{} {
+			if raw.JSON != nil {
+				return getResponse{Raw: raw.JSON, ETag: raw.ETag, MaxAge: raw.TTL}
+			}
+			var sock Sock
+			if len(socks) > 0 {
+				sock = socks[0]
+			}
+			if variantSize != "" {
+				sock.Variants = variantsOfSize(sock.Variants, variantSize)
+			}
+			return getResponse{Sock: sock, MaxAge: raw.TTL, Stale: stale, Err: err}
+		})
+	}
+}
+
+// isBase reports whether prices in currency are those of the database.
+func (c *converter) isBase(currency string) bool {
+	return currency == "" || currency == c.rates.Base()
+}
+
+// convert answers the request identified by key in its currency: from the
+// cache if it can, otherwise by converting what load returns. respond builds
+// the endpoint's response, from the cached JSON of the response if raw is
+// true and it was cached, and with the time the cached conversion has left
+// if there was one.
+func (c *converter) convert(ctx context.Context, key WarmRequest, raw bool, load func() ([]Sock, bool, error), respond func([]Sock, RawEntry, bool, error) interface{}) (interface{}, error) {
+	base := c.rates.Base()
+	rate, err := c.rates.Rate(key.Currency)
+	if err != nil {
+		return respond(nil, RawEntry{}, false, err), err
+	}
+	if entry, ttl, ok := c.cached(ctx, key, rate.RatString()); ok {
+		if raw {
+			return respond(nil, RawEntry{JSON: sentJSON(key, entry.Socks), ETag: entry.ETag, TTL: ttl}, false, nil), nil
+		}
+		var socks []Sock
+		if err := json.Unmarshal(entry.Socks, &socks); err == nil {
+			return respond(socks, RawEntry{TTL: ttl}, false, nil), nil
+		}
+	}
+
+	socks, stale, err := load()
+	if err != nil {
+		return respond(nil, RawEntry{}, false, err), err
+	}
+	priced := make([]Sock, len(socks))
+	for i, sock := range socks {
+		money, err := c.rates.Convert(sock.Price.Money(base), key.Currency)
+		if err != nil {
+			return respond(nil, RawEntry{}, false, err), err
+		}
+		sock.Money = &money
+		sock.Price = PriceOf(money)
+		if sock.Variants, err = c.priceVariants(sock.Variants, base, key.Currency); err != nil {
+			return respond(nil, RawEntry{}, false, err), err
+		}
+		priced[i] = sock
+	}
+
+	// Stale answers are not cached, so that they are not served once the
+	// database is back
+	if !stale && c.cache != nil {
+		if data, err := json.Marshal(priced); err == nil {
+			entry := CacheEntry{Request: key, Value: convertedEntry{Rate: rate.RatString(), ETag: jsonETag(sentJSON(key, data)), Socks: data}}
+			if err := c.cache.SetMany(ctx, []CacheEntry{entry}); err != nil {
+				c.logger.Log("currency", "error", "operation", "SetMany", "key", key.Key(), "error", err)
+			}
+		}
+	}
+	return respond(priced, RawEntry{}, stale, nil), nil
+}
+
+// sentJSON returns the JSON a response to key is sent as, given that of its
+// socks: Get responses are the one sock rather than an array of it.
+func sentJSON(key WarmRequest, socks []byte) []byte {
+	if key.Operation != "Get" {
+		return socks
+	}
+	return bytes.TrimSuffix(bytes.TrimPrefix(socks, []byte("[")), []byte("]"))
+}
+
+// priceVariants returns a copy of variants with their own prices, if any, in
+// currency.
+func (c *converter) priceVariants(variants []Variant, base, currency string) ([]Variant, error) {
+	if len(variants) == 0 {
+		return variants, nil
+	}
+	priced := make([]Variant, len(variants))
+	for i, v := range variants {
+		if v.Price != nil {
+			money, err := c.rates.Convert(v.Price.Money(base), currency)
+			if err != nil {
+				return nil, err
+			}
+			price := PriceOf(money)
+			v.Money, v.Price = &money, &price
+		}
+		priced[i] = v
+	}
+	return priced, nil
+}
+
+// cached returns the cached conversion of key, if it was converted at rate,
+// and the time it has left.
+func (c *converter) cached(ctx context.Context, key WarmRequest, rate string) (convertedEntry, time.Duration, bool) {
+	if c.cache == nil {
+		return convertedEntry{}, 0, false
+	}
+	raw, found, err := c.cache.GetRaw(ctx, key)
+	if err != nil {
+		c.logger.Log("currency", "error", "operation", "GetRaw", "key", key.Key(), "error", err)
+		return convertedEntry{}, 0, false
+	}
+	var entry convertedEntry
+	if !found || json.Unmarshal(raw.JSON, &entry) != nil || entry.Rate != rate {
+		return convertedEntry{}, 0, false
+	}
+	if entry.ETag == "" {
+		entry.ETag = jsonETag(sentJSON(key, entry.Socks))
+	}
+	return entry, raw.TTL, true
+}
@@ -0,0 +1,116 @@
+package catalogue
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+)
+
+func TestConvertEndpoints(t *testing.T) {
+	rates, err := NewRateTable("USD", map[string]string{"EUR": "0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &stubService{socks: map[string]Sock{s1.ID: s1}}
+	cache := newFakeCache()
+	e := ConvertEndpoints(MakeEndpoints(svc), rates, cache, log.NewNopLogger())
+	server := httptest.NewServer(MakeHTTPHandler(context.Background(), e, "", log.NewNopLogger()))
+	defer server.Close()
+
+	get := func(path string) (int, []Sock) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var socks []Sock
+		if resp.StatusCode == http.StatusOK {
+			if strings.HasPrefix(path, "/catalogue?") {
+				json.NewDecoder(resp.Body).Decode(&socks)
+			} else {
+				var sock Sock
+				json.NewDecoder(resp.Body).Decode(&sock)
+				socks = append(socks, sock)
+			}
+		}
+		return resp.StatusCode, socks
+	}
+
+	for _, testcase := range []struct {
+		path  string
+		price Price
+		money *Money
+	}{
+		{"/catalogue?size=5", 110, nil},
+		{"/catalogue?currency=usd", 110, nil},
+		{"/catalogue?currency=EUR", 55, &Money{55, "EUR"}},
+		{"/catalogue/1?currency=eur", 55, &Money{55, "EUR"}},
+	} {
+		status, socks := get(testcase.path)
+		if status != http.StatusOK || len(socks) != 1 {
+			t.Errorf("GET %s: want 1 sock, have %d %v", testcase.path, status, socks)
+			continue
+		}
+		if money := socks[0].Money; socks[0].Price != testcase.price || (money == nil) != (testcase.money == nil) || money != nil && *money != *testcase.money {
+			t.Errorf("GET %s: want price %v (%v), have %v (%v)", testcase.path, testcase.price, testcase.money, socks[0].Price, socks[0].Money)
+		}
+	}
+	// Prices in the base currency are left to the endpoints, and not cached
+	// again
+	for _, r := range []WarmRequest{
+		{Operation: "List", Tags: []string{}, Order: "id", PageNum: 1, PageSize: 10, Currency: "EUR"},
+		{Operation: "Get", ID: s1.ID, Currency: "EUR"},
+	} {
+		if !cache.keys[r.Key()] {
+			t.Errorf("cached conversions: want %s, have %v", r.Key(), cache.keys)
+		}
+	}
+	if len(cache.keys) != 2 {
+		t.Errorf("cached conversions: want the 2 in EUR, have %v", cache.keys)
+	}
+
+	// Converted answers come from the cache while the rate holds
+	delete(svc.socks, s1.ID)
+	if status, socks := get("/catalogue/1?currency=EUR"); status != http.StatusOK || socks[0].Money.Amount != 55 {
+		t.Errorf("GET /catalogue/1?currency=EUR: want the cached conversion, have %d %v", status, socks)
+	}
+	rates.Set(map[string]string{"EUR": "0.4"})
+	if status, _ := get("/catalogue/1?currency=EUR"); status != http.StatusNotFound {
+		t.Errorf("GET /catalogue/1?currency=EUR once the rate changed: want 404, have %d", status)
+	}
+
+	for _, path := range []string{"/catalogue?currency=CHF", "/catalogue?currency=euro", "/catalogue/1?currency=E1R"} {
+		if status, _ := get(path); status != http.StatusBadRequest {
+			t.Errorf("GET %s: want 400, have %d", path, status)
+		}
+	}
+}
+
+func TestConvertEndpointsPassesBaseThrough(t *testing.T) {
+	rates, err := NewRateTable("USD", map[string]string{"EUR": "0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte(`{"id":"1","price":1.1}`)
+	cache := newFakeCache()
+	e := ConvertEndpoints(Endpoints{
+		GetEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			return getResponse{Raw: raw, ETag: `"etag"`}, nil
+		},
+	}, rates, cache, log.NewNopLogger())
+
+	for _, currency := range []string{"", "USD"} {
+		response, err := e.GetEndpoint(context.Background(), getRequest{ID: "1", Currency: currency})
+		if resp := response.(getResponse); err != nil || string(resp.Raw) != string(raw) || resp.ETag != `"etag"` {
+			t.Errorf("Get in %q: want the raw response untouched, have %+v, %v", currency, resp, err)
+		}
+	}
+	if len(cache.keys) != 0 {
+		t.Errorf("Get in the base currency: want nothing cached, have %v", cache.keys)
+	}
+}
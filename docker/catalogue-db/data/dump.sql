@@ -8,8 +8,8 @@ CREATE TABLE IF NOT EXISTS sock (
 	description varchar(200), 
 	price float, 
 	count int, 
-	image_url_1 varchar(40), 
-	image_url_2 varchar(40), 
+	image_url_1 varchar(200), 
+	image_url_2 varchar(200), 
 	PRIMARY KEY(sock_id)
 );
 
@@ -77,6 +77,152 @@ INSERT INTO sock_tag VALUES ("837ab141-399e-4c1f-9abc-bace40296bac", "1");
 INSERT INTO sock_tag VALUES ("837ab141-399e-4c1f-9abc-bace40296bac", "11");
 INSERT INTO sock_tag VALUES ("837ab141-399e-4c1f-9abc-bace40296bac", "3");
 
+-- Prices are exact decimals, read in hundredths by the catalogue. Existing
+-- databases need this too: rounding to the cent recovers the prices the
+-- floats stood for.
+ALTER TABLE sock MODIFY price DECIMAL(10,2);
 
+-- When each sock last changed, for the Last-Modified header of the catalogue.
+-- Writes through the catalogue service also set it when only the tags or the
+-- images of a sock change.
+ALTER TABLE sock ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP;
 
+CREATE TABLE IF NOT EXISTS sock_change (
+	change_id BIGINT NOT NULL AUTO_INCREMENT, 
+	table_name varchar(20) NOT NULL, 
+	operation varchar(10) NOT NULL, 
+	sock_id varchar(40), 
+	tags varchar(200), 
+	changed_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), 
+	PRIMARY KEY(change_id), 
+	INDEX(changed_at)
+);
+
+-- Every write to the catalogue tables is recorded in sock_change, which the
+-- catalogue service polls to invalidate its cache. The triggers are created
+-- after the seed data so that it is not recorded. sock rows carry the tags of
+-- the sock, sock_tag and tag rows the tag that was linked, unlinked or renamed.
+
+CREATE TRIGGER sock_after_insert AFTER INSERT ON sock FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock", "insert", NEW.sock_id,
+		(SELECT GROUP_CONCAT(tag.name) FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=NEW.sock_id));
+CREATE TRIGGER sock_after_update AFTER UPDATE ON sock FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock", "update", NEW.sock_id,
+		(SELECT GROUP_CONCAT(tag.name) FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=NEW.sock_id));
+CREATE TRIGGER sock_after_delete AFTER DELETE ON sock FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock", "delete", OLD.sock_id,
+		(SELECT GROUP_CONCAT(tag.name) FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=OLD.sock_id));
+
+CREATE TRIGGER sock_tag_after_insert AFTER INSERT ON sock_tag FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock_tag", "insert", NEW.sock_id,
+		(SELECT name FROM tag WHERE tag_id=NEW.tag_id));
+CREATE TRIGGER sock_tag_after_update AFTER UPDATE ON sock_tag FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock_tag", "update", NEW.sock_id,
+		(SELECT GROUP_CONCAT(name) FROM tag WHERE tag_id IN (OLD.tag_id, NEW.tag_id)));
+CREATE TRIGGER sock_tag_after_delete AFTER DELETE ON sock_tag FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock_tag", "delete", OLD.sock_id,
+		(SELECT name FROM tag WHERE tag_id=OLD.tag_id));
+
+CREATE TRIGGER tag_after_insert AFTER INSERT ON tag FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, tags) VALUES ("tag", "insert", NEW.name);
+CREATE TRIGGER tag_after_update AFTER UPDATE ON tag FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, tags) VALUES ("tag", "update", CONCAT_WS(",", OLD.name, NEW.name));
+CREATE TRIGGER tag_after_delete AFTER DELETE ON tag FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, tags) VALUES ("tag", "delete", OLD.name);
+
+-- Events of the writes made through the catalogue service, recorded in the
+-- same transaction as the write and published by its outbox relay. payload
+-- is the event as JSON; published_at is set once it has been published.
+CREATE TABLE IF NOT EXISTS outbox (
+	seq BIGINT NOT NULL AUTO_INCREMENT, 
+	event_id varchar(36) NOT NULL, 
+	event_type varchar(20) NOT NULL, 
+	sock_id varchar(40) NOT NULL, 
+	payload TEXT NOT NULL, 
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), 
+	published_at TIMESTAMP(6) NULL, 
+	PRIMARY KEY(seq), 
+	UNIQUE(event_id), 
+	INDEX(published_at)
+);
+
+-- Stock set aside for orders. Reserving takes the stock out of sock.count;
+-- releasing, or expiring while still reserved, puts it back.
+CREATE TABLE IF NOT EXISTS reservation (
+	reservation_id varchar(36) NOT NULL, 
+	sock_id varchar(40) NOT NULL, 
+	quantity int NOT NULL, 
+	status varchar(10) NOT NULL, 
+	expires_at TIMESTAMP(6) NOT NULL, 
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), 
+	PRIMARY KEY(reservation_id), 
+	INDEX(status, expires_at), 
+	FOREIGN KEY (sock_id) 
+		REFERENCES sock(sock_id)
+);
 
+-- The sizes and colours a sock comes in, each with its own stock and, when
+-- price is not NULL, its own price.
+CREATE TABLE IF NOT EXISTS sock_variant (
+	sku varchar(40) NOT NULL, 
+	sock_id varchar(40) NOT NULL, 
+	size varchar(10) NOT NULL DEFAULT '', 
+	colour varchar(20) NOT NULL DEFAULT '', 
+	price DECIMAL(10,2) NULL, 
+	count int NOT NULL DEFAULT 0, 
+	PRIMARY KEY(sku), 
+	INDEX(sock_id, size), 
+	FOREIGN KEY (sock_id) 
+		REFERENCES sock(sock_id)
+);
+
+CREATE TRIGGER sock_variant_after_insert AFTER INSERT ON sock_variant FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock_variant", "insert", NEW.sock_id,
+		(SELECT GROUP_CONCAT(tag.name) FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=NEW.sock_id));
+CREATE TRIGGER sock_variant_after_update AFTER UPDATE ON sock_variant FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock_variant", "update", NEW.sock_id,
+		(SELECT GROUP_CONCAT(tag.name) FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=NEW.sock_id));
+CREATE TRIGGER sock_variant_after_delete AFTER DELETE ON sock_variant FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock_variant", "delete", OLD.sock_id,
+		(SELECT GROUP_CONCAT(tag.name) FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=OLD.sock_id));
+
+-- The images of a sock, shown primary first, then by position. The catalogue
+-- still writes the first two to image_url_1 and image_url_2 for readers that
+-- predate this table, and falls back to them for socks without rows here.
+CREATE TABLE IF NOT EXISTS sock_image (
+	sock_id varchar(40) NOT NULL, 
+	position int NOT NULL, 
+	url varchar(200) NOT NULL, 
+	alt varchar(200) NOT NULL DEFAULT '', 
+	width int NOT NULL DEFAULT 0, 
+	height int NOT NULL DEFAULT 0, 
+	is_primary BOOLEAN NOT NULL DEFAULT FALSE, 
+	PRIMARY KEY(sock_id, position), 
+	FOREIGN KEY (sock_id) 
+		REFERENCES sock(sock_id)
+);
+
+-- Move the images of existing socks over, the first one primary
+INSERT IGNORE INTO sock_image (sock_id, position, url, is_primary)
+	SELECT sock_id, 0, image_url_1, TRUE FROM sock WHERE image_url_1 <> '';
+INSERT IGNORE INTO sock_image (sock_id, position, url, is_primary)
+	SELECT sock_id, 1, image_url_2, image_url_1 = '' FROM sock WHERE image_url_2 <> '';
+
+CREATE TRIGGER sock_image_after_insert AFTER INSERT ON sock_image FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock_image", "insert", NEW.sock_id,
+		(SELECT GROUP_CONCAT(tag.name) FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=NEW.sock_id));
+CREATE TRIGGER sock_image_after_update AFTER UPDATE ON sock_image FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock_image", "update", NEW.sock_id,
+		(SELECT GROUP_CONCAT(tag.name) FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=NEW.sock_id));
+CREATE TRIGGER sock_image_after_delete AFTER DELETE ON sock_image FOR EACH ROW
+	INSERT INTO sock_change (table_name, operation, sock_id, tags) VALUES ("sock_image", "delete", OLD.sock_id,
+		(SELECT GROUP_CONCAT(tag.name) FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=OLD.sock_id));
+
+-- How much of each currency one unit of the catalogue's currency buys, for
+-- ?currency= (see -rates-db).
+CREATE TABLE IF NOT EXISTS exchange_rate (
+	currency CHAR(3) NOT NULL, 
+	rate DECIMAL(18,8) NOT NULL, 
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, 
+	PRIMARY KEY(currency)
+);
@@ -5,6 +5,10 @@ package catalogue
 // transport.
 
 import (
+	"encoding/json"
+	"errors"
+	"time"
+
 	"github.com/go-kit/kit/endpoint"
 	"golang.org/x/net/context"
 )
@@ -30,37 +34,195 @@ func MakeEndpoints(s Service) Endpoints {
 	}
 }
 
-// MakeListEndpoint returns an endpoint via the given service.
+// WriteEndpoints collects the endpoints that comprise the Writer.
+type WriteEndpoints struct {
+	CreateEndpoint    endpoint.Endpoint
+	UpdateEndpoint    endpoint.Endpoint
+	SetStockEndpoint  endpoint.Endpoint
+	SetImagesEndpoint endpoint.Endpoint
+
+	// UploadImageEndpoint is nil unless set to MakeUploadImageEndpoint.
+	UploadImageEndpoint endpoint.Endpoint
+}
+
+// MakeWriteEndpoints returns a WriteEndpoints structure, where each endpoint
+// is backed by the given writer.
+func MakeWriteEndpoints(w Writer) WriteEndpoints {
+	return WriteEndpoints{
+		CreateEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			sock, err := w.Create(request.(writeRequest).Sock)
+			return writeResponse{Sock: sock, Err: err}, err
+		},
+		UpdateEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			sock, err := w.Update(request.(writeRequest).Sock)
+			return writeResponse{Sock: sock, Err: err}, err
+		},
+		SetStockEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(setStockRequest)
+			sock, err := w.SetStock(req.ID, req.Count)
+			return writeResponse{Sock: sock, Err: err}, err
+		},
+		SetImagesEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(setImagesRequest)
+			sock, err := w.SetImages(req.ID, req.Images)
+			return writeResponse{Sock: sock, Err: err}, err
+		},
+	}
+}
+
+// MakeUploadImageEndpoint returns an endpoint adding uploaded images to socks
+// with u.
+func MakeUploadImageEndpoint(u *ImageUploader) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(uploadImageRequest)
+		sock, image, err := u.Upload(ctx, req.ID, req.Upload)
+		return uploadImageResponse{Sock: sock, Image: image, Err: err}, err
+	}
+}
+
+// InventoryEndpoints collects the endpoints that comprise the Inventory.
+type InventoryEndpoints struct {
+	ReserveEndpoint endpoint.Endpoint
+	ReleaseEndpoint endpoint.Endpoint
+	CommitEndpoint  endpoint.Endpoint
+}
+
+// MakeInventoryEndpoints returns an InventoryEndpoints structure, where each
+// endpoint is backed by the given inventory.
+func MakeInventoryEndpoints(inv Inventory) InventoryEndpoints {
+	return InventoryEndpoints{
+		ReserveEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(reserveRequest)
+			r, err := inv.Reserve(req.ID, req.Quantity)
+			return reservationResponse{Reservation: r, Err: err}, err
+		},
+		ReleaseEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			r, err := inv.Release(request.(reservationRequest).ID)
+			return reservationResponse{Reservation: r, Err: err}, err
+		},
+		CommitEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			r, err := inv.Commit(request.(reservationRequest).ID)
+			return reservationResponse{Reservation: r, Err: err}, err
+		},
+	}
+}
+
+// MakeListEndpoint returns an endpoint via the given service. Services that
+// implement RawService answer with the JSON they have ready when they can,
+// and with the time it has left in their cache.
 func MakeListEndpoint(s Service) endpoint.Endpoint {
+	if rs, ok := s.(RawService); ok {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			req := request.(listRequest)
+			raw, socks, err := rs.ListRaw(Filter{Tags: req.Tags, VariantSize: req.VariantSize}, req.Order, req.PageNum, req.PageSize)
+			if errors.Is(err, ErrStale) {
+				return listResponse{Socks: socks, Stale: true}, nil
+			}
+			return listResponse{Socks: socks, Raw: raw.JSON, ETag: raw.ETag, MaxAge: raw.TTL, Err: err}, err
+		}
+	}
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(listRequest)
-		socks, err := s.List(req.Tags, req.Order, req.PageNum, req.PageSize)
+		socks, err := s.List(Filter{Tags: req.Tags, VariantSize: req.VariantSize}, req.Order, req.PageNum, req.PageSize)
+		if errors.Is(err, ErrStale) {
+			return listResponse{Socks: socks, Stale: true}, nil
+		}
 		return listResponse{Socks: socks, Err: err}, err
 	}
 }
 
-// MakeCountEndpoint returns an endpoint via the given service.
+// MakeCountEndpoint returns an endpoint via the given service. Services that
+// implement RawService answer with the time the count has left in their
+// cache.
 func MakeCountEndpoint(s Service) endpoint.Endpoint {
+	if rs, ok := s.(RawService); ok {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			req := request.(countRequest)
+			n, ttl, err := rs.CountTTL(Filter{Tags: req.Tags, VariantSize: req.VariantSize})
+			if errors.Is(err, ErrStale) {
+				return countResponse{N: n, Stale: true}, nil
+			}
+			return countResponse{N: n, MaxAge: ttl, Err: err}, err
+		}
+	}
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(countRequest)
-		n, err := s.Count(req.Tags)
+		n, err := s.Count(Filter{Tags: req.Tags, VariantSize: req.VariantSize})
+		if errors.Is(err, ErrStale) {
+			return countResponse{N: n, Stale: true}, nil
+		}
 		return countResponse{N: n, Err: err}, err
 	}
 }
 
-// MakeGetEndpoint returns an endpoint via the given service.
+// MakeGetEndpoint returns an endpoint via the given service. Services that
+// implement RawService answer with the JSON they have ready when the whole
+// sock is asked for, and with the time the sock has left in their cache.
 func MakeGetEndpoint(s Service) endpoint.Endpoint {
+	rs, raw := s.(RawService)
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(getRequest)
+		if raw {
+			raw, sock, err := rs.GetRaw(req.ID)
+			if errors.Is(err, ErrStale) {
+				if req.VariantSize != "" {
+					sock.Variants = variantsOfSize(sock.Variants, req.VariantSize)
+				}
+				return getResponse{Sock: sock, Stale: true}, nil
+			}
+			resp := getResponse{Sock: sock, Raw: raw.JSON, ETag: raw.ETag, MaxAge: raw.TTL, Err: err}
+			if req.VariantSize == "" || err != nil {
+				return resp, err
+			}
+			// The variants of one size are not cached on their own
+			if resp.Sock, err = resp.sock(); err != nil {
+				return getResponse{Err: err}, err
+			}
+			resp.Raw, resp.ETag = nil, ""
+			resp.Sock.Variants = variantsOfSize(resp.Sock.Variants, req.VariantSize)
+			return resp, nil
+		}
 		sock, err := s.Get(req.ID)
+		if req.VariantSize != "" {
+			sock.Variants = variantsOfSize(sock.Variants, req.VariantSize)
+		}
+		if errors.Is(err, ErrStale) {
+			return getResponse{Sock: sock, Stale: true}, nil
+		}
 		return getResponse{Sock: sock, Err: err}, err
 	}
 }
 
-// MakeTagsEndpoint returns an endpoint via the given service.
+// variantsOfSize returns the variants of the given size, leaving variants
+// as they are.
+func variantsOfSize(variants []Variant, size string) []Variant {
+	var sized []Variant
+	for _, v := range variants {
+		if v.Size == size {
+			sized = append(sized, v)
+		}
+	}
+	return sized
+}
+
+// MakeTagsEndpoint returns an endpoint via the given service. Services that
+// implement RawService answer with the time the tags have left in their
+// cache.
 func MakeTagsEndpoint(s Service) endpoint.Endpoint {
+	if rs, ok := s.(RawService); ok {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			tags, ttl, err := rs.TagsTTL()
+			if errors.Is(err, ErrStale) {
+				return tagsResponse{Tags: tags, Stale: true}, nil
+			}
+			return tagsResponse{Tags: tags, MaxAge: ttl, Err: err}, err
+		}
+	}
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		tags, err := s.Tags()
+		if errors.Is(err, ErrStale) {
+			return tagsResponse{Tags: tags, Stale: true}, nil
+		}
 		return tagsResponse{Tags: tags, Err: err}, err
 	}
 }
@@ -74,33 +236,97 @@ func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 }
 
 type listRequest struct {
-	Tags     []string `json:"tags"`
-	Order    string   `json:"order"`
-	PageNum  int      `json:"pageNum"`
-	PageSize int      `json:"pageSize"`
+	Tags        []string `json:"tags"`
+	VariantSize string   `json:"variantSize,omitempty"`
+	Order       string   `json:"order"`
+	PageNum     int      `json:"pageNum"`
+	PageSize    int      `json:"pageSize"`
+	Currency    string   `json:"currency,omitempty"`
 }
 
 type listResponse struct {
-	Socks []Sock `json:"sock"`
-	Err   error  `json:"err"`
+	Socks  []Sock        `json:"sock"`
+	Raw    []byte        `json:"-"` // the JSON of Socks instead, see RawService
+	ETag   string        `json:"-"` // of Raw, if known
+	Err    error         `json:"-"`
+	Stale  bool          `json:"-"`
+	MaxAge time.Duration `json:"-"` // see RawService
+}
+
+// Failed implements endpoint.Failer.
+func (r listResponse) Failed() error { return r.Err }
+
+func (r listResponse) stale() bool { return r.Stale }
+
+func (r listResponse) maxAge() time.Duration { return r.MaxAge }
+
+// sockList returns the socks of r, decoding its raw JSON if that is what it
+// has.
+func (r listResponse) sockList() ([]Sock, error) {
+	if r.Raw == nil {
+		return r.Socks, nil
+	}
+	var socks []Sock
+	err := json.Unmarshal(r.Raw, &socks)
+	return socks, err
 }
 
 type countRequest struct {
-	Tags []string `json:"tags"`
+	Tags        []string `json:"tags"`
+	VariantSize string   `json:"variantSize,omitempty"`
 }
 
 type countResponse struct {
-	N   int   `json:"size"` // to match original
-	Err error `json:"err"`
+	N      int           `json:"size"` // to match original
+	Err    error         `json:"-"`
+	Stale  bool          `json:"-"`
+	MaxAge time.Duration `json:"-"` // see RawService
 }
 
+// Failed implements endpoint.Failer.
+func (r countResponse) Failed() error { return r.Err }
+
+func (r countResponse) stale() bool { return r.Stale }
+
+func (r countResponse) maxAge() time.Duration { return r.MaxAge }
+
 type getRequest struct {
-	ID string `json:"id"`
+	ID          string `json:"id"`
+	VariantSize string `json:"variantSize,omitempty"`
+	Currency    string `json:"currency,omitempty"`
 }
 
 type getResponse struct {
-	Sock Sock  `json:"sock"`
-	Err  error `json:"err"`
+	Sock   Sock          `json:"sock"`
+	Raw    []byte        `json:"-"` // the JSON of Sock instead, see RawService
+	ETag   string        `json:"-"` // of Raw, if known
+	Err    error         `json:"-"`
+	Stale  bool          `json:"-"`
+	MaxAge time.Duration `json:"-"` // see RawService
+}
+
+// Failed implements endpoint.Failer.
+func (r getResponse) Failed() error { return r.Err }
+
+func (r getResponse) stale() bool { return r.Stale }
+
+func (r getResponse) maxAge() time.Duration { return r.MaxAge }
+
+func (r getResponse) lastModified() time.Time {
+	if r.Raw != nil {
+		return lastModifiedJSON(r.Raw)
+	}
+	return LastModified(r.Sock)
+}
+
+// sock returns the sock of r, decoding its raw JSON if that is what it has.
+func (r getResponse) sock() (Sock, error) {
+	if r.Raw == nil {
+		return r.Sock, nil
+	}
+	var sock Sock
+	err := json.Unmarshal(r.Raw, &sock)
+	return sock, err
 }
 
 type tagsRequest struct {
@@ -108,10 +334,72 @@ type tagsRequest struct {
 }
 
 type tagsResponse struct {
-	Tags []string `json:"tags"`
-	Err  error    `json:"err"`
+	Tags   []string      `json:"tags"`
+	Err    error         `json:"-"`
+	Stale  bool          `json:"-"`
+	MaxAge time.Duration `json:"-"` // see RawService
 }
 
+// Failed implements endpoint.Failer.
+func (r tagsResponse) Failed() error { return r.Err }
+
+func (r tagsResponse) stale() bool { return r.Stale }
+
+func (r tagsResponse) maxAge() time.Duration { return r.MaxAge }
+
+type writeRequest struct {
+	Sock Sock
+}
+
+type setStockRequest struct {
+	ID    string `json:"-"`
+	Count int    `json:"count"`
+}
+
+type setImagesRequest struct {
+	ID     string
+	Images []Image
+}
+
+type uploadImageRequest struct {
+	ID     string
+	Upload ImageUpload
+}
+
+type uploadImageResponse struct {
+	Sock  Sock
+	Image Image
+	Err   error
+}
+
+// Failed implements endpoint.Failer.
+func (r uploadImageResponse) Failed() error { return r.Err }
+
+type writeResponse struct {
+	Sock Sock  `json:"sock"`
+	Err  error `json:"-"`
+}
+
+// Failed implements endpoint.Failer.
+func (r writeResponse) Failed() error { return r.Err }
+
+type reserveRequest struct {
+	ID       string `json:"-"`
+	Quantity int    `json:"quantity"`
+}
+
+type reservationRequest struct {
+	ID string `json:"id"`
+}
+
+type reservationResponse struct {
+	Reservation Reservation `json:"reservation"`
+	Err         error       `json:"-"`
+}
+
+// Failed implements endpoint.Failer.
+func (r reservationResponse) Failed() error { return r.Err }
+
 type healthRequest struct {
 	//
 }
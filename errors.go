@@ -0,0 +1,209 @@
+package catalogue
+
+// errors.go contains the typed error model shared by the service and its
+// transports. Every error that reaches a client carries a stable,
+// machine-readable code alongside a human readable message.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/sony/gobreaker"
+	"google.golang.org/grpc/codes"
+)
+
+// Code is a stable, machine-readable error code. Clients may switch on it;
+// the message text may change between releases, codes may not.
+type Code string
+
+// Error codes returned by the catalogue.
+const (
+	CodeNotFound           Code = "NOT_FOUND"
+	CodeInvalidArgument    Code = "INVALID_ARGUMENT"
+	CodeUnavailable        Code = "UNAVAILABLE"
+	CodeRateLimited        Code = "RATE_LIMITED"
+	CodeDeadlineExceeded   Code = "DEADLINE_EXCEEDED"
+	CodeConflict           Code = "CONFLICT"
+	CodeFailedPrecondition Code = "FAILED_PRECONDITION"
+	CodeUnauthenticated    Code = "UNAUTHENTICATED"
+	CodeTooLarge           Code = "TOO_LARGE"
+	CodeInternal           Code = "INTERNAL"
+)
+
+// HTTPStatus returns the HTTP status code that corresponds to c.
+func (c Code) HTTPStatus() int {
+	switch c {
+	case CodeNotFound:
+		return http.StatusNotFound
+	case CodeInvalidArgument:
+		return http.StatusBadRequest
+	case CodeUnavailable:
+		return http.StatusServiceUnavailable
+	case CodeRateLimited:
+		return http.StatusTooManyRequests
+	case CodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case CodeConflict:
+		return http.StatusConflict
+	case CodeFailedPrecondition:
+		return http.StatusPreconditionFailed
+	case CodeUnauthenticated:
+		return http.StatusUnauthorized
+	case CodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GRPCCode returns the gRPC status code that corresponds to c.
+func (c Code) GRPCCode() codes.Code {
+	switch c {
+	case CodeNotFound:
+		return codes.NotFound
+	case CodeInvalidArgument:
+		return codes.InvalidArgument
+	case CodeUnavailable:
+		return codes.Unavailable
+	case CodeRateLimited, CodeTooLarge:
+		return codes.ResourceExhausted
+	case CodeDeadlineExceeded:
+		return codes.DeadlineExceeded
+	case CodeConflict:
+		return codes.Aborted
+	case CodeFailedPrecondition:
+		return codes.FailedPrecondition
+	case CodeUnauthenticated:
+		return codes.Unauthenticated
+	default:
+		return codes.Internal
+	}
+}
+
+// Error is the catalogue's typed error. Two errors are considered equal by
+// errors.Is when they share a code and message, so decorated copies made
+// with WithDetails still match the sentinel they were derived from.
+type Error struct {
+	Code    Code
+	Message string
+	Details map[string]interface{}
+	Err     error // underlying cause, never sent to clients
+}
+
+// NewError returns an error with the given code and message.
+func NewError(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// InvalidArgument returns an INVALID_ARGUMENT error for the named field.
+func InvalidArgument(field, value, reason string) *Error {
+	return &Error{
+		Code:    CodeInvalidArgument,
+		Message: fmt.Sprintf("invalid %s: %s", field, reason),
+		Details: map[string]interface{}{
+			"field": field,
+			"value": value,
+		},
+	}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying cause, if any.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an *Error with the same code and message.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e.Code == t.Code && e.Message == t.Message
+}
+
+// HTTPStatus returns the HTTP status code for the error.
+func (e *Error) HTTPStatus() int {
+	return e.Code.HTTPStatus()
+}
+
+// WithDetails returns a copy of e with the given key/value pair added to its
+// details.
+func (e *Error) WithDetails(key string, value interface{}) *Error {
+	details := make(map[string]interface{}, len(e.Details)+1)
+	for k, v := range e.Details {
+		details[k] = v
+	}
+	details[key] = value
+	cp := *e
+	cp.Details = details
+	return &cp
+}
+
+// WithCause returns a copy of e wrapping the given cause.
+func (e *Error) WithCause(err error) *Error {
+	cp := *e
+	cp.Err = err
+	return &cp
+}
+
+// AsError converts any error into an *Error. Errors that are already typed are
+// returned as-is; well known errors from the standard library and the circuit
+// breaker are mapped to their codes; anything else becomes INTERNAL.
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Code: CodeDeadlineExceeded, Message: "deadline exceeded", Err: err}
+	case errors.Is(err, context.Canceled):
+		return &Error{Code: CodeUnavailable, Message: "request canceled", Err: err}
+	case errors.Is(err, gobreaker.ErrOpenState):
+		return &Error{Code: CodeUnavailable, Message: "circuit breaker is open", Err: err}
+	case errors.Is(err, gobreaker.ErrTooManyRequests):
+		return &Error{Code: CodeRateLimited, Message: "too many requests", Err: err}
+	}
+	return &Error{Code: CodeInternal, Message: "internal error", Err: err}
+}
+
+// problem is the problem+json (RFC 7807) body written for every error. The
+// legacy error/status_code/status_text fields are kept for older clients.
+type problem struct {
+	Type       string                 `json:"type"`
+	Title      string                 `json:"title"`
+	Status     int                    `json:"status"`
+	Detail     string                 `json:"detail"`
+	Code       Code                   `json:"code"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	Error      string                 `json:"error"`
+	StatusCode int                    `json:"status_code"`
+	StatusText string                 `json:"status_text"`
+}
+
+func newProblem(e *Error) problem {
+	status := e.HTTPStatus()
+	return problem{
+		Type:       "about:blank",
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     e.Message,
+		Code:       e.Code,
+		Details:    e.Details,
+		Error:      e.Message,
+		StatusCode: status,
+		StatusText: http.StatusText(status),
+	}
+}
@@ -0,0 +1,434 @@
+package catalogue
+
+// event_feed.go streams the catalogue events published by OutboxRelay to
+// browsers, as Server-Sent Events or over a WebSocket. Each replica reads the
+// event stream once and fans it out to its clients, so the feed works
+// whichever replica a write or a client lands on.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+// StreamEvent is an Event with its ID in the event stream, which clients
+// present to resume after it.
+type StreamEvent struct {
+	StreamID string
+	Event    Event
+}
+
+// EventReader reads the event stream. Stream IDs are Redis Stream IDs,
+// "<milliseconds>-<sequence>".
+type EventReader interface {
+	// Read waits up to block for events after the one with the given ID and
+	// returns up to count of them, oldest first.
+	Read(ctx context.Context, after string, count int64, block time.Duration) ([]StreamEvent, error)
+
+	// Range returns up to count events after the one with the given ID,
+	// oldest first, without waiting.
+	Range(ctx context.Context, after string, count int64) ([]StreamEvent, error)
+
+	// Last returns the ID of the newest event, or "0-0" if there is none.
+	Last(ctx context.Context) (string, error)
+}
+
+// RedisStreamReader reads the Redis Stream RedisStreamSink publishes to.
+type RedisStreamReader struct {
+	client redis.UniversalClient
+	stream string
+}
+
+// NewRedisStreamReader reads events from stream.
+func NewRedisStreamReader(client redis.UniversalClient, stream string) *RedisStreamReader {
+	return &RedisStreamReader{client: client, stream: stream}
+}
+
+func (r *RedisStreamReader) Read(ctx context.Context, after string, count int64, block time.Duration) ([]StreamEvent, error) {
+	streams, err := r.client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{r.stream, after},
+		Count:   count,
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		// Nothing came within block
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) == 0 {
+		return nil, nil
+	}
+	return decodeStreamEvents(streams[0].Messages), nil
+}
+
+func (r *RedisStreamReader) Range(ctx context.Context, after string, count int64) ([]StreamEvent, error) {
+	msgs, err := r.client.XRangeN(ctx, r.stream, nextStreamID(after), "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeStreamEvents(msgs), nil
+}
+
+func (r *RedisStreamReader) Last(ctx context.Context) (string, error) {
+	msgs, err := r.client.XRevRangeN(ctx, r.stream, "+", "-", 1).Result()
+	if err != nil || len(msgs) == 0 {
+		return "0-0", err
+	}
+	return msgs[0].ID, nil
+}
+
+// decodeStreamEvents decodes the event field of msgs, skipping entries
+// without a valid one.
+func decodeStreamEvents(msgs []redis.XMessage) []StreamEvent {
+	events := make([]StreamEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		data, _ := msg.Values["event"].(string)
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			continue
+		}
+		events = append(events, StreamEvent{StreamID: msg.ID, Event: e})
+	}
+	return events
+}
+
+// parseStreamID splits a stream ID into its milliseconds and sequence.
+func parseStreamID(id string) (ms, seq uint64, ok bool) {
+	i := strings.IndexByte(id, '-')
+	if i < 0 {
+		return 0, 0, false
+	}
+	ms, err1 := strconv.ParseUint(id[:i], 10, 64)
+	seq, err2 := strconv.ParseUint(id[i+1:], 10, 64)
+	return ms, seq, err1 == nil && err2 == nil
+}
+
+// nextStreamID returns the smallest ID after id, so that ranges starting from
+// it exclude id.
+func nextStreamID(id string) string {
+	ms, seq, _ := parseStreamID(id)
+	return fmt.Sprintf("%d-%d", ms, seq+1)
+}
+
+// streamIDAfter reports whether stream ID a comes after b.
+func streamIDAfter(a, b string) bool {
+	ams, aseq, _ := parseStreamID(a)
+	bms, bseq, _ := parseStreamID(b)
+	return ams > bms || ams == bms && aseq > bseq
+}
+
+// EventFilter selects the events of the given socks or tags. The zero filter
+// selects every event.
+type EventFilter struct {
+	IDs  []string
+	Tags []string
+}
+
+// Matches reports whether e is selected by the filter.
+func (f EventFilter) Matches(e Event) bool {
+	if len(f.IDs) == 0 && len(f.Tags) == 0 {
+		return true
+	}
+	if contains(f.IDs, e.SockID) {
+		return true
+	}
+	for _, t := range e.Tags {
+		if contains(f.Tags, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrFeedOverrun is returned by EventFeed.Stream when the client fell too far
+// behind; it should reconnect and resume from the last event it received.
+var ErrFeedOverrun = NewError(CodeUnavailable, "event feed client fell behind")
+
+// Defaults for NewEventFeed.
+const (
+	DefaultFeedHeartbeat = 15 * time.Second
+	DefaultFeedBuffer    = 64
+)
+
+// feedBatch is the number of events read from the stream at once.
+const feedBatch = 100
+
+// EventFeed fans the event stream out to its subscribers.
+type EventFeed struct {
+	reader    EventReader
+	logger    log.Logger
+	heartbeat time.Duration
+	buffer    int
+
+	mtx  sync.Mutex
+	subs map[chan StreamEvent]bool
+}
+
+// EventFeedOption configures an EventFeed.
+type EventFeedOption func(*EventFeed)
+
+// WithFeedHeartbeat sets how often idle clients are sent a heartbeat, to keep
+// proxies from closing their connections.
+func WithFeedHeartbeat(d time.Duration) EventFeedOption {
+	return func(f *EventFeed) {
+		f.heartbeat = d
+	}
+}
+
+// WithFeedBuffer sets how many events a client may fall behind before it is
+// disconnected.
+func WithFeedBuffer(n int) EventFeedOption {
+	return func(f *EventFeed) {
+		f.buffer = n
+	}
+}
+
+// NewEventFeed creates an EventFeed reading from reader. Run must be called
+// for it to see new events.
+func NewEventFeed(reader EventReader, logger log.Logger, opts ...EventFeedOption) *EventFeed {
+	f := &EventFeed{
+		reader:    reader,
+		logger:    logger,
+		heartbeat: DefaultFeedHeartbeat,
+		buffer:    DefaultFeedBuffer,
+		subs:      map[chan StreamEvent]bool{},
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Run reads new events and hands them to the subscribers until ctx is done.
+func (f *EventFeed) Run(ctx context.Context) error {
+	retry := func() error {
+		select {
+		case <-time.After(time.Second):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var last string
+	for {
+		var err error
+		if last, err = f.reader.Last(ctx); err == nil {
+			break
+		}
+		f.logger.Log("feed", "error", "operation", "Last", "error", err)
+		if err := retry(); err != nil {
+			return err
+		}
+	}
+	f.logger.Log("feed", "started", "position", last)
+	for {
+		events, err := f.reader.Read(ctx, last, feedBatch, 5*time.Second)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			f.logger.Log("feed", "error", "operation", "Read", "position", last, "error", err)
+			if err := retry(); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, e := range events {
+			f.broadcast(e)
+			last = e.StreamID
+		}
+	}
+}
+
+// broadcast hands e to every subscriber, dropping those whose buffer is full
+func (f *EventFeed) broadcast(e StreamEvent) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of the events read from now on, which is
+// closed when the subscriber falls behind, and a function to unsubscribe.
+func (f *EventFeed) subscribe() (<-chan StreamEvent, func()) {
+	ch := make(chan StreamEvent, f.buffer)
+	f.mtx.Lock()
+	f.subs[ch] = true
+	f.mtx.Unlock()
+	return ch, func() {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		if f.subs[ch] {
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Stream calls send with every event selected by filter until ctx is done or
+// send fails. With lastID set, the events after it still in the stream are
+// sent first. send is called with nil when no event has been sent for a
+// heartbeat interval.
+func (f *EventFeed) Stream(ctx context.Context, filter EventFilter, lastID string, send func(*StreamEvent) error) error {
+	// Subscribe before reading the backlog so that nothing falls between
+	live, unsubscribe := f.subscribe()
+	defer unsubscribe()
+
+	after := lastID
+	for after != "" {
+		events, err := f.reader.Range(ctx, after, feedBatch)
+		if err != nil {
+			return err
+		}
+		for i := range events {
+			if filter.Matches(events[i].Event) {
+				if err := send(&events[i]); err != nil {
+					return err
+				}
+			}
+			after = events[i].StreamID
+		}
+		if len(events) < feedBatch {
+			break
+		}
+	}
+
+	heartbeat := time.NewTicker(f.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-live:
+			if !ok {
+				return ErrFeedOverrun
+			}
+			if after != "" && !streamIDAfter(e.StreamID, after) || !filter.Matches(e.Event) {
+				continue
+			}
+			if err := send(&e); err != nil {
+				return err
+			}
+			heartbeat.Reset(f.heartbeat)
+		case <-heartbeat.C:
+			if err := send(nil); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// decodeFeedRequest reads the filter from the id and tags parameters and the
+// position to resume from from the Last-Event-ID header, or the lastEventId
+// parameter for clients that cannot set it.
+func decodeFeedRequest(r *http.Request) (EventFilter, string, error) {
+	filter := EventFilter{Tags: decodeTags(r)}
+	for _, id := range strings.Split(r.FormValue("id"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			filter.IDs = append(filter.IDs, id)
+		}
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.FormValue("lastEventId")
+	}
+	if _, _, ok := parseStreamID(lastID); lastID != "" && !ok {
+		return EventFilter{}, "", InvalidArgument("Last-Event-ID", lastID, "must be an event ID from this feed")
+	}
+	return filter, lastID, nil
+}
+
+// mountEventFeed adds the event feed routes to r:
+//
+// GET /catalogue/events?id=&tags=     Server-Sent Events
+// GET /catalogue/events/ws?id=&tags=  WebSocket, one JSON message per event
+func mountEventFeed(r *mux.Router, feed *EventFeed, logger log.Logger) {
+	r.Methods("GET").Path("/catalogue/events").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		filter, lastID, err := decodeFeedRequest(req)
+		if err != nil {
+			encodeError(req.Context(), err, w)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			encodeError(req.Context(), NewError(CodeInternal, "streaming is not supported"), w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // nginx
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 3000\n\n")
+		flusher.Flush()
+
+		err = feed.Stream(req.Context(), filter, lastID, func(e *StreamEvent) error {
+			if e == nil {
+				_, err := fmt.Fprint(w, ": heartbeat\n\n")
+				flusher.Flush()
+				return err
+			}
+			data, err := json.Marshal(e.Event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.StreamID, e.Event.Type, data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logger.Log("feed", "closed", "transport", "SSE", "error", err)
+		}
+	})
+	r.Methods("GET").Path("/catalogue/events/ws").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		filter, lastID, err := decodeFeedRequest(req)
+		if err != nil {
+			encodeError(req.Context(), err, w)
+			return
+		}
+		websocket.Server{Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			// The client sends nothing; reading notices it going away
+			ctx, cancel := context.WithCancel(req.Context())
+			defer cancel()
+			go func() {
+				var discard []byte
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+				cancel()
+			}()
+			err := feed.Stream(ctx, filter, lastID, func(e *StreamEvent) error {
+				if e == nil {
+					return nil
+				}
+				return websocket.JSON.Send(ws, struct {
+					ID    string `json:"id"`
+					Event Event  `json:"event"`
+				}{e.StreamID, e.Event})
+			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				logger.Log("feed", "closed", "transport", "WebSocket", "error", err)
+			}
+		}}.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,255 @@
+package catalogue
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/websocket"
+)
+
+// memoryStream is an EventReader over events added by the test.
+type memoryStream struct {
+	mtx    sync.Mutex
+	events []StreamEvent
+}
+
+func (m *memoryStream) add(sockID string, tags ...string) StreamEvent {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	e := StreamEvent{
+		StreamID: fmt.Sprintf("%d-0", len(m.events)+1),
+		Event:    Event{ID: fmt.Sprintf("event-%d", len(m.events)+1), Type: EventStockChanged, SockID: sockID, Tags: tags},
+	}
+	m.events = append(m.events, e)
+	return e
+}
+
+func (m *memoryStream) Range(_ context.Context, after string, count int64) ([]StreamEvent, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var events []StreamEvent
+	for _, e := range m.events {
+		if streamIDAfter(e.StreamID, after) && int64(len(events)) < count {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m *memoryStream) Read(ctx context.Context, after string, count int64, block time.Duration) ([]StreamEvent, error) {
+	deadline := time.Now().Add(block)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		if events, _ := m.Range(ctx, after, count); len(events) > 0 {
+			return events, nil
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	return nil, nil
+}
+
+func (m *memoryStream) Last(ctx context.Context) (string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if len(m.events) == 0 {
+		return "0-0", nil
+	}
+	return m.events[len(m.events)-1].StreamID, nil
+}
+
+func newFeedServer(t *testing.T, stream *memoryStream, opts ...EventFeedOption) (*EventFeed, *httptest.Server) {
+	ctx, cancel := context.WithCancel(context.Background())
+	feed := NewEventFeed(stream, log.NewNopLogger(), opts...)
+	go feed.Run(ctx)
+	server := httptest.NewServer(MakeHTTPHandler(ctx, MakeEndpoints(&stubService{}), "", log.NewNopLogger(), WithEventFeed(feed)))
+	t.Cleanup(func() {
+		cancel()
+		server.CloseClientConnections()
+		server.Close()
+	})
+	return feed, server
+}
+
+// waitForSubscribers waits until the feed has n subscribers.
+func waitForSubscribers(t *testing.T, feed *EventFeed, n int) {
+	for i := 0; i < 200; i++ {
+		feed.mtx.Lock()
+		have := len(feed.subs)
+		feed.mtx.Unlock()
+		if have == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("want %d feed subscribers", n)
+}
+
+func TestEventFeedSSE(t *testing.T) {
+	stream := &memoryStream{}
+	stream.add("old", "brown")    // 1-0, before Last-Event-ID
+	stream.add("missed", "brown") // 2-0, in the backlog
+	stream.add("other", "blue")   // 3-0, filtered out
+	feed, server := newFeedServer(t, stream)
+
+	req, _ := http.NewRequest("GET", server.URL+"/catalogue/events?tags=brown&id=by-id", nil)
+	req.Header.Set("Last-Event-ID", "1-0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("GET /catalogue/events: want an event stream, have %d %s", resp.StatusCode, ct)
+	}
+	waitForSubscribers(t, feed, 1)
+	stream.add("by-id")
+	stream.add("live", "blue", "brown")
+
+	events := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "id: ") || strings.HasPrefix(line, "data: ") {
+				events <- line
+			}
+		}
+		close(events)
+	}()
+	for _, want := range []string{"id: 2-0", `"sockId":"missed"`, "id: 4-0", `"sockId":"by-id"`, "id: 5-0", `"sockId":"live"`} {
+		select {
+		case line := <-events:
+			if !strings.Contains(line, want) {
+				t.Errorf("GET /catalogue/events: want %s, have %s", want, line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("GET /catalogue/events: want %s, have nothing", want)
+		}
+	}
+
+	resp, err = http.Get(server.URL + "/catalogue/events?lastEventId=yesterday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("GET /catalogue/events with a bad Last-Event-ID: want 400, have %d", resp.StatusCode)
+	}
+}
+
+func TestEventFeedWebSocket(t *testing.T) {
+	stream := &memoryStream{}
+	stream.add("old")
+	feed, server := newFeedServer(t, stream)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/catalogue/events/ws?id=mine", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	waitForSubscribers(t, feed, 1)
+	stream.add("theirs")
+	stream.add("mine")
+
+	var msg struct {
+		ID    string `json:"id"`
+		Event Event  `json:"event"`
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if msg.ID != "3-0" || msg.Event.SockID != "mine" {
+		t.Errorf("Receive: want event 3-0 of mine, have %+v", msg)
+	}
+}
+
+func TestEventFeedOverrun(t *testing.T) {
+	stream := &memoryStream{}
+	feed := NewEventFeed(stream, log.NewNopLogger(), WithFeedBuffer(1), WithFeedHeartbeat(time.Hour))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A client stuck sending its first event falls behind
+	stuck := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- feed.Stream(ctx, EventFilter{}, "", func(*StreamEvent) error {
+			<-stuck
+			return nil
+		})
+	}()
+	waitForSubscribers(t, feed, 1)
+	for i := 0; i < 3; i++ {
+		feed.broadcast(stream.add("sock"))
+	}
+	close(stuck)
+	select {
+	case err := <-done:
+		if err != ErrFeedOverrun {
+			t.Errorf("Stream of a slow client: want %v, have %v", ErrFeedOverrun, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Stream of a slow client: still running")
+	}
+	waitForSubscribers(t, feed, 0)
+}
+
+// failingStream is an EventReader whose reads fail, counting them.
+type failingStream struct {
+	memoryStream
+	reads int32
+}
+
+func (f *failingStream) Read(context.Context, string, int64, time.Duration) ([]StreamEvent, error) {
+	atomic.AddInt32(&f.reads, 1)
+	return nil, errors.New("connection refused")
+}
+
+func TestEventFeedBacksOff(t *testing.T) {
+	stream := &failingStream{}
+	feed := NewEventFeed(stream, log.NewNopLogger())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := feed.Run(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Run: want %v, have %v", context.DeadlineExceeded, err)
+	}
+	// It waits a second after a failed read
+	if reads := atomic.LoadInt32(&stream.reads); reads != 1 {
+		t.Errorf("Run with a failing reader: want 1 read, have %d", reads)
+	}
+}
+
+func TestRedisStreamReader(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newMiniredis(t)
+	reader := NewRedisStreamReader(client, DefaultEventStream)
+
+	if events, err := reader.Read(ctx, "0-0", 10, 10*time.Millisecond); err != nil || len(events) != 0 {
+		t.Errorf("Read of an empty stream: want nothing, have %v, %v", events, err)
+	}
+	e, _ := newEvent(EventStockChanged, s1.ID, s1.Tags, StockChange{Previous: 1, Count: 0})
+	if err := NewRedisStreamSink(client, DefaultEventStream, 0).Publish(ctx, []Event{e}); err != nil {
+		t.Fatal(err)
+	}
+	events, err := reader.Read(ctx, "0-0", 10, 10*time.Millisecond)
+	if err != nil || len(events) != 1 || events[0].Event.ID != e.ID {
+		t.Fatalf("Read: want %s, have %v, %v", e.ID, events, err)
+	}
+	if last, err := reader.Last(ctx); err != nil || last != events[0].StreamID {
+		t.Errorf("Last: want %s, have %s, %v", events[0].StreamID, last, err)
+	}
+
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	if _, err := reader.Read(ctx, "0-0", 10, 10*time.Millisecond); err == nil {
+		t.Errorf("Read from a failing Redis: want error, have nil")
+	}
+}
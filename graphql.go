@@ -0,0 +1,750 @@
+package catalogue
+
+// graphql.go contains the GraphQL endpoint, which answers in one request what
+// a page of the frontend asks of /catalogue, /catalogue/size and /tags. Its
+// fields are resolved through a Service, so CachedService caches them as it
+// does the REST routes; the socks asked for by id are got together with
+// GetSocks; and queries deeper or more complex than the limits are turned
+// away before anything is resolved.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/sony/gobreaker"
+	"golang.org/x/net/context"
+)
+
+// Defaults of the limits of GraphQL queries.
+const (
+	// DefaultGraphQLMaxDepth is how deeply fields may nest: the name of the
+	// tags of a sock is three deep.
+	DefaultGraphQLMaxDepth = 6
+	// DefaultGraphQLMaxComplexity is how many fields a query may resolve,
+	// those within lists counted once for every element the lists may have.
+	DefaultGraphQLMaxComplexity = 2000
+)
+
+// graphqlListSize is the number of elements a list is costed at unless its
+// pageSize or ids say how long it is, or it is a list of tags.
+const graphqlListSize = 10
+
+// graphqlMaxBodySize is the largest GraphQL request read.
+const graphqlMaxBodySize = 1 << 20
+
+// GraphQLOption configures the endpoint made by MakeGraphQLEndpoint.
+type GraphQLOption func(*graphqlLimits)
+
+type graphqlLimits struct {
+	maxDepth      int
+	maxComplexity int
+}
+
+// WithGraphQLMaxDepth turns away queries whose fields nest deeper than depth.
+func WithGraphQLMaxDepth(depth int) GraphQLOption {
+	return func(l *graphqlLimits) {
+		l.maxDepth = depth
+	}
+}
+
+// WithGraphQLMaxComplexity turns away queries that may resolve more than
+// complexity fields. A field costs one, plus the cost of its own fields; the
+// fields of a list cost as much again for every element: pageSize of them,
+// the number of ids, the number of tags there are for lists of tags, or ten.
+func WithGraphQLMaxComplexity(complexity int) GraphQLOption {
+	return func(l *graphqlLimits) {
+		l.maxComplexity = complexity
+	}
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// MakeGraphQLEndpoint returns an endpoint answering GraphQL queries of the
+// catalogue with s. Its responses are *graphql.Result, errors included.
+func MakeGraphQLEndpoint(s Service, opts ...GraphQLOption) endpoint.Endpoint {
+	limits := graphqlLimits{
+		maxDepth:      DefaultGraphQLMaxDepth,
+		maxComplexity: DefaultGraphQLMaxComplexity,
+	}
+	for _, opt := range opts {
+		opt(&limits)
+	}
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		// The schema is the same every time; this is a bug
+		panic(err)
+	}
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(graphqlRequest)
+		doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+		if err != nil {
+			return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}, nil
+		}
+		if v := graphql.ValidateDocument(&schema, doc, graphql.SpecifiedRules); !v.IsValid {
+			return &graphql.Result{Errors: v.Errors}, nil
+		}
+		state := &graphqlState{service: s}
+		state.loader = &sockLoader{state: state, loaded: map[string]error{}, socks: map[string]Sock{}}
+		if err := limits.check(&schema, doc, req.OperationName, req.Variables, state.tagCount); err != nil {
+			return &graphql.Result{Errors: graphqlErrors(gqlerrors.FormatErrors(err))}, nil
+		}
+		result := graphql.Execute(graphql.ExecuteParams{
+			Schema:        schema,
+			AST:           doc,
+			OperationName: req.OperationName,
+			Args:          req.Variables,
+			Context:       context.WithValue(ctx, graphqlStateKey{}, state),
+		})
+		result.Errors = graphqlErrors(result.Errors)
+		if state.stale {
+			result.Extensions = map[string]interface{}{"stale": true}
+		}
+		return result, nil
+	}
+}
+
+// graphqlBreaker guards a GraphQL endpoint with cb. Its errors are in its
+// results rather than returned, so the first error of a result that would
+// count against a REST route's breaker counts against cb; the result is
+// answered all the same. Once cb is open, queries fail as the REST routes do.
+func graphqlBreaker(cb *gobreaker.CircuitBreaker) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			var response interface{}
+			_, err := cb.Execute(func() (interface{}, error) {
+				var err error
+				if response, err = next(ctx, request); err != nil {
+					return nil, err
+				}
+				if result, ok := response.(*graphql.Result); ok {
+					for _, fe := range result.Errors {
+						if e := catalogueError(fe); e != nil && isServerError(e) {
+							return nil, e
+						}
+					}
+				}
+				return nil, nil
+			})
+			if response == nil {
+				return nil, err
+			}
+			return response, nil
+		}
+	}
+}
+
+// decodeGraphQLRequest reads a query from the query, variables and
+// operationName parameters of a GET, or from the JSON object of a POST.
+func decodeGraphQLRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req graphqlRequest
+	if r.Method == "GET" {
+		req.Query = r.FormValue("query")
+		req.OperationName = r.FormValue("operationName")
+		if v := r.FormValue("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return nil, InvalidArgument("variables", v, "must be a JSON object")
+			}
+		}
+	} else {
+		r.Body = http.MaxBytesReader(nil, r.Body, graphqlMaxBodySize)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, NewError(CodeTooLarge, "request too large").WithDetails("limit", graphqlMaxBodySize)
+			}
+			return nil, InvalidArgument("body", "", err.Error())
+		}
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		return nil, InvalidArgument("query", req.Query, "must not be empty")
+	}
+	return req, nil
+}
+
+// encodeGraphQLResponse writes the result of a query, which is a 200 whether
+// or not it has errors, as GraphQL over HTTP has it.
+func encodeGraphQLResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	return encodeResponse(ctx, w, response)
+}
+
+// graphqlErrors gives the errors of errs that are the catalogue's the message
+// and code of their *Error, without its cause, under extensions as problem
+// responses have them.
+func graphqlErrors(errs []gqlerrors.FormattedError) []gqlerrors.FormattedError {
+	for i, fe := range errs {
+		e := catalogueError(fe)
+		if e == nil {
+			continue
+		}
+		errs[i].Message = e.Message
+		errs[i].Extensions = map[string]interface{}{"code": e.Code}
+		if len(e.Details) > 0 {
+			errs[i].Extensions["details"] = e.Details
+		}
+	}
+	return errs
+}
+
+// catalogueError returns the *Error that err wraps, looking through the
+// errors graphql-go wraps resolver errors in, or nil if there is none.
+func catalogueError(err error) *Error {
+	for err != nil {
+		var e *Error
+		if errors.As(err, &e) {
+			return e
+		}
+		switch wrapper := err.(type) {
+		case gqlerrors.FormattedError:
+			err = wrapper.OriginalError()
+		case *gqlerrors.Error:
+			err = wrapper.OriginalError
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+type graphqlStateKey struct{}
+
+// graphqlState is what the resolvers of a query share. Queries are resolved
+// one field at a time, so it needs no locking.
+type graphqlState struct {
+	service Service
+	loader  *sockLoader
+	stale   bool // some answer was a stale copy
+
+	tags       []string // every tag, once tagsLoaded
+	tagsErr    error
+	tagsLoaded bool
+}
+
+func stateOf(ctx context.Context) *graphqlState {
+	return ctx.Value(graphqlStateKey{}).(*graphqlState)
+}
+
+// result returns err as the error of a field, except for ErrStale, whose
+// answer is used and only marks the response as stale.
+func (st *graphqlState) result(err error) error {
+	if errors.Is(err, ErrStale) {
+		st.stale = true
+		return nil
+	}
+	if err != nil {
+		return AsError(err)
+	}
+	return nil
+}
+
+// allTags returns every tag, asking the service only once a query.
+func (st *graphqlState) allTags() ([]string, error) {
+	if !st.tagsLoaded {
+		tags, err := st.service.Tags()
+		st.tags, st.tagsErr, st.tagsLoaded = tags, st.result(err), true
+	}
+	return st.tags, st.tagsErr
+}
+
+// tagCount returns the number of tags there are, which no list of tags is
+// longer than, or graphqlListSize if they cannot be had.
+func (st *graphqlState) tagCount() int {
+	tags, err := st.allTags()
+	if err != nil {
+		return graphqlListSize
+	}
+	return len(tags)
+}
+
+// sockLoader gets the socks asked for by id in a query together. The ids are
+// queued as their fields are resolved, which returns a thunk; graphql-go
+// resolves the thunks after the fields around them, by which time the ids of
+// those fields are queued too, and the first thunk gets them all with one
+// GetSocks.
+type sockLoader struct {
+	state  *graphqlState
+	queued []string
+	loaded map[string]error // by id, nil once loaded without error
+	socks  map[string]Sock
+}
+
+func (l *sockLoader) queue(ids ...string) {
+	for _, id := range ids {
+		if _, ok := l.loaded[id]; !ok && !contains(l.queued, id) {
+			l.queued = append(l.queued, id)
+		}
+	}
+}
+
+// get returns the sock of id, or nil if there is none, getting the socks
+// queued if it is one of them.
+func (l *sockLoader) get(id string) (interface{}, error) {
+	if len(l.queued) > 0 {
+		ids := l.queued
+		l.queued = nil
+		socks, err := GetSocks(l.state.service, ids)
+		err = l.state.result(err)
+		for _, sock := range socks {
+			l.socks[sock.ID] = sock
+		}
+		for _, id := range ids {
+			l.loaded[id] = err
+		}
+	}
+	if err := l.loaded[id]; err != nil {
+		return nil, err
+	}
+	if sock, ok := l.socks[id]; ok {
+		return sock, nil
+	}
+	return nil, nil
+}
+
+func newGraphQLSchema() (graphql.Schema, error) {
+	// Socks have tags, which are made after them: their fields are a thunk
+	// so that they can refer to them
+	var sockType, tagType *graphql.Object
+	variantType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Variant",
+		Fields: graphql.Fields{
+			"sku":    {Type: graphql.NewNonNull(graphql.String)},
+			"size":   {Type: graphql.String},
+			"colour": {Type: graphql.String},
+			"price": {
+				Type:        graphql.Float,
+				Description: "Overrides the price of the sock",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if price := p.Source.(Variant).Price; price != nil {
+						return price.Float(), nil
+					}
+					return nil, nil
+				},
+			},
+			"count": {Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+	imageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Image",
+		Fields: graphql.Fields{
+			"url":     {Type: graphql.NewNonNull(graphql.String)},
+			"alt":     {Type: graphql.String},
+			"width":   {Type: graphql.Int},
+			"height":  {Type: graphql.Int},
+			"primary": {Type: graphql.NewNonNull(graphql.Boolean)},
+		},
+	})
+	sockType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Sock",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":          {Type: graphql.NewNonNull(graphql.ID)},
+				"name":        {Type: graphql.NewNonNull(graphql.String)},
+				"description": {Type: graphql.NewNonNull(graphql.String)},
+				"imageUrl": {
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if urls := p.Source.(Sock).ImageURL; urls != nil {
+							return urls, nil
+						}
+						return []string{}, nil
+					},
+				},
+				"price": {
+					Type: graphql.NewNonNull(graphql.Float),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(Sock).Price.Float(), nil
+					},
+				},
+				"count": {Type: graphql.NewNonNull(graphql.Int)},
+				"tags": {
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(tagType))),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if tags := p.Source.(Sock).Tags; tags != nil {
+							return tags, nil
+						}
+						return []string{}, nil
+					},
+				},
+				"variants": {
+					Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(variantType))),
+					Description: "The variants of the sock, only those of the size variant if it is given",
+					Args: graphql.FieldConfigArgument{
+						"variant": {Type: graphql.String},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						size, err := variantArg(p)
+						if err != nil {
+							return nil, err
+						}
+						variants := []Variant{}
+						for _, v := range p.Source.(Sock).Variants {
+							if size == "" || v.Size == size {
+								variants = append(variants, v)
+							}
+						}
+						return variants, nil
+					},
+				},
+				"images": {
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(imageType))),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if images := p.Source.(Sock).Images; images != nil {
+							return images, nil
+						}
+						return []Image{}, nil
+					},
+				},
+				"updatedAt": {Type: graphql.DateTime},
+			}
+		}),
+	})
+	tagType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Tag",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"name": {
+					Type: graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+				},
+				"count": {
+					Type: graphql.NewNonNull(graphql.Int),
+					Args: graphql.FieldConfigArgument{
+						"variant": {Type: graphql.String},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return resolveCount(p, []string{p.Source.(string)})
+					},
+				},
+			}
+		}),
+	})
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"socks": {
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(sockType))),
+				Description: "A page of the socks with any of tags, or of all of them, as GET /catalogue",
+				Args:        listArguments(),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return resolveList(p, stringsArg(p, "tags"))
+				},
+			},
+			"count": {
+				Type:        graphql.NewNonNull(graphql.Int),
+				Description: "The number of socks with any of tags, or of all of them, as GET /catalogue/size",
+				Args: graphql.FieldConfigArgument{
+					"tags":    {Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+					"variant": {Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return resolveCount(p, stringsArg(p, "tags"))
+				},
+			},
+			"sock": {
+				Type:        sockType,
+				Description: "The sock of id, or null if there is none, as GET /catalogue/{id}",
+				Args: graphql.FieldConfigArgument{
+					"id": {Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					loader := stateOf(p.Context).loader
+					loader.queue(id)
+					return func() (interface{}, error) {
+						return loader.get(id)
+					}, nil
+				},
+			},
+			"socksById": {
+				Type:        graphql.NewNonNull(graphql.NewList(sockType)),
+				Description: "The socks of ids, in their order, with null for those there are none of",
+				Args: graphql.FieldConfigArgument{
+					"ids": {Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.ID)))},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					ids := stringsArg(p, "ids")
+					loader := stateOf(p.Context).loader
+					loader.queue(ids...)
+					return func() (interface{}, error) {
+						socks := make([]interface{}, len(ids))
+						for i, id := range ids {
+							sock, err := loader.get(id)
+							if err != nil {
+								return nil, err
+							}
+							socks[i] = sock
+						}
+						return socks, nil
+					}, nil
+				},
+			},
+			"tags": {
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(tagType))),
+				Description: "Every tag, as GET /tags",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					tags, err := stateOf(p.Context).allTags()
+					if err != nil {
+						return nil, err
+					}
+					return tags, nil
+				},
+			},
+		},
+	})
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// listArguments are the arguments of the fields that list socks, as the
+// parameters of GET /catalogue.
+func listArguments() graphql.FieldConfigArgument {
+	return graphql.FieldConfigArgument{
+		"tags":     {Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+		"variant":  {Type: graphql.String, Description: "Only socks that come in this size"},
+		"order":    {Type: graphql.String, DefaultValue: "id"},
+		"page":     {Type: graphql.Int, DefaultValue: 1},
+		"pageSize": {Type: graphql.Int, DefaultValue: 10},
+	}
+}
+
+func resolveList(p graphql.ResolveParams, tags []string) (interface{}, error) {
+	size, err := variantArg(p)
+	if err != nil {
+		return nil, err
+	}
+	page, pageSize := p.Args["page"].(int), p.Args["pageSize"].(int)
+	if page < 1 {
+		return nil, InvalidArgument("page", strconv.Itoa(page), "must be greater than zero")
+	}
+	if pageSize < 1 {
+		return nil, InvalidArgument("pageSize", strconv.Itoa(pageSize), "must be greater than zero")
+	}
+	order := strings.ToLower(p.Args["order"].(string))
+	state := stateOf(p.Context)
+	socks, err := state.service.List(Filter{Tags: tags, VariantSize: size}, order, page, pageSize)
+	if err := state.result(err); err != nil {
+		return nil, err
+	}
+	return socks, nil
+}
+
+func resolveCount(p graphql.ResolveParams, tags []string) (interface{}, error) {
+	size, err := variantArg(p)
+	if err != nil {
+		return nil, err
+	}
+	state := stateOf(p.Context)
+	n, err := state.service.Count(Filter{Tags: tags, VariantSize: size})
+	if err := state.result(err); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// variantArg returns the variant argument of p, the size of a variant, as
+// decodeVariantSize does the variant parameter.
+func variantArg(p graphql.ResolveParams) (string, error) {
+	variant, _ := p.Args["variant"].(string)
+	size, err := parseVariantSize(variant)
+	if err != nil {
+		return "", InvalidArgument("variant", variant, "must be a sock size such as S, M or L")
+	}
+	return size, nil
+}
+
+// stringsArg returns the list of strings argument name of p, without the
+// empty ones.
+func stringsArg(p graphql.ResolveParams, name string) []string {
+	values, _ := p.Args[name].([]interface{})
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return grpcTags(strs)
+}
+
+// check returns an error if the operation of doc is deeper or more complex
+// than the limits. doc must be valid. tagCount is called for the length of
+// lists of tags, if the query has any.
+func (l graphqlLimits) check(schema *graphql.Schema, doc *ast.Document, operationName string, variables map[string]interface{}, tagCount func() int) error {
+	c := queryCost{schema: schema, fragments: map[string]*ast.FragmentDefinition{}, variables: variables, defaults: map[string]ast.Value{}, tagCount: tagCount}
+	var op *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.OperationDefinition:
+			if operationName == "" || def.Name != nil && def.Name.Value == operationName {
+				op = def
+			}
+		case *ast.FragmentDefinition:
+			c.fragments[def.Name.Value] = def
+		}
+	}
+	if op == nil || op.Operation != ast.OperationTypeQuery {
+		// Execute says what is wrong with it
+		return nil
+	}
+	for _, v := range op.VariableDefinitions {
+		if v.DefaultValue != nil {
+			c.defaults[v.Variable.Name.Value] = v.DefaultValue
+		}
+	}
+	depth, complexity := c.selections(schema.QueryType(), op.SelectionSet)
+	if depth > l.maxDepth {
+		return NewError(CodeTooLarge, fmt.Sprintf("query is %d fields deep, more than %d", depth, l.maxDepth)).
+			WithDetails("depth", depth).WithDetails("limit", l.maxDepth)
+	}
+	if complexity > l.maxComplexity {
+		return NewError(CodeTooLarge, fmt.Sprintf("query has a complexity of %d, more than %d", complexity, l.maxComplexity)).
+			WithDetails("complexity", complexity).WithDetails("limit", l.maxComplexity)
+	}
+	return nil
+}
+
+// maxQueryCost bounds the complexity of fields, which could otherwise
+// overflow with page sizes large enough.
+const maxQueryCost = 1 << 40
+
+// queryCost works out the depth and complexity of queries, see
+// WithGraphQLMaxComplexity.
+type queryCost struct {
+	schema    *graphql.Schema
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	defaults  map[string]ast.Value // of the variables
+	tagCount  func() int
+}
+
+func (c queryCost) selections(parent *graphql.Object, set *ast.SelectionSet) (depth, complexity int) {
+	if set == nil {
+		return 0, 0
+	}
+	for _, selection := range set.Selections {
+		var d, n int
+		switch s := selection.(type) {
+		case *ast.Field:
+			d, n = c.field(parent, s)
+		case *ast.InlineFragment:
+			d, n = c.selections(c.typeCondition(parent, s.TypeCondition), s.SelectionSet)
+		case *ast.FragmentSpread:
+			if f, ok := c.fragments[s.Name.Value]; ok {
+				d, n = c.selections(c.typeCondition(parent, f.TypeCondition), f.SelectionSet)
+			}
+		}
+		depth = max(depth, d)
+		complexity = min(complexity+n, maxQueryCost)
+	}
+	return depth, complexity
+}
+
+func (c queryCost) field(parent *graphql.Object, f *ast.Field) (depth, complexity int) {
+	// Introspection is answered from the schema
+	if strings.HasPrefix(f.Name.Value, "__") {
+		return 0, 0
+	}
+	def, ok := parent.Fields()[f.Name.Value]
+	if !ok {
+		return 1, 1
+	}
+	t, list := def.Type, false
+	if nonNull, ok := t.(*graphql.NonNull); ok {
+		t = nonNull.OfType
+	}
+	if l, ok := t.(*graphql.List); ok {
+		t, list = l.OfType, true
+		if nonNull, ok := t.(*graphql.NonNull); ok {
+			t = nonNull.OfType
+		}
+	}
+	var d, n int
+	if object, ok := t.(*graphql.Object); ok {
+		d, n = c.selections(object, f.SelectionSet)
+	}
+	if list {
+		n *= c.listSize(f, t)
+	}
+	return d + 1, min(1+n, maxQueryCost)
+}
+
+// listSize returns the number of elements the list of f, of elements of t,
+// may have.
+func (c queryCost) listSize(f *ast.Field, t graphql.Type) int {
+	for _, arg := range f.Arguments {
+		switch arg.Name.Value {
+		case "pageSize":
+			if n, ok := c.intValue(arg.Value); ok {
+				return max(0, min(n, 1<<20))
+			}
+		case "ids":
+			return c.listLength(arg.Value)
+		}
+	}
+	if t.Name() == "Tag" {
+		return c.tagCount()
+	}
+	return graphqlListSize
+}
+
+// value returns the value of v if it is a variable: from the variables, as
+// JSON, or its default, as an ast.Value.
+func (c queryCost) value(v ast.Value) interface{} {
+	variable, ok := v.(*ast.Variable)
+	if !ok {
+		return v
+	}
+	if value, ok := c.variables[variable.Name.Value]; ok {
+		return value
+	}
+	if value, ok := c.defaults[variable.Name.Value]; ok {
+		return value
+	}
+	return nil
+}
+
+func (c queryCost) intValue(v ast.Value) (int, bool) {
+	switch v := c.value(v).(type) {
+	case *ast.IntValue:
+		n, err := strconv.Atoi(v.Value)
+		return n, err == nil
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
+
+func (c queryCost) listLength(v ast.Value) int {
+	switch v := c.value(v).(type) {
+	case *ast.ListValue:
+		return len(v.Values)
+	case []interface{}:
+		return len(v)
+	}
+	// A single value is a list of one
+	return 1
+}
+
+// typeCondition returns the object type named by a fragment's type
+// condition, or parent if there is none.
+func (c queryCost) typeCondition(parent *graphql.Object, named *ast.Named) *graphql.Object {
+	if named == nil {
+		return parent
+	}
+	if object, ok := c.schema.Type(named.Name.Value).(*graphql.Object); ok {
+		return object
+	}
+	return parent
+}
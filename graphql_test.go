@@ -0,0 +1,261 @@
+package catalogue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+)
+
+type graphqlResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Path       []interface{}          `json:"path"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+// postGraphQL posts query with variables to the GraphQL route of a handler
+// of s.
+func postGraphQL(t *testing.T, s Service, query string, variables map[string]interface{}, opts ...GraphQLOption) graphqlResponse {
+	t.Helper()
+	body, _ := json.Marshal(graphqlRequest{Query: query, Variables: variables})
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(s), "", log.NewNopLogger(), WithGraphQL(MakeGraphQLEndpoint(s, opts...)))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/graphql", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /graphql: want 200, have %d %s", rec.Code, rec.Body)
+	}
+	var resp graphqlResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("POST /graphql: %v: %s", err, rec.Body)
+	}
+	return resp
+}
+
+func TestGraphQL(t *testing.T) {
+	price := Price(250)
+	sock := s1
+	sock.Variants = []Variant{{SKU: "1-M", Size: "M", Count: 3}, {SKU: "1-L", Size: "L", Price: &price, Count: 1}}
+	s := &stubService{socks: map[string]Sock{sock.ID: sock}}
+
+	resp := postGraphQL(t, s, `query Page($id: ID!) {
+		socks(tags: ["odd"], pageSize: 6) { id name price imageUrl tags { name } }
+		count
+		tags { name count(variant: "m") }
+		sock(id: $id) { name variants(variant: "l") { sku price count } images { url } }
+		missing: sock(id: "missing") { id }
+	}`, map[string]interface{}{"id": sock.ID})
+	if len(resp.Errors) > 0 {
+		t.Fatalf("want no errors, have %+v", resp.Errors)
+	}
+	for field, want := range map[string]string{
+		"socks":   `[{"id":"1","imageUrl":["ImageUrl_11","ImageUrl_21"],"name":"name1","price":1.1,"tags":[{"name":"odd"},{"name":"prime"}]}]`,
+		"count":   `1`,
+		"tags":    `[{"count":1,"name":"brown"}]`,
+		"sock":    `{"images":[],"name":"name1","variants":[{"count":1,"price":2.5,"sku":"1-L"}]}`,
+		"missing": `null`,
+	} {
+		if have := string(resp.Data[field]); have != want {
+			t.Errorf("%s: want %s, have %s", field, want, have)
+		}
+	}
+
+	// Over GET
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(s), "", log.NewNopLogger(), WithGraphQL(MakeGraphQLEndpoint(s)))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(`{ count }`), nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"count":1`) {
+		t.Errorf("GET /graphql: want the count, have %d %s", rec.Code, rec.Body)
+	}
+
+	// Requests that are not GraphQL at all
+	for name, req := range map[string]*http.Request{
+		"no query":     httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query": ""}`)),
+		"not JSON":     httptest.NewRequest("POST", "/graphql", strings.NewReader(`{ count }`)),
+		"bad variable": httptest.NewRequest("GET", "/graphql?query=%7Bcount%7D&variables=nonsense", nil),
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: want 400, have %d %s", name, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestGraphQLBatchesSocks(t *testing.T) {
+	s := &multiGetService{stubService: &stubService{socks: map[string]Sock{s1.ID: s1, s2.ID: s2, s3.ID: s3}}}
+	resp := postGraphQL(t, s, `{
+		a: sock(id: "1") { name }
+		b: sock(id: "2") { name }
+		c: sock(id: "1") { id }
+		d: sock(id: "missing") { id }
+		socksById(ids: ["3", "missing", "2"]) { id }
+	}`, nil)
+	if len(resp.Errors) > 0 {
+		t.Fatalf("want no errors, have %+v", resp.Errors)
+	}
+	if len(s.batches) == 1 {
+		sort.Strings(s.batches[0])
+	}
+	if want := [][]string{{"1", "2", "3", "missing"}}; !reflect.DeepEqual(s.batches, want) || s.gets != 0 {
+		t.Errorf("want the socks got at once as %v, have %v and %d Gets", want, s.batches, s.gets)
+	}
+	if have := string(resp.Data["socksById"]); have != `[{"id":"3"},null,{"id":"2"}]` {
+		t.Errorf("socksById: want socks 3 and 2 around a null, have %s", have)
+	}
+	if have := string(resp.Data["b"]); have != `{"name":"name2"}` {
+		t.Errorf("b: want name2, have %s", have)
+	}
+
+	// Services that cannot are asked for a sock at a time
+	stub := &stubService{socks: map[string]Sock{s1.ID: s1}}
+	resp = postGraphQL(t, stub, `{ a: sock(id: "1") { id } b: sock(id: "2") { id } }`, nil)
+	if string(resp.Data["a"]) != `{"id":"1"}` || string(resp.Data["b"]) != `null` {
+		t.Errorf("without GetMany: want sock 1 and null, have %s", resp.Data)
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	s := &stubService{socks: map[string]Sock{s1.ID: s1}}
+	deep := `{ socks { tags { name } } }`
+	resp := postGraphQL(t, s, deep, nil, WithGraphQLMaxDepth(2))
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != string(CodeTooLarge) || resp.Data != nil {
+		t.Errorf("3 deep with a limit of 2: want %s and no data, have %+v", CodeTooLarge, resp)
+	}
+	if resp := postGraphQL(t, s, deep, nil, WithGraphQLMaxDepth(3)); len(resp.Errors) > 0 {
+		t.Errorf("3 deep with a limit of 3: want no errors, have %+v", resp.Errors)
+	}
+
+	for name, c := range map[string]struct {
+		query     string
+		variables map[string]interface{}
+		want      int
+	}{
+		"scalars":      {`{ count tags { name } }`, nil, 1 + 1 + 1*1},
+		"page size":    {`{ socks(pageSize: 100) { id name } }`, nil, 1 + 100*2},
+		"default page": {`{ socks { id tags { name } } }`, nil, 1 + 10*(1+1+1*1)},
+		"variable":     {`query($n: Int) { socks(pageSize: $n) { id } }`, map[string]interface{}{"n": 50}, 1 + 50},
+		"default":      {`query($n: Int = 30) { socks(pageSize: $n) { id } }`, nil, 1 + 30},
+		"ids":          {`{ socksById(ids: ["1", "2", "3"]) { id name } }`, nil, 1 + 3*2},
+		"fragments":    {`{ sock(id: "1") { ...f ... on Sock { name } } } fragment f on Sock { id }`, nil, 1 + 2},
+		"introspected": {`{ __typename sock(id: "1") { id } }`, nil, 1 + 1},
+	} {
+		resp := postGraphQL(t, s, c.query, c.variables, WithGraphQLMaxComplexity(c.want))
+		if len(resp.Errors) > 0 {
+			t.Errorf("%s with a limit of %d: want no errors, have %+v", name, c.want, resp.Errors)
+		}
+		resp = postGraphQL(t, s, c.query, c.variables, WithGraphQLMaxComplexity(c.want-1))
+		if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != string(CodeTooLarge) {
+			t.Errorf("%s with a limit of %d: want %s, have %+v", name, c.want-1, CodeTooLarge, resp.Errors)
+		}
+	}
+}
+
+func TestGraphQLBreaker(t *testing.T) {
+	s := &stubService{err: ErrDBConnection}
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(s), "", log.NewNopLogger(),
+		WithGraphQL(MakeGraphQLEndpoint(s)),
+		WithBreakerSettings(map[string]BreakerSettings{"GraphQL": {ConsecutiveFailures: 2, Timeout: time.Hour}}))
+	post := func(query string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(graphqlRequest{Query: query})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/graphql", bytes.NewReader(body)))
+		return rec
+	}
+
+	// Invalid arguments say nothing about the database
+	for i := 0; i < 3; i++ {
+		if rec := post(`{ socks(variant: "huge") { id } }`); rec.Code != http.StatusOK {
+			t.Fatalf("invalid variant %d: want 200, have %d %s", i, rec.Code, rec.Body)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if rec := post(`{ count }`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), string(CodeUnavailable)) {
+			t.Fatalf("without a database %d: want 200 with %s, have %d %s", i, CodeUnavailable, rec.Code, rec.Body)
+		}
+	}
+	if rec := post(`{ count }`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("once the breaker opened: want 503, have %d %s", rec.Code, rec.Body)
+	}
+}
+
+// taggedService has tags, and counts how often it is asked for them.
+type taggedService struct {
+	*stubService
+	tags  []string
+	calls int
+}
+
+func (s *taggedService) Tags() ([]string, error) {
+	s.calls++
+	return s.tags, nil
+}
+
+func TestGraphQLCostsTagsByCount(t *testing.T) {
+	s := &taggedService{stubService: &stubService{socks: map[string]Sock{s1.ID: s1}}}
+	for i := 0; i < 30; i++ {
+		s.tags = append(s.tags, fmt.Sprintf("tag-%d", i))
+	}
+	// Lists of tags are as long as there are tags, however many tags a
+	// sock has
+	query := `{ tags { name count } sock(id: "1") { tags { name } } }`
+	want := 1 + 30*2 + 1 + 1 + 30*1
+	if resp := postGraphQL(t, s, query, nil, WithGraphQLMaxComplexity(want)); len(resp.Errors) > 0 {
+		t.Errorf("with a limit of %d: want no errors, have %+v", want, resp.Errors)
+	}
+	if s.calls != 1 {
+		t.Errorf("want the tags asked for once, for the cost and the answer, have %d times", s.calls)
+	}
+	if resp := postGraphQL(t, s, query, nil, WithGraphQLMaxComplexity(want-1)); len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != string(CodeTooLarge) {
+		t.Errorf("with a limit of %d: want %s, have %+v", want-1, CodeTooLarge, resp.Errors)
+	}
+
+	// Queries without tags do not ask for them
+	s.calls = 0
+	postGraphQL(t, s, `{ count }`, nil)
+	if s.calls != 0 {
+		t.Errorf("query without tags: want the tags not asked for, have %d times", s.calls)
+	}
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	s := &stubService{socks: map[string]Sock{s1.ID: s1}}
+	resp := postGraphQL(t, s, `{ count sock(id: "1") { variants(variant: "huge") { sku } } }`, nil)
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != string(CodeInvalidArgument) || !reflect.DeepEqual(resp.Errors[0].Path, []interface{}{"sock", "variants"}) {
+		t.Errorf("invalid variant: want %s at sock.variants, have %+v", CodeInvalidArgument, resp.Errors)
+	}
+	if string(resp.Data["count"]) != "1" || string(resp.Data["sock"]) != "null" {
+		t.Errorf("invalid variant: want the count all the same and no sock, have %s", resp.Data)
+	}
+	if resp := postGraphQL(t, s, `{ socks { colour } }`, nil); len(resp.Errors) != 1 || resp.Data != nil {
+		t.Errorf("unknown field: want a validation error, have %+v", resp)
+	}
+
+	// The cause of a database error is not sent
+	s.err = NewError(CodeUnavailable, "database connection error").WithCause(NewError(CodeInternal, "dial tcp 10.0.0.1:3306"))
+	for _, query := range []string{`{ sock(id: "1") { id } }`, `{ tags { name } }`} {
+		resp := postGraphQL(t, s, query, nil)
+		if len(resp.Errors) != 1 || resp.Errors[0].Message != "database connection error" || resp.Errors[0].Extensions["code"] != string(CodeUnavailable) {
+			t.Errorf("%s without a database: want %s without its cause, have %+v", query, CodeUnavailable, resp.Errors)
+		}
+	}
+
+	// Stale answers are answers
+	resp = postGraphQL(t, staleService{}, `{ socks { id } }`, nil)
+	if len(resp.Errors) > 0 || string(resp.Data["socks"]) != `[{"id":"1"}]` || resp.Extensions["stale"] != true {
+		t.Errorf("stale: want sock 1 marked stale, have %+v", resp)
+	}
+}
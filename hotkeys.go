@@ -0,0 +1,302 @@
+package catalogue
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WarmRequest identifies one cacheable catalogue request: a List page, a
+// Count, a Get or the tag list. Its Key is the cache key the answer is stored
+// under. List and Get requests with a Currency are answered by
+// ConvertEndpoints, and never warmed.
+type WarmRequest struct {
+	Operation   string   `json:"operation"`
+	Tags        []string `json:"tags,omitempty"`
+	VariantSize string   `json:"variantSize,omitempty"`
+	Order       string   `json:"order,omitempty"`
+	PageNum     int      `json:"pageNum,omitempty"`
+	PageSize    int      `json:"pageSize,omitempty"`
+	ID          string   `json:"id,omitempty"`
+	Currency    string   `json:"currency,omitempty"`
+}
+
+// Key returns the cache key of the request.
+func (r WarmRequest) Key() string {
+	switch r.Operation {
+	case "List":
+		return productListKey(r.Filter(), r.Order, r.PageNum, r.PageSize) + currencySuffix(r.Currency)
+	case "Count":
+		return countKey(r.Filter())
+	case "Get":
+		return productKey(r.ID) + currencySuffix(r.Currency)
+	default:
+		return tagsKey()
+	}
+}
+
+// Filter returns the filter of a List or Count request.
+func (r WarmRequest) Filter() Filter {
+	return Filter{Tags: r.Tags, VariantSize: r.VariantSize}
+}
+
+func currencySuffix(currency string) string {
+	if currency == "" {
+		return ""
+	}
+	return ":currency:" + currency
+}
+
+// ParseCacheKey turns a cache key back into the request it answers.
+func ParseCacheKey(key string) (WarmRequest, error) {
+	i := strings.LastIndex(key, ":currency:")
+	if i < 0 || !isCurrencyCode(key[i+len(":currency:"):]) {
+		return parseCacheKey(key)
+	}
+	r, err := parseCacheKey(key[:i])
+	if err != nil || (r.Operation != "List" && r.Operation != "Get") {
+		return WarmRequest{}, fmt.Errorf("not a catalogue cache key: %q", key)
+	}
+	r.Currency = key[i+len(":currency:"):]
+	return r, nil
+}
+
+func parseCacheKey(key string) (WarmRequest, error) {
+	switch {
+	case key == tagsKey():
+		return WarmRequest{Operation: "Tags"}, nil
+	case strings.HasPrefix(key, "catalogue:product:"):
+		return WarmRequest{Operation: "Get", ID: strings.TrimPrefix(key, "catalogue:product:")}, nil
+	case strings.HasPrefix(key, "catalogue:count:"):
+		tags, _ := keyTags(key)
+		var variantSize string
+		if i := strings.Index(key, ":variant:"); i >= 0 {
+			variantSize = key[i+len(":variant:"):]
+		}
+		return WarmRequest{Operation: "Count", Tags: tags, VariantSize: variantSize}, nil
+	case strings.HasPrefix(key, "catalogue:products:"):
+		tags, ok := keyTags(key)
+		if !ok {
+			break
+		}
+		// What follows the tags is {order}:page:{n}:size:{n}, then
+		// :variant:{size} if filtered by variant size
+		parts := strings.Split(key[strings.Index(key, ":order:")+len(":order:"):], ":")
+		if (len(parts) != 5 && (len(parts) != 7 || parts[5] != "variant")) || parts[1] != "page" || parts[3] != "size" {
+			break
+		}
+		pageNum, err1 := strconv.Atoi(parts[2])
+		pageSize, err2 := strconv.Atoi(parts[4])
+		if err1 != nil || err2 != nil {
+			break
+		}
+		r := WarmRequest{Operation: "List", Tags: tags, Order: parts[0], PageNum: pageNum, PageSize: pageSize}
+		if len(parts) == 7 {
+			r.VariantSize = parts[6]
+		}
+		return r, nil
+	}
+	return WarmRequest{}, fmt.Errorf("not a catalogue cache key: %q", key)
+}
+
+// HotKey is a frequently requested cache key with its decayed request count.
+type HotKey struct {
+	Key     string      `json:"key"`
+	Count   float64     `json:"count"`
+	Request WarmRequest `json:"request"`
+}
+
+const (
+	sketchDepth = 4
+	sketchWidth = 2048
+
+	// decaySteps is how many times per half-life counts are decayed.
+	decaySteps = 8
+)
+
+// Defaults for NewAccessTracker.
+const (
+	DefaultHotKeyHalfLife = 10 * time.Minute
+	DefaultHotKeyCapacity = 256
+)
+
+// AccessTracker estimates how often each cache key is requested. Counts are
+// kept in a count-min sketch, so memory does not grow with the number of
+// distinct keys, and halve every half-life so that the hot keys follow
+// current traffic. The heaviest keys are remembered by name so they can be
+// listed and warmed.
+type AccessTracker struct {
+	mu        sync.Mutex
+	clock     Clock
+	halfLife  time.Duration
+	capacity  int
+	sketch    [sketchDepth][sketchWidth]float64
+	top       map[string]float64
+	lastDecay time.Time
+}
+
+// AccessTrackerOption configures an AccessTracker.
+type AccessTrackerOption func(*AccessTracker)
+
+// WithHalfLife sets how long it takes for a request to count half as much.
+func WithHalfLife(d time.Duration) AccessTrackerOption {
+	return func(t *AccessTracker) {
+		t.halfLife = d
+	}
+}
+
+// WithHotKeyCapacity sets how many of the heaviest keys are remembered.
+func WithHotKeyCapacity(n int) AccessTrackerOption {
+	return func(t *AccessTracker) {
+		t.capacity = n
+	}
+}
+
+// WithTrackerClock replaces the clock used to decay counts.
+func WithTrackerClock(clock Clock) AccessTrackerOption {
+	return func(t *AccessTracker) {
+		t.clock = clock
+	}
+}
+
+// NewAccessTracker creates an empty AccessTracker.
+func NewAccessTracker(opts ...AccessTrackerOption) *AccessTracker {
+	t := &AccessTracker{
+		clock:    systemClock{},
+		halfLife: DefaultHotKeyHalfLife,
+		capacity: DefaultHotKeyCapacity,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.top = make(map[string]float64, t.capacity)
+	t.lastDecay = t.clock.Now()
+	return t
+}
+
+// Record counts one request for key.
+func (t *AccessTracker) Record(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.decay()
+
+	// Conservative update: only raise the counters that are at the minimum
+	var idx [sketchDepth]uint32
+	h1, h2 := sketchHashes(key)
+	estimate := math.Inf(1)
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) % sketchWidth
+		estimate = math.Min(estimate, t.sketch[i][idx[i]])
+	}
+	estimate++
+	for i := range idx {
+		if t.sketch[i][idx[i]] < estimate {
+			t.sketch[i][idx[i]] = estimate
+		}
+	}
+
+	if _, ok := t.top[key]; ok || len(t.top) < t.capacity {
+		t.top[key] = estimate
+		return
+	}
+	minKey, minCount := "", math.Inf(1)
+	for k, c := range t.top {
+		if c < minCount {
+			minKey, minCount = k, c
+		}
+	}
+	if estimate > minCount {
+		delete(t.top, minKey)
+		t.top[key] = estimate
+	}
+}
+
+// HotKeys returns up to n of the most requested keys, most requested first.
+func (t *AccessTracker) HotKeys(n int) []HotKey {
+	t.mu.Lock()
+	t.decay()
+	keys := make([]HotKey, 0, len(t.top))
+	for k, c := range t.top {
+		keys = append(keys, HotKey{Key: k, Count: c})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if n >= 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	for i := range keys {
+		keys[i].Request, _ = ParseCacheKey(keys[i].Key)
+	}
+	return keys
+}
+
+// decay scales every count down by the time elapsed since the last decay.
+// It must be called with mu held.
+func (t *AccessTracker) decay() {
+	if t.halfLife <= 0 {
+		return
+	}
+	now := t.clock.Now()
+	elapsed := now.Sub(t.lastDecay)
+	if elapsed < t.halfLife/decaySteps {
+		return
+	}
+	factor := math.Pow(0.5, float64(elapsed)/float64(t.halfLife))
+	for i := range t.sketch {
+		for j := range t.sketch[i] {
+			t.sketch[i][j] *= factor
+		}
+	}
+	for k, c := range t.top {
+		if c *= factor; c < 0.01 {
+			delete(t.top, k)
+			continue
+		}
+		t.top[k] = c
+	}
+	t.lastDecay = now
+}
+
+func sketchHashes(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// WarmSource supplies the requests a CacheWarmer should warm.
+type WarmSource interface {
+	Requests(ctx context.Context) ([]WarmRequest, error)
+}
+
+// HotKeySource warms the n most requested keys recorded by tracker.
+func HotKeySource(tracker *AccessTracker, n int) WarmSource {
+	return hotKeySource{tracker: tracker, n: n}
+}
+
+type hotKeySource struct {
+	tracker *AccessTracker
+	n       int
+}
+
+func (s hotKeySource) Requests(_ context.Context) ([]WarmRequest, error) {
+	var requests []WarmRequest
+	for _, k := range s.tracker.HotKeys(s.n) {
+		if k.Request.Operation != "" {
+			requests = append(requests, k.Request)
+		}
+	}
+	return requests, nil
+}
@@ -0,0 +1,101 @@
+package catalogue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+)
+
+func TestAccessTrackerHotKeys(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	tracker := NewAccessTracker(WithHalfLife(time.Minute), WithHotKeyCapacity(2), WithTrackerClock(clock))
+
+	list := WarmRequest{Operation: "List", Tags: []string{"brown"}, Order: "id", PageNum: 1, PageSize: 6}
+	get := WarmRequest{Operation: "Get", ID: s1.ID}
+	for i := 0; i < 5; i++ {
+		tracker.Record(list.Key())
+	}
+	for i := 0; i < 3; i++ {
+		tracker.Record(get.Key())
+	}
+	tracker.Record(WarmRequest{Operation: "Tags"}.Key())
+
+	hot := tracker.HotKeys(10)
+	if len(hot) != 2 {
+		t.Fatalf("HotKeys: want the 2 keys that fit, have %v", hot)
+	}
+	if hot[0].Key != list.Key() || hot[0].Count != 5 {
+		t.Errorf("HotKeys[0]: want %s x5, have %s x%v", list.Key(), hot[0].Key, hot[0].Count)
+	}
+	if !reflect.DeepEqual(hot[1].Request, get) {
+		t.Errorf("HotKeys[1].Request: want %+v, have %+v", get, hot[1].Request)
+	}
+
+	// Two half-lives later the old counts are worth a quarter
+	clock.Advance(2 * time.Minute)
+	for i := 0; i < 3; i++ {
+		tracker.Record(get.Key())
+	}
+	hot = tracker.HotKeys(1)
+	if hot[0].Key != get.Key() || hot[0].Count != 3.75 {
+		t.Errorf("HotKeys after decay: want %s x3.75, have %s x%v", get.Key(), hot[0].Key, hot[0].Count)
+	}
+}
+
+func TestParseCacheKey(t *testing.T) {
+	for _, want := range []WarmRequest{
+		{Operation: "List", Tags: []string{}, Order: "price", PageNum: 2, PageSize: 6},
+		{Operation: "List", Tags: []string{"blue", "geek"}, Order: "id", PageNum: 1, PageSize: 10},
+		{Operation: "Count", Tags: []string{"brown"}},
+		{Operation: "Get", ID: "a0a4f044-b040-410d-8ead-4de0446aec7e"},
+		{Operation: "Tags"},
+		{Operation: "List", Tags: []string{"blue"}, Order: "id", PageNum: 1, PageSize: 6, Currency: "EUR"},
+		{Operation: "List", Tags: []string{}, VariantSize: "XL", Order: "id", PageNum: 1, PageSize: 6},
+		{Operation: "List", Tags: []string{"blue"}, VariantSize: "M", Order: "id", PageNum: 3, PageSize: 6, Currency: "GBP"},
+		{Operation: "Count", Tags: []string{"blue"}, VariantSize: "S"},
+		{Operation: "Get", ID: "a0a4f044-b040-410d-8ead-4de0446aec7e", Currency: "JPY"},
+	} {
+		have, err := ParseCacheKey(want.Key())
+		if err != nil {
+			t.Errorf("ParseCacheKey(%s): %v", want.Key(), err)
+			continue
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("ParseCacheKey(%s): want %+v, have %+v", want.Key(), want, have)
+		}
+	}
+	if _, err := ParseCacheKey("catalogue:products:all:order:id"); err == nil {
+		t.Errorf("ParseCacheKey of a truncated key: want error, have nil")
+	}
+	if _, err := ParseCacheKey("catalogue:count:all:currency:EUR"); err == nil {
+		t.Errorf("ParseCacheKey of a count in a currency: want error, have nil")
+	}
+}
+
+func TestCacheWarmerHotKeys(t *testing.T) {
+	tracker := NewAccessTracker()
+	next := &stubService{socks: map[string]Sock{s1.ID: s1}}
+	s := NewCachedService(next, newFakeCache(), log.NewNopLogger(), WithAccessTracker(tracker))
+	if _, err := s.Get(s1.ID); err != nil {
+		t.Fatalf("Get(%s): %v", s1.ID, err)
+	}
+	if hot := tracker.HotKeys(1); len(hot) != 1 || hot[0].Request.ID != s1.ID {
+		t.Fatalf("HotKeys after Get(%s): have %v", s1.ID, hot)
+	}
+
+	cache := newFakeCache()
+	w := NewCacheWarmer(next, cache, log.NewNopLogger(), WithWarmSource(HotKeySource(tracker, 10)))
+	report, err := w.WarmCache(context.Background())
+	if err != nil {
+		t.Fatalf("WarmCache: %v", err)
+	}
+	if report.Failed != 0 {
+		t.Errorf("WarmCache: want no failures, have %+v", report)
+	}
+	if _, ok := cache.products[s1.ID]; !ok {
+		t.Errorf("WarmCache: want hot key %s warmed", s1.ID)
+	}
+}
@@ -0,0 +1,200 @@
+package catalogue
+
+// image_cache.go contains the caches of rendered images: one on local disk,
+// bounded by its total size, and one in Redis, shared by the replicas and
+// bounded by the size of its entries and their TTL.
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RenditionCache keeps rendered images by key. Keys are hex digests.
+type RenditionCache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, data []byte) error
+}
+
+// errRenditionTooLarge is returned by Set for renditions larger than the
+// cache takes.
+var errRenditionTooLarge = errors.New("rendition too large to cache")
+
+// DiskRenditionCache keeps renditions as files in a directory, evicting the
+// least recently used once they take more than its size limit.
+type DiskRenditionCache struct {
+	dir      string
+	maxBytes int64
+
+	mtx  sync.Mutex
+	size int64
+}
+
+// NewDiskRenditionCache returns a cache of at most maxBytes of renditions in
+// dir, which is created if needed. Renditions already in dir count towards
+// the limit.
+func NewDiskRenditionCache(dir string, maxBytes int64) (*DiskRenditionCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &DiskRenditionCache{dir: dir, maxBytes: maxBytes}
+	files, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		c.size += f.size
+	}
+	c.evict()
+	return c, nil
+}
+
+func (c *DiskRenditionCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// Get reads the rendition with the given key, marking it used.
+func (c *DiskRenditionCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	p := c.path(key)
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return data, true, nil
+}
+
+// Set writes the rendition with the given key, then evicts the least
+// recently used renditions until the cache fits its limit.
+func (c *DiskRenditionCache) Set(_ context.Context, key string, data []byte) error {
+	if int64(len(data)) > c.maxBytes {
+		return errRenditionTooLarge
+	}
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// Written aside and renamed, so that readers never see half a file
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.size += int64(len(data))
+	c.evict()
+	return nil
+}
+
+type cachedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// files lists the renditions in the cache.
+func (c *DiskRenditionCache) files() ([]cachedFile, error) {
+	var files []cachedFile
+	err := filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Base(p)[0] == '.' {
+			return err
+		}
+		files = append(files, cachedFile{path: p, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// evict removes the least recently used renditions while the cache is over
+// its limit. It recounts the size from the directory, which replacing a
+// rendition or another process may have changed. c.mtx must be held.
+func (c *DiskRenditionCache) evict() {
+	if c.size <= c.maxBytes {
+		return
+	}
+	files, err := c.files()
+	if err != nil {
+		return
+	}
+	c.size = 0
+	for _, f := range files {
+		c.size += f.size
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if c.size <= c.maxBytes {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			c.size -= f.size
+		}
+	}
+}
+
+// Defaults for NewRedisRenditionCache.
+const (
+	DefaultRenditionTTL      = 24 * time.Hour
+	DefaultMaxRenditionBytes = 1 << 20
+)
+
+// RedisRenditionCache keeps renditions in Redis, outside the catalogue:
+// keyspace so that they do not count as catalogue cache entries. Renditions
+// larger than its limit are not kept; the total is bounded by their TTL and
+// the maxmemory policy of Redis.
+type RedisRenditionCache struct {
+	client   redis.UniversalClient
+	ttl      time.Duration
+	maxBytes int
+}
+
+// NewRedisRenditionCache returns a cache keeping renditions of at most
+// maxBytes in Redis for ttl.
+func NewRedisRenditionCache(client redis.UniversalClient, ttl time.Duration, maxBytes int) *RedisRenditionCache {
+	return &RedisRenditionCache{client: client, ttl: ttl, maxBytes: maxBytes}
+}
+
+func renditionKey(key string) string {
+	return "catalogue-image:" + key
+}
+
+// Get reads the rendition with the given key.
+func (c *RedisRenditionCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	data, err := c.client.Get(ctx, renditionKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// Set writes the rendition with the given key.
+func (c *RedisRenditionCache) Set(ctx context.Context, key string, data []byte) error {
+	if len(data) > c.maxBytes {
+		return errRenditionTooLarge
+	}
+	return c.client.Set(ctx, renditionKey(key), data, c.ttl).Err()
+}
@@ -0,0 +1,112 @@
+package catalogue
+
+// image_upload.go contains the upload of sock images: they are checked to be
+// images of a sensible size, stored in a BlobStore, and added to the images
+// of their sock.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Limits of uploaded images.
+const (
+	MaxImageUploadBytes     = 10 << 20
+	MaxImageUploadDimension = 8192
+)
+
+// imageURLPrefix is where MakeHTTPHandler serves images.
+const imageURLPrefix = "/catalogue/images/"
+
+// uploadPrefix is the key prefix of uploaded images in their store.
+const uploadPrefix = "uploads/"
+
+// uploadExtensions are the types of image that can be uploaded, as sniffed by
+// http.DetectContentType, and the extension they are stored with.
+var uploadExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// ErrUploadTooLarge is returned for uploads over MaxImageUploadBytes.
+var ErrUploadTooLarge = NewError(CodeTooLarge, "upload too large").WithDetails("limit", MaxImageUploadBytes)
+
+// ErrBlobStoreUnavailable is returned when an upload cannot be stored.
+var ErrBlobStoreUnavailable = NewError(CodeUnavailable, "file store unavailable")
+
+// ImageUpload is an uploaded image and how its sock shows it.
+type ImageUpload struct {
+	Data    []byte
+	Alt     string
+	Primary bool
+}
+
+// ImageUploader stores uploaded images and adds them to their socks.
+type ImageUploader struct {
+	store  BlobStore
+	writer Writer
+	logger log.Logger
+}
+
+// NewImageUploader returns an ImageUploader storing images in store and
+// adding them to socks with writer, whose commit hooks invalidate the cached
+// socks.
+func NewImageUploader(store BlobStore, writer Writer, logger log.Logger) *ImageUploader {
+	return &ImageUploader{store: store, writer: writer, logger: logger}
+}
+
+// Upload stores the uploaded image and adds it to the sock with the given ID.
+// The type of the image is sniffed from its content; what the client says it
+// is does not count.
+func (u *ImageUploader) Upload(ctx context.Context, id string, upload ImageUpload) (Sock, Image, error) {
+	if len(upload.Data) > MaxImageUploadBytes {
+		return Sock{}, Image{}, ErrUploadTooLarge
+	}
+	contentType := http.DetectContentType(upload.Data)
+	ext, ok := uploadExtensions[contentType]
+	if !ok {
+		return Sock{}, Image{}, InvalidArgument("image", contentType, "must be a JPEG, PNG, GIF or WebP image")
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(upload.Data))
+	if err != nil {
+		return Sock{}, Image{}, InvalidArgument("image", contentType, "cannot be decoded")
+	}
+	if config.Width > MaxImageUploadDimension || config.Height > MaxImageUploadDimension || config.Width*config.Height > maxSourcePixels {
+		return Sock{}, Image{}, InvalidArgument("image", fmt.Sprintf("%dx%d", config.Width, config.Height),
+			fmt.Sprintf("must be at most %dx%d", MaxImageUploadDimension, MaxImageUploadDimension))
+	}
+
+	key := uploadPrefix + newUUID() + ext
+	if err := u.store.Put(ctx, key, bytes.NewReader(upload.Data), int64(len(upload.Data)), contentType); err != nil {
+		u.logger.Log("upload", "error", "operation", "Put", "key", key, "error", err)
+		return Sock{}, Image{}, ErrBlobStoreUnavailable
+	}
+	img := Image{
+		URL:     imageURLPrefix + key,
+		Alt:     upload.Alt,
+		Width:   config.Width,
+		Height:  config.Height,
+		Primary: upload.Primary,
+	}
+	sock, err := u.writer.AddImage(id, img)
+	if err != nil {
+		// Nothing refers to the file
+		if err := u.store.Delete(ctx, key); err != nil {
+			u.logger.Log("upload", "error", "operation", "Delete", "key", key, "error", err)
+		}
+		return Sock{}, Image{}, err
+	}
+	for _, added := range sock.Images {
+		if added.URL == img.URL {
+			img = added
+		}
+	}
+	return sock, img, nil
+}
@@ -0,0 +1,138 @@
+package catalogue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// testPNG returns a width x height PNG.
+func testPNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageUploader(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileBlobStore(dir)
+	writer := &recordingWriter{}
+	u := NewImageUploader(store, writer, log.NewNopLogger())
+	ctx := context.Background()
+
+	sock, img, err := u.Upload(ctx, s1.ID, ImageUpload{Data: testPNG(t, 64, 32), Alt: "Argyle", Primary: true})
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if !strings.HasPrefix(img.URL, "/catalogue/images/uploads/") || !strings.HasSuffix(img.URL, ".png") || img.Width != 64 || img.Height != 32 || img.Alt != "Argyle" {
+		t.Errorf("Upload: unexpected image %+v", img)
+	}
+	if len(sock.Images) != 1 || sock.Images[0].URL != img.URL {
+		t.Errorf("Upload: want the image added to %s, have %+v", s1.ID, sock.Images)
+	}
+	f, _, err := store.Open(ctx, strings.TrimPrefix(img.URL, "/catalogue/images/"))
+	if err != nil {
+		t.Fatalf("Upload: want the image stored, %v", err)
+	}
+	f.Close()
+
+	for name, upload := range map[string][]byte{
+		"text":         []byte("hello, world"),
+		"html":         []byte("<html><img src=x></html>"),
+		"truncated":    testPNG(t, 10, 10)[:20],
+		"too wide":     testPNG(t, MaxImageUploadDimension+1, 1),
+		"header-only":  []byte("\x89PNG\r\n\x1a\n"),
+		"empty":        nil,
+		"jpeg trailer": []byte("\xff\xd8\xff"),
+	} {
+		if _, _, err := u.Upload(ctx, s1.ID, ImageUpload{Data: upload}); AsError(err).Code != CodeInvalidArgument {
+			t.Errorf("Upload of %s: want %s, have %v", name, CodeInvalidArgument, err)
+		}
+	}
+	if _, _, err := u.Upload(ctx, s1.ID, ImageUpload{Data: make([]byte, MaxImageUploadBytes+1)}); !errors.Is(err, ErrUploadTooLarge) {
+		t.Errorf("Upload over the limit: want %v, have %v", ErrUploadTooLarge, err)
+	}
+
+	// An image of a missing sock is not kept
+	if _, img, err = u.Upload(ctx, "missing", ImageUpload{Data: testPNG(t, 8, 8)}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Upload for a missing sock: want %v, have %v", ErrNotFound, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "uploads", "*")); len(files) != 1 {
+		t.Errorf("Upload for a missing sock: want only the first upload stored, have %+v", files)
+	}
+}
+
+func TestUploadImageRoute(t *testing.T) {
+	writer := &recordingWriter{}
+	e := MakeWriteEndpoints(writer)
+	e.UploadImageEndpoint = MakeUploadImageEndpoint(NewImageUploader(NewFileBlobStore(t.TempDir()), writer, log.NewNopLogger()))
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(&stubService{}), "", log.NewNopLogger(), WithWriter(e, "secret"))
+
+	upload := func(id string, parts map[string]string, file []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, value := range parts {
+			mw.WriteField(name, value)
+		}
+		if file != nil {
+			fw, _ := mw.CreateFormFile("image", "socks.png")
+			fw.Write(file)
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", "/catalogue/"+id+"/images", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := upload(s1.ID, map[string]string{"alt": "Argyle", "primary": "true"}, testPNG(t, 20, 10))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload: want 201, have %d: %s", rec.Code, rec.Body)
+	}
+	var sock Sock
+	if err := json.Unmarshal(rec.Body.Bytes(), &sock); err != nil || len(sock.Images) != 1 || !sock.Images[0].Primary || sock.Images[0].Alt != "Argyle" {
+		t.Errorf("upload: want the sock with its new image, have %s (%v)", rec.Body, err)
+	}
+	if loc := rec.Header().Get("Location"); loc != sock.Images[0].URL {
+		t.Errorf("upload: want Location %s, have %s", sock.Images[0].URL, loc)
+	}
+
+	for name, tc := range map[string]struct {
+		id    string
+		parts map[string]string
+		file  []byte
+		code  int
+	}{
+		"no file":     {s1.ID, nil, nil, 400},
+		"not boolean": {s1.ID, map[string]string{"primary": "yes please"}, testPNG(t, 2, 2), 400},
+		"not image":   {s1.ID, nil, []byte("GIF? no"), 400},
+		"missing":     {"missing", nil, testPNG(t, 2, 2), 404},
+		"too large":   {s1.ID, nil, make([]byte, MaxImageUploadBytes+128<<10), 413},
+	} {
+		if rec := upload(tc.id, tc.parts, tc.file); rec.Code != tc.code {
+			t.Errorf("%s: want %d, have %d: %s", name, tc.code, rec.Code, rec.Body)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/catalogue/"+s1.ID+"/images", strings.NewReader("x"))
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("upload without a token: want 401, have %d", rec.Code)
+	}
+}
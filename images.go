@@ -0,0 +1,390 @@
+package catalogue
+
+// images.go serves the sock images under /catalogue/images/, resized and
+// transcoded when the request asks for it. Rendered images are identified by
+// a digest of their source and parameters, which is both their strong ETag
+// and their key in the RenditionCache.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // decodes GIF sources
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/go-kit/kit/log"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // decodes WebP sources
+)
+
+// Image formats a client can ask for with ?format=.
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+)
+
+var imageContentTypes = map[string]string{
+	FormatJPEG: "image/jpeg",
+	FormatPNG:  "image/png",
+	FormatWebP: "image/webp",
+}
+
+// Defaults for NewImageServer.
+const (
+	DefaultImageMaxDimension = 2048
+	DefaultImageMaxAge       = 24 * time.Hour
+	DefaultImageJPEGQuality  = 85
+)
+
+// maxSourcePixels is the largest source image decoded, so that a huge image
+// cannot take all the memory of the service.
+const maxSourcePixels = 40 << 20
+
+// ImageOption configures the ImageServer returned by NewImageServer.
+type ImageOption func(*ImageServer)
+
+// WithRenditionCache keeps rendered images in cache.
+func WithRenditionCache(cache RenditionCache) ImageOption {
+	return func(s *ImageServer) {
+		s.cache = cache
+	}
+}
+
+// WithImageStore serves the images of store, such as uploaded ones, that are
+// not in the image directory.
+func WithImageStore(store BlobStore) ImageOption {
+	return func(s *ImageServer) {
+		s.stores = append(s.stores, store)
+	}
+}
+
+// WithImageMaxAge sets how long clients and proxies may use an image before
+// revalidating it.
+func WithImageMaxAge(d time.Duration) ImageOption {
+	return func(s *ImageServer) {
+		s.maxAge = d
+	}
+}
+
+// WithImageMaxDimension sets the largest width or height that can be asked
+// for.
+func WithImageMaxDimension(n int) ImageOption {
+	return func(s *ImageServer) {
+		s.maxDimension = n
+	}
+}
+
+// ImageServer serves the images in a directory. Given ?w= or ?h= it scales
+// them down to fit, keeping their aspect ratio, and given ?format= it
+// transcodes them to JPEG, PNG or WebP.
+type ImageServer struct {
+	stores       []BlobStore // looked in in order
+	logger       log.Logger
+	cache        RenditionCache
+	maxAge       time.Duration
+	maxDimension int
+	renders      chan struct{} // limits the renders running at once
+
+	mtx     sync.Mutex
+	digests map[string]sourceDigest
+}
+
+// sourceDigest is the SHA-256 of a source image, valid while its size and
+// modification time stay the same.
+type sourceDigest struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// NewImageServer returns an ImageServer for the images in root.
+func NewImageServer(root string, logger log.Logger, opts ...ImageOption) *ImageServer {
+	s := &ImageServer{
+		stores:       []BlobStore{NewFileBlobStore(root)},
+		logger:       logger,
+		maxAge:       DefaultImageMaxAge,
+		maxDimension: DefaultImageMaxDimension,
+		renders:      make(chan struct{}, 4),
+		digests:      map[string]sourceDigest{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// rendition is what a request asks to be done to an image. The zero value
+// asks for the image as it is.
+type rendition struct {
+	Width, Height int
+	Format        string
+}
+
+func (s *ImageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rend, err := s.decodeRendition(r)
+	if err != nil {
+		encodeError(ctx, err, w)
+		return
+	}
+	name := cleanKey(r.URL.Path)
+	f, info, err := s.open(ctx, name)
+	if err != nil {
+		if !errors.Is(err, ErrBlobNotFound) {
+			s.logger.Log("images", "error", "image", name, "error", err)
+		}
+		encodeError(ctx, err, w)
+		return
+	}
+	defer f.Close()
+	sum, err := s.digest(name, f, info)
+	if err != nil {
+		s.logger.Log("images", "error", "image", name, "error", err)
+		encodeError(ctx, err, w)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.maxAge.Seconds())))
+	if rend == (rendition{}) {
+		w.Header().Set("ETag", `"`+sum[:32]+`"`)
+		http.ServeContent(w, r, name, info.ModTime, f)
+		return
+	}
+
+	// The ETag is known before rendering, so revalidations never render
+	key := rend.key(sum)
+	etag := `"` + key[:32] + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, format, err := s.rendered(ctx, key, f, rend)
+	if err != nil {
+		s.logger.Log("images", "error", "image", name, "width", rend.Width, "height", rend.Height, "format", rend.Format, "error", err)
+		encodeError(ctx, err, w)
+		return
+	}
+	w.Header().Set("Content-Type", imageContentTypes[format])
+	http.ServeContent(w, r, "", info.ModTime, bytes.NewReader(data))
+}
+
+// decodeRendition reads the w, h and format parameters.
+func (s *ImageServer) decodeRendition(r *http.Request) (rendition, error) {
+	var rend rendition
+	q := r.URL.Query()
+	for _, dim := range []struct {
+		field string
+		value *int
+	}{{"w", &rend.Width}, {"h", &rend.Height}} {
+		v := q.Get(dim.field)
+		if v == "" {
+			continue
+		}
+		n, err := parsePositiveInt(dim.field, v)
+		if err != nil {
+			return rendition{}, err
+		}
+		if n > s.maxDimension {
+			return rendition{}, InvalidArgument(dim.field, v, fmt.Sprintf("must be at most %d", s.maxDimension))
+		}
+		*dim.value = n
+	}
+	if format := strings.ToLower(q.Get("format")); format != "" {
+		if format == "jpg" {
+			format = FormatJPEG
+		}
+		if _, ok := imageContentTypes[format]; !ok {
+			return rendition{}, InvalidArgument("format", q.Get("format"), "must be jpeg, png or webp")
+		}
+		rend.Format = format
+	}
+	return rend, nil
+}
+
+// key returns the key of the rendition of the source with the given digest.
+func (rend rendition) key(sum string) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s/%dx%d.%s", sum, rend.Width, rend.Height, rend.Format)))
+	return hex.EncodeToString(h[:])
+}
+
+// open opens the image with the given name in the first store that has it.
+func (s *ImageServer) open(ctx context.Context, name string) (io.ReadSeekCloser, BlobInfo, error) {
+	for _, store := range s.stores {
+		f, info, err := store.Open(ctx, name)
+		if !errors.Is(err, ErrBlobNotFound) {
+			return f, info, err
+		}
+	}
+	return nil, BlobInfo{}, ErrBlobNotFound
+}
+
+// digest returns the SHA-256 of the source image f with the given name,
+// hashing it only when it has changed since it was last asked for.
+func (s *ImageServer) digest(name string, f io.ReadSeeker, info BlobInfo) (string, error) {
+	s.mtx.Lock()
+	d, ok := s.digests[name]
+	s.mtx.Unlock()
+	if ok && d.size == info.Size && d.modTime.Equal(info.ModTime) {
+		return d.sum, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	d = sourceDigest{size: info.Size, modTime: info.ModTime, sum: hex.EncodeToString(h.Sum(nil))}
+	s.mtx.Lock()
+	s.digests[name] = d
+	s.mtx.Unlock()
+	return d.sum, nil
+}
+
+// rendered returns the rendition of the source image src with the given key,
+// from the cache if it is there, and its format.
+func (s *ImageServer) rendered(ctx context.Context, key string, src io.ReadSeeker, rend rendition) ([]byte, string, error) {
+	if s.cache != nil {
+		data, found, err := s.cache.Get(ctx, key)
+		if err != nil {
+			s.logger.Log("images", "error", "operation", "Get", "key", key, "error", err)
+		}
+		if found {
+			return data, formatOf(data), nil
+		}
+	}
+
+	// Requests that go away while waiting for a render slot give it up
+	select {
+	case s.renders <- struct{}{}:
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+	data, format, err := renderImage(src, rend)
+	<-s.renders
+	if err != nil {
+		return nil, "", err
+	}
+	if s.cache != nil {
+		if err := s.cache.Set(ctx, key, data); err != nil && !errors.Is(err, errRenditionTooLarge) {
+			s.logger.Log("images", "error", "operation", "Set", "key", key, "error", err)
+		}
+	}
+	return data, format, nil
+}
+
+// Errors of source images that cannot be rendered.
+var (
+	errImageTooLarge    = NewError(CodeInternal, "image too large to render")
+	errUndecodableImage = NewError(CodeInternal, "image cannot be decoded")
+)
+
+// renderImage scales src down to fit within the width and height of rend,
+// either of which may be zero, and encodes it in the format of rend or, if
+// it has none, that of src.
+func renderImage(src io.ReadSeeker, rend rendition) ([]byte, string, error) {
+	config, srcFormat, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, "", errUndecodableImage.WithCause(err)
+	}
+	if config.Width*config.Height > maxSourcePixels {
+		return nil, "", errImageTooLarge.WithDetails("width", config.Width).WithDetails("height", config.Height)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, "", errUndecodableImage.WithCause(err)
+	}
+
+	format := rend.Format
+	if format == "" {
+		format = srcFormat
+		if _, ok := imageContentTypes[format]; !ok {
+			format = FormatPNG
+		}
+	}
+	width, height := fitWithin(config.Width, config.Height, rend.Width, rend.Height)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	op := draw.Src
+	if format == FormatJPEG {
+		// JPEG has no transparency: what is transparent turns white
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		op = draw.Over
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), op, nil)
+
+	var buf bytes.Buffer
+	switch format {
+	case FormatJPEG:
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: DefaultImageJPEGQuality})
+	case FormatPNG:
+		err = png.Encode(&buf, dst)
+	case FormatWebP:
+		err = nativewebp.Encode(&buf, dst, nil)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), format, nil
+}
+
+// fitWithin returns the size of a width x height image scaled down to fit
+// within maxWidth x maxHeight, keeping its aspect ratio. A zero maximum does
+// not constrain, and images are never scaled up.
+func fitWithin(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && maxWidth < width {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && float64(maxHeight) < scale*float64(height) {
+		scale = float64(maxHeight) / float64(height)
+	}
+	w, h := int(scale*float64(width)+0.5), int(scale*float64(height)+0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// formatOf returns the format of encoded image data.
+func formatOf(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8")):
+		return FormatJPEG
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return FormatWebP
+	}
+	return FormatPNG
+}
+
+// etagMatches reports whether an If-None-Match header lists etag. Weak
+// validators match their strong counterparts, as RFC 9110 asks for
+// If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
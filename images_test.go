@@ -0,0 +1,233 @@
+package catalogue
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/image/webp"
+)
+
+// countingRenditionCache is a RenditionCache in memory that counts writes.
+type countingRenditionCache struct {
+	data map[string][]byte
+	sets int
+}
+
+func (c *countingRenditionCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	data, ok := c.data[key]
+	return data, ok, nil
+}
+
+func (c *countingRenditionCache) Set(_ context.Context, key string, data []byte) error {
+	c.data[key] = data
+	c.sets++
+	return nil
+}
+
+// writeTestImage writes a width x height PNG to dir/name.
+func writeTestImage(t *testing.T, dir, name string, width, height int) {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImageServer(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "images")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestImage(t, base, "secret.png", 10, 10)
+	writeTestImage(t, dir, "argyle.png", 400, 200)
+	cache := &countingRenditionCache{data: map[string][]byte{}}
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(&stubService{}), dir, log.NewNopLogger(),
+		WithImageOptions(WithRenditionCache(cache)))
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		query         string
+		contentType   string
+		width, height int
+	}{
+		{"", "image/png", 400, 200},
+		{"?w=100", "image/png", 100, 50},
+		{"?w=100&h=20", "image/png", 40, 20},
+		{"?h=100&format=jpg", "image/jpeg", 200, 100},
+		{"?w=1000", "image/png", 400, 200}, // never scaled up
+		{"?w=80&format=webp", "image/webp", 80, 40},
+	} {
+		rec := get("/catalogue/images/argyle.png" + tc.query)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: want 200, have %d: %s", tc.query, rec.Code, rec.Body)
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != tc.contentType {
+			t.Errorf("%s: want Content-Type %s, have %s", tc.query, tc.contentType, ct)
+		}
+		var config image.Config
+		var err error
+		if tc.contentType == "image/webp" {
+			config, err = webp.DecodeConfig(rec.Body)
+		} else {
+			config, _, err = image.DecodeConfig(rec.Body)
+		}
+		if err != nil || config.Width != tc.width || config.Height != tc.height {
+			t.Errorf("%s: want %dx%d, have %dx%d (%v)", tc.query, tc.width, tc.height, config.Width, config.Height, err)
+		}
+		if etag := rec.Header().Get("ETag"); !strings.HasPrefix(etag, `"`) {
+			t.Errorf("%s: want a strong ETag, have %q", tc.query, etag)
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=86400" {
+			t.Errorf("%s: want Cache-Control public, max-age=86400, have %q", tc.query, cc)
+		}
+	}
+
+	// Renditions are rendered once, and revalidated without rendering
+	sets := cache.sets
+	first := get("/catalogue/images/argyle.png?w=100")
+	if cache.sets != sets {
+		t.Errorf("second request: want the cached rendition, have %d renders", cache.sets-sets)
+	}
+	if rec := get("/catalogue/images/argyle.png?w=100", "If-None-Match", first.Header().Get("ETag")); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: want 304, have %d", rec.Code)
+	}
+	if rec := get("/catalogue/images/argyle.png", "If-None-Match", get("/catalogue/images/argyle.png").Header().Get("ETag")); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match of the original: want 304, have %d", rec.Code)
+	}
+	if other := get("/catalogue/images/argyle.png?w=101"); other.Header().Get("ETag") == first.Header().Get("ETag") {
+		t.Errorf("want renditions of different sizes to have different ETags")
+	}
+
+	for path, code := range map[string]int{
+		"/catalogue/images/argyle.png?w=0":        400,
+		"/catalogue/images/argyle.png?w=ten":      400,
+		"/catalogue/images/argyle.png?h=5000":     400,
+		"/catalogue/images/argyle.png?format=gif": 400,
+		"/catalogue/images/missing.png?w=10":      404,
+		"/catalogue/images/":                      404,
+	} {
+		if rec := get(path); rec.Code != code {
+			t.Errorf("%s: want %d, have %d", path, code, rec.Code)
+		}
+	}
+
+	// The router redirects paths with dot segments, but the server must not
+	// leave its directory either way
+	server := NewImageServer(dir, log.NewNopLogger())
+	for _, path := range []string{"../secret.png", "/../secret.png", "images/../../secret.png"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = path
+		server.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: want 404, have %d", path, rec.Code)
+		}
+	}
+}
+
+func TestImageServerRenderSlots(t *testing.T) {
+	server := NewImageServer(t.TempDir(), log.NewNopLogger())
+	for i := 0; i < cap(server.renders); i++ {
+		server.renders <- struct{}{}
+	}
+
+	// With every slot taken, requests wait only as long as they last
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, _, err := server.rendered(ctx, "key", bytes.NewReader(nil), rendition{Width: 10})
+	if err != context.DeadlineExceeded {
+		t.Errorf("rendered with no slot free: want %v, have %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestFitWithin(t *testing.T) {
+	for _, tc := range []struct {
+		width, height, maxWidth, maxHeight int
+		wantWidth, wantHeight              int
+	}{
+		{400, 200, 0, 0, 400, 200},
+		{400, 200, 100, 0, 100, 50},
+		{400, 200, 0, 50, 100, 50},
+		{400, 200, 100, 100, 100, 50},
+		{200, 400, 100, 100, 50, 100},
+		{400, 200, 800, 800, 400, 200},
+		{1000, 1, 10, 0, 10, 1},
+	} {
+		w, h := fitWithin(tc.width, tc.height, tc.maxWidth, tc.maxHeight)
+		if w != tc.wantWidth || h != tc.wantHeight {
+			t.Errorf("fitWithin(%d, %d, %d, %d): want %dx%d, have %dx%d", tc.width, tc.height, tc.maxWidth, tc.maxHeight, tc.wantWidth, tc.wantHeight, w, h)
+		}
+	}
+}
+
+func TestDiskRenditionCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskRenditionCache(dir, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	keys := []string{"aa01", "bb02", "cc03"}
+	for _, key := range keys[:2] {
+		if err := c.Set(ctx, key, bytes.Repeat([]byte("x"), 10)); err != nil {
+			t.Fatalf("Set(%s): %v", key, err)
+		}
+	}
+	// Reading aa01 makes bb02 the least recently used
+	old, older := time.Now().Add(-time.Hour), time.Now().Add(-2*time.Hour)
+	os.Chtimes(c.path("aa01"), older, older)
+	os.Chtimes(c.path("bb02"), old, old)
+	if data, found, err := c.Get(ctx, "aa01"); !found || err != nil || len(data) != 10 {
+		t.Fatalf("Get(aa01): want 10 bytes, have %q, %v, %v", data, found, err)
+	}
+	if err := c.Set(ctx, keys[2], bytes.Repeat([]byte("x"), 10)); err != nil {
+		t.Fatalf("Set(%s): %v", keys[2], err)
+	}
+	for key, want := range map[string]bool{"aa01": true, "bb02": false, "cc03": true} {
+		if _, found, _ := c.Get(ctx, key); found != want {
+			t.Errorf("Get(%s) after eviction: want found %v, have %v", key, want, found)
+		}
+	}
+	if err := c.Set(ctx, "dd04", bytes.Repeat([]byte("x"), 30)); err == nil {
+		t.Errorf("Set of a rendition over the limit: want an error")
+	}
+
+	// A new cache counts what is already there
+	c, err = NewDiskRenditionCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := c.files(); len(files) != 1 {
+		t.Errorf("NewDiskRenditionCache over the limit: want 1 rendition left, have %d", len(files))
+	}
+}
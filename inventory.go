@@ -0,0 +1,272 @@
+package catalogue
+
+// inventory.go contains the stock operations of the order flow. A reservation
+// takes stock out of Sock.Count as soon as it is made, so that two orders can
+// never be promised the same sock, and gives it back unless it is committed
+// before it expires.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+)
+
+// Inventory reserves stock for orders.
+type Inventory interface {
+	Reserve(id string, quantity int) (Reservation, error) // POST /catalogue/{id}/reservations
+	Release(reservationID string) (Reservation, error)    // POST /reservations/{id}/release
+	Commit(reservationID string) (Reservation, error)     // POST /reservations/{id}/commit
+
+	// Expire releases up to limit reservations past their expiry and reports
+	// how many it released.
+	Expire(limit int) (int, error)
+}
+
+// Reservation statuses.
+const (
+	ReservationReserved  = "reserved"
+	ReservationReleased  = "released"
+	ReservationCommitted = "committed"
+	ReservationExpired   = "expired"
+)
+
+// Reservation is stock set aside for an order.
+type Reservation struct {
+	ID       string    `json:"id" db:"reservation_id"`
+	SockID   string    `json:"sockId" db:"sock_id"`
+	Quantity int       `json:"quantity" db:"quantity"`
+	Status   string    `json:"status" db:"status"`
+	Expires  time.Time `json:"expires" db:"-"`
+}
+
+// ErrInsufficientStock is returned when reserving more socks than are in
+// stock.
+var ErrInsufficientStock = NewError(CodeConflict, "insufficient stock")
+
+// ErrReservationNotFound is returned when there is no reservation for a
+// given ID.
+var ErrReservationNotFound = NewError(CodeNotFound, "reservation not found")
+
+// ErrReservationClosed is returned when releasing or committing a
+// reservation that has already been released, committed or expired.
+var ErrReservationClosed = NewError(CodeFailedPrecondition, "reservation is no longer open")
+
+// DefaultReservationTTL is how long a reservation holds its stock unless
+// WithReservationTTL says otherwise.
+const DefaultReservationTTL = 15 * time.Minute
+
+// WithReservationTTL sets how long reservations hold their stock before the
+// reaper returns it.
+func WithReservationTTL(d time.Duration) WriterOption {
+	return func(w *catalogueWriter) {
+		w.reservationTTL = d
+	}
+}
+
+// NewCatalogueInventory returns an Inventory backed by an SQL database. Like
+// the Writer, it records a StockChanged event in the outbox for every change
+// to the stock and calls the commit hooks with it.
+func NewCatalogueInventory(db *sqlx.DB, logger log.Logger, opts ...WriterOption) Inventory {
+	return newCatalogueWriter(db, logger, opts...)
+}
+
+// Reserve takes quantity socks out of stock until the reservation expires.
+func (w *catalogueWriter) Reserve(id string, quantity int) (Reservation, error) {
+	if quantity < 1 {
+		return Reservation{}, InvalidArgument("quantity", fmt.Sprint(quantity), "must be greater than zero")
+	}
+	r := Reservation{
+		ID:       newUUID(),
+		SockID:   id,
+		Quantity: quantity,
+		Status:   ReservationReserved,
+		Expires:  time.Now().Add(w.reservationTTL).UTC(),
+	}
+	err := w.write("Reserve", func(tx *sqlx.Tx) ([]Event, error) {
+		// Checking and taking the stock in one statement is what keeps
+		// concurrent reservations from taking more than there is
+		res, err := tx.Exec("UPDATE sock SET count = count - ? WHERE sock_id = ? AND count >= ?;", quantity, id, quantity)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = insufficientStock(tx, id, quantity)
+			}
+			return nil, err
+		}
+		if _, err := tx.Exec("INSERT INTO reservation (reservation_id, sock_id, quantity, status, expires_at) VALUES (?, ?, ?, ?, NOW(6) + INTERVAL ? MICROSECOND);",
+			r.ID, id, quantity, r.Status, w.reservationTTL.Microseconds()); err != nil {
+			return nil, err
+		}
+		event, err := stockEvent(tx, id, -quantity)
+		return []Event{event}, err
+	})
+	if err != nil {
+		return Reservation{}, err
+	}
+	return r, nil
+}
+
+// Release returns the stock of an open reservation.
+func (w *catalogueWriter) Release(reservationID string) (Reservation, error) {
+	return w.close("Release", reservationID, ReservationReleased)
+}
+
+// Commit makes an open reservation final: its stock is not returned.
+func (w *catalogueWriter) Commit(reservationID string) (Reservation, error) {
+	return w.close("Commit", reservationID, ReservationCommitted)
+}
+
+// Expire releases the reservations past their expiry, oldest first.
+func (w *catalogueWriter) Expire(limit int) (int, error) {
+	var ids []string
+	if err := w.db.Select(&ids, "SELECT reservation_id FROM reservation WHERE status = ? AND expires_at < NOW(6) ORDER BY expires_at LIMIT ?;",
+		ReservationReserved, limit); err != nil {
+		w.logger.Log("database error", err, "operation", "Expire")
+		return 0, ErrDBConnection
+	}
+	expired := 0
+	for _, id := range ids {
+		_, err := w.close("Expire", id, ReservationExpired)
+		if errors.Is(err, ErrReservationClosed) {
+			continue // released or committed since
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// close moves an open reservation to status, returning its stock unless it
+// is committed. Committing fails once the reservation has expired, even
+// before the reaper has released it.
+func (w *catalogueWriter) close(operation, reservationID, status string) (Reservation, error) {
+	var r Reservation
+	err := w.write(operation, func(tx *sqlx.Tx) ([]Event, error) {
+		var row struct {
+			Reservation
+			Remaining int64 `db:"remaining"` // microseconds until expiry
+		}
+		err := tx.Get(&row, "SELECT reservation_id, sock_id, quantity, status, TIMESTAMPDIFF(MICROSECOND, NOW(6), expires_at) AS remaining FROM reservation WHERE reservation_id = ? FOR UPDATE;", reservationID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrReservationNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		r = row.Reservation
+		r.Expires = time.Now().Add(time.Duration(row.Remaining) * time.Microsecond).UTC()
+		if r.Status != ReservationReserved {
+			return nil, ErrReservationClosed.WithDetails("status", r.Status)
+		}
+		if status == ReservationCommitted && row.Remaining < 0 {
+			return nil, ErrReservationClosed.WithDetails("status", ReservationExpired)
+		}
+		if _, err := tx.Exec("UPDATE reservation SET status = ? WHERE reservation_id = ?;", status, reservationID); err != nil {
+			return nil, err
+		}
+		r.Status = status
+		if status == ReservationCommitted {
+			return nil, nil
+		}
+		if _, err := tx.Exec("UPDATE sock SET count = count + ? WHERE sock_id = ?;", r.Quantity, r.SockID); err != nil {
+			return nil, err
+		}
+		event, err := stockEvent(tx, r.SockID, r.Quantity)
+		return []Event{event}, err
+	})
+	if err != nil {
+		return Reservation{}, err
+	}
+	return r, nil
+}
+
+// insufficientStock tells a missing sock from one with too few in stock.
+func insufficientStock(tx *sqlx.Tx, id string, quantity int) error {
+	var count int
+	err := tx.Get(&count, "SELECT count FROM sock WHERE sock_id = ?;", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return ErrInsufficientStock.WithDetails("available", count).WithDetails("requested", quantity)
+}
+
+// stockEvent returns the StockChanged event of a sock whose stock has just
+// changed by delta in tx.
+func stockEvent(tx *sqlx.Tx, id string, delta int) (Event, error) {
+	var count int
+	if err := tx.Get(&count, "SELECT count FROM sock WHERE sock_id = ?;", id); err != nil {
+		return Event{}, err
+	}
+	var tags []string
+	if err := tx.Select(&tags, "SELECT tag.name FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=?;", id); err != nil {
+		return Event{}, err
+	}
+	return newEvent(EventStockChanged, id, tags, StockChange{Previous: count - delta, Count: count})
+}
+
+// Defaults for NewReservationReaper.
+const (
+	DefaultReapInterval = 30 * time.Second
+	DefaultReapBatch    = 100
+)
+
+// ReservationReaper returns the stock of expired reservations. Every replica
+// can run one: a reservation is only ever released once.
+type ReservationReaper struct {
+	inventory Inventory
+	logger    log.Logger
+	interval  time.Duration
+	batch     int
+}
+
+// NewReservationReaper creates a ReservationReaper checking inventory for
+// expired reservations every interval.
+func NewReservationReaper(inventory Inventory, logger log.Logger, interval time.Duration) *ReservationReaper {
+	if interval <= 0 {
+		interval = DefaultReapInterval
+	}
+	return &ReservationReaper{
+		inventory: inventory,
+		logger:    logger,
+		interval:  interval,
+		batch:     DefaultReapBatch,
+	}
+}
+
+// Run releases expired reservations until ctx is done.
+func (r *ReservationReaper) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		// Keep going while full batches come back
+		for {
+			n, err := r.inventory.Expire(r.batch)
+			if err != nil {
+				r.logger.Log("reaper", "error", "error", err)
+			}
+			if n > 0 {
+				r.logger.Log("reaper", "expired", "reservations", n)
+			}
+			if err != nil || n < r.batch {
+				break
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+//go:build integration
+
+package catalogue
+
+// Run against a database loaded with docker/catalogue-db/data/dump.sql:
+//
+//	CATALOGUE_TEST_DSN='root:@tcp(localhost:3306)/socksdb' go test -tags integration -run Integration .
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestIntegrationConcurrentReserve(t *testing.T) {
+	dsn := os.Getenv("CATALOGUE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("CATALOGUE_TEST_DSN is not set")
+	}
+	db, err := sqlx.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(20)
+
+	inv := newCatalogueWriter(db, log.NewNopLogger())
+	sock, err := inv.Create(Sock{Name: "Reservable", Count: 10, Tags: []string{"integration"}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer func() {
+		db.Exec("DELETE FROM reservation WHERE sock_id = ?;", sock.ID)
+		db.Exec("DELETE FROM sock_tag WHERE sock_id = ?;", sock.ID)
+		db.Exec("DELETE FROM sock WHERE sock_id = ?;", sock.ID)
+	}()
+
+	const orders = 50
+	var wg sync.WaitGroup
+	reservations := make(chan Reservation, orders)
+	for i := 0; i < orders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := inv.Reserve(sock.ID, 1)
+			if err == nil {
+				reservations <- r
+			} else if !errors.Is(err, ErrInsufficientStock) {
+				t.Errorf("Reserve: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(reservations)
+
+	if len(reservations) != 10 {
+		t.Errorf("Reserve: want 10 of %d orders reserved, have %d", orders, len(reservations))
+	}
+	var count int
+	if err := db.Get(&count, "SELECT count FROM sock WHERE sock_id = ?;", sock.ID); err != nil || count != 0 {
+		t.Errorf("stock after reserving: want 0, have %d (%v)", count, err)
+	}
+
+	r := <-reservations
+	if _, err := inv.Release(r.ID); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := inv.Commit(r.ID); !errors.Is(err, ErrReservationClosed) {
+		t.Errorf("Commit after Release: want %v, have %v", ErrReservationClosed, err)
+	}
+	if err := db.Get(&count, "SELECT count FROM sock WHERE sock_id = ?;", sock.ID); err != nil || count != 1 {
+		t.Errorf("stock after releasing: want 1, have %d (%v)", count, err)
+	}
+}
@@ -0,0 +1,278 @@
+package catalogue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// expectStockEvent expects the reads and the outbox insert of a StockChanged
+// event leaving count socks in stock.
+func expectStockEvent(mock sqlmock.Sqlmock, id string, count int) {
+	mock.ExpectQuery("SELECT count FROM sock").WithArgs(id).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+	mock.ExpectQuery("SELECT tag.name").WithArgs(id).WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("odd"))
+	mock.ExpectExec("INSERT INTO outbox").WithArgs(sqlmock.AnyArg(), EventStockChanged, id, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestInventoryReserve(t *testing.T) {
+	var committed []Event
+	w, mock := newMockWriter(t, WithReservationTTL(time.Minute), WithCommitHook(func(events []Event) { committed = append(committed, events...) }))
+	inv := w.(Inventory)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE sock SET count = count -").WithArgs(2, s1.ID, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO reservation").WithArgs(sqlmock.AnyArg(), s1.ID, 2, ReservationReserved, time.Minute.Microseconds()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectStockEvent(mock, s1.ID, 3)
+	mock.ExpectCommit()
+	r, err := inv.Reserve(s1.ID, 2)
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if r.ID == "" || r.Status != ReservationReserved || time.Until(r.Expires) < 59*time.Second {
+		t.Errorf("Reserve: want an open reservation for a minute, have %+v", r)
+	}
+	var stock StockChange
+	if len(committed) != 1 || json.Unmarshal(committed[0].Data, &stock) != nil || stock != (StockChange{Previous: 5, Count: 3}) {
+		t.Errorf("Reserve: want stock to go from 5 to 3, have %+v", committed)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE sock SET count = count -").WithArgs(9, s1.ID, 9).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT count FROM sock").WithArgs(s1.ID).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectRollback()
+	_, err = inv.Reserve(s1.ID, 9)
+	if !errors.Is(err, ErrInsufficientStock) || AsError(err).Details["available"] != 3 {
+		t.Errorf("Reserve more than in stock: want %v with 3 available, have %#v", ErrInsufficientStock, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE sock SET count = count -").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT count FROM sock").WillReturnRows(sqlmock.NewRows([]string{"count"}))
+	mock.ExpectRollback()
+	if _, err := inv.Reserve("missing", 1); err != ErrNotFound {
+		t.Errorf("Reserve of a missing sock: want %v, have %v", ErrNotFound, err)
+	}
+
+	if _, err := inv.Reserve(s1.ID, 0); AsError(err).Code != CodeInvalidArgument {
+		t.Errorf("Reserve nothing: want %s, have %v", CodeInvalidArgument, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+	if len(committed) != 1 {
+		t.Errorf("failed reservations: want no events, have %+v", committed[1:])
+	}
+}
+
+func TestInventoryReleaseAndCommit(t *testing.T) {
+	var committed []Event
+	w, mock := newMockWriter(t, WithCommitHook(func(events []Event) { committed = append(committed, events...) }))
+	inv := w.(Inventory)
+	cols := []string{"reservation_id", "sock_id", "quantity", "status", "remaining"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT reservation_id").WithArgs("r1").WillReturnRows(sqlmock.NewRows(cols).AddRow("r1", s1.ID, 2, ReservationReserved, 1000000))
+	mock.ExpectExec("UPDATE reservation SET status").WithArgs(ReservationReleased, "r1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sock SET count = count \\+").WithArgs(2, s1.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectStockEvent(mock, s1.ID, 5)
+	mock.ExpectCommit()
+	if r, err := inv.Release("r1"); err != nil || r.Status != ReservationReleased || r.Quantity != 2 {
+		t.Errorf("Release: want r1 released, have %+v, %v", r, err)
+	}
+	if len(committed) != 1 || committed[0].Type != EventStockChanged {
+		t.Errorf("Release: want one %s event, have %+v", EventStockChanged, committed)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT reservation_id").WithArgs("r1").WillReturnRows(sqlmock.NewRows(cols).AddRow("r1", s1.ID, 2, ReservationReleased, 1000000))
+	mock.ExpectRollback()
+	if _, err := inv.Commit("r1"); !errors.Is(err, ErrReservationClosed) {
+		t.Errorf("Commit of a released reservation: want %v, have %v", ErrReservationClosed, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT reservation_id").WithArgs("r2").WillReturnRows(sqlmock.NewRows(cols).AddRow("r2", s1.ID, 1, ReservationReserved, -5))
+	mock.ExpectRollback()
+	if _, err := inv.Commit("r2"); !errors.Is(err, ErrReservationClosed) || AsError(err).Details["status"] != ReservationExpired {
+		t.Errorf("Commit of an expired reservation: want %v, have %#v", ErrReservationClosed, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT reservation_id").WithArgs("r3").WillReturnRows(sqlmock.NewRows(cols).AddRow("r3", s1.ID, 1, ReservationReserved, 1000000))
+	mock.ExpectExec("UPDATE reservation SET status").WithArgs(ReservationCommitted, "r3").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if r, err := inv.Commit("r3"); err != nil || r.Status != ReservationCommitted {
+		t.Errorf("Commit: want r3 committed, have %+v, %v", r, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT reservation_id").WithArgs("missing").WillReturnRows(sqlmock.NewRows(cols))
+	mock.ExpectRollback()
+	if _, err := inv.Release("missing"); err != ErrReservationNotFound {
+		t.Errorf("Release of a missing reservation: want %v, have %v", ErrReservationNotFound, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+	if len(committed) != 1 {
+		t.Errorf("want only the release to change the stock, have %+v", committed)
+	}
+}
+
+func TestInventoryExpire(t *testing.T) {
+	w, mock := newMockWriter(t)
+	inv := w.(Inventory)
+	cols := []string{"reservation_id", "sock_id", "quantity", "status", "remaining"}
+
+	mock.ExpectQuery("SELECT reservation_id FROM reservation WHERE status").WithArgs(ReservationReserved, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"reservation_id"}).AddRow("r1").AddRow("r2"))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT reservation_id").WithArgs("r1").WillReturnRows(sqlmock.NewRows(cols).AddRow("r1", s1.ID, 2, ReservationReserved, -1))
+	mock.ExpectExec("UPDATE reservation SET status").WithArgs(ReservationExpired, "r1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sock SET count = count \\+").WithArgs(2, s1.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectStockEvent(mock, s1.ID, 5)
+	mock.ExpectCommit()
+	// Committed between the query and its turn
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT reservation_id").WithArgs("r2").WillReturnRows(sqlmock.NewRows(cols).AddRow("r2", s1.ID, 1, ReservationCommitted, -1))
+	mock.ExpectRollback()
+
+	if n, err := inv.Expire(10); err != nil || n != 1 {
+		t.Errorf("Expire: want 1 reservation expired, have %d, %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+// TestInventoryConcurrentReserve has more orders than socks reserve at once.
+// The database decides which reservations fit, through the conditional
+// UPDATE; every other one must fail with ErrInsufficientStock and record
+// nothing.
+func TestInventoryConcurrentReserve(t *testing.T) {
+	var mtx sync.Mutex
+	var committed []Event
+	w, mock := newMockWriter(t, WithCommitHook(func(events []Event) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		committed = append(committed, events...)
+	}))
+	inv := w.(Inventory)
+	mock.MatchExpectationsInOrder(false)
+
+	const orders, stock = 20, 5
+	for i := 0; i < orders; i++ {
+		mock.ExpectBegin()
+		affected := int64(0)
+		if i < stock {
+			affected = 1
+		}
+		mock.ExpectExec("UPDATE sock SET count = count -").WithArgs(1, s1.ID, 1).WillReturnResult(sqlmock.NewResult(0, affected))
+		mock.ExpectQuery("SELECT count FROM sock").WithArgs(s1.ID).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	}
+	for i := 0; i < stock; i++ {
+		mock.ExpectExec("INSERT INTO reservation").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT tag.name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("odd"))
+		mock.ExpectExec("INSERT INTO outbox").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}
+	for i := stock; i < orders; i++ {
+		mock.ExpectRollback()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, orders)
+	for i := 0; i < orders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := inv.Reserve(s1.ID, 1)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	reserved, refused := 0, 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			reserved++
+		case errors.Is(err, ErrInsufficientStock):
+			refused++
+		default:
+			t.Errorf("Reserve: want success or %v, have %v", ErrInsufficientStock, err)
+		}
+	}
+	if reserved != stock || refused != orders-stock {
+		t.Errorf("Reserve: want %d reserved and %d refused, have %d and %d", stock, orders-stock, reserved, refused)
+	}
+	if len(committed) != stock {
+		t.Errorf("Reserve: want %d events, have %d", stock, len(committed))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+// fixedInventory holds stock socks of s1 and nothing else.
+type fixedInventory struct {
+	stock int
+}
+
+func (f *fixedInventory) Reserve(id string, quantity int) (Reservation, error) {
+	if id != s1.ID {
+		return Reservation{}, ErrNotFound
+	}
+	if quantity > f.stock {
+		return Reservation{}, ErrInsufficientStock
+	}
+	f.stock -= quantity
+	return Reservation{ID: "r1", SockID: id, Quantity: quantity, Status: ReservationReserved}, nil
+}
+
+func (f *fixedInventory) Release(id string) (Reservation, error) {
+	return Reservation{}, ErrReservationNotFound
+}
+
+func (f *fixedInventory) Commit(id string) (Reservation, error) {
+	return Reservation{ID: id, Status: ReservationCommitted}, nil
+}
+
+func (f *fixedInventory) Expire(limit int) (int, error) { return 0, nil }
+
+func TestReservationRoutes(t *testing.T) {
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(&stubService{}), "", log.NewNopLogger(),
+		WithInventory(MakeInventoryEndpoints(&fixedInventory{stock: 3}), "secret"))
+
+	for _, tc := range []struct {
+		path, token, body string
+		code              int
+	}{
+		{"/catalogue/" + s1.ID + "/reservations", "", `{"quantity": 2}`, 401},
+		{"/catalogue/" + s1.ID + "/reservations", "secret", `{"quantity": 2}`, 201},
+		{"/catalogue/" + s1.ID + "/reservations", "secret", `{"quantity": 2}`, 409},
+		{"/catalogue/missing/reservations", "secret", `{"quantity": 1}`, 404},
+		{"/reservations/r1/commit", "secret", "", 200},
+		{"/reservations/r9/release", "secret", "", 404},
+	} {
+		req := httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body))
+		if tc.token != "" {
+			req.Header.Set("X-Admin-Token", tc.token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("POST %s: want %d, have %d: %s", tc.path, tc.code, rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package catalogue
+
+import (
+	"sync"
+	"time"
+
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// Clock tells the time. CacheMetrics uses it to age out latency samples, so
+// tests can substitute a fake one.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// DefaultLatencyWindows are the sliding windows CacheMetrics reports latency
+// percentiles over unless configured otherwise.
+var DefaultLatencyWindows = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+const (
+	// windowSlots is the number of sub-histograms a window is split into.
+	// Samples expire a slot at a time, so a window covers between
+	// (windowSlots-1)/windowSlots and all of its nominal duration.
+	windowSlots = 6
+
+	// Latencies are recorded in microseconds between 1µs and one minute, to
+	// two significant figures.
+	minLatency = 1
+	maxLatency = int64(time.Minute / time.Microsecond)
+	latencySig = 2
+)
+
+// LatencyStats summarises the requests of one operation within a window.
+type LatencyStats struct {
+	Requests int64         `json:"requests"`
+	Hits     int64         `json:"hits"`
+	P50      time.Duration `json:"p50"`
+	P95      time.Duration `json:"p95"`
+	P99      time.Duration `json:"p99"`
+	Max      time.Duration `json:"max"`
+}
+
+// WindowStats holds the per-operation latency statistics of one sliding
+// window.
+type WindowStats struct {
+	Window     time.Duration           `json:"window"`
+	Operations map[string]LatencyStats `json:"operations"`
+}
+
+// slidingHistogram keeps the latency samples of the last window as a ring of
+// HDR histograms, one per slot.
+type slidingHistogram struct {
+	slot  time.Duration
+	slots [windowSlots]*hdrhistogram.Histogram
+	hits  [windowSlots]int64
+	epoch [windowSlots]int64 // which slot (time / slot) each ring entry holds
+}
+
+func newSlidingHistogram(window time.Duration) *slidingHistogram {
+	h := &slidingHistogram{slot: window / windowSlots}
+	if h.slot <= 0 {
+		h.slot = time.Nanosecond
+	}
+	for i := range h.slots {
+		h.slots[i] = hdrhistogram.New(minLatency, maxLatency, latencySig)
+		h.epoch[i] = -1
+	}
+	return h
+}
+
+func (h *slidingHistogram) record(now time.Time, d time.Duration, hit bool) {
+	idx := now.UnixNano() / int64(h.slot)
+	pos := idx % windowSlots
+	if h.epoch[pos] != idx {
+		h.slots[pos].Reset()
+		h.hits[pos] = 0
+		h.epoch[pos] = idx
+	}
+	us := int64(d / time.Microsecond)
+	if us < minLatency {
+		us = minLatency
+	}
+	if us > maxLatency {
+		us = maxLatency
+	}
+	h.slots[pos].RecordValue(us)
+	if hit {
+		h.hits[pos]++
+	}
+}
+
+func (h *slidingHistogram) stats(now time.Time) LatencyStats {
+	idx := now.UnixNano() / int64(h.slot)
+	merged := hdrhistogram.New(minLatency, maxLatency, latencySig)
+	var hits int64
+	for i := range h.slots {
+		if e := h.epoch[i]; e >= 0 && idx-e < windowSlots {
+			merged.Merge(h.slots[i])
+			hits += h.hits[i]
+		}
+	}
+	if merged.TotalCount() == 0 {
+		return LatencyStats{}
+	}
+	us := func(v int64) time.Duration { return time.Duration(v) * time.Microsecond }
+	return LatencyStats{
+		Requests: merged.TotalCount(),
+		Hits:     hits,
+		P50:      us(merged.ValueAtPercentile(50)),
+		P95:      us(merged.ValueAtPercentile(95)),
+		P99:      us(merged.ValueAtPercentile(99)),
+		Max:      us(merged.Max()),
+	}
+}
+
+func (h *slidingHistogram) reset() {
+	for i := range h.slots {
+		h.slots[i].Reset()
+		h.hits[i] = 0
+		h.epoch[i] = -1
+	}
+}
+
+// latencyWindows tracks a sliding histogram per window and operation.
+type latencyWindows struct {
+	mu      sync.Mutex
+	clock   Clock
+	windows []time.Duration
+	hists   map[time.Duration]map[string]*slidingHistogram
+}
+
+func newLatencyWindows(clock Clock, windows []time.Duration) *latencyWindows {
+	w := &latencyWindows{
+		clock:   clock,
+		windows: windows,
+		hists:   map[time.Duration]map[string]*slidingHistogram{},
+	}
+	for _, window := range windows {
+		w.hists[window] = map[string]*slidingHistogram{}
+		for _, op := range operations {
+			w.hists[window][op] = newSlidingHistogram(window)
+		}
+	}
+	return w
+}
+
+func (w *latencyWindows) record(operation string, d time.Duration, hit bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.clock.Now()
+	for _, window := range w.windows {
+		if h, ok := w.hists[window][operation]; ok {
+			h.record(now, d, hit)
+		}
+	}
+}
+
+func (w *latencyWindows) stats() []WindowStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.clock.Now()
+	stats := make([]WindowStats, 0, len(w.windows))
+	for _, window := range w.windows {
+		ws := WindowStats{Window: window, Operations: map[string]LatencyStats{}}
+		for op, h := range w.hists[window] {
+			ws.Operations[op] = h.stats(now)
+		}
+		stats = append(stats, ws)
+	}
+	return stats
+}
+
+func (w *latencyWindows) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ops := range w.hists {
+		for _, h := range ops {
+			h.reset()
+		}
+	}
+}
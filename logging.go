@@ -8,12 +8,17 @@ import (
 )
 
 // LoggingMiddleware logs method calls, parameters, results, and elapsed time.
+// The services it decorates stay RawServices if they are.
 func LoggingMiddleware(logger log.Logger) Middleware {
 	return func(next Service) Service {
-		return loggingMiddleware{
+		mw := loggingMiddleware{
 			next:   next,
 			logger: logger,
 		}
+		if raw, ok := next.(RawService); ok {
+			return rawLoggingMiddleware{loggingMiddleware: mw, raw: raw}
+		}
+		return mw
 	}
 }
 
@@ -22,11 +27,12 @@ type loggingMiddleware struct {
 	logger log.Logger
 }
 
-func (mw loggingMiddleware) List(tags []string, order string, pageNum, pageSize int) (socks []Sock, err error) {
+func (mw loggingMiddleware) List(filter Filter, order string, pageNum, pageSize int) (socks []Sock, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "List",
-			"tags", strings.Join(tags, ", "),
+			"tags", strings.Join(filter.Tags, ", "),
+			"variantSize", filter.VariantSize,
 			"order", order,
 			"pageNum", pageNum,
 			"pageSize", pageSize,
@@ -35,20 +41,21 @@ func (mw loggingMiddleware) List(tags []string, order string, pageNum, pageSize
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.List(tags, order, pageNum, pageSize)
+	return mw.next.List(filter, order, pageNum, pageSize)
 }
 
-func (mw loggingMiddleware) Count(tags []string) (n int, err error) {
+func (mw loggingMiddleware) Count(filter Filter) (n int, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "Count",
-			"tags", strings.Join(tags, ", "),
+			"tags", strings.Join(filter.Tags, ", "),
+			"variantSize", filter.VariantSize,
 			"result", n,
 			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.Count(tags)
+	return mw.next.Count(filter)
 }
 
 func (mw loggingMiddleware) Get(id string) (s Sock, err error) {
@@ -64,6 +71,19 @@ func (mw loggingMiddleware) Get(id string) (s Sock, err error) {
 	return mw.next.Get(id)
 }
 
+func (mw loggingMiddleware) GetMany(ids []string) (socks []Sock, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetMany",
+			"ids", strings.Join(ids, ", "),
+			"result", len(socks),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return GetSocks(mw.next, ids)
+}
+
 func (mw loggingMiddleware) Tags() (tags []string, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
@@ -86,3 +106,67 @@ func (mw loggingMiddleware) Health() (health []Health) {
 	}(time.Now())
 	return mw.next.Health()
 }
+
+// rawLoggingMiddleware is the loggingMiddleware of a RawService.
+type rawLoggingMiddleware struct {
+	loggingMiddleware
+	raw RawService
+}
+
+func (mw rawLoggingMiddleware) ListRaw(filter Filter, order string, pageNum, pageSize int) (data RawEntry, socks []Sock, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "List",
+			"tags", strings.Join(filter.Tags, ", "),
+			"variantSize", filter.VariantSize,
+			"order", order,
+			"pageNum", pageNum,
+			"pageSize", pageSize,
+			"result", len(socks),
+			"bytes", len(data.JSON),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.raw.ListRaw(filter, order, pageNum, pageSize)
+}
+
+func (mw rawLoggingMiddleware) GetRaw(id string) (data RawEntry, s Sock, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Get",
+			"id", id,
+			"sock", s.ID,
+			"bytes", len(data.JSON),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.raw.GetRaw(id)
+}
+
+func (mw rawLoggingMiddleware) CountTTL(filter Filter) (n int, ttl time.Duration, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Count",
+			"tags", strings.Join(filter.Tags, ", "),
+			"variantSize", filter.VariantSize,
+			"result", n,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.raw.CountTTL(filter)
+}
+
+func (mw rawLoggingMiddleware) TagsTTL() (tags []string, ttl time.Duration, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Tags",
+			"result", len(tags),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.raw.TagsTTL()
+}
@@ -1,147 +1,291 @@
 package catalogue
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
-// CacheMetrics tracks cache performance metrics
+// operations are the service methods the cache metrics are labelled with
+var operations = []string{"List", "Get", "Count", "Tags"}
+
+// CacheMetrics tracks cache performance metrics as Prometheus collectors.
+// It implements prometheus.Collector itself, so registering it exposes the
+// metrics on /metrics; GetMetrics reads the same collectors back as a
+// snapshot for logging and the health check.
 type CacheMetrics struct {
-	mu sync.RWMutex
-	
-	// Hit/Miss counters
-	totalRequests int64
-	cacheHits     int64
-	cacheMisses   int64
-	cacheErrors   int64
-	
-	// Response time tracking
-	totalResponseTime time.Duration
-	cacheResponseTime time.Duration
-	dbResponseTime    time.Duration
-	
-	// Operation counters
-	listRequests    int64
-	getRequests     int64
-	countRequests   int64
-	tagsRequests    int64
-	
+	hits        *prometheus.CounterVec
+	misses      *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+	bypassed    *prometheus.CounterVec
+	staleServed *prometheus.CounterVec
+
+	cacheDuration *prometheus.HistogramVec
+	dbDuration    *prometheus.HistogramVec
+
+	// Prometheus counters never go down, so Reset records the values they
+	// had at the time and GetMetrics reports the difference
+	mu       sync.Mutex
+	baseline map[string]operationCounts
+
+	clock       Clock
+	windowSizes []time.Duration
+	windows     *latencyWindows
+
 	logger log.Logger
 }
 
-// NewCacheMetrics creates a new metrics tracker
-func NewCacheMetrics(logger log.Logger) *CacheMetrics {
-	return &CacheMetrics{
-		logger: logger,
+// CacheMetricsOption configures a CacheMetrics
+type CacheMetricsOption func(*CacheMetrics)
+
+// WithClock sets the clock used to age out latency samples
+func WithClock(clock Clock) CacheMetricsOption {
+	return func(m *CacheMetrics) {
+		m.clock = clock
+	}
+}
+
+// WithLatencyWindows sets the sliding windows latency percentiles are
+// reported over. The default is DefaultLatencyWindows.
+func WithLatencyWindows(windows ...time.Duration) CacheMetricsOption {
+	return func(m *CacheMetrics) {
+		m.windowSizes = windows
+	}
+}
+
+// NewCacheMetrics creates a new metrics tracker. The collectors are not
+// registered; pass the tracker to prometheus.MustRegister to export them.
+func NewCacheMetrics(logger log.Logger, opts ...CacheMetricsOption) *CacheMetrics {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: name,
+			Help: help,
+		}, []string{"operation"})
+	}
+	histogram := func(name, help string) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    name,
+			Help:    help,
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"operation"})
+	}
+	m := &CacheMetrics{
+		hits:          counter("catalogue_cache_hits_total", "Requests answered from Redis."),
+		misses:        counter("catalogue_cache_misses_total", "Requests that missed Redis and went to the database."),
+		errors:        counter("catalogue_cache_errors_total", "Requests where Redis failed and the database was used instead."),
+		bypassed:      counter("catalogue_cache_bypassed_total", "Requests that skipped Redis because its circuit breaker was open."),
+		staleServed:   counter("catalogue_cache_stale_served_total", "Responses served from a last-known-good copy after a database failure."),
+		cacheDuration: histogram("catalogue_cache_duration_seconds", "Time spent answering requests from Redis."),
+		dbDuration:    histogram("catalogue_db_duration_seconds", "Time spent answering requests from the database, including the failed cache lookup."),
+		baseline:      map[string]operationCounts{},
+		clock:         systemClock{},
+		windowSizes:   DefaultLatencyWindows,
+		logger:        logger,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.windows = newLatencyWindows(m.clock, m.windowSizes)
+	// Initialise every series so that rates start from zero rather than
+	// appearing on the first request
+	for _, op := range operations {
+		for _, vec := range m.counters() {
+			vec.WithLabelValues(op)
+		}
+		m.cacheDuration.WithLabelValues(op)
+		m.dbDuration.WithLabelValues(op)
+	}
+	return m
+}
+
+func (m *CacheMetrics) counters() []*prometheus.CounterVec {
+	return []*prometheus.CounterVec{m.hits, m.misses, m.errors, m.bypassed, m.staleServed}
+}
+
+// Describe implements prometheus.Collector.
+func (m *CacheMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, vec := range m.counters() {
+		vec.Describe(ch)
+	}
+	m.cacheDuration.Describe(ch)
+	m.dbDuration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *CacheMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, vec := range m.counters() {
+		vec.Collect(ch)
 	}
+	m.cacheDuration.Collect(ch)
+	m.dbDuration.Collect(ch)
 }
 
 // RecordCacheHit records a cache hit with response time
 func (m *CacheMetrics) RecordCacheHit(operation string, duration time.Duration) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	
-	m.totalRequests++
-	m.cacheHits++
-	m.totalResponseTime += duration
-	m.cacheResponseTime += duration
-	
-	m.incrementOperationCounter(operation)
+	m.hits.WithLabelValues(operation).Inc()
+	m.cacheDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	m.windows.record(operation, duration, true)
 }
 
 // RecordCacheMiss records a cache miss with response time
 func (m *CacheMetrics) RecordCacheMiss(operation string, duration time.Duration) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	
-	m.totalRequests++
-	m.cacheMisses++
-	m.totalResponseTime += duration
-	m.dbResponseTime += duration
-	
-	m.incrementOperationCounter(operation)
+	m.misses.WithLabelValues(operation).Inc()
+	m.dbDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	m.windows.record(operation, duration, false)
 }
 
 // RecordCacheError records a cache error
 func (m *CacheMetrics) RecordCacheError(operation string, duration time.Duration) {
+	m.errors.WithLabelValues(operation).Inc()
+	m.dbDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	m.windows.record(operation, duration, false)
+}
+
+// RecordCacheBypass records a request that skipped Redis because the cache
+// circuit breaker was open
+func (m *CacheMetrics) RecordCacheBypass(operation string, duration time.Duration) {
+	m.bypassed.WithLabelValues(operation).Inc()
+	m.dbDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	m.windows.record(operation, duration, false)
+}
+
+// RecordStaleServed records a response answered from a last-known-good copy
+// after the database failed. The request itself was already counted as a miss.
+func (m *CacheMetrics) RecordStaleServed(operation string) {
+	m.staleServed.WithLabelValues(operation).Inc()
+}
+
+// operationCounts are the raw cumulative values behind one operation's
+// metrics
+type operationCounts struct {
+	hits, misses, errors, bypassed, stale int64
+	cacheCount, dbCount                   uint64
+	cacheSum, dbSum                       float64
+}
+
+func (c operationCounts) sub(o operationCounts) operationCounts {
+	return operationCounts{
+		hits:       c.hits - o.hits,
+		misses:     c.misses - o.misses,
+		errors:     c.errors - o.errors,
+		bypassed:   c.bypassed - o.bypassed,
+		stale:      c.stale - o.stale,
+		cacheCount: c.cacheCount - o.cacheCount,
+		dbCount:    c.dbCount - o.dbCount,
+		cacheSum:   c.cacheSum - o.cacheSum,
+		dbSum:      c.dbSum - o.dbSum,
+	}
+}
+
+func (m *CacheMetrics) counts(operation string) operationCounts {
+	var c operationCounts
+	c.hits = counterValue(m.hits, operation)
+	c.misses = counterValue(m.misses, operation)
+	c.errors = counterValue(m.errors, operation)
+	c.bypassed = counterValue(m.bypassed, operation)
+	c.stale = counterValue(m.staleServed, operation)
+	c.cacheCount, c.cacheSum = histogramValue(m.cacheDuration, operation)
+	c.dbCount, c.dbSum = histogramValue(m.dbDuration, operation)
+	return c
+}
+
+// Reset starts the snapshot returned by GetMetrics afresh and empties the
+// latency windows. The exported Prometheus counters are left untouched.
+func (m *CacheMetrics) Reset() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	
-	m.totalRequests++
-	m.cacheErrors++
-	m.totalResponseTime += duration
-	m.dbResponseTime += duration
-	
-	m.incrementOperationCounter(operation)
-}
-
-func (m *CacheMetrics) incrementOperationCounter(operation string) {
-	switch operation {
-	case "List":
-		m.listRequests++
-	case "Get":
-		m.getRequests++
-	case "Count":
-		m.countRequests++
-	case "Tags":
-		m.tagsRequests++
+	for _, op := range operations {
+		m.baseline[op] = m.counts(op)
 	}
+	m.windows.reset()
 }
 
 // GetMetrics returns current metrics snapshot
 func (m *CacheMetrics) GetMetrics() MetricsSnapshot {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	
-	hitRatio := float64(0)
-	if m.totalRequests > 0 {
-		hitRatio = float64(m.cacheHits) / float64(m.totalRequests) * 100
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var snap MetricsSnapshot
+	var cacheCount, dbCount uint64
+	var cacheSum, dbSum float64
+	for _, op := range operations {
+		c := m.counts(op).sub(m.baseline[op])
+		snap.CacheHits += c.hits
+		snap.CacheMisses += c.misses
+		snap.CacheErrors += c.errors
+		snap.CacheBypassed += c.bypassed
+		snap.StaleServed += c.stale
+
+		requests := c.hits + c.misses + c.errors + c.bypassed
+		switch op {
+		case "List":
+			snap.ListRequests = requests
+		case "Get":
+			snap.GetRequests = requests
+		case "Count":
+			snap.CountRequests = requests
+		case "Tags":
+			snap.TagsRequests = requests
+		}
+
+		cacheCount, cacheSum = cacheCount+c.cacheCount, cacheSum+c.cacheSum
+		dbCount, dbSum = dbCount+c.dbCount, dbSum+c.dbSum
 	}
-	
-	avgResponseTime := time.Duration(0)
-	if m.totalRequests > 0 {
-		avgResponseTime = m.totalResponseTime / time.Duration(m.totalRequests)
+	snap.TotalRequests = snap.CacheHits + snap.CacheMisses + snap.CacheErrors + snap.CacheBypassed
+
+	if snap.TotalRequests > 0 {
+		snap.HitRatio = float64(snap.CacheHits) / float64(snap.TotalRequests) * 100
 	}
-	
-	avgCacheResponseTime := time.Duration(0)
-	if m.cacheHits > 0 {
-		avgCacheResponseTime = m.cacheResponseTime / time.Duration(m.cacheHits)
+	if n := cacheCount + dbCount; n > 0 {
+		snap.AvgResponseTime = seconds((cacheSum + dbSum) / float64(n))
 	}
-	
-	avgDbResponseTime := time.Duration(0)
-	dbRequests := m.cacheMisses + m.cacheErrors
-	if dbRequests > 0 {
-		avgDbResponseTime = m.dbResponseTime / time.Duration(dbRequests)
+	if cacheCount > 0 {
+		snap.AvgCacheResponseTime = seconds(cacheSum / float64(cacheCount))
 	}
-	
-	return MetricsSnapshot{
-		TotalRequests:        m.totalRequests,
-		CacheHits:            m.cacheHits,
-		CacheMisses:          m.cacheMisses,
-		CacheErrors:          m.cacheErrors,
-		HitRatio:             hitRatio,
-		AvgResponseTime:      avgResponseTime,
-		AvgCacheResponseTime: avgCacheResponseTime,
-		AvgDbResponseTime:    avgDbResponseTime,
-		ListRequests:         m.listRequests,
-		GetRequests:          m.getRequests,
-		CountRequests:        m.countRequests,
-		TagsRequests:         m.tagsRequests,
+	if dbCount > 0 {
+		snap.AvgDbResponseTime = seconds(dbSum / float64(dbCount))
+	}
+	snap.Windows = m.windows.stats()
+	return snap
+}
+
+func counterValue(vec *prometheus.CounterVec, operation string) int64 {
+	var metric dto.Metric
+	if err := vec.WithLabelValues(operation).Write(&metric); err != nil {
+		return 0
+	}
+	return int64(metric.GetCounter().GetValue())
+}
+
+func histogramValue(vec *prometheus.HistogramVec, operation string) (uint64, float64) {
+	var metric dto.Metric
+	if err := vec.WithLabelValues(operation).(prometheus.Metric).Write(&metric); err != nil {
+		return 0, 0
 	}
+	return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
 }
 
 // LogMetrics logs current metrics
 func (m *CacheMetrics) LogMetrics() {
 	metrics := m.GetMetrics()
-	
+
 	m.logger.Log(
 		"metrics", "cache_performance",
 		"total_requests", metrics.TotalRequests,
 		"cache_hits", metrics.CacheHits,
 		"cache_misses", metrics.CacheMisses,
 		"cache_errors", metrics.CacheErrors,
+		"cache_bypassed", metrics.CacheBypassed,
+		"stale_served", metrics.StaleServed,
 		"hit_ratio_percent", metrics.HitRatio,
 		"avg_response_time_ms", metrics.AvgResponseTime.Milliseconds(),
 		"avg_cache_response_time_ms", metrics.AvgCacheResponseTime.Milliseconds(),
@@ -151,6 +295,26 @@ func (m *CacheMetrics) LogMetrics() {
 		"count_requests", metrics.CountRequests,
 		"tags_requests", metrics.TagsRequests,
 	)
+
+	for _, w := range metrics.Windows {
+		keyvals := []interface{}{"metrics", "cache_latency", "window", w.Window.String()}
+		for _, op := range operations {
+			stats := w.Operations[op]
+			keyvals = append(keyvals,
+				fmt.Sprintf("%s_requests", op), stats.Requests,
+				fmt.Sprintf("%s_p50_ms", op), durationMs(stats.P50),
+				fmt.Sprintf("%s_p95_ms", op), durationMs(stats.P95),
+				fmt.Sprintf("%s_p99_ms", op), durationMs(stats.P99),
+			)
+		}
+		m.logger.Log(keyvals...)
+	}
+}
+
+// durationMs formats d in milliseconds with microsecond precision, since
+// cache hits are usually well under a millisecond
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
 }
 
 // StartPeriodicLogging starts periodic metrics logging
@@ -161,24 +325,79 @@ func (m *CacheMetrics) StartPeriodicLogging(interval time.Duration) {
 			m.LogMetrics()
 		}
 	}()
-	
+
 	m.logger.Log("metrics", "periodic_logging_started", "interval_seconds", interval.Seconds())
 }
 
 // MetricsSnapshot represents a point-in-time view of cache metrics
 type MetricsSnapshot struct {
-	TotalRequests        int64
-	CacheHits            int64
-	CacheMisses          int64
-	CacheErrors          int64
-	HitRatio             float64
-	AvgResponseTime      time.Duration
-	AvgCacheResponseTime time.Duration
-	AvgDbResponseTime    time.Duration
-	ListRequests         int64
-	GetRequests          int64
-	CountRequests        int64
-	TagsRequests         int64
+	TotalRequests        int64         `json:"totalRequests"`
+	CacheHits            int64         `json:"cacheHits"`
+	CacheMisses          int64         `json:"cacheMisses"`
+	CacheErrors          int64         `json:"cacheErrors"`
+	CacheBypassed        int64         `json:"cacheBypassed"`
+	StaleServed          int64         `json:"staleServed"`
+	HitRatio             float64       `json:"hitRatio"`
+	AvgResponseTime      time.Duration `json:"avgResponseTime"`
+	AvgCacheResponseTime time.Duration `json:"avgCacheResponseTime"`
+	AvgDbResponseTime    time.Duration `json:"avgDbResponseTime"`
+	ListRequests         int64         `json:"listRequests"`
+	GetRequests          int64         `json:"getRequests"`
+	CountRequests        int64         `json:"countRequests"`
+	TagsRequests         int64         `json:"tagsRequests"`
+	Windows              []WindowStats `json:"windows"`
+}
+
+// RedisPoolCollector exports the connection pool statistics of a Redis
+// client as Prometheus metrics.
+type RedisPoolCollector struct {
+	stats func() *redis.PoolStats
+
+	hits       *prometheus.Desc
+	misses     *prometheus.Desc
+	timeouts   *prometheus.Desc
+	totalConns *prometheus.Desc
+	idleConns  *prometheus.Desc
+	staleConns *prometheus.Desc
+}
+
+// NewRedisPoolCollector returns a collector reading pool statistics from
+// stats, typically the PoolStats method of a cache created by
+// NewCatalogueCache.
+func NewRedisPoolCollector(stats func() *redis.PoolStats) *RedisPoolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("catalogue_redis_pool_"+name, help, nil, nil)
+	}
+	return &RedisPoolCollector{
+		stats:      stats,
+		hits:       desc("hits_total", "Times a free connection was found in the pool."),
+		misses:     desc("misses_total", "Times a free connection was not found in the pool."),
+		timeouts:   desc("timeouts_total", "Times a wait for a pool connection timed out."),
+		totalConns: desc("total_connections", "Connections currently in the pool."),
+		idleConns:  desc("idle_connections", "Idle connections currently in the pool."),
+		staleConns: desc("stale_connections_total", "Stale connections removed from the pool."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *RedisPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.timeouts
+	ch <- c.totalConns
+	ch <- c.idleConns
+	ch <- c.staleConns
+}
+
+// Collect implements prometheus.Collector.
+func (c *RedisPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stats.IdleConns))
+	ch <- prometheus.MustNewConstMetric(c.staleConns, prometheus.CounterValue, float64(stats.StaleConns))
 }
 
 // MetricsMiddleware wraps a service with performance metrics collection
@@ -197,7 +416,7 @@ func NewMetricsMiddleware(metrics *CacheMetrics) Middleware {
 	}
 }
 
-func (mw *metricsMiddleware) List(tags []string, order string, pageNum, pageSize int) ([]Sock, error) {
+func (mw *metricsMiddleware) List(filter Filter, order string, pageNum, pageSize int) ([]Sock, error) {
 	start := time.Now()
 	defer func() {
 		// Note: This middleware should be applied after the cached service
@@ -206,17 +425,17 @@ func (mw *metricsMiddleware) List(tags []string, order string, pageNum, pageSize
 		mw.metrics.logger.Log("operation", "List", "total_duration_ms", duration.Milliseconds())
 	}()
 	
-	return mw.next.List(tags, order, pageNum, pageSize)
+	return mw.next.List(filter, order, pageNum, pageSize)
 }
 
-func (mw *metricsMiddleware) Count(tags []string) (int, error) {
+func (mw *metricsMiddleware) Count(filter Filter) (int, error) {
 	start := time.Now()
 	defer func() {
 		duration := time.Since(start)
 		mw.metrics.logger.Log("operation", "Count", "total_duration_ms", duration.Milliseconds())
 	}()
 	
-	return mw.next.Count(tags)
+	return mw.next.Count(filter)
 }
 
 func (mw *metricsMiddleware) Get(id string) (Sock, error) {
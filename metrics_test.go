@@ -0,0 +1,149 @@
+package catalogue
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCacheMetricsSnapshot(t *testing.T) {
+	m := NewCacheMetrics(log.NewNopLogger())
+	m.RecordCacheHit("List", 2*time.Millisecond)
+	m.RecordCacheHit("Get", 4*time.Millisecond)
+	m.RecordCacheMiss("Get", 40*time.Millisecond)
+	m.RecordCacheError("Tags", 20*time.Millisecond)
+
+	have := m.GetMetrics()
+	if have.TotalRequests != 4 || have.CacheHits != 2 || have.CacheMisses != 1 || have.CacheErrors != 1 {
+		t.Errorf("GetMetrics: unexpected counts %+v", have)
+	}
+	if have.GetRequests != 2 || have.ListRequests != 1 || have.TagsRequests != 1 {
+		t.Errorf("GetMetrics: unexpected per-operation counts %+v", have)
+	}
+	if have.HitRatio != 50 {
+		t.Errorf("HitRatio: want 50, have %v", have.HitRatio)
+	}
+	if want := 3 * time.Millisecond; have.AvgCacheResponseTime.Round(time.Millisecond) != want {
+		t.Errorf("AvgCacheResponseTime: want %v, have %v", want, have.AvgCacheResponseTime)
+	}
+	if want := 30 * time.Millisecond; have.AvgDbResponseTime.Round(time.Millisecond) != want {
+		t.Errorf("AvgDbResponseTime: want %v, have %v", want, have.AvgDbResponseTime)
+	}
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(m); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() != "catalogue_cache_hits_total" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == "Get" && metric.GetCounter().GetValue() != 1 {
+				t.Errorf("catalogue_cache_hits_total{operation=Get}: want 1, have %v", metric.GetCounter().GetValue())
+			}
+		}
+		return
+	}
+	t.Errorf("Gather: catalogue_cache_hits_total not exported")
+}
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestCacheMetricsLatencyWindows(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	m := NewCacheMetrics(log.NewNopLogger(), WithClock(clock), WithLatencyWindows(time.Minute, time.Hour))
+
+	// 100 requests from 1ms to 100ms: p50 ~50ms, p95 ~95ms, p99 ~99ms
+	for i := 1; i <= 100; i++ {
+		m.RecordCacheHit("Get", time.Duration(i)*time.Millisecond)
+	}
+	windows := m.GetMetrics().Windows
+	if len(windows) != 2 {
+		t.Fatalf("Windows: want 2, have %d", len(windows))
+	}
+	for _, w := range windows {
+		stats := w.Operations["Get"]
+		if stats.Requests != 100 || stats.Hits != 100 {
+			t.Errorf("%s: want 100 requests and hits, have %d/%d", w.Window, stats.Requests, stats.Hits)
+		}
+		for _, testcase := range []struct {
+			name       string
+			have, want time.Duration
+		}{
+			{"p50", stats.P50, 50 * time.Millisecond},
+			{"p95", stats.P95, 95 * time.Millisecond},
+			{"p99", stats.P99, 99 * time.Millisecond},
+		} {
+			if diff := testcase.have - testcase.want; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf("%s %s: want ~%v, have %v", w.Window, testcase.name, testcase.want, testcase.have)
+			}
+		}
+	}
+
+	// Two minutes later the samples have left the 1m window but not the 1h one
+	clock.Advance(2 * time.Minute)
+	m.RecordCacheMiss("Get", 500*time.Millisecond)
+	windows = m.GetMetrics().Windows
+	if have := windows[0].Operations["Get"]; have.Requests != 1 || have.P50 < 490*time.Millisecond {
+		t.Errorf("1m window after 2m: want only the new sample, have %+v", have)
+	}
+	if have := windows[1].Operations["Get"]; have.Requests != 101 || have.Hits != 100 {
+		t.Errorf("1h window after 2m: want 101 requests, 100 hits, have %+v", have)
+	}
+
+	clock.Advance(2 * time.Hour)
+	if have := m.GetMetrics().Windows[1].Operations["Get"]; have.Requests != 0 {
+		t.Errorf("1h window after 2h: want no samples, have %d", have.Requests)
+	}
+}
+
+func TestCacheMetricsReset(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	m := NewCacheMetrics(log.NewNopLogger(), WithClock(clock))
+	m.RecordCacheHit("List", time.Millisecond)
+	m.RecordCacheMiss("List", 10*time.Millisecond)
+
+	m.Reset()
+	have := m.GetMetrics()
+	if have.TotalRequests != 0 || have.ListRequests != 0 || have.AvgResponseTime != 0 {
+		t.Errorf("GetMetrics after Reset: want zeroes, have %+v", have)
+	}
+	for _, w := range have.Windows {
+		if n := w.Operations["List"].Requests; n != 0 {
+			t.Errorf("%s window after Reset: want no samples, have %d", w.Window, n)
+		}
+	}
+
+	m.RecordCacheHit("List", 2*time.Millisecond)
+	have = m.GetMetrics()
+	if have.TotalRequests != 1 || have.CacheHits != 1 || have.HitRatio != 100 {
+		t.Errorf("GetMetrics after Reset and one hit: have %+v", have)
+	}
+	if want := 2 * time.Millisecond; have.AvgCacheResponseTime.Round(time.Millisecond) != want {
+		t.Errorf("AvgCacheResponseTime: want %v, have %v", want, have.AvgCacheResponseTime)
+	}
+}
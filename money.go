@@ -0,0 +1,343 @@
+package catalogue
+
+// money.go contains the money type the catalogue prices socks in, and the
+// exchange rates it converts them with. Amounts are kept in integer minor
+// units and converted with exact rational arithmetic, so that a price of
+// 17.32 stays 17.32.
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DefaultCurrency is the currency of the prices in the database unless
+// configured otherwise.
+const DefaultCurrency = "USD"
+
+// Money is an amount of a currency, in the currency's minor units: 1732 USD
+// is 17.32 dollars, 1732 JPY is 1732 yen.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// minorUnits lists the ISO 4217 currencies whose minor unit is not a
+// hundredth.
+var minorUnits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// MinorUnits returns the number of decimal places of currency.
+func MinorUnits(currency string) int {
+	if n, ok := minorUnits[currency]; ok {
+		return n
+	}
+	return 2
+}
+
+// isCurrencyCode reports whether s looks like an ISO 4217 code.
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Price is a price as the database holds it, a DECIMAL(10,2) in the
+// currency of the catalogue, kept in hundredths so that it is read, written
+// and cached exactly. It is a plain number in JSON: 17.32.
+type Price int64
+
+// priceScale is the number of decimal places of a Price.
+const priceScale = 2
+
+// ParsePrice reads a decimal such as "17.32", with at most two decimal
+// places.
+func ParsePrice(s string) (Price, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || strings.ContainsAny(s, "eE/") {
+		return 0, fmt.Errorf("price %q is not a decimal", s)
+	}
+	r.Mul(r, pow10Rat(priceScale))
+	if !r.IsInt() || !r.Num().IsInt64() {
+		return 0, fmt.Errorf("price %q has more than %d decimal places", s, priceScale)
+	}
+	return Price(r.Num().Int64()), nil
+}
+
+// PriceOf returns m as a Price, rounded half away from zero to the
+// hundredth for currencies with more decimal places.
+func PriceOf(m Money) Price {
+	x := new(big.Rat).SetInt64(m.Amount)
+	x.Mul(x, pow10Rat(priceScale-MinorUnits(m.Currency)))
+	return Price(roundRat(x))
+}
+
+// Money returns p as an amount of currency, rounded half away from zero to
+// its minor unit for currencies without hundredths.
+func (p Price) Money(currency string) Money {
+	x := new(big.Rat).SetInt64(int64(p))
+	x.Mul(x, pow10Rat(MinorUnits(currency)-priceScale))
+	return Money{Amount: roundRat(x), Currency: currency}
+}
+
+// Float returns p in major units, for clients that want a float.
+func (p Price) Float() float64 {
+	return float64(p) / math.Pow10(priceScale)
+}
+
+// String returns p as a decimal without trailing zeros: "17.3", "15".
+func (p Price) String() string {
+	s := Money{Amount: int64(p)}.Decimal()
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// Scan reads p from the DECIMAL the driver returns, as text. Floats, from
+// columns not yet migrated to DECIMAL, are rounded to the hundredth.
+func (p *Price) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*p = 0
+		return nil
+	case []byte:
+		return p.parse(string(v))
+	case string:
+		return p.parse(v)
+	case int64:
+		*p = Price(v * 100)
+		return nil
+	case float64:
+		return p.parse(strconv.FormatFloat(v, 'f', priceScale, 64))
+	case driver.Valuer:
+		value, err := v.Value()
+		if err != nil {
+			return err
+		}
+		return p.Scan(value)
+	}
+	return fmt.Errorf("price: cannot scan %T", src)
+}
+
+func (p *Price) parse(s string) error {
+	price, err := ParsePrice(s)
+	if err != nil {
+		return err
+	}
+	*p = price
+	return nil
+}
+
+// Value writes p as a decimal string, which the DECIMAL column takes as it
+// is.
+func (p Price) Value() (driver.Value, error) {
+	return Money{Amount: int64(p)}.Decimal(), nil
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Price) UnmarshalJSON(data []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	return p.parse(n.String())
+}
+
+// Float returns m in major units, for the JSON price field.
+func (m Money) Float() float64 {
+	return float64(m.Amount) / math.Pow10(MinorUnits(m.Currency))
+}
+
+// Decimal returns m in major units, without rounding: "17.32".
+func (m Money) Decimal() string {
+	units := MinorUnits(m.Currency)
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if units == 0 {
+		return fmt.Sprintf("%s%d", sign, amount)
+	}
+	scale := int64(math.Pow10(units))
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, units, amount%scale)
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// ErrUnknownCurrency is returned when converting to or from a currency the
+// rate table has no rate for.
+var ErrUnknownCurrency = NewError(CodeInvalidArgument, "unknown currency")
+
+// RateTable holds how much of each currency one unit of its base currency
+// buys. It is safe for concurrent use.
+type RateTable struct {
+	mtx   sync.RWMutex
+	base  string
+	rates map[string]*big.Rat
+}
+
+// NewRateTable returns a rate table for base with the given rates, which are
+// decimal strings such as "0.92" so that they are read exactly.
+func NewRateTable(base string, rates map[string]string) (*RateTable, error) {
+	t := &RateTable{base: base}
+	if err := t.Set(rates); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Set replaces the rates of t.
+func (t *RateTable) Set(rates map[string]string) error {
+	if !isCurrencyCode(t.base) {
+		return fmt.Errorf("rates: base %q is not a currency code", t.base)
+	}
+	parsed := map[string]*big.Rat{t.base: big.NewRat(1, 1)}
+	for currency, rate := range rates {
+		currency = strings.ToUpper(strings.TrimSpace(currency))
+		if !isCurrencyCode(currency) {
+			return fmt.Errorf("rates: %q is not a currency code", currency)
+		}
+		r, ok := new(big.Rat).SetString(strings.TrimSpace(rate))
+		if !ok || r.Sign() <= 0 {
+			return fmt.Errorf("rates: %s rate %q is not a positive number", currency, rate)
+		}
+		parsed[currency] = r
+	}
+	t.mtx.Lock()
+	t.rates = parsed
+	t.mtx.Unlock()
+	return nil
+}
+
+// Base returns the base currency of t.
+func (t *RateTable) Base() string {
+	return t.base
+}
+
+// Rate returns how much of currency one unit of the base currency buys.
+func (t *RateTable) Rate(currency string) (*big.Rat, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	r, ok := t.rates[currency]
+	if !ok {
+		return nil, ErrUnknownCurrency.WithDetails("currency", currency)
+	}
+	return r, nil
+}
+
+// Convert returns m in currency to, rounded half away from zero to the minor
+// unit of to.
+func (t *RateTable) Convert(m Money, to string) (Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+	from, err := t.Rate(m.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	rate, err := t.Rate(to)
+	if err != nil {
+		return Money{}, err
+	}
+	x := new(big.Rat).SetInt64(m.Amount)
+	x.Mul(x, rate)
+	x.Quo(x, from)
+	x.Mul(x, pow10Rat(MinorUnits(to)-MinorUnits(m.Currency)))
+	return Money{Amount: roundRat(x), Currency: to}, nil
+}
+
+func pow10Rat(n int) *big.Rat {
+	if n < 0 {
+		return new(big.Rat).Inv(pow10Rat(-n))
+	}
+	return new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil))
+}
+
+// roundRat rounds x half away from zero.
+func roundRat(x *big.Rat) int64 {
+	q, m := new(big.Int).QuoRem(x.Num(), x.Denom(), new(big.Int))
+	// x.Denom() is positive, so the remainder has the sign of x
+	if m.Abs(m).Lsh(m, 1).Cmp(x.Denom()) >= 0 {
+		q.Add(q, big.NewInt(int64(x.Sign())))
+	}
+	return q.Int64()
+}
+
+// ratesFile is the format read by LoadRatesFile. Rates may be JSON numbers
+// or strings.
+type ratesFile struct {
+	Base  string                 `json:"base"`
+	Rates map[string]json.Number `json:"rates"`
+}
+
+// LoadRatesFile reads a rate table from a JSON file such as
+//
+//	{"base": "USD", "rates": {"EUR": "0.92", "GBP": 0.79, "JPY": 151.3}}
+func LoadRatesFile(path string) (*RateTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f ratesFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	rates := make(map[string]string, len(f.Rates))
+	for currency, rate := range f.Rates {
+		rates[currency] = rate.String()
+	}
+	t, err := NewRateTable(f.Base, rates)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+// LoadRatesDB reads the rates of base from the exchange_rate table.
+func LoadRatesDB(db *sqlx.DB, base string) (*RateTable, error) {
+	t := &RateTable{base: base}
+	if err := t.LoadDB(db); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadDB replaces the rates of t with those of the exchange_rate table.
+func (t *RateTable) LoadDB(db *sqlx.DB) error {
+	var rows []struct {
+		Currency string `db:"currency"`
+		Rate     string `db:"rate"`
+	}
+	if err := db.Select(&rows, "SELECT currency, rate FROM exchange_rate;"); err != nil {
+		return err
+	}
+	rates := make(map[string]string, len(rows))
+	for _, r := range rows {
+		rates[r.Currency] = r.Rate
+	}
+	return t.Set(rates)
+}
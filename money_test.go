@@ -0,0 +1,151 @@
+package catalogue
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestMoney(t *testing.T) {
+	for _, testcase := range []struct {
+		price   string
+		money   Money
+		decimal string
+	}{
+		{"17.32", Money{1732, "USD"}, "17.32"},
+		{"0.1", Money{10, "EUR"}, "0.10"},
+		{"1500.00", Money{1500, "JPY"}, "1500"},
+		{"1500.50", Money{1501, "JPY"}, "1501"},
+		{"1.23", Money{1230, "KWD"}, "1.230"},
+		{"-2.5", Money{-250, "GBP"}, "-2.50"},
+	} {
+		price, err := ParsePrice(testcase.price)
+		if err != nil {
+			t.Errorf("ParsePrice(%s): %v", testcase.price, err)
+			continue
+		}
+		have := price.Money(testcase.money.Currency)
+		if have != testcase.money {
+			t.Errorf("%s.Money(%s): want %v, have %v", testcase.price, testcase.money.Currency, testcase.money, have)
+		}
+		if d := have.Decimal(); d != testcase.decimal {
+			t.Errorf("%v.Decimal(): want %s, have %s", have, testcase.decimal, d)
+		}
+	}
+	if p := PriceOf(Money{1234, "KWD"}); p != 123 {
+		t.Errorf("PriceOf(1.234 KWD): want 123, have %d", p)
+	}
+	for _, s := range []string{"1.234", "1e2", "1/2", "abc", ""} {
+		if _, err := ParsePrice(s); err == nil {
+			t.Errorf("ParsePrice(%q): want error", s)
+		}
+	}
+}
+
+func TestPriceScanAndJSON(t *testing.T) {
+	for _, testcase := range []struct {
+		src  interface{}
+		want Price
+	}{
+		{[]byte("17.32"), 1732},
+		{"0.10", 10},
+		{int64(15), 1500},
+		{float64(float32(17.32)), 1732},
+		{Price(250), 250},
+	} {
+		var p Price
+		if err := p.Scan(testcase.src); err != nil || p != testcase.want {
+			t.Errorf("Scan(%v): want %d, have %d, %v", testcase.src, testcase.want, p, err)
+		}
+	}
+	if v, _ := Price(1730).Value(); v != "17.30" {
+		t.Errorf("Value: want 17.30, have %v", v)
+	}
+
+	data, err := json.Marshal(Variant{SKU: "1-M", Price: newPrice(1730)})
+	if err != nil || string(data) != `{"sku":"1-M","price":17.3,"count":0}` {
+		t.Errorf("Marshal: have %s, %v", data, err)
+	}
+	var v Variant
+	if err := json.Unmarshal(data, &v); err != nil || v.Price == nil || *v.Price != 1730 {
+		t.Errorf("Unmarshal %s: have %v, %v", data, v.Price, err)
+	}
+	if err := json.Unmarshal([]byte(`{"price":0.125}`), &v); err == nil {
+		t.Errorf("Unmarshal 0.125: want error")
+	}
+}
+
+func newPrice(p Price) *Price {
+	return &p
+}
+
+func TestRateTableConvert(t *testing.T) {
+	rates, err := NewRateTable("USD", map[string]string{"EUR": "0.92", "JPY": "151.37", "KWD": "0.3075", "gbp": "0.79"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testcase := range []struct {
+		from Money
+		to   Money
+	}{
+		{Money{1732, "USD"}, Money{1593, "EUR"}}, // 15.9344
+		{Money{1000, "USD"}, Money{920, "EUR"}},  // exactly, where floats would not be
+		{Money{1732, "USD"}, Money{2622, "JPY"}}, // 2621.7284 yen
+		{Money{1732, "USD"}, Money{5326, "KWD"}}, // 5.3259 dinars
+		{Money{50, "USD"}, Money{40, "GBP"}},     // 0.395 rounds up
+		{Money{-50, "USD"}, Money{-40, "GBP"}},   // and away from zero
+		{Money{1593, "EUR"}, Money{1732, "USD"}}, // back again
+		{Money{920, "EUR"}, Money{1514, "JPY"}},  // through the base
+		{Money{1732, "USD"}, Money{1732, "USD"}},
+	} {
+		have, err := rates.Convert(testcase.from, testcase.to.Currency)
+		if err != nil {
+			t.Errorf("Convert(%v, %s): %v", testcase.from, testcase.to.Currency, err)
+			continue
+		}
+		if have != testcase.to {
+			t.Errorf("Convert(%v, %s): want %v, have %v", testcase.from, testcase.to.Currency, testcase.to, have)
+		}
+	}
+
+	if _, err := rates.Convert(Money{100, "USD"}, "CHF"); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("Convert to CHF: want %v, have %v", ErrUnknownCurrency, err)
+	}
+	if _, err := NewRateTable("USD", map[string]string{"EUR": "-1"}); err == nil {
+		t.Errorf("NewRateTable with a negative rate: want error, have nil")
+	}
+}
+
+func TestLoadRates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	if err := os.WriteFile(path, []byte(`{"base": "EUR", "rates": {"USD": "1.0870", "JPY": 164.5}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rates, err := LoadRatesFile(path)
+	if err != nil {
+		t.Fatalf("LoadRatesFile: %v", err)
+	}
+	if have, _ := rates.Convert(Money{1000, "EUR"}, "JPY"); rates.Base() != "EUR" || have != (Money{1645, "JPY"}) {
+		t.Errorf("LoadRatesFile: want 10.00 EUR in 1645 JPY, have %s in %v", rates.Base(), have)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.ExpectQuery("SELECT currency, rate FROM exchange_rate").
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "rate"}).AddRow("EUR", "0.92000000"))
+	rates, err = LoadRatesDB(sqlx.NewDb(db, "sqlmock"), "USD")
+	if err != nil {
+		t.Fatalf("LoadRatesDB: %v", err)
+	}
+	if have, _ := rates.Convert(Money{1000, "USD"}, "EUR"); have != (Money{920, "EUR"}) {
+		t.Errorf("LoadRatesDB: want 9.20 EUR, have %v", have)
+	}
+}
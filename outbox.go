@@ -0,0 +1,321 @@
+package catalogue
+
+// outbox.go publishes the events that Writer records in the outbox table, so
+// that other services (cart, orders, search) learn of price and stock changes.
+// Delivery is at least once: consumers must use the event ID to drop the
+// duplicates, see Deduplicator.
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/jmoiron/sqlx"
+)
+
+// Event types.
+const (
+	EventSockCreated  = "SockCreated"  // Data is a SockChange
+	EventSockUpdated  = "SockUpdated"  // Data is a SockChange with Previous set
+	EventStockChanged = "StockChanged" // Data is a StockChange
+)
+
+// Event is a change to the catalogue, as published to other services.
+type Event struct {
+	// ID is unique to the event and the same on every delivery of it, so
+	// that consumers can use it as an idempotency key.
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	SockID string    `json:"sockId"`
+	Tags   []string  `json:"tags,omitempty"` // of the sock, before and after the change
+	Time   time.Time `json:"time"`
+
+	Data json.RawMessage `json:"data"`
+}
+
+// SockChange is the data of SockCreated and SockUpdated events.
+type SockChange struct {
+	Sock     Sock  `json:"sock"`
+	Previous *Sock `json:"previous,omitempty"`
+}
+
+// StockChange is the data of StockChanged events.
+type StockChange struct {
+	Previous int `json:"previous"`
+	Count    int `json:"count"`
+}
+
+// EventInvalidations returns the cache entries made stale by events, for
+// use as a WithCommitHook.
+func EventInvalidations(events []Event) Invalidation {
+	var inv Invalidation
+	for _, e := range events {
+		if !contains(inv.Products, e.SockID) {
+			inv.Products = append(inv.Products, e.SockID)
+		}
+		inv.Tags = union(inv.Tags, e.Tags)
+		// Listings show the whole sock, stock included
+		inv.Listings = true
+		if e.Type != EventStockChanged {
+			inv.Counts = true
+			inv.TagList = true
+		}
+	}
+	return inv
+}
+
+// EventSink publishes events.
+type EventSink interface {
+	// Publish publishes events in order. It may have published some of them
+	// when it fails; they are published again on the next attempt.
+	Publish(ctx context.Context, events []Event) error
+}
+
+// DefaultEventStream is the Redis Stream events are published to. It is
+// outside the catalogue: namespace so that invalidating the cache leaves it
+// alone.
+const DefaultEventStream = "catalogue-events"
+
+// RedisStreamSink publishes events to a Redis Stream. Every entry has the
+// fields id, type, sock, tags (comma separated) and event, the Event as JSON.
+type RedisStreamSink struct {
+	client redis.UniversalClient
+	stream string
+	maxLen int64
+}
+
+// NewRedisStreamSink publishes events to stream, trimming it to roughly
+// maxLen entries (0 never trims).
+func NewRedisStreamSink(client redis.UniversalClient, stream string, maxLen int64) *RedisStreamSink {
+	return &RedisStreamSink{client: client, stream: stream, maxLen: maxLen}
+}
+
+// Publish adds events to the stream in a single round trip.
+func (s *RedisStreamSink) Publish(ctx context.Context, events []Event) error {
+	pipe := s.client.Pipeline()
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: s.stream,
+			MaxLen: s.maxLen,
+			Approx: true,
+			Values: []interface{}{"id", e.ID, "type", e.Type, "sock", e.SockID, "tags", strings.Join(e.Tags, ","), "event", data},
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ErrEventInProgress is returned by Deduplicator.Handle while another
+// delivery of the event is being handled. The event must not be acknowledged,
+// so that it is delivered again should that handling fail.
+var ErrEventInProgress = NewError(CodeConflict, "event is being handled")
+
+// DefaultDedupLease is how long a delivery may take to be handled before
+// another delivery of the same event is handled in its place.
+const DefaultDedupLease = time.Minute
+
+// Deduplicator lets a consumer handle each event once, although the relay
+// may deliver it more than once, by remembering the IDs of the events it has
+// handled in Redis. While an event is being handled its ID holds a lease,
+// and it is only marked handled once handle has succeeded.
+type Deduplicator struct {
+	client redis.UniversalClient
+	prefix string
+	ttl    time.Duration
+	lease  time.Duration
+}
+
+// DeduplicatorOption configures a Deduplicator.
+type DeduplicatorOption func(*Deduplicator)
+
+// WithDedupLease sets how long handling an event may take before its lease
+// runs out and a redelivery is handled, should the consumer have died.
+func WithDedupLease(d time.Duration) DeduplicatorOption {
+	return func(dd *Deduplicator) {
+		dd.lease = d
+	}
+}
+
+// NewDeduplicator remembers the events handled by consumer for ttl, which
+// must outlast any redelivery.
+func NewDeduplicator(client redis.UniversalClient, consumer string, ttl time.Duration, opts ...DeduplicatorOption) *Deduplicator {
+	d := &Deduplicator{client: client, prefix: DefaultEventStream + ":seen:" + consumer + ":", ttl: ttl, lease: DefaultDedupLease}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// dedupHandled is the value of the key of a handled event; leases hold a
+// token of their own.
+const dedupHandled = "handled"
+
+// releaseLease deletes KEYS[1] if it still holds the lease ARGV[1].
+var releaseLease = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// Handle calls handle unless the event with the given ID has been handled
+// already, in which case it returns nil, or is being handled, in which case
+// it returns ErrEventInProgress. The event is marked handled once handle has
+// succeeded; when it fails the lease is given up, so that a redelivery is
+// handled again.
+func (d *Deduplicator) Handle(ctx context.Context, id string, handle func() error) error {
+	key, lease := d.prefix+id, newUUID()
+	first, err := d.client.SetNX(ctx, key, lease, d.lease).Result()
+	if err != nil {
+		return err
+	}
+	if !first {
+		state, err := d.client.Get(ctx, key).Result()
+		switch {
+		case err == redis.Nil:
+			// Released meanwhile
+			return d.Handle(ctx, id, handle)
+		case err != nil:
+			return err
+		case state == dedupHandled:
+			return nil
+		}
+		return ErrEventInProgress
+	}
+	if err := handle(); err != nil {
+		releaseLease.Run(ctx, d.client, []string{key}, lease)
+		return err
+	}
+	return d.client.Set(ctx, key, dedupHandled, d.ttl).Err()
+}
+
+// Defaults for NewOutboxRelay.
+const (
+	DefaultRelayInterval   = time.Second
+	DefaultRelayBatch      = 100
+	DefaultOutboxRetention = 24 * time.Hour
+)
+
+// OutboxRelay publishes the unpublished events of the outbox table, oldest
+// first, and marks them published. Events whose publication cannot be marked
+// are published again, and so are those of a relay racing another replica's.
+// The events of a sock are published in the order they were committed, since
+// every write locks the sock's row.
+type OutboxRelay struct {
+	db        *sqlx.DB
+	sink      EventSink
+	logger    log.Logger
+	interval  time.Duration
+	batch     int
+	retention time.Duration
+}
+
+// OutboxRelayOption configures an OutboxRelay.
+type OutboxRelayOption func(*OutboxRelay)
+
+// WithRelayInterval sets how often the outbox is polled.
+func WithRelayInterval(d time.Duration) OutboxRelayOption {
+	return func(r *OutboxRelay) {
+		r.interval = d
+	}
+}
+
+// WithOutboxRetention sets how long published events are kept in the outbox
+// (0 keeps them forever).
+func WithOutboxRetention(d time.Duration) OutboxRelayOption {
+	return func(r *OutboxRelay) {
+		r.retention = d
+	}
+}
+
+// NewOutboxRelay creates an OutboxRelay publishing the outbox of db to sink.
+func NewOutboxRelay(db *sqlx.DB, sink EventSink, logger log.Logger, opts ...OutboxRelayOption) *OutboxRelay {
+	r := &OutboxRelay{
+		db:        db,
+		sink:      sink,
+		logger:    logger,
+		interval:  DefaultRelayInterval,
+		batch:     DefaultRelayBatch,
+		retention: DefaultOutboxRetention,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run relays events until ctx is done.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	r.logger.Log("outbox", "started", "interval", r.interval)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		// Keep relaying while full batches come back
+		for {
+			n, err := r.Relay(ctx)
+			if err != nil {
+				r.logger.Log("outbox", "error", "operation", "Relay", "error", err)
+			}
+			if err != nil || n < r.batch {
+				break
+			}
+		}
+		if r.retention > 0 {
+			if _, err := r.db.ExecContext(ctx, "DELETE FROM outbox WHERE published_at < NOW(6) - INTERVAL ? SECOND;", int64(r.retention/time.Second)); err != nil {
+				r.logger.Log("outbox", "error", "operation", "Purge", "error", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Relay publishes the next batch of events and reports how many there were.
+// An event that cannot be decoded is logged and marked published, so that it
+// does not hold up those behind it.
+func (r *OutboxRelay) Relay(ctx context.Context) (int, error) {
+	var rows []struct {
+		Seq     int64  `db:"seq"`
+		Payload []byte `db:"payload"`
+	}
+	if err := r.db.SelectContext(ctx, &rows, "SELECT seq, payload FROM outbox WHERE published_at IS NULL ORDER BY seq LIMIT ?;", r.batch); err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	seqs := make([]int64, len(rows))
+	events := make([]Event, 0, len(rows))
+	for i, row := range rows {
+		seqs[i] = row.Seq
+		var e Event
+		if err := json.Unmarshal(row.Payload, &e); err != nil {
+			r.logger.Log("outbox", "error", "operation", "Decode", "seq", row.Seq, "error", err)
+			continue
+		}
+		events = append(events, e)
+	}
+	if len(events) > 0 {
+		if err := r.sink.Publish(ctx, events); err != nil {
+			return 0, err
+		}
+	}
+	query, args, err := sqlx.In("UPDATE outbox SET published_at = NOW(6) WHERE seq IN (?);", seqs)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.db.ExecContext(ctx, query, args...); err != nil {
+		return 0, err
+	}
+	r.logger.Log("outbox", "published", "events", len(events), "seq", seqs[len(seqs)-1])
+	return len(rows), nil
+}
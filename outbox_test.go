@@ -0,0 +1,173 @@
+package catalogue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-kit/kit/log"
+	"github.com/go-redis/redis/v8"
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// fakeSink records the events published to it, or fails with err.
+type fakeSink struct {
+	published []Event
+	err       error
+}
+
+func (s *fakeSink) Publish(_ context.Context, events []Event) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.published = append(s.published, events...)
+	return nil
+}
+
+func TestOutboxRelay(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening stub database connection", err)
+	}
+	defer db.Close()
+	sink := &fakeSink{err: errors.New("connection refused")}
+	relay := NewOutboxRelay(sqlx.NewDb(db, "sqlmock"), sink, log.NewNopLogger())
+
+	event, err := newEvent(EventStockChanged, s1.ID, s1.Tags, StockChange{Previous: 1, Count: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(event)
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"seq", "payload"}).AddRow(4, payload).AddRow(5, "not json")
+	}
+
+	// Nothing is marked published while the sink fails
+	mock.ExpectQuery("SELECT seq, payload FROM outbox").WithArgs(DefaultRelayBatch).WillReturnRows(rows())
+	if _, err := relay.Relay(context.Background()); err == nil {
+		t.Errorf("Relay to a failing sink: want error, have nil")
+	}
+
+	sink.err = nil
+	mock.ExpectQuery("SELECT seq, payload FROM outbox").WithArgs(DefaultRelayBatch).WillReturnRows(rows())
+	mock.ExpectExec("UPDATE outbox SET published_at").WithArgs(4, 5).WillReturnResult(sqlmock.NewResult(0, 2))
+	n, err := relay.Relay(context.Background())
+	if err != nil || n != 2 {
+		t.Fatalf("Relay: want 2 rows relayed, have %d, %v", n, err)
+	}
+	if len(sink.published) != 1 || sink.published[0].ID != event.ID || sink.published[0].Type != EventStockChanged {
+		t.Errorf("Relay: want %+v published, have %+v", event, sink.published)
+	}
+
+	mock.ExpectQuery("SELECT seq, payload FROM outbox").WillReturnRows(sqlmock.NewRows([]string{"seq", "payload"}))
+	if n, err := relay.Relay(context.Background()); err != nil || n != 0 {
+		t.Errorf("Relay with nothing to publish: want 0, have %d, %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+// newMiniredis returns a client of a Redis server that lives as long as t.
+func newMiniredis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+func TestRedisStreamSink(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newMiniredis(t)
+	sink := NewRedisStreamSink(client, DefaultEventStream, 0)
+
+	created, _ := newEvent(EventSockCreated, s1.ID, s1.Tags, SockChange{Sock: s1})
+	stock, _ := newEvent(EventStockChanged, s1.ID, s1.Tags, StockChange{Previous: 1, Count: 0})
+	if err := sink.Publish(ctx, []Event{created, stock}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	entries, err := client.XRange(ctx, DefaultEventStream, "-", "+").Result()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("XRange: want 2 entries, have %v, %v", entries, err)
+	}
+	for i, want := range []Event{created, stock} {
+		v := entries[i].Values
+		if v["id"] != want.ID || v["type"] != want.Type || v["sock"] != s1.ID || v["tags"] != "odd,prime" {
+			t.Errorf("entry %d: want the fields of %s, have %v", i, want.Type, v)
+		}
+		var have Event
+		if err := json.Unmarshal([]byte(v["event"].(string)), &have); err != nil || have.ID != want.ID || string(have.Data) != string(want.Data) {
+			t.Errorf("entry %d: want %s as JSON, have %v (%v)", i, want.ID, v["event"], err)
+		}
+	}
+
+	mr.SetError("READONLY You can't write against a read only replica")
+	if err := sink.Publish(ctx, []Event{stock}); err == nil {
+		t.Errorf("Publish to a failing Redis: want error, have nil")
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newMiniredis(t)
+	d := NewDeduplicator(client, "cart", time.Hour, WithDedupLease(time.Minute))
+
+	calls := 0
+	handle := func() error { calls++; return nil }
+	for i := 0; i < 2; i++ {
+		if err := d.Handle(ctx, "e1", handle); err != nil {
+			t.Fatalf("Handle #%d: %v", i, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Handle twice: want it handled once, have %d", calls)
+	}
+	if ttl := mr.TTL(DefaultEventStream + ":seen:cart:e1"); ttl != time.Hour {
+		t.Errorf("handled: want it remembered for an hour, have %v", ttl)
+	}
+
+	// A redelivery while the first is being handled is neither handled nor
+	// skipped, and is handled once the first fails
+	started, finish := make(chan struct{}), make(chan error)
+	first := make(chan error)
+	go func() {
+		first <- d.Handle(ctx, "e2", func() error {
+			close(started)
+			return <-finish
+		})
+	}()
+	<-started
+	calls = 0
+	if err := d.Handle(ctx, "e2", handle); err != ErrEventInProgress || calls != 0 {
+		t.Errorf("Handle while in progress: want %v, have %v and %d calls", ErrEventInProgress, err, calls)
+	}
+	finish <- errors.New("cart unavailable")
+	if err := <-first; err == nil {
+		t.Fatalf("failing handle: want its error, have nil")
+	}
+	if err := d.Handle(ctx, "e2", handle); err != nil || calls != 1 {
+		t.Errorf("Handle after a failure: want it handled, have %v and %d calls", err, calls)
+	}
+
+	// A consumer that dies holding the lease only holds it until it runs out
+	mr.Set(DefaultEventStream+":seen:cart:e3", "lease-of-a-dead-consumer")
+	mr.SetTTL(DefaultEventStream+":seen:cart:e3", time.Minute)
+	calls = 0
+	if err := d.Handle(ctx, "e3", handle); err != ErrEventInProgress {
+		t.Errorf("Handle while leased: want %v, have %v", ErrEventInProgress, err)
+	}
+	mr.FastForward(time.Minute)
+	if err := d.Handle(ctx, "e3", handle); err != nil || calls != 1 {
+		t.Errorf("Handle once the lease ran out: want it handled, have %v and %d calls", err, calls)
+	}
+
+	mr.SetError("LOADING")
+	if err := d.Handle(ctx, "e4", handle); err == nil {
+		t.Errorf("Handle without Redis: want error, have nil")
+	}
+}
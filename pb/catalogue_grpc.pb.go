@@ -0,0 +1,290 @@
+// The gRPC interface of the catalogue: the reads of the HTTP routes of
+// transport.go, served by MakeGRPCServer. Run compile.sh after changing it.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: catalogue.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Catalogue_List_FullMethodName   = "/catalogue.Catalogue/List"
+	Catalogue_Count_FullMethodName  = "/catalogue.Catalogue/Count"
+	Catalogue_Get_FullMethodName    = "/catalogue.Catalogue/Get"
+	Catalogue_Tags_FullMethodName   = "/catalogue.Catalogue/Tags"
+	Catalogue_Health_FullMethodName = "/catalogue.Catalogue/Health"
+)
+
+// CatalogueClient is the client API for Catalogue service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type CatalogueClient interface {
+	// List returns a page of socks, as GET /catalogue does.
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListReply, error)
+	// Count returns how many socks List would return over all pages, as GET
+	// /catalogue/size does.
+	Count(ctx context.Context, in *CountRequest, opts ...grpc.CallOption) (*CountReply, error)
+	// Get returns a sock, or NOT_FOUND, as GET /catalogue/{id} does.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetReply, error)
+	// Tags returns every tag, as GET /tags does.
+	Tags(ctx context.Context, in *TagsRequest, opts ...grpc.CallOption) (*TagsReply, error)
+	// Health returns the health of the service and its database, as GET
+	// /health does.
+	Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthReply, error)
+}
+
+type catalogueClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCatalogueClient(cc grpc.ClientConnInterface) CatalogueClient {
+	return &catalogueClient{cc}
+}
+
+func (c *catalogueClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListReply)
+	err := c.cc.Invoke(ctx, Catalogue_List_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *catalogueClient) Count(ctx context.Context, in *CountRequest, opts ...grpc.CallOption) (*CountReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CountReply)
+	err := c.cc.Invoke(ctx, Catalogue_Count_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *catalogueClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetReply)
+	err := c.cc.Invoke(ctx, Catalogue_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *catalogueClient) Tags(ctx context.Context, in *TagsRequest, opts ...grpc.CallOption) (*TagsReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TagsReply)
+	err := c.cc.Invoke(ctx, Catalogue_Tags_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *catalogueClient) Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HealthReply)
+	err := c.cc.Invoke(ctx, Catalogue_Health_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CatalogueServer is the server API for Catalogue service.
+// All implementations must embed UnimplementedCatalogueServer
+// for forward compatibility.
+type CatalogueServer interface {
+	// List returns a page of socks, as GET /catalogue does.
+	List(context.Context, *ListRequest) (*ListReply, error)
+	// Count returns how many socks List would return over all pages, as GET
+	// /catalogue/size does.
+	Count(context.Context, *CountRequest) (*CountReply, error)
+	// Get returns a sock, or NOT_FOUND, as GET /catalogue/{id} does.
+	Get(context.Context, *GetRequest) (*GetReply, error)
+	// Tags returns every tag, as GET /tags does.
+	Tags(context.Context, *TagsRequest) (*TagsReply, error)
+	// Health returns the health of the service and its database, as GET
+	// /health does.
+	Health(context.Context, *HealthRequest) (*HealthReply, error)
+	mustEmbedUnimplementedCatalogueServer()
+}
+
+// UnimplementedCatalogueServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedCatalogueServer struct{}
+
+func (UnimplementedCatalogueServer) List(context.Context, *ListRequest) (*ListReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedCatalogueServer) Count(context.Context, *CountRequest) (*CountReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Count not implemented")
+}
+func (UnimplementedCatalogueServer) Get(context.Context, *GetRequest) (*GetReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedCatalogueServer) Tags(context.Context, *TagsRequest) (*TagsReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Tags not implemented")
+}
+func (UnimplementedCatalogueServer) Health(context.Context, *HealthRequest) (*HealthReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Health not implemented")
+}
+func (UnimplementedCatalogueServer) mustEmbedUnimplementedCatalogueServer() {}
+func (UnimplementedCatalogueServer) testEmbeddedByValue()                   {}
+
+// UnsafeCatalogueServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CatalogueServer will
+// result in compilation errors.
+type UnsafeCatalogueServer interface {
+	mustEmbedUnimplementedCatalogueServer()
+}
+
+func RegisterCatalogueServer(s grpc.ServiceRegistrar, srv CatalogueServer) {
+	// If the following call pancis, it indicates UnimplementedCatalogueServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Catalogue_ServiceDesc, srv)
+}
+
+func _Catalogue_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CatalogueServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Catalogue_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CatalogueServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Catalogue_Count_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CatalogueServer).Count(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Catalogue_Count_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CatalogueServer).Count(ctx, req.(*CountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Catalogue_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CatalogueServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Catalogue_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CatalogueServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Catalogue_Tags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TagsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CatalogueServer).Tags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Catalogue_Tags_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CatalogueServer).Tags(ctx, req.(*TagsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Catalogue_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CatalogueServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Catalogue_Health_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CatalogueServer).Health(ctx, req.(*HealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Catalogue_ServiceDesc is the grpc.ServiceDesc for Catalogue service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Catalogue_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "catalogue.Catalogue",
+	HandlerType: (*CatalogueServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "List",
+			Handler:    _Catalogue_List_Handler,
+		},
+		{
+			MethodName: "Count",
+			Handler:    _Catalogue_Count_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _Catalogue_Get_Handler,
+		},
+		{
+			MethodName: "Tags",
+			Handler:    _Catalogue_Tags_Handler,
+		},
+		{
+			MethodName: "Health",
+			Handler:    _Catalogue_Health_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "catalogue.proto",
+}
@@ -0,0 +1,13 @@
+#!/usr/bin/env sh
+
+# Regenerates catalogue.pb.go and catalogue_grpc.pb.go from catalogue.proto.
+# Needs protoc (https://github.com/protocolbuffers/protobuf/releases) and the
+# Go plugins:
+#
+#   go install google.golang.org/protobuf/cmd/protoc-gen-go@v1.34.2
+#   go install google.golang.org/grpc/cmd/protoc-gen-go-grpc@v1.5.1
+
+cd "$(dirname "$0")" || exit 1
+protoc catalogue.proto \
+	--go_out=. --go_opt=paths=source_relative \
+	--go-grpc_out=. --go-grpc_opt=paths=source_relative
@@ -4,6 +4,8 @@ package catalogue
 // catalogue service. Everything here is agnostic to the transport (HTTP).
 
 import (
+	"bytes"
+	"database/sql"
 	"errors"
 	"strings"
 	"time"
@@ -15,28 +17,104 @@ import (
 // Service is the catalogue service, providing read operations on a saleable
 // catalogue of sock products.
 type Service interface {
-	List(tags []string, order string, pageNum, pageSize int) ([]Sock, error) // GET /catalogue
-	Count(tags []string) (int, error)                                        // GET /catalogue/size
+	List(filter Filter, order string, pageNum, pageSize int) ([]Sock, error) // GET /catalogue
+	Count(filter Filter) (int, error)                                        // GET /catalogue/size
 	Get(id string) (Sock, error)                                             // GET /catalogue/{id}
 	Tags() ([]string, error)                                                 // GET /tags
 	Health() []Health                                                        // GET /health
 }
 
+// Filter selects the socks List and Count return: those with any of Tags, or
+// every sock if there are none, that come in VariantSize if it is set.
+type Filter struct {
+	Tags        []string
+	VariantSize string
+}
+
 // Middleware decorates a Service.
 type Middleware func(Service) Service
 
+// MultiGetter is implemented by services that can get several socks at once
+// for less than a Get each, see GetSocks.
+type MultiGetter interface {
+	// GetMany returns the socks of ids that exist, once each, in the order
+	// of ids.
+	GetMany(ids []string) ([]Sock, error)
+}
+
+// GetSocks returns the socks of ids that exist, once each, in the order of
+// ids: with GetMany if s is a MultiGetter, with a Get for each of them
+// otherwise. If any of them was a stale copy, ErrStale is returned along with
+// the socks.
+func GetSocks(s Service, ids []string) ([]Sock, error) {
+	if m, ok := s.(MultiGetter); ok {
+		return m.GetMany(ids)
+	}
+	socks := make([]Sock, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	var stale error
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		sock, err := s.Get(id)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			continue
+		case errors.Is(err, ErrStale):
+			stale = err
+		case err != nil:
+			return nil, err
+		}
+		socks = append(socks, sock)
+	}
+	return socks, stale
+}
+
 // Sock describes the thing on offer in the catalogue.
 type Sock struct {
-	ID          string   `json:"id" db:"id"`
-	Name        string   `json:"name" db:"name"`
-	Description string   `json:"description" db:"description"`
-	ImageURL    []string `json:"imageUrl" db:"-"`
-	ImageURL_1  string   `json:"-" db:"image_url_1"`
-	ImageURL_2  string   `json:"-" db:"image_url_2"`
-	Price       float32  `json:"price" db:"price"`
-	Count       int      `json:"count" db:"count"`
-	Tags        []string `json:"tag" db:"-"`
-	TagString   string   `json:"-" db:"tag_name"`
+	ID          string     `json:"id" db:"id"`
+	Name        string     `json:"name" db:"name"`
+	Description string     `json:"description" db:"description"`
+	ImageURL    []string   `json:"imageUrl" db:"-"`
+	ImageURL_1  string     `json:"-" db:"image_url_1"`
+	ImageURL_2  string     `json:"-" db:"image_url_2"`
+	Price       Price      `json:"price" db:"price"`
+	Money       *Money     `json:"money,omitempty" db:"-"` // Price to the minor unit, see ConvertEndpoints
+	Count       int        `json:"count" db:"count"`
+	Tags        []string   `json:"tag" db:"-"`
+	TagString   string     `json:"-" db:"tag_name"`
+	Variants    []Variant  `json:"variants,omitempty" db:"-"`
+	Images      []Image    `json:"images,omitempty" db:"-"`
+	UpdatedAt   *time.Time `json:"updatedAt,omitempty" db:"-"` // see LastModified
+	Updated     int64      `json:"-" db:"updated_at"`          // Unix time
+}
+
+// Variant is one size and colour of a sock, with its own stock. List and Get
+// return the variants of every sock; List and Count given a variant size
+// only count socks that come in it.
+type Variant struct {
+	SKU    string `json:"sku" db:"sku"`
+	SockID string `json:"-" db:"sock_id"`
+	Size   string `json:"size,omitempty" db:"size"`
+	Colour string `json:"colour,omitempty" db:"colour"`
+	Price  *Price `json:"price,omitempty" db:"price"` // overrides the price of the sock
+	Money  *Money `json:"money,omitempty" db:"-"`
+	Count  int    `json:"count" db:"count"`
+}
+
+// Image is a picture of a sock. A sock has any number of images, the primary
+// one first; ImageURL lists their URLs in the same order for clients that
+// predate them.
+type Image struct {
+	SockID   string `json:"-" db:"sock_id"`
+	URL      string `json:"url" db:"url"`
+	Alt      string `json:"alt,omitempty" db:"alt"`
+	Width    int    `json:"width,omitempty" db:"width"`
+	Height   int    `json:"height,omitempty" db:"height"`
+	Primary  bool   `json:"primary" db:"is_primary"`
+	Position int    `json:"-" db:"position"`
 }
 
 // Health describes the health of a service
@@ -47,12 +125,12 @@ type Health struct {
 }
 
 // ErrNotFound is returned when there is no sock for a given ID.
-var ErrNotFound = errors.New("not found")
+var ErrNotFound = NewError(CodeNotFound, "not found")
 
 // ErrDBConnection is returned when connection with the database fails.
-var ErrDBConnection = errors.New("database connection error")
+var ErrDBConnection = NewError(CodeUnavailable, "database connection error")
 
-var baseQuery = "SELECT sock.sock_id AS id, sock.name, sock.description, sock.price, sock.count, sock.image_url_1, sock.image_url_2, GROUP_CONCAT(tag.name) AS tag_name FROM sock JOIN sock_tag ON sock.sock_id=sock_tag.sock_id JOIN tag ON sock_tag.tag_id=tag.tag_id"
+var baseQuery = "SELECT sock.sock_id AS id, sock.name, sock.description, sock.price, sock.count, sock.image_url_1, sock.image_url_2, UNIX_TIMESTAMP(sock.updated_at) AS updated_at, GROUP_CONCAT(tag.name) AS tag_name FROM sock JOIN sock_tag ON sock.sock_id=sock_tag.sock_id JOIN tag ON sock_tag.tag_id=tag.tag_id"
 
 // NewCatalogueService returns an implementation of the Service interface,
 // with connection to an SQL database.
@@ -68,21 +146,10 @@ type catalogueService struct {
 	logger log.Logger
 }
 
-func (s *catalogueService) List(tags []string, order string, pageNum, pageSize int) ([]Sock, error) {
+func (s *catalogueService) List(filter Filter, order string, pageNum, pageSize int) ([]Sock, error) {
 	var socks []Sock
-	query := baseQuery
-
-	var args []interface{}
-
-	for i, t := range tags {
-		if i == 0 {
-			query += " WHERE tag.name=?"
-			args = append(args, t)
-		} else {
-			query += " OR tag.name=?"
-			args = append(args, t)
-		}
-	}
+	where, args := filterClause(filter)
+	query := baseQuery + where
 
 	query += " GROUP BY id"
 
@@ -101,30 +168,28 @@ func (s *catalogueService) List(tags []string, order string, pageNum, pageSize i
 	for i, s := range socks {
 		socks[i].ImageURL = []string{s.ImageURL_1, s.ImageURL_2}
 		socks[i].Tags = strings.Split(s.TagString, ",")
+		socks[i].UpdatedAt = unixTime(s.Updated)
 	}
 
 	// DEMO: Change 0 to 850
 	time.Sleep(0 * time.Millisecond)
 
 	socks = cut(socks, pageNum, pageSize)
+	if err := s.loadVariants(socks, filter.VariantSize); err != nil {
+		s.logger.Log("database error", err)
+		return []Sock{}, ErrDBConnection
+	}
+	if err := s.loadImages(socks); err != nil {
+		s.logger.Log("database error", err)
+		return []Sock{}, ErrDBConnection
+	}
 
 	return socks, nil
 }
 
-func (s *catalogueService) Count(tags []string) (int, error) {
-	query := "SELECT COUNT(DISTINCT sock.sock_id) FROM sock JOIN sock_tag ON sock.sock_id=sock_tag.sock_id JOIN tag ON sock_tag.tag_id=tag.tag_id"
-
-	var args []interface{}
-
-	for i, t := range tags {
-		if i == 0 {
-			query += " WHERE tag.name=?"
-			args = append(args, t)
-		} else {
-			query += " OR tag.name=?"
-			args = append(args, t)
-		}
-	}
+func (s *catalogueService) Count(filter Filter) (int, error) {
+	where, args := filterClause(filter)
+	query := "SELECT COUNT(DISTINCT sock.sock_id) FROM sock JOIN sock_tag ON sock.sock_id=sock_tag.sock_id JOIN tag ON sock_tag.tag_id=tag.tag_id" + where
 
 	query += ";"
 
@@ -152,15 +217,211 @@ func (s *catalogueService) Get(id string) (Sock, error) {
 
 	var sock Sock
 	err := s.db.Get(&sock, query, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Sock{}, ErrNotFound
+	}
 	if err != nil {
 		s.logger.Log("database error", err)
-		return Sock{}, ErrNotFound
+		return Sock{}, ErrDBConnection
 	}
 
 	sock.ImageURL = []string{sock.ImageURL_1, sock.ImageURL_2}
 	sock.Tags = strings.Split(sock.TagString, ",")
+	sock.UpdatedAt = unixTime(sock.Updated)
 
-	return sock, nil
+	socks := []Sock{sock}
+	if err := s.loadVariants(socks, ""); err != nil {
+		s.logger.Log("database error", err)
+		return Sock{}, ErrDBConnection
+	}
+	if err := s.loadImages(socks); err != nil {
+		s.logger.Log("database error", err)
+		return Sock{}, ErrDBConnection
+	}
+
+	return socks[0], nil
+}
+
+// GetMany reads the socks of ids in one query, rather than one each as Get
+// would, and their variants and images in one more each.
+func (s *catalogueService) GetMany(ids []string) ([]Sock, error) {
+	if len(ids) == 0 {
+		return []Sock{}, nil
+	}
+	query, args, err := sqlx.In(baseQuery+" WHERE sock.sock_id IN (?) GROUP BY sock.sock_id;", ids)
+	if err != nil {
+		return nil, err
+	}
+	var found []Sock
+	if err := s.db.Select(&found, s.db.Rebind(query), args...); err != nil {
+		s.logger.Log("database error", err)
+		return []Sock{}, ErrDBConnection
+	}
+	byID := make(map[string]Sock, len(found))
+	for _, sock := range found {
+		sock.ImageURL = []string{sock.ImageURL_1, sock.ImageURL_2}
+		sock.Tags = strings.Split(sock.TagString, ",")
+		sock.UpdatedAt = unixTime(sock.Updated)
+		byID[sock.ID] = sock
+	}
+	socks := make([]Sock, 0, len(found))
+	for _, id := range ids {
+		if sock, ok := byID[id]; ok {
+			socks = append(socks, sock)
+			delete(byID, id)
+		}
+	}
+	if err := s.loadVariants(socks, ""); err != nil {
+		s.logger.Log("database error", err)
+		return []Sock{}, ErrDBConnection
+	}
+	if err := s.loadImages(socks); err != nil {
+		s.logger.Log("database error", err)
+		return []Sock{}, ErrDBConnection
+	}
+	return socks, nil
+}
+
+// filterClause returns the WHERE clause selecting the socks of filter.
+func filterClause(filter Filter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if tags := filter.Tags; len(tags) > 0 {
+		conditions = append(conditions, "("+strings.Repeat("tag.name=? OR ", len(tags)-1)+"tag.name=?)")
+		for _, t := range tags {
+			args = append(args, t)
+		}
+	}
+	if filter.VariantSize != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM sock_variant WHERE sock_variant.sock_id=sock.sock_id AND sock_variant.size=?)")
+		args = append(args, filter.VariantSize)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// loadVariants fills in the variants of socks, only those of variantSize if
+// it is set. They are read in one query for the whole page rather than joined
+// into baseQuery, where every variant would repeat the sock's tags in
+// GROUP_CONCAT.
+func (s *catalogueService) loadVariants(socks []Sock, variantSize string) error {
+	if len(socks) == 0 {
+		return nil
+	}
+	ids := make([]string, len(socks))
+	bySock := make(map[string]int, len(socks))
+	for i, sock := range socks {
+		ids[i] = sock.ID
+		bySock[sock.ID] = i
+	}
+	query, args, err := sqlx.In("SELECT sku, sock_id, size, colour, price, count FROM sock_variant WHERE sock_id IN (?)", ids)
+	if err != nil {
+		return err
+	}
+	if variantSize != "" {
+		query += " AND size=?"
+		args = append(args, variantSize)
+	}
+	var variants []Variant
+	if err := s.db.Select(&variants, s.db.Rebind(query+" ORDER BY sock_id, sku;"), args...); err != nil {
+		return err
+	}
+	for _, v := range variants {
+		if i, ok := bySock[v.SockID]; ok {
+			socks[i].Variants = append(socks[i].Variants, v)
+		}
+	}
+	return nil
+}
+
+// loadImages fills in the images of socks, primary first, and lists their
+// URLs in ImageURL. Socks without rows in sock_image keep the URLs of their
+// image_url columns.
+func (s *catalogueService) loadImages(socks []Sock) error {
+	if len(socks) == 0 {
+		return nil
+	}
+	ids := make([]string, len(socks))
+	bySock := make(map[string]int, len(socks))
+	for i, sock := range socks {
+		ids[i] = sock.ID
+		bySock[sock.ID] = i
+	}
+	query, args, err := sqlx.In("SELECT sock_id, url, alt, width, height, is_primary, position FROM sock_image WHERE sock_id IN (?) ORDER BY sock_id, is_primary DESC, position;", ids)
+	if err != nil {
+		return err
+	}
+	var images []Image
+	if err := s.db.Select(&images, s.db.Rebind(query), args...); err != nil {
+		return err
+	}
+	for _, img := range images {
+		if i, ok := bySock[img.SockID]; ok {
+			socks[i].Images = append(socks[i].Images, img)
+		}
+	}
+	for i := range socks {
+		if len(socks[i].Images) > 0 {
+			socks[i].ImageURL = imageURLs(socks[i].Images)
+		}
+	}
+	return nil
+}
+
+// unixTime returns the time of a Unix timestamp read from the database, or
+// nil for rows that predate their column.
+func unixTime(sec int64) *time.Time {
+	if sec <= 0 {
+		return nil
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t
+}
+
+// LastModified returns when the last of socks was updated, or the zero time
+// if none of them know.
+func LastModified(socks ...Sock) time.Time {
+	var last time.Time
+	for _, sock := range socks {
+		if sock.UpdatedAt != nil && sock.UpdatedAt.After(last) {
+			last = *sock.UpdatedAt
+		}
+	}
+	return last
+}
+
+// lastModifiedJSON is LastModified of socks encoded as JSON, found without
+// decoding them. Quotes within strings are escaped, so "updatedAt":" only
+// appears as the key.
+func lastModifiedJSON(data []byte) time.Time {
+	var last time.Time
+	key := []byte(`"updatedAt":"`)
+	for {
+		i := bytes.Index(data, key)
+		if i < 0 {
+			return last
+		}
+		data = data[i+len(key):]
+		end := bytes.IndexByte(data, '"')
+		if end < 0 {
+			return last
+		}
+		if t, err := time.Parse(time.RFC3339Nano, string(data[:end])); err == nil && t.After(last) {
+			last = t
+		}
+		data = data[end:]
+	}
+}
+
+// imageURLs returns the URLs of images.
+func imageURLs(images []Image) []string {
+	urls := make([]string, len(images))
+	for i, img := range images {
+		urls[i] = img.URL
+	}
+	return urls
 }
 
 func (s *catalogueService) Health() []Health {
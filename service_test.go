@@ -1,10 +1,12 @@
 package catalogue
 
 import (
+	"errors"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/jmoiron/sqlx"
@@ -12,11 +14,11 @@ import (
 )
 
 var (
-	s1 = Sock{ID: "1", Name: "name1", Description: "description1", Price: 1.1, Count: 1, ImageURL: []string{"ImageUrl_11", "ImageUrl_21"}, ImageURL_1: "ImageUrl_11", ImageURL_2: "ImageUrl_21", Tags: []string{"odd", "prime"}, TagString: "odd,prime"}
-	s2 = Sock{ID: "2", Name: "name2", Description: "description2", Price: 1.2, Count: 2, ImageURL: []string{"ImageUrl_12", "ImageUrl_22"}, ImageURL_1: "ImageUrl_12", ImageURL_2: "ImageUrl_22", Tags: []string{"even", "prime"}, TagString: "even,prime"}
-	s3 = Sock{ID: "3", Name: "name3", Description: "description3", Price: 1.3, Count: 3, ImageURL: []string{"ImageUrl_13", "ImageUrl_23"}, ImageURL_1: "ImageUrl_13", ImageURL_2: "ImageUrl_23", Tags: []string{"odd", "prime"}, TagString: "odd,prime"}
-	s4 = Sock{ID: "4", Name: "name4", Description: "description4", Price: 1.4, Count: 4, ImageURL: []string{"ImageUrl_14", "ImageUrl_24"}, ImageURL_1: "ImageUrl_14", ImageURL_2: "ImageUrl_24", Tags: []string{"even"}, TagString: "even"}
-	s5 = Sock{ID: "5", Name: "name5", Description: "description5", Price: 1.5, Count: 5, ImageURL: []string{"ImageUrl_15", "ImageUrl_25"}, ImageURL_1: "ImageUrl_15", ImageURL_2: "ImageUrl_25", Tags: []string{"odd", "prime"}, TagString: "odd,prime"}
+	s1 = Sock{ID: "1", Name: "name1", Description: "description1", Price: 110, Count: 1, ImageURL: []string{"ImageUrl_11", "ImageUrl_21"}, ImageURL_1: "ImageUrl_11", ImageURL_2: "ImageUrl_21", Tags: []string{"odd", "prime"}, TagString: "odd,prime"}
+	s2 = Sock{ID: "2", Name: "name2", Description: "description2", Price: 120, Count: 2, ImageURL: []string{"ImageUrl_12", "ImageUrl_22"}, ImageURL_1: "ImageUrl_12", ImageURL_2: "ImageUrl_22", Tags: []string{"even", "prime"}, TagString: "even,prime"}
+	s3 = Sock{ID: "3", Name: "name3", Description: "description3", Price: 130, Count: 3, ImageURL: []string{"ImageUrl_13", "ImageUrl_23"}, ImageURL_1: "ImageUrl_13", ImageURL_2: "ImageUrl_23", Tags: []string{"odd", "prime"}, TagString: "odd,prime"}
+	s4 = Sock{ID: "4", Name: "name4", Description: "description4", Price: 140, Count: 4, ImageURL: []string{"ImageUrl_14", "ImageUrl_24"}, ImageURL_1: "ImageUrl_14", ImageURL_2: "ImageUrl_24", Tags: []string{"even"}, TagString: "even"}
+	s5 = Sock{ID: "5", Name: "name5", Description: "description5", Price: 150, Count: 5, ImageURL: []string{"ImageUrl_15", "ImageUrl_25"}, ImageURL_1: "ImageUrl_15", ImageURL_2: "ImageUrl_25", Tags: []string{"odd", "prime"}, TagString: "odd,prime"}
 
 	socks = []Sock{s1, s2, s3, s4, s5}
 	tags  = []string{"odd", "even", "prime"}
@@ -24,6 +26,10 @@ var (
 
 var logger log.Logger
 
+var variantCols = []string{"sku", "sock_id", "size", "colour", "price", "count"}
+
+var imageCols = []string{"sock_id", "url", "alt", "width", "height", "is_primary", "position"}
+
 func TestCatalogueServiceList(t *testing.T) {
 	logger = log.NewLogfmtLogger(os.Stderr)
 	db, mock, err := sqlmock.New()
@@ -42,18 +48,24 @@ func TestCatalogueServiceList(t *testing.T) {
 		AddRow(s3.ID, s3.Name, s3.Description, s3.Price, s3.Count, s3.ImageURL[0], s3.ImageURL[1], strings.Join(s3.Tags, ",")).
 		AddRow(s4.ID, s4.Name, s4.Description, s4.Price, s4.Count, s4.ImageURL[0], s4.ImageURL[1], strings.Join(s4.Tags, ",")).
 		AddRow(s5.ID, s5.Name, s5.Description, s5.Price, s5.Count, s5.ImageURL[0], s5.ImageURL[1], strings.Join(s5.Tags, ",")))
+	mock.ExpectQuery("SELECT sku").WillReturnRows(sqlmock.NewRows(variantCols))
+	mock.ExpectQuery("SELECT sock_id, url").WillReturnRows(sqlmock.NewRows(imageCols))
 
 	// Test Case 2
 	mock.ExpectQuery("SELECT *").WillReturnRows(sqlmock.NewRows(cols).
 		AddRow(s4.ID, s4.Name, s4.Description, s4.Price, s4.Count, s4.ImageURL[0], s4.ImageURL[1], strings.Join(s4.Tags, ",")).
 		AddRow(s1.ID, s1.Name, s1.Description, s1.Price, s1.Count, s1.ImageURL[0], s1.ImageURL[1], strings.Join(s1.Tags, ",")).
 		AddRow(s2.ID, s2.Name, s2.Description, s2.Price, s2.Count, s2.ImageURL[0], s2.ImageURL[1], strings.Join(s2.Tags, ",")))
+	mock.ExpectQuery("SELECT sku").WillReturnRows(sqlmock.NewRows(variantCols))
+	mock.ExpectQuery("SELECT sock_id, url").WillReturnRows(sqlmock.NewRows(imageCols))
 
 	// // Test Case 3
 	mock.ExpectQuery("SELECT *").WillReturnRows(sqlmock.NewRows(cols).
 		AddRow(s1.ID, s1.Name, s1.Description, s1.Price, s1.Count, s1.ImageURL[0], s1.ImageURL[1], strings.Join(s1.Tags, ",")).
 		AddRow(s3.ID, s3.Name, s3.Description, s3.Price, s3.Count, s3.ImageURL[0], s3.ImageURL[1], strings.Join(s3.Tags, ",")).
 		AddRow(s5.ID, s5.Name, s5.Description, s5.Price, s5.Count, s5.ImageURL[0], s5.ImageURL[1], strings.Join(s5.Tags, ",")))
+	mock.ExpectQuery("SELECT sku").WillReturnRows(sqlmock.NewRows(variantCols))
+	mock.ExpectQuery("SELECT sock_id, url").WillReturnRows(sqlmock.NewRows(imageCols))
 
 	s := NewCatalogueService(sqlxDB, logger)
 	for _, testcase := range []struct {
@@ -85,7 +97,7 @@ func TestCatalogueServiceList(t *testing.T) {
 			want:     []Sock{s5},
 		},
 	} {
-		have, err := s.List(testcase.tags, testcase.order, testcase.pageNum, testcase.pageSize)
+		have, err := s.List(Filter{Tags: testcase.tags}, testcase.order, testcase.pageNum, testcase.pageSize)
 		if err != nil {
 			t.Errorf(
 				"List(%v, %s, %d, %d): returned error %s",
@@ -127,12 +139,11 @@ func TestCatalogueServiceCount(t *testing.T) {
 		{[]string{"prime"}, 4},
 		{[]string{"even", "prime"}, 1},
 	} {
-		have, err := s.Count(testcase.tags)
+		have, err := s.Count(Filter{Tags: testcase.tags})
 		if err != nil {
 			t.Errorf(
 				"Count(%v): returned error %s",
 				testcase.tags, err.Error(),
-				err.Error(),
 			)
 		}
 		if want := testcase.want; want != have {
@@ -158,6 +169,8 @@ func TestCatalogueServiceGet(t *testing.T) {
 	// Test Case 2
 	mock.ExpectQuery("SELECT *").WillReturnRows(sqlmock.NewRows(cols).
 		AddRow(s3.ID, s3.Name, s3.Description, s3.Price, s3.Count, s3.ImageURL[0], s3.ImageURL[1], strings.Join(s3.Tags, ",")))
+	mock.ExpectQuery("SELECT sku").WillReturnRows(sqlmock.NewRows(variantCols))
+	mock.ExpectQuery("SELECT sock_id, url").WillReturnRows(sqlmock.NewRows(imageCols))
 
 	s := NewCatalogueService(sqlxDB, logger)
 	{
@@ -189,6 +202,51 @@ func TestCatalogueServiceGet(t *testing.T) {
 	}
 }
 
+func TestCatalogueServiceVariants(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening stub database connection", err)
+	}
+	defer db.Close()
+	s := NewCatalogueService(sqlx.NewDb(db, "sqlmock"), log.NewNopLogger())
+
+	cols := []string{"id", "name", "description", "price", "count", "image_url_1", "image_url_2", "tag_name"}
+	mock.ExpectQuery(`WHERE \(tag.name=\? OR tag.name=\?\) AND EXISTS \(SELECT 1 FROM sock_variant`).
+		WithArgs("odd", "even", "M", "id").
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(s1.ID, s1.Name, s1.Description, s1.Price, s1.Count, s1.ImageURL[0], s1.ImageURL[1], strings.Join(s1.Tags, ",")).
+			AddRow(s2.ID, s2.Name, s2.Description, s2.Price, s2.Count, s2.ImageURL[0], s2.ImageURL[1], strings.Join(s2.Tags, ",")))
+	mock.ExpectQuery(`FROM sock_variant WHERE sock_id IN \(\?, \?\) AND size=\? ORDER BY sock_id, sku`).
+		WithArgs(s1.ID, s2.ID, "M").
+		WillReturnRows(sqlmock.NewRows(variantCols).
+			AddRow("1-M-RED", s1.ID, "M", "red", nil, 3).
+			AddRow("1-M-BLU", s1.ID, "M", "blue", nil, 0).
+			AddRow("2-M", s2.ID, "M", "", 2.5, 1))
+	mock.ExpectQuery("SELECT sock_id, url").WillReturnRows(sqlmock.NewRows(imageCols))
+
+	have, err := s.List(Filter{Tags: []string{"odd", "even"}, VariantSize: "M"}, "id", 1, 10)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(have) != 2 || len(have[0].Variants) != 2 || len(have[1].Variants) != 1 {
+		t.Fatalf("List: want 2 variants of %s and 1 of %s, have %+v", s1.ID, s2.ID, have)
+	}
+	if v := have[0].Variants[0]; v.SKU != "1-M-RED" || v.Colour != "red" || v.Price != nil || v.Count != 3 {
+		t.Errorf("List: unexpected variant %+v", v)
+	}
+	if v := have[1].Variants[0]; v.Price == nil || *v.Price != 250 {
+		t.Errorf("List: want the price of %s overridden, have %+v", v.SKU, v)
+	}
+
+	mock.ExpectPrepare(`AND EXISTS`).ExpectQuery().WithArgs("odd", "M").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	if n, err := s.Count(Filter{Tags: []string{"odd"}, VariantSize: "M"}); err != nil || n != 1 {
+		t.Errorf("Count: want 1, have %d (%v)", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestCatalogueServiceTags(t *testing.T) {
 	logger = log.NewLogfmtLogger(os.Stderr)
 	db, mock, err := sqlmock.New()
@@ -259,3 +317,115 @@ func (s printIDs) String() string {
 	}
 	return "[" + strings.Join(ids, ", ") + "]"
 }
+
+func TestCatalogueServiceImages(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening stub database connection", err)
+	}
+	defer db.Close()
+	s := NewCatalogueService(sqlx.NewDb(db, "sqlmock"), log.NewNopLogger())
+
+	cols := []string{"id", "name", "description", "price", "count", "image_url_1", "image_url_2", "tag_name"}
+	mock.ExpectQuery("SELECT *").WillReturnRows(sqlmock.NewRows(cols).
+		AddRow(s1.ID, s1.Name, s1.Description, s1.Price, s1.Count, s1.ImageURL[0], s1.ImageURL[1], strings.Join(s1.Tags, ",")).
+		AddRow(s2.ID, s2.Name, s2.Description, s2.Price, s2.Count, s2.ImageURL[0], s2.ImageURL[1], strings.Join(s2.Tags, ",")))
+	mock.ExpectQuery("SELECT sku").WillReturnRows(sqlmock.NewRows(variantCols))
+	mock.ExpectQuery(`FROM sock_image WHERE sock_id IN \(\?, \?\) ORDER BY sock_id, is_primary DESC, position`).
+		WithArgs(s1.ID, s2.ID).
+		WillReturnRows(sqlmock.NewRows(imageCols).
+			AddRow(s1.ID, "/front.jpg", "Front", 800, 600, true, 2).
+			AddRow(s1.ID, "/side.jpg", "", 0, 0, false, 0).
+			AddRow(s1.ID, "/back.jpg", "", 0, 0, false, 1))
+
+	have, err := s.List(Filter{}, "", 1, 10)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if want := []string{"/front.jpg", "/side.jpg", "/back.jpg"}; !reflect.DeepEqual(have[0].ImageURL, want) {
+		t.Errorf("List: want image URLs %v, have %v", want, have[0].ImageURL)
+	}
+	if img := have[0].Images[0]; !img.Primary || img.Alt != "Front" || img.Width != 800 || img.Height != 600 {
+		t.Errorf("List: unexpected primary image %+v", img)
+	}
+	// Socks without images keep their image_url columns
+	if len(have[1].Images) != 0 || !reflect.DeepEqual(have[1].ImageURL, s2.ImageURL) {
+		t.Errorf("List: want %s to keep %v, have %v", s2.ID, s2.ImageURL, have[1].ImageURL)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCatalogueServiceUpdatedAt(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening stub database connection", err)
+	}
+	defer db.Close()
+	s := NewCatalogueService(sqlx.NewDb(db, "sqlmock"), log.NewNopLogger())
+
+	cols := []string{"id", "name", "description", "price", "count", "image_url_1", "image_url_2", "updated_at", "tag_name"}
+	mock.ExpectQuery(`UNIX_TIMESTAMP\(sock.updated_at\) AS updated_at`).WillReturnRows(sqlmock.NewRows(cols).
+		AddRow(s1.ID, s1.Name, s1.Description, s1.Price, s1.Count, s1.ImageURL[0], s1.ImageURL[1], 1709294400, strings.Join(s1.Tags, ",")).
+		AddRow(s2.ID, s2.Name, s2.Description, s2.Price, s2.Count, s2.ImageURL[0], s2.ImageURL[1], 1709290800, strings.Join(s2.Tags, ",")))
+	mock.ExpectQuery("SELECT sku").WillReturnRows(sqlmock.NewRows(variantCols))
+	mock.ExpectQuery("SELECT sock_id, url").WillReturnRows(sqlmock.NewRows(imageCols))
+
+	have, err := s.List(Filter{}, "", 1, 10)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if have[0].UpdatedAt == nil || have[0].UpdatedAt.Unix() != 1709294400 {
+		t.Errorf("List: want %s updated at 1709294400, have %v", s1.ID, have[0].UpdatedAt)
+	}
+	if want := time.Unix(1709294400, 0); !LastModified(have...).Equal(want) {
+		t.Errorf("LastModified: want %v, have %v", want, LastModified(have...))
+	}
+	if !LastModified(s1, s2).IsZero() {
+		t.Errorf("LastModified of socks without updated_at: want the zero time")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCatalogueServiceGetMany(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening stub database connection", err)
+	}
+	defer db.Close()
+	s := NewCatalogueService(sqlx.NewDb(db, "sqlmock"), log.NewNopLogger()).(MultiGetter)
+
+	cols := []string{"id", "name", "description", "price", "count", "image_url_1", "image_url_2", "tag_name"}
+	mock.ExpectQuery(`WHERE sock.sock_id IN \(\?, \?, \?\) GROUP BY sock.sock_id`).
+		WithArgs(s3.ID, "missing", s1.ID).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(s1.ID, s1.Name, s1.Description, s1.Price, s1.Count, s1.ImageURL[0], s1.ImageURL[1], strings.Join(s1.Tags, ",")).
+			AddRow(s3.ID, s3.Name, s3.Description, s3.Price, s3.Count, s3.ImageURL[0], s3.ImageURL[1], strings.Join(s3.Tags, ",")))
+	mock.ExpectQuery(`FROM sock_variant WHERE sock_id IN \(\?, \?\)`).
+		WithArgs(s3.ID, s1.ID).
+		WillReturnRows(sqlmock.NewRows(variantCols).AddRow("1-M", s1.ID, "M", "", nil, 3))
+	mock.ExpectQuery("SELECT sock_id, url").WillReturnRows(sqlmock.NewRows(imageCols))
+
+	// In the order asked for, without the missing one
+	have, err := s.GetMany([]string{s3.ID, "missing", s1.ID})
+	if err != nil {
+		t.Fatalf("GetMany: %v", err)
+	}
+	if len(have) != 2 || have[0].ID != s3.ID || have[1].ID != s1.ID {
+		t.Fatalf("GetMany: want %s and %s, have %+v", s3.ID, s1.ID, have)
+	}
+	if len(have[1].Variants) != 1 || !reflect.DeepEqual(have[0].Tags, s3.Tags) {
+		t.Errorf("GetMany: want the variant of %s and the tags of %s, have %+v", s1.ID, s3.ID, have)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectQuery("SELECT *").WillReturnError(errors.New("connection refused"))
+	if _, err := s.GetMany([]string{s1.ID}); err != ErrDBConnection {
+		t.Errorf("GetMany without a database: want %v, have %v", ErrDBConnection, err)
+	}
+}
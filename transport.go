@@ -5,148 +5,459 @@ package catalogue
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/sony/gobreaker"
 	"golang.org/x/net/context"
 )
 
+// HandlerOption configures the handler built by MakeHTTPHandler.
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	breakers  map[string]BreakerSettings
+	admin     *AdminConfig
+	ready     []func() error
+	writer    *WriteEndpoints
+	inventory *InventoryEndpoints
+	token     string
+	feed      *EventFeed
+	images    []ImageOption
+	compress  *compressor
+	store     CompressedStore
+	graphql   endpoint.Endpoint
+}
+
+// WithBreakerSettings sets the circuit breaker settings for each route, keyed
+// by route name (List, Count, Get, Tags, Health, GraphQL). The "*" entry applies to
+// routes without one of their own; DefaultRouteBreakerSettings applies when
+// neither is present, and to the fields an entry leaves zero.
+func WithBreakerSettings(settings map[string]BreakerSettings) HandlerOption {
+	return func(c *handlerConfig) {
+		c.breakers = settings
+	}
+}
+
+// WithReadiness makes GET /ready answer 503 while check returns an error,
+// for example CacheWarmer.Ready until the initial warm has completed.
+func WithReadiness(check func() error) HandlerOption {
+	return func(c *handlerConfig) {
+		c.ready = append(c.ready, check)
+	}
+}
+
+// WithWriter mounts the write routes, which require the same token as the
+// admin API.
+func WithWriter(e WriteEndpoints, token string) HandlerOption {
+	return func(c *handlerConfig) {
+		c.writer = &e
+		c.token = token
+	}
+}
+
+// WithEventFeed mounts the event feed routes, which stream the events of feed.
+func WithEventFeed(feed *EventFeed) HandlerOption {
+	return func(c *handlerConfig) {
+		c.feed = feed
+	}
+}
+
+// WithInventory mounts the reservation routes, which require the same token
+// as the admin API.
+func WithInventory(e InventoryEndpoints, token string) HandlerOption {
+	return func(c *handlerConfig) {
+		c.inventory = &e
+		c.token = token
+	}
+}
+
+// WithGraphQL mounts the GraphQL endpoint, see MakeGraphQLEndpoint.
+func WithGraphQL(e endpoint.Endpoint) HandlerOption {
+	return func(c *handlerConfig) {
+		c.graphql = e
+	}
+}
+
+// WithImageOptions configures the server of /catalogue/images/, see
+// NewImageServer.
+func WithImageOptions(opts ...ImageOption) HandlerOption {
+	return func(c *handlerConfig) {
+		c.images = append(c.images, opts...)
+	}
+}
+
+// WithCompression compresses the responses with the first of encodings, in
+// order of preference, that the client accepts, from minSize bytes up. No
+// encodings turns compression off; by default DefaultEncodings are offered
+// from DefaultCompressMinSize.
+func WithCompression(encodings []string, minSize int) HandlerOption {
+	return func(c *handlerConfig) {
+		c.compress = newCompressor(encodings, minSize, DefaultCompressedBodies)
+	}
+}
+
+// WithCompressedStore keeps the compressed bodies of whole responses, such
+// as those of cache hits, in store as well as in memory, so that other
+// replicas, and this one once restarted, do not compress them again.
+func WithCompressedStore(store CompressedStore) HandlerOption {
+	return func(c *handlerConfig) {
+		c.store = store
+	}
+}
+
+func (c handlerConfig) breakerSettings(route string) BreakerSettings {
+	return routeBreakerSettings(c.breakers, route)
+}
+
+// routeBreakerSettings returns the settings of route out of settings, as
+// WithBreakerSettings describes.
+func routeBreakerSettings(settings map[string]BreakerSettings, route string) BreakerSettings {
+	if s, ok := settings[route]; ok {
+		return s.withDefaults(DefaultRouteBreakerSettings)
+	}
+	if s, ok := settings["*"]; ok {
+		return s.withDefaults(DefaultRouteBreakerSettings)
+	}
+	return DefaultRouteBreakerSettings
+}
+
+// isServerError reports whether err should count against a route's circuit
+// breaker. Client mistakes and missing socks say nothing about our health.
+func isServerError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch AsError(err).Code {
+	case CodeNotFound, CodeInvalidArgument:
+		return false
+	}
+	return true
+}
+
 // MakeHTTPHandler mounts the endpoints into a REST-y HTTP handler.
-func MakeHTTPHandler(ctx context.Context, e Endpoints, imagePath string, logger log.Logger) *mux.Router {
+func MakeHTTPHandler(ctx context.Context, e Endpoints, imagePath string, logger log.Logger, opts ...HandlerOption) *mux.Router {
+	config := handlerConfig{
+		compress: newCompressor(DefaultEncodings, DefaultCompressMinSize, DefaultCompressedBodies),
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	config.compress.store = config.store
+	breaker := func(route string) endpoint.Middleware {
+		return circuitbreaker.Gobreaker(NewCircuitBreaker(route, config.breakerSettings(route), func(err error) bool {
+			return !isServerError(err)
+		}, logger))
+	}
+
 	r := mux.NewRouter().StrictSlash(false)
+	r.Use(config.compress.middleware)
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorLogger(logger),
 		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(requestConditions),
 	}
 
-	// GET /catalogue       List
-	// GET /catalogue/size  Count
-	// GET /catalogue/{id}  Get
-	// GET /tags            Tags
-	// GET /health		Health Check
+	// GET /catalogue                     List
+	// GET /catalogue/size                Count
+	// GET /catalogue/{id}                Get
+	// GET /tags                          Tags
+	// GET /catalogue/events              Change feed, see mountEventFeed
+	// POST /catalogue                    Create, see WithWriter
+	// PUT /catalogue/{id}                Update
+	// PUT /catalogue/{id}/stock          SetStock
+	// PUT /catalogue/{id}/images         SetImages
+	// POST /catalogue/{id}/images        Upload, see MakeUploadImageEndpoint
+	// POST /catalogue/{id}/reservations  Reserve, see WithInventory
+	// POST /reservations/{id}/release    Release
+	// POST /reservations/{id}/commit     Commit
+	// GET /catalogue/images/{name}       Images, see ImageServer
+	// GET, POST /graphql                 GraphQL, see WithGraphQL
+	// GET /health                        Health Check
+	// GET /ready                         Readiness, see WithReadiness
+	// /admin/...                         Admin API, see mountAdmin
 
+	// Before /catalogue/{id}, which would match it
+	if config.feed != nil {
+		mountEventFeed(r, config.feed, logger)
+	}
 	r.Methods("GET").Path("/catalogue").Handler(httptransport.NewServer(
-		circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
-			Name:    "List",
-			Timeout: 30 * time.Second,
-		}))(e.ListEndpoint),
+		breaker("List")(e.ListEndpoint),
 		decodeListRequest,
 		encodeListResponse,
 		options...,
 	))
 	r.Methods("GET").Path("/catalogue/size").Handler(httptransport.NewServer(
-		circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
-			Name:    "Count",
-			Timeout: 30 * time.Second,
-		}))(e.CountEndpoint),
+		breaker("Count")(e.CountEndpoint),
 		decodeCountRequest,
-		encodeResponse,
+		encodeCountResponse,
 		options...,
 	))
 	r.Methods("GET").Path("/catalogue/{id}").Handler(httptransport.NewServer(
-		circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
-			Name:    "Get",
-			Timeout: 30 * time.Second,
-		}))(e.GetEndpoint),
+		breaker("Get")(e.GetEndpoint),
 		decodeGetRequest,
 		encodeGetResponse, // special case, this one can have an error
 		options...,
 	))
 	r.Methods("GET").Path("/tags").Handler(httptransport.NewServer(
-		circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
-			Name:    "Tags",
-			Timeout: 30 * time.Second,
-		}))(e.TagsEndpoint),
+		breaker("Tags")(e.TagsEndpoint),
 		decodeTagsRequest,
-		encodeResponse,
+		encodeTagsResponse,
 		options...,
 	))
-	r.Methods("GET").PathPrefix("/catalogue/images/").Handler(http.StripPrefix(
-		"/catalogue/images/",
-		http.FileServer(http.Dir(imagePath)),
+	if config.writer != nil {
+		auth := requireToken(config.token)
+		r.Methods("POST").Path("/catalogue").Handler(auth(httptransport.NewServer(
+			config.writer.CreateEndpoint,
+			decodeWriteRequest,
+			encodeCreateResponse,
+			options...,
+		)))
+		r.Methods("PUT").Path("/catalogue/{id}").Handler(auth(httptransport.NewServer(
+			config.writer.UpdateEndpoint,
+			decodeWriteRequest,
+			encodeWriteResponse,
+			options...,
+		)))
+		r.Methods("PUT").Path("/catalogue/{id}/stock").Handler(auth(httptransport.NewServer(
+			config.writer.SetStockEndpoint,
+			decodeSetStockRequest,
+			encodeWriteResponse,
+			options...,
+		)))
+		r.Methods("PUT").Path("/catalogue/{id}/images").Handler(auth(httptransport.NewServer(
+			config.writer.SetImagesEndpoint,
+			decodeSetImagesRequest,
+			encodeWriteResponse,
+			options...,
+		)))
+		if config.writer.UploadImageEndpoint != nil {
+			r.Methods("POST").Path("/catalogue/{id}/images").Handler(auth(httptransport.NewServer(
+				config.writer.UploadImageEndpoint,
+				decodeUploadImageRequest,
+				encodeUploadImageResponse,
+				options...,
+			)))
+		}
+	}
+	if config.inventory != nil {
+		auth := requireToken(config.token)
+		r.Methods("POST").Path("/catalogue/{id}/reservations").Handler(auth(httptransport.NewServer(
+			config.inventory.ReserveEndpoint,
+			decodeReserveRequest,
+			encodeReserveResponse,
+			options...,
+		)))
+		r.Methods("POST").Path("/reservations/{id}/release").Handler(auth(httptransport.NewServer(
+			config.inventory.ReleaseEndpoint,
+			decodeReservationRequest,
+			encodeReservationResponse,
+			options...,
+		)))
+		r.Methods("POST").Path("/reservations/{id}/commit").Handler(auth(httptransport.NewServer(
+			config.inventory.CommitEndpoint,
+			decodeReservationRequest,
+			encodeReservationResponse,
+			options...,
+		)))
+	}
+	if config.graphql != nil {
+		r.Methods("GET", "POST").Path("/graphql").Handler(httptransport.NewServer(
+			graphqlBreaker(NewCircuitBreaker("GraphQL", config.breakerSettings("GraphQL"), func(err error) bool {
+				return !isServerError(err)
+			}, logger))(config.graphql),
+			decodeGraphQLRequest,
+			encodeGraphQLResponse,
+			options...,
+		))
+	}
+	r.Methods("GET").PathPrefix(imageURLPrefix).Handler(http.StripPrefix(
+		imageURLPrefix,
+		NewImageServer(imagePath, logger, config.images...),
 	))
 	r.Methods("GET").PathPrefix("/health").Handler(httptransport.NewServer(
-		circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
-			Name:    "Health",
-			Timeout: 30 * time.Second,
-		}))(e.HealthEndpoint),
+		breaker("Health")(e.HealthEndpoint),
 		decodeHealthRequest,
 		encodeHealthResponse,
 		options...,
 	))
+	r.Methods("GET").Path("/ready").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, check := range config.ready {
+			if err := check(); err != nil {
+				encodeError(req.Context(), err, w)
+				return
+			}
+		}
+		encodeResponse(req.Context(), w, map[string]string{"status": "ready"})
+	})
+	if config.admin != nil {
+		mountAdmin(r, *config.admin)
+	}
 	r.Handle("/metrics", promhttp.Handler())
 	return r
 }
 
 func encodeError(_ context.Context, err error, w http.ResponseWriter) {
-	code := http.StatusInternalServerError
-	switch err {
-	case ErrNotFound:
-		code = http.StatusNotFound
-	}
+	e := AsError(err)
+	code := e.HTTPStatus()
+	w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
 	w.WriteHeader(code)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error":       err.Error(),
-		"status_code": code,
-		"status_text": http.StatusText(code),
-	})
+	json.NewEncoder(w).Encode(newProblem(e))
 }
 
 func decodeListRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	pageNum := 1
 	if page := r.FormValue("page"); page != "" {
-		pageNum, _ = strconv.Atoi(page)
+		n, err := parsePositiveInt("page", page)
+		if err != nil {
+			return nil, err
+		}
+		pageNum = n
 	}
 	pageSize := 10
 	if size := r.FormValue("size"); size != "" {
-		pageSize, _ = strconv.Atoi(size)
+		n, err := parsePositiveInt("size", size)
+		if err != nil {
+			return nil, err
+		}
+		pageSize = n
+	}
+	variantSize, err := decodeVariantSize(r)
+	if err != nil {
+		return nil, err
 	}
 	order := "id"
 	if sort := r.FormValue("sort"); sort != "" {
 		order = strings.ToLower(sort)
 	}
-	tags := []string{}
-	if tagsval := r.FormValue("tags"); tagsval != "" {
-		tags = strings.Split(tagsval, ",")
+	currency, err := decodeCurrency(r)
+	if err != nil {
+		return nil, err
 	}
 	return listRequest{
-		Tags:     tags,
-		Order:    order,
-		PageNum:  pageNum,
-		PageSize: pageSize,
+		Tags:        decodeTags(r),
+		VariantSize: variantSize,
+		Order:       order,
+		PageNum:     pageNum,
+		PageSize:    pageSize,
+		Currency:    currency,
 	}, nil
 }
 
+// variantSizePattern matches the sizes socks come in: S, M, L, XL, 3XL and
+// so on.
+var variantSizePattern = regexp.MustCompile(`^([2-6]?X{0,4}[SL]|M)$`)
+
+// decodeVariantSize reads the sock size socks are wanted in, if any.
+func decodeVariantSize(r *http.Request) (string, error) {
+	size := r.FormValue("variant")
+	if size == "" {
+		return "", nil
+	}
+	if !variantSizePattern.MatchString(strings.ToUpper(size)) {
+		return "", InvalidArgument("variant", size, "must be a sock size such as S, M or L")
+	}
+	return strings.ToUpper(size), nil
+}
+
+// decodeCurrency reads the currency prices are wanted in, if any.
+func decodeCurrency(r *http.Request) (string, error) {
+	return parseCurrency(r.FormValue("currency"))
+}
+
+// parseCurrency returns the ISO 4217 code currency is, in upper case, or ""
+// if it is empty.
+func parseCurrency(currency string) (string, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency != "" && !isCurrencyCode(currency) {
+		return "", InvalidArgument("currency", currency, "must be an ISO 4217 currency code")
+	}
+	return currency, nil
+}
+
+// parsePositiveInt parses a query parameter that must be an integer >= 1.
+func parsePositiveInt(field, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, InvalidArgument(field, value, "must be an integer")
+	}
+	if n < 1 {
+		return 0, InvalidArgument(field, value, "must be greater than zero")
+	}
+	return n, nil
+}
+
+// decodeTags splits the comma separated tags parameter, dropping empty
+// entries so that "?tags=a,,b" behaves like "?tags=a,b".
+func decodeTags(r *http.Request) []string {
+	tags := []string{}
+	if tagsval := r.FormValue("tags"); tagsval != "" {
+		for _, t := range strings.Split(tagsval, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
+
 // encodeListResponse is distinct from the generic encodeResponse because our
 // clients expect that we will encode the slice (array) of socks directly,
 // without the wrapping response object.
 func encodeListResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	resp := response.(listResponse)
-	return encodeResponse(ctx, w, resp.Socks)
+	if resp.Raw != nil {
+		return encodeRaw(ctx, w, resp, resp.Raw, resp.ETag)
+	}
+	if len(resp.Socks) >= streamListSize {
+		return encodeStreaming(ctx, w, resp, resp.Socks)
+	}
+	return encodeConditional(ctx, w, resp, resp.Socks)
+}
+
+func encodeCountResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	return encodeConditional(ctx, w, response, response)
 }
 
+// decodeCountRequest ignores page sizes, so that clients can count with the
+// query they list with.
 func decodeCountRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	tags := []string{}
-	if tagsval := r.FormValue("tags"); tagsval != "" {
-		tags = strings.Split(tagsval, ",")
+	variantSize, err := decodeVariantSize(r)
+	if err != nil {
+		return nil, err
 	}
 	return countRequest{
-		Tags: tags,
+		Tags:        decodeTags(r),
+		VariantSize: variantSize,
 	}, nil
 }
 
 func decodeGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	id := mux.Vars(r)["id"]
+	if strings.TrimSpace(id) == "" {
+		return nil, InvalidArgument("id", id, "must not be empty")
+	}
+	variantSize, err := decodeVariantSize(r)
+	if err != nil {
+		return nil, err
+	}
+	currency, err := decodeCurrency(r)
+	if err != nil {
+		return nil, err
+	}
 	return getRequest{
-		ID: mux.Vars(r)["id"],
+		ID:          id,
+		VariantSize: variantSize,
+		Currency:    currency,
 	}, nil
 }
 
@@ -158,13 +469,131 @@ func encodeGetResponse(ctx context.Context, w http.ResponseWriter, response inte
 		encodeError(ctx, resp.Err, w)
 		return nil
 	}
-	return encodeResponse(ctx, w, resp.Sock)
+	if resp.Raw != nil {
+		return encodeRaw(ctx, w, resp, resp.Raw, resp.ETag)
+	}
+	return encodeConditional(ctx, w, resp, resp.Sock)
 }
 
 func decodeTagsRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	return struct{}{}, nil
 }
 
+func encodeTagsResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	return encodeConditional(ctx, w, response, response)
+}
+
+// decodeWriteRequest reads the sock to create or update from the body. The
+// ID in the path, if any, wins over the one in the body.
+func decodeWriteRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var sock Sock
+	if err := json.NewDecoder(r.Body).Decode(&sock); err != nil {
+		return nil, InvalidArgument("body", "", err.Error())
+	}
+	if id, ok := mux.Vars(r)["id"]; ok {
+		sock.ID = id
+	}
+	return writeRequest{Sock: sock}, nil
+}
+
+func decodeSetStockRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req setStockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, InvalidArgument("body", "", err.Error())
+	}
+	req.ID = mux.Vars(r)["id"]
+	return req, nil
+}
+
+// decodeSetImagesRequest reads the images of a sock from the body, a JSON
+// array in the order they are shown.
+func decodeSetImagesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var images []Image
+	if err := json.NewDecoder(r.Body).Decode(&images); err != nil {
+		return nil, InvalidArgument("body", "", err.Error())
+	}
+	return setImagesRequest{ID: mux.Vars(r)["id"], Images: images}, nil
+}
+
+// decodeUploadImageRequest reads a multipart/form-data upload with the image
+// in the "image" part and, optionally, "alt" and "primary" parts.
+func decodeUploadImageRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	// Room for the other parts and the multipart framing
+	r.Body = http.MaxBytesReader(nil, r.Body, MaxImageUploadBytes+64<<10)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, ErrUploadTooLarge
+		}
+		return nil, InvalidArgument("body", "", err.Error())
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return nil, InvalidArgument("image", "", "must be a file part")
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, InvalidArgument("image", "", err.Error())
+	}
+	var primary bool
+	if v := r.FormValue("primary"); v != "" {
+		if primary, err = strconv.ParseBool(v); err != nil {
+			return nil, InvalidArgument("primary", v, "must be true or false")
+		}
+	}
+	return uploadImageRequest{
+		ID:     mux.Vars(r)["id"],
+		Upload: ImageUpload{Data: data, Alt: r.FormValue("alt"), Primary: primary},
+	}, nil
+}
+
+// encodeUploadImageResponse answers 201 with the sock, and the new image in
+// Location.
+func encodeUploadImageResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(uploadImageResponse)
+	w.Header().Set("Location", resp.Image.URL)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(resp.Sock)
+}
+
+func encodeCreateResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	sock := response.(writeResponse).Sock
+	w.Header().Set("Location", "/catalogue/"+sock.ID)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(sock)
+}
+
+func encodeWriteResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	return encodeResponse(ctx, w, response.(writeResponse).Sock)
+}
+
+func decodeReserveRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req reserveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, InvalidArgument("body", "", err.Error())
+	}
+	req.ID = mux.Vars(r)["id"]
+	return req, nil
+}
+
+func decodeReservationRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return reservationRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func encodeReserveResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(response.(reservationResponse).Reservation)
+}
+
+func encodeReservationResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	return encodeResponse(ctx, w, response.(reservationResponse).Reservation)
+}
+
 func decodeHealthRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	return struct{}{}, nil
 }
@@ -173,8 +602,18 @@ func encodeHealthResponse(ctx context.Context, w http.ResponseWriter, response i
 	return encodeResponse(ctx, w, response.(healthResponse))
 }
 
+// setStaleHeaders marks responses that were answered from a last-known-good
+// copy while the database was unavailable.
+func setStaleHeaders(w http.ResponseWriter, response interface{}) {
+	if s, ok := response.(interface{ stale() bool }); ok && s.stale() {
+		w.Header().Set("X-Cache", "STALE")
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+}
+
 func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
 	// All of our response objects are JSON serializable, so we just do that.
+	setStaleHeaders(w, response)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	return json.NewEncoder(w).Encode(response)
 }
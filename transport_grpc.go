@@ -0,0 +1,324 @@
+package catalogue
+
+// transport_grpc.go contains the binding from endpoints to gRPC, for the
+// services that talk it rather than HTTP. The messages are defined in
+// pb/catalogue.proto.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/transport"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/microservices-demo/catalogue/pb"
+)
+
+// ErrorDomain is the domain of the ErrorInfo detail of the gRPC errors of
+// the catalogue, whose reason is the Code of the error.
+const ErrorDomain = "catalogue.microservices-demo"
+
+type grpcServer struct {
+	pb.UnimplementedCatalogueServer
+	list   grpctransport.Handler
+	count  grpctransport.Handler
+	get    grpctransport.Handler
+	tags   grpctransport.Handler
+	health grpctransport.Handler
+}
+
+// GRPCOption configures the server built by MakeGRPCServer.
+type GRPCOption func(*grpcConfig)
+
+type grpcConfig struct {
+	breakers map[string]BreakerSettings
+}
+
+// WithGRPCBreakerSettings sets the circuit breaker settings for each RPC,
+// keyed as WithBreakerSettings keys the routes, so that the same settings
+// serve both. The breakers are those of the gRPC server alone, named
+// "grpc.List" and so on.
+func WithGRPCBreakerSettings(settings map[string]BreakerSettings) GRPCOption {
+	return func(c *grpcConfig) {
+		c.breakers = settings
+	}
+}
+
+// MakeGRPCServer serves the List, Count, Get, Tags and Health endpoints over
+// gRPC, each behind a circuit breaker of its own as the HTTP routes are.
+// Register it with pb.RegisterCatalogueServer.
+func MakeGRPCServer(e Endpoints, logger log.Logger, opts ...GRPCOption) pb.CatalogueServer {
+	var config grpcConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	breaker := func(rpc string) endpoint.Middleware {
+		return circuitbreaker.Gobreaker(NewCircuitBreaker("grpc."+rpc, routeBreakerSettings(config.breakers, rpc), func(err error) bool {
+			return !isServerError(err)
+		}, logger))
+	}
+
+	options := []grpctransport.ServerOption{
+		grpctransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+	}
+	return &grpcServer{
+		list:   grpctransport.NewServer(breaker("List")(e.ListEndpoint), decodeGRPCListRequest, encodeGRPCListReply, options...),
+		count:  grpctransport.NewServer(breaker("Count")(e.CountEndpoint), decodeGRPCCountRequest, encodeGRPCCountReply, options...),
+		get:    grpctransport.NewServer(breaker("Get")(e.GetEndpoint), decodeGRPCGetRequest, encodeGRPCGetReply, options...),
+		tags:   grpctransport.NewServer(breaker("Tags")(e.TagsEndpoint), decodeGRPCTagsRequest, encodeGRPCTagsReply, options...),
+		health: grpctransport.NewServer(breaker("Health")(e.HealthEndpoint), decodeGRPCHealthRequest, encodeGRPCHealthReply, options...),
+	}
+}
+
+func (s *grpcServer) List(ctx context.Context, req *pb.ListRequest) (*pb.ListReply, error) {
+	_, rep, err := s.list.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.ListReply), nil
+}
+
+func (s *grpcServer) Count(ctx context.Context, req *pb.CountRequest) (*pb.CountReply, error) {
+	_, rep, err := s.count.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.CountReply), nil
+}
+
+func (s *grpcServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetReply, error) {
+	_, rep, err := s.get.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.GetReply), nil
+}
+
+func (s *grpcServer) Tags(ctx context.Context, req *pb.TagsRequest) (*pb.TagsReply, error) {
+	_, rep, err := s.tags.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.TagsReply), nil
+}
+
+func (s *grpcServer) Health(ctx context.Context, req *pb.HealthRequest) (*pb.HealthReply, error) {
+	_, rep, err := s.health.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return rep.(*pb.HealthReply), nil
+}
+
+// grpcError is the gRPC status of err: its code is that of the Code of err,
+// which is also the reason of its ErrorInfo detail, along with the details
+// of err.
+func grpcError(err error) error {
+	e := AsError(err)
+	st := status.New(e.Code.GRPCCode(), e.Message)
+	info := &errdetails.ErrorInfo{Reason: string(e.Code), Domain: ErrorDomain}
+	if len(e.Details) > 0 {
+		info.Metadata = make(map[string]string, len(e.Details))
+		for k, v := range e.Details {
+			info.Metadata[k] = fmt.Sprint(v)
+		}
+	}
+	if detailed, err := st.WithDetails(info); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// decodeGRPCListRequest applies the defaults and checks of
+// decodeListRequest.
+func decodeGRPCListRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.ListRequest)
+	pageNum, pageSize := int(req.PageNum), int(req.PageSize)
+	if pageNum < 0 {
+		return nil, InvalidArgument("page_num", fmt.Sprint(pageNum), "must be greater than zero")
+	}
+	if pageNum == 0 {
+		pageNum = 1
+	}
+	if pageSize < 0 {
+		return nil, InvalidArgument("page_size", fmt.Sprint(pageSize), "must be greater than zero")
+	}
+	if pageSize == 0 {
+		pageSize = 10
+	}
+	variantSize, err := parseVariantSize(req.VariantSize)
+	if err != nil {
+		return nil, err
+	}
+	order := "id"
+	if req.Order != "" {
+		order = strings.ToLower(req.Order)
+	}
+	currency, err := parseCurrency(req.Currency)
+	if err != nil {
+		return nil, err
+	}
+	return listRequest{
+		Tags:        grpcTags(req.Tags),
+		VariantSize: variantSize,
+		Order:       order,
+		PageNum:     pageNum,
+		PageSize:    pageSize,
+		Currency:    currency,
+	}, nil
+}
+
+func encodeGRPCListReply(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(listResponse)
+	socks, err := resp.sockList()
+	if err != nil {
+		return nil, err
+	}
+	rep := &pb.ListReply{Socks: make([]*pb.Sock, len(socks)), Stale: resp.Stale}
+	for i, sock := range socks {
+		rep.Socks[i] = sockToPB(sock)
+	}
+	return rep, nil
+}
+
+func decodeGRPCCountRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.CountRequest)
+	variantSize, err := parseVariantSize(req.VariantSize)
+	if err != nil {
+		return nil, err
+	}
+	return countRequest{Tags: grpcTags(req.Tags), VariantSize: variantSize}, nil
+}
+
+func encodeGRPCCountReply(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(countResponse)
+	return &pb.CountReply{Count: int32(resp.N), Stale: resp.Stale}, nil
+}
+
+func decodeGRPCGetRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.GetRequest)
+	if strings.TrimSpace(req.Id) == "" {
+		return nil, InvalidArgument("id", req.Id, "must not be empty")
+	}
+	variantSize, err := parseVariantSize(req.VariantSize)
+	if err != nil {
+		return nil, err
+	}
+	currency, err := parseCurrency(req.Currency)
+	if err != nil {
+		return nil, err
+	}
+	return getRequest{ID: req.Id, VariantSize: variantSize, Currency: currency}, nil
+}
+
+func encodeGRPCGetReply(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(getResponse)
+	sock, err := resp.sock()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetReply{Sock: sockToPB(sock), Stale: resp.Stale}, nil
+}
+
+func decodeGRPCTagsRequest(_ context.Context, _ interface{}) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+func encodeGRPCTagsReply(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(tagsResponse)
+	return &pb.TagsReply{Tags: resp.Tags, Stale: resp.Stale}, nil
+}
+
+func decodeGRPCHealthRequest(_ context.Context, _ interface{}) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+func encodeGRPCHealthReply(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(healthResponse)
+	rep := &pb.HealthReply{Health: make([]*pb.Health, len(resp.Health))}
+	for i, h := range resp.Health {
+		rep.Health[i] = &pb.Health{Service: h.Service, Status: h.Status, Time: h.Time}
+	}
+	return rep, nil
+}
+
+// grpcTags drops the empty tags, as decodeTags does.
+func grpcTags(tags []string) []string {
+	kept := []string{}
+	for _, t := range tags {
+		if t = strings.TrimSpace(t); t != "" {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// parseVariantSize returns the sock size size is, in upper case, or "" if it
+// is empty.
+func parseVariantSize(size string) (string, error) {
+	if size == "" {
+		return "", nil
+	}
+	if !variantSizePattern.MatchString(strings.ToUpper(size)) {
+		return "", InvalidArgument("variant_size", size, "must be a sock size such as S, M or L")
+	}
+	return strings.ToUpper(size), nil
+}
+
+func priceToPB(p *Price) *float32 {
+	if p == nil {
+		return nil
+	}
+	f := float32(p.Float())
+	return &f
+}
+
+func sockToPB(s Sock) *pb.Sock {
+	sock := &pb.Sock{
+		Id:          s.ID,
+		Name:        s.Name,
+		Description: s.Description,
+		ImageUrl:    s.ImageURL,
+		Price:       float32(s.Price.Float()),
+		Money:       moneyToPB(s.Money),
+		Count:       int32(s.Count),
+		Tags:        s.Tags,
+	}
+	for _, v := range s.Variants {
+		sock.Variants = append(sock.Variants, &pb.Variant{
+			Sku:    v.SKU,
+			Size:   v.Size,
+			Colour: v.Colour,
+			Price:  priceToPB(v.Price),
+			Money:  moneyToPB(v.Money),
+			Count:  int32(v.Count),
+		})
+	}
+	for _, img := range s.Images {
+		sock.Images = append(sock.Images, &pb.Image{
+			Url:     img.URL,
+			Alt:     img.Alt,
+			Width:   int32(img.Width),
+			Height:  int32(img.Height),
+			Primary: img.Primary,
+		})
+	}
+	if s.UpdatedAt != nil {
+		sock.UpdatedAt = timestamppb.New(*s.UpdatedAt)
+	}
+	return sock
+}
+
+func moneyToPB(m *Money) *pb.Money {
+	if m == nil {
+		return nil
+	}
+	return &pb.Money{Amount: m.Amount, Currency: m.Currency}
+}
@@ -0,0 +1,175 @@
+package catalogue
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/microservices-demo/catalogue/pb"
+)
+
+// dialGRPC serves e over an in-process connection and returns a client of
+// it.
+func dialGRPC(t *testing.T, e Endpoints, opts ...GRPCOption) pb.CatalogueClient {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterCatalogueServer(server, MakeGRPCServer(e, log.NewNopLogger(), opts...))
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewCatalogueClient(conn)
+}
+
+func TestGRPCTransport(t *testing.T) {
+	updated := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	price := Price(250)
+	sock := s1
+	sock.UpdatedAt = &updated
+	sock.Variants = []Variant{{SKU: "1-M", Size: "M", Count: 3}, {SKU: "1-L", Size: "L", Price: &price, Count: 1}}
+	client := dialGRPC(t, MakeEndpoints(&stubService{socks: map[string]Sock{sock.ID: sock}}))
+	ctx := context.Background()
+
+	list, err := client.List(ctx, &pb.ListRequest{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list.Socks) != 1 || list.Socks[0].Id != sock.ID || list.Socks[0].Price != float32(sock.Price.Float()) || !list.Socks[0].UpdatedAt.AsTime().Equal(updated) || list.Stale {
+		t.Errorf("List: want %s, have %v", sock.ID, list)
+	}
+	count, err := client.Count(ctx, &pb.CountRequest{Tags: []string{"brown"}})
+	if err != nil || count.Count != 1 {
+		t.Errorf("Count: want 1, have %v (%v)", count, err)
+	}
+	get, err := client.Get(ctx, &pb.GetRequest{Id: sock.ID, VariantSize: "l"})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if v := get.Sock.Variants; len(v) != 1 || v[0].Sku != "1-L" || v[0].Price == nil || *v[0].Price != float32(price.Float()) {
+		t.Errorf("Get size L: want the L variant with its price, have %v", v)
+	}
+	tags, err := client.Tags(ctx, &pb.TagsRequest{})
+	if err != nil || len(tags.Tags) != 1 || tags.Tags[0] != "brown" {
+		t.Errorf("Tags: want brown, have %v (%v)", tags, err)
+	}
+
+	for name, call := range map[string]struct {
+		do   func() error
+		code codes.Code
+	}{
+		"missing sock": {func() error { _, err := client.Get(ctx, &pb.GetRequest{Id: "missing"}); return err }, codes.NotFound},
+		"empty id":     {func() error { _, err := client.Get(ctx, &pb.GetRequest{}); return err }, codes.InvalidArgument},
+		"bad size":     {func() error { _, err := client.List(ctx, &pb.ListRequest{VariantSize: "huge"}); return err }, codes.InvalidArgument},
+		"bad page":     {func() error { _, err := client.List(ctx, &pb.ListRequest{PageNum: -1}); return err }, codes.InvalidArgument},
+		"bad currency": {func() error { _, err := client.Get(ctx, &pb.GetRequest{Id: sock.ID, Currency: "euro"}); return err }, codes.InvalidArgument},
+	} {
+		if have := status.Code(call.do()); have != call.code {
+			t.Errorf("%s: want %s, have %s", name, call.code, have)
+		}
+	}
+
+	_, err = client.Get(ctx, &pb.GetRequest{Id: sock.ID, Currency: "euro"})
+	var info *errdetails.ErrorInfo
+	for _, d := range status.Convert(err).Details() {
+		if i, ok := d.(*errdetails.ErrorInfo); ok {
+			info = i
+		}
+	}
+	if info == nil || info.Reason != string(CodeInvalidArgument) || info.Domain != ErrorDomain || info.Metadata["field"] != "currency" {
+		t.Errorf("invalid currency: want the ErrorInfo of %s, have %v", CodeInvalidArgument, info)
+	}
+
+	// The database is down
+	client = dialGRPC(t, MakeEndpoints(&stubService{err: ErrDBConnection}))
+	if _, err := client.Tags(ctx, &pb.TagsRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Tags without a database: want %s, have %v", codes.Unavailable, err)
+	}
+}
+
+func TestGRPCTransportStaleAndRaw(t *testing.T) {
+	// Stale answers are answers
+	client := dialGRPC(t, MakeEndpoints(&staleService{}))
+	list, err := client.List(context.Background(), &pb.ListRequest{})
+	if err != nil || !list.Stale || len(list.Socks) != 1 {
+		t.Errorf("stale List: want 1 stale sock, have %v (%v)", list, err)
+	}
+
+	// Cache hits sent as JSON over HTTP are decoded for gRPC
+	cache := byteCache{newFakeCache()}
+	cache.put(WarmRequest{Operation: "Get", ID: s1.ID}, s1)
+	client = dialGRPC(t, MakeEndpoints(NewCachedService(&stubService{}, cache, log.NewNopLogger())))
+	get, err := client.Get(context.Background(), &pb.GetRequest{Id: s1.ID})
+	if err != nil || get.Sock.Name != s1.Name {
+		t.Errorf("cached Get: want %s, have %v (%v)", s1.Name, get, err)
+	}
+}
+
+func TestGRPCBreakers(t *testing.T) {
+	var calls int
+	failing := func(err error) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			calls++
+			return nil, err
+		}
+	}
+	client := dialGRPC(t, Endpoints{
+		GetEndpoint:  failing(ErrNotFound),
+		TagsEndpoint: failing(errors.New("connection refused")),
+	}, WithGRPCBreakerSettings(map[string]BreakerSettings{"*": {ConsecutiveFailures: 2, Timeout: time.Hour}}))
+	ctx := context.Background()
+
+	// Missing socks say nothing about the database
+	for i := 0; i < 3; i++ {
+		if _, err := client.Get(ctx, &pb.GetRequest{Id: "missing"}); status.Code(err) != codes.NotFound {
+			t.Fatalf("Get %d: want NotFound, have %v", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := client.Tags(ctx, &pb.TagsRequest{}); status.Code(err) != codes.Internal {
+			t.Fatalf("Tags %d: want Internal, have %v", i, err)
+		}
+	}
+	calls = 0
+	if _, err := client.Tags(ctx, &pb.TagsRequest{}); status.Code(err) != codes.Unavailable || calls != 0 {
+		t.Errorf("Tags once its breaker opened: want Unavailable without a call, have %v and %d calls", err, calls)
+	}
+}
+
+func TestGRPCCode(t *testing.T) {
+	for code, want := range map[Code]codes.Code{
+		CodeNotFound:           codes.NotFound,
+		CodeInvalidArgument:    codes.InvalidArgument,
+		CodeUnavailable:        codes.Unavailable,
+		CodeRateLimited:        codes.ResourceExhausted,
+		CodeDeadlineExceeded:   codes.DeadlineExceeded,
+		CodeConflict:           codes.Aborted,
+		CodeFailedPrecondition: codes.FailedPrecondition,
+		CodeUnauthenticated:    codes.Unauthenticated,
+		CodeTooLarge:           codes.ResourceExhausted,
+		CodeInternal:           codes.Internal,
+	} {
+		if have := code.GRPCCode(); have != want {
+			t.Errorf("%s: want %s, have %s", code, want, have)
+		}
+	}
+}
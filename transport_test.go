@@ -0,0 +1,113 @@
+package catalogue
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestDecodeListRequestValidation(t *testing.T) {
+	for _, testcase := range []struct {
+		query string
+		field string
+	}{
+		{"page=abc", "page"},
+		{"page=0", "page"},
+		{"size=-1", "size"},
+		{"size=ten", "size"},
+		{"size=M", "size"},
+		{"variant=huge", "variant"},
+	} {
+		r := httptest.NewRequest("GET", "/catalogue?"+testcase.query, nil)
+		_, err := decodeListRequest(context.Background(), r)
+		e := AsError(err)
+		if e == nil || e.Code != CodeInvalidArgument {
+			t.Errorf("decodeListRequest(%s): want %s, have %v", testcase.query, CodeInvalidArgument, err)
+			continue
+		}
+		if have := e.Details["field"]; have != testcase.field {
+			t.Errorf("decodeListRequest(%s): want field %s, have %v", testcase.query, testcase.field, have)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/catalogue?page=2&size=3&tags=a,,b", nil)
+	req, err := decodeListRequest(context.Background(), r)
+	if err != nil {
+		t.Fatalf("decodeListRequest: %v", err)
+	}
+	if have := req.(listRequest); have.PageNum != 2 || have.PageSize != 3 || len(have.Tags) != 2 {
+		t.Errorf("decodeListRequest: unexpected request %+v", have)
+	}
+}
+
+func TestDecodeVariantSize(t *testing.T) {
+	for _, testcase := range []struct {
+		query       string
+		pageSize    int
+		variantSize string
+	}{
+		{"", 10, ""},
+		{"size=5", 5, ""},
+		{"variant=m", 10, "M"},
+		{"variant=3xl&size=6", 6, "3XL"},
+	} {
+		r := httptest.NewRequest("GET", "/catalogue?"+testcase.query, nil)
+		req, err := decodeListRequest(context.Background(), r)
+		if err != nil {
+			t.Errorf("decodeListRequest(%s): %v", testcase.query, err)
+			continue
+		}
+		if have := req.(listRequest); have.PageSize != testcase.pageSize || have.VariantSize != testcase.variantSize {
+			t.Errorf("decodeListRequest(%s): want size %d and variant size %q, have %d and %q", testcase.query, testcase.pageSize, testcase.variantSize, have.PageSize, have.VariantSize)
+		}
+	}
+
+	// Counts take the query of the listing they go with
+	r := httptest.NewRequest("GET", "/catalogue/size?size=6&variant=L", nil)
+	if req, err := decodeCountRequest(context.Background(), r); err != nil || req.(countRequest).VariantSize != "L" {
+		t.Errorf("decodeCountRequest: want variant size L, have %+v (%v)", req, err)
+	}
+}
+
+func TestEncodeError(t *testing.T) {
+	for _, testcase := range []struct {
+		err    error
+		status int
+		code   Code
+	}{
+		{ErrNotFound, http.StatusNotFound, CodeNotFound},
+		{ErrDBConnection, http.StatusServiceUnavailable, CodeUnavailable},
+		{InvalidArgument("page", "x", "must be an integer"), http.StatusBadRequest, CodeInvalidArgument},
+		{errors.New("boom"), http.StatusInternalServerError, CodeInternal},
+	} {
+		w := httptest.NewRecorder()
+		encodeError(context.Background(), testcase.err, w)
+		if w.Code != testcase.status {
+			t.Errorf("encodeError(%v): want status %d, have %d", testcase.err, testcase.status, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json; charset=utf-8" {
+			t.Errorf("encodeError(%v): unexpected content type %q", testcase.err, ct)
+		}
+		var body problem
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("encodeError(%v): %v", testcase.err, err)
+		}
+		if body.Code != testcase.code || body.Status != testcase.status {
+			t.Errorf("encodeError(%v): want %s/%d, have %s/%d", testcase.err, testcase.code, testcase.status, body.Code, body.Status)
+		}
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	decorated := ErrNotFound.WithDetails("id", "42")
+	if !errors.Is(decorated, ErrNotFound) {
+		t.Errorf("errors.Is(%v, ErrNotFound): want true", decorated)
+	}
+	if errors.Is(decorated, ErrDBConnection) {
+		t.Errorf("errors.Is(%v, ErrDBConnection): want false", decorated)
+	}
+}
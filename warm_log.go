@@ -0,0 +1,131 @@
+package catalogue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// RequestLogEntry is one line of a request log: a catalogue request as it
+// arrived over HTTP. cmd/requestlog writes these from HTTP access logs.
+type RequestLogEntry struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+}
+
+// WarmRequest returns the cacheable request e stands for. It reports false
+// for anything that is not a GET of List, Count, Get or Tags, and for requests
+// the HTTP transport would reject.
+func (e RequestLogEntry) WarmRequest() (WarmRequest, bool) {
+	if e.Method != "" && e.Method != "GET" {
+		return WarmRequest{}, false
+	}
+	path, query := e.Path, e.Query
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	// Decode the parameters exactly as the transport does, so that the
+	// warmed keys are the ones clients will ask for
+	r := &http.Request{Method: "GET", URL: &url.URL{Path: path, RawQuery: query}}
+	switch {
+	case path == "/catalogue":
+		req, err := decodeListRequest(context.Background(), r)
+		if err != nil {
+			return WarmRequest{}, false
+		}
+		l := req.(listRequest)
+		return WarmRequest{Operation: "List", Tags: l.Tags, VariantSize: l.VariantSize, Order: l.Order, PageNum: l.PageNum, PageSize: l.PageSize}, true
+	case path == "/catalogue/size":
+		req, err := decodeCountRequest(context.Background(), r)
+		if err != nil {
+			return WarmRequest{}, false
+		}
+		c := req.(countRequest)
+		return WarmRequest{Operation: "Count", Tags: c.Tags, VariantSize: c.VariantSize}, true
+	case path == "/tags":
+		return WarmRequest{Operation: "Tags"}, true
+	case strings.HasPrefix(path, "/catalogue/"):
+		id := strings.TrimPrefix(path, "/catalogue/")
+		if strings.TrimSpace(id) == "" || strings.Contains(id, "/") {
+			return WarmRequest{}, false
+		}
+		return WarmRequest{Operation: "Get", ID: id}, true
+	}
+	return WarmRequest{}, false
+}
+
+// RequestLogSource warms the limit most frequent requests of the JSONL
+// request log at path. Lines that are not RequestLogEntry objects, or not
+// cacheable catalogue requests, are skipped. A limit <= 0 warms every
+// distinct request in the log.
+func RequestLogSource(path string, limit int) WarmSource {
+	return requestLogSource{path: path, limit: limit}
+}
+
+type requestLogSource struct {
+	path  string
+	limit int
+}
+
+func (s requestLogSource) Requests(ctx context.Context) ([]WarmRequest, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type counted struct {
+		request WarmRequest
+		count   int
+	}
+	byKey := map[string]*counted{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var e RequestLogEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil || e.Path == "" {
+			continue
+		}
+		r, ok := e.WarmRequest()
+		if !ok {
+			continue
+		}
+		key := r.Key()
+		if c, ok := byKey[key]; ok {
+			c.count++
+			continue
+		}
+		byKey[key] = &counted{request: r, count: 1}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	all := make([]*counted, 0, len(byKey))
+	for _, c := range byKey {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].count != all[j].count {
+			return all[i].count > all[j].count
+		}
+		return all[i].request.Key() < all[j].request.Key()
+	})
+	if s.limit > 0 && len(all) > s.limit {
+		all = all[:s.limit]
+	}
+	requests := make([]WarmRequest, len(all))
+	for i, c := range all {
+		requests[i] = c.request
+	}
+	return requests, nil
+}
@@ -0,0 +1,55 @@
+package catalogue
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestRequestLogSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log.jsonl")
+	log := strings.Join([]string{
+		`{"method": "GET", "path": "/catalogue", "query": "tags=brown&size=6"}`,
+		`{"method": "GET", "path": "/catalogue/3395a43e-2d88-40de-b95f-e00e1502085b"}`,
+		`{"method": "GET", "path": "/catalogue?size=6&tags=brown"}`,
+		`{"method": "GET", "path": "/catalogue/size", "query": "tags=brown"}`,
+		`{"method": "GET", "path": "/catalogue", "query": "tags=brown&size=6"}`,
+		`{"method": "GET", "path": "/catalogue/images/holy_1.jpeg"}`,
+		`{"method": "GET", "path": "/catalogue/3395a43e-2d88-40de-b95f-e00e1502085b"}`,
+		`{"method": "GET", "path": "/catalogue", "query": "page=zero"}`,
+		`{"method": "POST", "path": "/catalogue"}`,
+		`{"request_id": "user-001", "title": "not a request"}`,
+		`not json`,
+	}, "\n")
+	if err := os.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := RequestLogSource(path, 2).Requests(context.Background())
+	if err != nil {
+		t.Fatalf("Requests: %v", err)
+	}
+	want := []WarmRequest{
+		{Operation: "List", Tags: []string{"brown"}, Order: "id", PageNum: 1, PageSize: 6},
+		{Operation: "Get", ID: "3395a43e-2d88-40de-b95f-e00e1502085b"},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("Requests: want %+v, have %+v", want, have)
+	}
+
+	all, err := RequestLogSource(path, 0).Requests(context.Background())
+	if err != nil {
+		t.Fatalf("Requests: %v", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("Requests without a limit: want 3 distinct requests, have %+v", all)
+	}
+
+	if _, err := RequestLogSource(filepath.Join(t.TempDir(), "missing"), 0).Requests(context.Background()); err == nil {
+		t.Errorf("Requests from a missing log: want error, have nil")
+	}
+}
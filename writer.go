@@ -0,0 +1,482 @@
+package catalogue
+
+// writer.go contains the write side of the catalogue. Every change records
+// its events in the outbox table in the same transaction, so that OutboxRelay
+// publishes an event for every committed change and none for rolled back ones.
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// Writer changes the catalogue.
+type Writer interface {
+	Create(sock Sock) (Sock, error)              // POST /catalogue
+	Update(sock Sock) (Sock, error)              // PUT /catalogue/{id}
+	SetStock(id string, count int) (Sock, error) // PUT /catalogue/{id}/stock
+
+	// SetImages replaces the images of the sock with the given ID.
+	SetImages(id string, images []Image) (Sock, error) // PUT /catalogue/{id}/images
+	// AddImage adds an image to the sock with the given ID, after the others
+	// unless it is primary.
+	AddImage(id string, image Image) (Sock, error) // POST /catalogue/{id}/images
+}
+
+// ErrExists is returned when creating a sock whose ID is taken.
+var ErrExists = NewError(CodeConflict, "sock already exists")
+
+// WriterOption configures the Writer returned by NewCatalogueWriter.
+type WriterOption func(*catalogueWriter)
+
+// WithCommitHook calls hook with the events of every committed change, for
+// example to invalidate the cache entries they make stale without waiting
+// for the change log.
+func WithCommitHook(hook func([]Event)) WriterOption {
+	return func(w *catalogueWriter) {
+		w.hooks = append(w.hooks, hook)
+	}
+}
+
+// NewCatalogueWriter returns a Writer backed by an SQL database.
+func NewCatalogueWriter(db *sqlx.DB, logger log.Logger, opts ...WriterOption) Writer {
+	return newCatalogueWriter(db, logger, opts...)
+}
+
+func newCatalogueWriter(db *sqlx.DB, logger log.Logger, opts ...WriterOption) *catalogueWriter {
+	w := &catalogueWriter{
+		db:             db,
+		logger:         logger,
+		reservationTTL: DefaultReservationTTL,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+type catalogueWriter struct {
+	db             *sqlx.DB
+	logger         log.Logger
+	hooks          []func([]Event)
+	reservationTTL time.Duration
+}
+
+// Create adds sock to the catalogue, giving it a random ID unless it has one.
+func (w *catalogueWriter) Create(sock Sock) (Sock, error) {
+	sock, err := normaliseSock(sock)
+	if err != nil {
+		return Sock{}, err
+	}
+	if sock.ID == "" {
+		sock.ID = newUUID()
+	}
+	err = w.write("Create", func(tx *sqlx.Tx) ([]Event, error) {
+		_, err := tx.Exec("INSERT INTO sock (sock_id, name, description, price, count, image_url_1, image_url_2) VALUES (?, ?, ?, ?, ?, ?, ?);",
+			sock.ID, sock.Name, sock.Description, sock.Price, sock.Count, sock.ImageURL_1, sock.ImageURL_2)
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 { // ER_DUP_ENTRY
+			return nil, ErrExists.WithDetails("id", sock.ID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := linkTags(tx, sock.ID, sock.Tags); err != nil {
+			return nil, err
+		}
+		if err := insertImages(tx, sock.ID, sock.Images); err != nil {
+			return nil, err
+		}
+		event, err := newEvent(EventSockCreated, sock.ID, sock.Tags, SockChange{Sock: sock})
+		return []Event{event}, err
+	})
+	if err != nil {
+		return Sock{}, err
+	}
+	return sock, nil
+}
+
+// Update replaces every field of the sock with sock.ID, including its tags
+// and images.
+func (w *catalogueWriter) Update(sock Sock) (Sock, error) {
+	sock, err := normaliseSock(sock)
+	if err != nil {
+		return Sock{}, err
+	}
+	if sock.ID == "" {
+		return Sock{}, InvalidArgument("id", sock.ID, "must not be empty")
+	}
+	err = w.write("Update", func(tx *sqlx.Tx) ([]Event, error) {
+		previous, err := lockSock(tx, sock.ID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("UPDATE sock SET name=?, description=?, price=?, count=?, image_url_1=?, image_url_2=?, updated_at=CURRENT_TIMESTAMP WHERE sock_id=?;",
+			sock.Name, sock.Description, sock.Price, sock.Count, sock.ImageURL_1, sock.ImageURL_2, sock.ID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM sock_tag WHERE sock_id=?;", sock.ID); err != nil {
+			return nil, err
+		}
+		if err := linkTags(tx, sock.ID, sock.Tags); err != nil {
+			return nil, err
+		}
+		if err := replaceImages(tx, sock.ID, sock.Images); err != nil {
+			return nil, err
+		}
+		// The tags of both versions, so that the listings the sock left see
+		// the update too
+		tags := union(previous.Tags, sock.Tags)
+		updated, err := newEvent(EventSockUpdated, sock.ID, tags, SockChange{Sock: sock, Previous: &previous})
+		if err != nil || previous.Count == sock.Count {
+			return []Event{updated}, err
+		}
+		stock, err := newEvent(EventStockChanged, sock.ID, sock.Tags, StockChange{Previous: previous.Count, Count: sock.Count})
+		return []Event{updated, stock}, err
+	})
+	if err != nil {
+		return Sock{}, err
+	}
+	return sock, nil
+}
+
+// SetStock sets the number of socks with the given ID in stock.
+func (w *catalogueWriter) SetStock(id string, count int) (Sock, error) {
+	if count < 0 {
+		return Sock{}, InvalidArgument("count", fmt.Sprint(count), "must not be negative")
+	}
+	var sock Sock
+	err := w.write("SetStock", func(tx *sqlx.Tx) ([]Event, error) {
+		var err error
+		if sock, err = lockSock(tx, id); err != nil {
+			return nil, err
+		}
+		previous := sock.Count
+		if previous == count {
+			return nil, nil
+		}
+		if _, err := tx.Exec("UPDATE sock SET count=? WHERE sock_id=?;", count, id); err != nil {
+			return nil, err
+		}
+		sock.Count = count
+		event, err := newEvent(EventStockChanged, id, sock.Tags, StockChange{Previous: previous, Count: count})
+		return []Event{event}, err
+	})
+	if err != nil {
+		return Sock{}, err
+	}
+	return sock, nil
+}
+
+// SetImages replaces the images of the sock with the given ID. The first two
+// are also written to its image_url columns.
+func (w *catalogueWriter) SetImages(id string, images []Image) (Sock, error) {
+	images, err := normaliseImages(images)
+	if err != nil {
+		return Sock{}, err
+	}
+	return w.changeImages("SetImages", id, func([]Image) ([]Image, error) {
+		return images, nil
+	})
+}
+
+// AddImage adds image to the sock with the given ID.
+func (w *catalogueWriter) AddImage(id string, image Image) (Sock, error) {
+	if _, err := normaliseImages([]Image{image}); err != nil {
+		return Sock{}, err
+	}
+	return w.changeImages("AddImage", id, func(images []Image) ([]Image, error) {
+		if image.Primary {
+			for i := range images {
+				images[i].Primary = false
+			}
+			return normaliseImages(append([]Image{image}, images...))
+		}
+		return normaliseImages(append(images, image))
+	})
+}
+
+// changeImages replaces the images of the sock with the given ID by what
+// change makes of its current ones, which it may modify.
+func (w *catalogueWriter) changeImages(operation, id string, change func([]Image) ([]Image, error)) (Sock, error) {
+	var sock Sock
+	err := w.write(operation, func(tx *sqlx.Tx) ([]Event, error) {
+		previous, err := lockSock(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		// Socks from before sock_image have only their image_url columns
+		current := append([]Image{}, previous.Images...)
+		if len(current) == 0 {
+			current = imagesFromURLs(previous.ImageURL)
+		}
+		images, err := change(current)
+		if err != nil {
+			return nil, err
+		}
+		sock = previous
+		setImages(&sock, images)
+		if _, err := tx.Exec("UPDATE sock SET image_url_1=?, image_url_2=?, updated_at=CURRENT_TIMESTAMP WHERE sock_id=?;", sock.ImageURL_1, sock.ImageURL_2, id); err != nil {
+			return nil, err
+		}
+		if err := replaceImages(tx, id, images); err != nil {
+			return nil, err
+		}
+		event, err := newEvent(EventSockUpdated, id, sock.Tags, SockChange{Sock: sock, Previous: &previous})
+		return []Event{event}, err
+	})
+	if err != nil {
+		return Sock{}, err
+	}
+	return sock, nil
+}
+
+// write runs change in a transaction and records the events it returns in
+// the outbox before committing. Errors other than *Error are logged and
+// reported as ErrDBConnection.
+func (w *catalogueWriter) write(operation string, change func(tx *sqlx.Tx) ([]Event, error)) error {
+	tx, err := w.db.Beginx()
+	if err != nil {
+		w.logger.Log("database error", err, "operation", operation)
+		return ErrDBConnection
+	}
+	events, err := change(tx)
+	for i := 0; err == nil && i < len(events); i++ {
+		e := events[i]
+		var payload []byte
+		if payload, err = json.Marshal(e); err == nil {
+			_, err = tx.Exec("INSERT INTO outbox (event_id, event_type, sock_id, payload) VALUES (?, ?, ?, ?);",
+				e.ID, e.Type, e.SockID, payload)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+	} else {
+		err = tx.Commit()
+	}
+	if err != nil {
+		var e *Error
+		if errors.As(err, &e) {
+			return err
+		}
+		w.logger.Log("database error", err, "operation", operation)
+		return ErrDBConnection
+	}
+	if len(events) > 0 {
+		for _, hook := range w.hooks {
+			hook(events)
+		}
+	}
+	return nil
+}
+
+// lockSock reads the sock with the given ID, its tags and its images, locking
+// its row until the transaction ends.
+func lockSock(tx *sqlx.Tx, id string) (Sock, error) {
+	var sock Sock
+	err := tx.Get(&sock, "SELECT sock_id AS id, name, description, price, count, image_url_1, image_url_2 FROM sock WHERE sock_id=? FOR UPDATE;", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Sock{}, ErrNotFound
+	}
+	if err != nil {
+		return Sock{}, err
+	}
+	if err := tx.Select(&sock.Tags, "SELECT tag.name FROM sock_tag JOIN tag ON sock_tag.tag_id=tag.tag_id WHERE sock_tag.sock_id=?;", id); err != nil {
+		return Sock{}, err
+	}
+	if err := tx.Select(&sock.Images, "SELECT sock_id, url, alt, width, height, is_primary, position FROM sock_image WHERE sock_id=? ORDER BY is_primary DESC, position;", id); err != nil {
+		return Sock{}, err
+	}
+	sock.ImageURL = []string{sock.ImageURL_1, sock.ImageURL_2}
+	if len(sock.Images) > 0 {
+		sock.ImageURL = imageURLs(sock.Images)
+	}
+	sock.TagString = strings.Join(sock.Tags, ",")
+	return sock, nil
+}
+
+// linkTags tags the sock with the given ID, creating the tags that do not
+// exist yet.
+func linkTags(tx *sqlx.Tx, id string, tags []string) error {
+	for _, name := range tags {
+		var tagID int64
+		err := tx.Get(&tagID, "SELECT tag_id FROM tag WHERE name=?;", name)
+		if errors.Is(err, sql.ErrNoRows) {
+			var res sql.Result
+			if res, err = tx.Exec("INSERT INTO tag (name) VALUES (?);", name); err == nil {
+				tagID, err = res.LastInsertId()
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO sock_tag (sock_id, tag_id) VALUES (?, ?);", id, tagID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceImages replaces the images of the sock with the given ID.
+func replaceImages(tx *sqlx.Tx, id string, images []Image) error {
+	if _, err := tx.Exec("DELETE FROM sock_image WHERE sock_id=?;", id); err != nil {
+		return err
+	}
+	return insertImages(tx, id, images)
+}
+
+// insertImages adds images to the sock with the given ID.
+func insertImages(tx *sqlx.Tx, id string, images []Image) error {
+	for _, img := range images {
+		if _, err := tx.Exec("INSERT INTO sock_image (sock_id, position, url, alt, width, height, is_primary) VALUES (?, ?, ?, ?, ?, ?, ?);",
+			id, img.Position, img.URL, img.Alt, img.Width, img.Height, img.Primary); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normaliseSock validates a sock to be written and fills in the fields the
+// database and the read side derive from the others.
+func normaliseSock(sock Sock) (Sock, error) {
+	if strings.TrimSpace(sock.Name) == "" {
+		return Sock{}, InvalidArgument("name", sock.Name, "must not be empty")
+	}
+	if sock.Price < 0 {
+		return Sock{}, InvalidArgument("price", fmt.Sprint(sock.Price), "must not be negative")
+	}
+	if sock.Count < 0 {
+		return Sock{}, InvalidArgument("count", fmt.Sprint(sock.Count), "must not be negative")
+	}
+	// Untagged socks are not listed, see baseQuery
+	var tags []string
+	for _, t := range sock.Tags {
+		if t = strings.TrimSpace(t); t != "" && !contains(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) == 0 {
+		return Sock{}, InvalidArgument("tag", strings.Join(sock.Tags, ","), "must have at least one tag")
+	}
+	sock.Tags = tags
+	sock.TagString = strings.Join(tags, ",")
+	// Set by the database
+	sock.UpdatedAt, sock.Updated = nil, 0
+	// Clients that predate images send their URLs only
+	images := sock.Images
+	if len(images) == 0 {
+		images = imagesFromURLs(sock.ImageURL)
+	}
+	images, err := normaliseImages(images)
+	if err != nil {
+		return Sock{}, err
+	}
+	setImages(&sock, images)
+	return sock, nil
+}
+
+// imagesFromURLs returns images with the given URLs, skipping empty ones.
+func imagesFromURLs(urls []string) []Image {
+	var images []Image
+	for _, url := range urls {
+		if url != "" {
+			images = append(images, Image{URL: url})
+		}
+	}
+	return images
+}
+
+// normaliseImages validates images and orders them the way the read side
+// does: the primary image, the first unless one is marked, then the others
+// in the order given.
+func normaliseImages(images []Image) ([]Image, error) {
+	primary := -1
+	for i, img := range images {
+		if strings.TrimSpace(img.URL) == "" {
+			return nil, InvalidArgument("images", img.URL, "must have a URL")
+		}
+		if img.Width < 0 || img.Height < 0 {
+			return nil, InvalidArgument("images", fmt.Sprintf("%dx%d", img.Width, img.Height), "must not have a negative size")
+		}
+		if img.Primary {
+			if primary >= 0 {
+				return nil, InvalidArgument("images", img.URL, "must have at most one primary image")
+			}
+			primary = i
+		}
+	}
+	if len(images) == 0 {
+		return nil, nil
+	}
+	if primary < 0 {
+		primary = 0
+	}
+	ordered := append([]Image{images[primary]}, images[:primary]...)
+	ordered = append(ordered, images[primary+1:]...)
+	for i := range ordered {
+		ordered[i].URL = strings.TrimSpace(ordered[i].URL)
+		ordered[i].Primary = i == 0
+		ordered[i].Position = i
+		ordered[i].SockID = ""
+	}
+	return ordered, nil
+}
+
+// setImages gives sock images, which are normalised, and the URLs the read
+// side derives from them: their first two in the image_url columns, and all
+// of them in ImageURL.
+func setImages(sock *Sock, images []Image) {
+	urls := append(imageURLs(images), "", "")
+	sock.Images = images
+	sock.ImageURL_1, sock.ImageURL_2 = urls[0], urls[1]
+	sock.ImageURL = urls[:2]
+	if len(images) > 0 {
+		sock.ImageURL = imageURLs(images)
+	}
+}
+
+// union returns the sorted distinct entries of a and b.
+func union(a, b []string) []string {
+	var all []string
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !contains(all, s) {
+			all = append(all, s)
+		}
+	}
+	sort.Strings(all)
+	return all
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// newEvent returns an event of the given type with a new ID.
+func newEvent(eventType, sockID string, tags []string, data interface{}) (Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:     newUUID(),
+		Type:   eventType,
+		SockID: sockID,
+		Tags:   tags,
+		Time:   time.Now().UTC(),
+		Data:   raw,
+	}, nil
+}
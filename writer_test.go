@@ -0,0 +1,346 @@
+package catalogue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func newMockWriter(t *testing.T, opts ...WriterOption) (Writer, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening stub database connection", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewCatalogueWriter(sqlx.NewDb(db, "sqlmock"), log.NewNopLogger(), opts...), mock
+}
+
+func TestWriterCreate(t *testing.T) {
+	var committed []Event
+	w, mock := newMockWriter(t, WithCommitHook(func(events []Event) { committed = append(committed, events...) }))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO sock \\(").WithArgs(sqlmock.AnyArg(), "Argyle", "", "9.50", 3, "/a.jpg", "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT tag_id FROM tag").WithArgs("blue").WillReturnRows(sqlmock.NewRows([]string{"tag_id"}).AddRow(2))
+	mock.ExpectExec("INSERT INTO sock_tag").WithArgs(sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT tag_id FROM tag").WithArgs("new").WillReturnRows(sqlmock.NewRows([]string{"tag_id"}))
+	mock.ExpectExec("INSERT INTO tag").WithArgs("new").WillReturnResult(sqlmock.NewResult(12, 1))
+	mock.ExpectExec("INSERT INTO sock_tag").WithArgs(sqlmock.AnyArg(), 12).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO sock_image").WithArgs(sqlmock.AnyArg(), 0, "/a.jpg", "", 0, 0, true).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO outbox").WithArgs(sqlmock.AnyArg(), EventSockCreated, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	sock, err := w.Create(Sock{Name: "Argyle", Price: 950, Count: 3, ImageURL: []string{"/a.jpg"}, Tags: []string{"blue", " new", "blue"}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if len(sock.ID) != 36 || !reflect.DeepEqual(sock.Tags, []string{"blue", "new"}) || !reflect.DeepEqual(sock.ImageURL, []string{"/a.jpg"}) || len(sock.Images) != 1 || !sock.Images[0].Primary {
+		t.Errorf("Create: want a new ID, 2 tags and a primary image, have %+v", sock)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+	if len(committed) != 1 || committed[0].Type != EventSockCreated || committed[0].SockID != sock.ID {
+		t.Fatalf("Create: want one %s event, have %+v", EventSockCreated, committed)
+	}
+	var data SockChange
+	if err := json.Unmarshal(committed[0].Data, &data); err != nil || data.Sock.Name != "Argyle" || data.Previous != nil {
+		t.Errorf("Create: want the new sock in the event data, have %s (%v)", committed[0].Data, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO sock \\(").WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	mock.ExpectRollback()
+	if _, err := w.Create(Sock{ID: sock.ID, Name: "Argyle", Tags: []string{"blue"}}); !errors.Is(err, ErrExists) {
+		t.Errorf("Create with a taken ID: want %v, have %v", ErrExists, err)
+	}
+	if len(committed) != 1 {
+		t.Errorf("Create with a taken ID: want no events, have %+v", committed[1:])
+	}
+
+	for _, invalid := range []Sock{
+		{Tags: []string{"blue"}},
+		{Name: "Argyle"},
+		{Name: "Argyle", Tags: []string{"blue"}, Count: -1},
+		{Name: "Argyle", Tags: []string{"blue"}, Images: []Image{{URL: "1", Primary: true}, {URL: "2", Primary: true}}},
+		{Name: "Argyle", Tags: []string{"blue"}, Images: []Image{{URL: " "}}},
+	} {
+		if _, err := w.Create(invalid); AsError(err).Code != CodeInvalidArgument {
+			t.Errorf("Create(%+v): want %s, have %v", invalid, CodeInvalidArgument, err)
+		}
+	}
+}
+
+func TestWriterUpdate(t *testing.T) {
+	var committed []Event
+	w, mock := newMockWriter(t, WithCommitHook(func(events []Event) { committed = append(committed, events...) }))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT sock_id AS id").WithArgs(s1.ID).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "name", "description", "price", "count", "image_url_1", "image_url_2"}).
+			AddRow(s1.ID, s1.Name, s1.Description, s1.Price, s1.Count, s1.ImageURL_1, s1.ImageURL_2))
+	mock.ExpectQuery("SELECT tag.name").WithArgs(s1.ID).WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("odd").AddRow("prime"))
+	mock.ExpectQuery("FROM sock_image").WithArgs(s1.ID).WillReturnRows(sqlmock.NewRows(imageCols))
+	mock.ExpectExec("UPDATE sock SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM sock_tag").WithArgs(s1.ID).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("SELECT tag_id FROM tag").WithArgs("odd").WillReturnRows(sqlmock.NewRows([]string{"tag_id"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO sock_tag").WithArgs(s1.ID, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM sock_image").WithArgs(s1.ID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO sock_image").WithArgs(s1.ID, 0, s1.ImageURL_1, "", 0, 0, true).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO sock_image").WithArgs(s1.ID, 1, s1.ImageURL_2, "", 0, 0, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO outbox").WithArgs(sqlmock.AnyArg(), EventSockUpdated, s1.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO outbox").WithArgs(sqlmock.AnyArg(), EventStockChanged, s1.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	updated := s1
+	updated.Count = 0
+	updated.Tags = []string{"odd"}
+	if _, err := w.Update(updated); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+	if len(committed) != 2 || committed[0].Type != EventSockUpdated || committed[1].Type != EventStockChanged {
+		t.Fatalf("Update: want %s and %s events, have %+v", EventSockUpdated, EventStockChanged, committed)
+	}
+	if want := []string{"odd", "prime"}; !reflect.DeepEqual(committed[0].Tags, want) {
+		t.Errorf("Update: want the tags before and after, %v, have %v", want, committed[0].Tags)
+	}
+	var stock StockChange
+	if err := json.Unmarshal(committed[1].Data, &stock); err != nil || stock != (StockChange{Previous: s1.Count, Count: 0}) {
+		t.Errorf("Update: want stock to go from %d to 0, have %s (%v)", s1.Count, committed[1].Data, err)
+	}
+
+	inv := EventInvalidations(committed)
+	want := Invalidation{Products: []string{s1.ID}, Tags: []string{"odd", "prime"}, Listings: true, Counts: true, TagList: true}
+	if !reflect.DeepEqual(inv, want) {
+		t.Errorf("EventInvalidations: want %+v, have %+v", want, inv)
+	}
+}
+
+func TestWriterSetStock(t *testing.T) {
+	var committed []Event
+	w, mock := newMockWriter(t, WithCommitHook(func(events []Event) { committed = append(committed, events...) }))
+	cols := []string{"id", "name", "description", "price", "count", "image_url_1", "image_url_2"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT sock_id AS id").WithArgs("missing").WillReturnRows(sqlmock.NewRows(cols))
+	mock.ExpectRollback()
+	if _, err := w.SetStock("missing", 1); err != ErrNotFound {
+		t.Errorf("SetStock of a missing sock: want %v, have %v", ErrNotFound, err)
+	}
+
+	// Setting the stock it already has records nothing
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT sock_id AS id").WithArgs(s2.ID).WillReturnRows(sqlmock.NewRows(cols).
+		AddRow(s2.ID, s2.Name, s2.Description, s2.Price, s2.Count, s2.ImageURL_1, s2.ImageURL_2))
+	mock.ExpectQuery("SELECT tag.name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("even"))
+	mock.ExpectQuery("FROM sock_image").WillReturnRows(sqlmock.NewRows(imageCols))
+	mock.ExpectCommit()
+	if sock, err := w.SetStock(s2.ID, s2.Count); err != nil || sock.Count != s2.Count {
+		t.Errorf("SetStock to the same count: want %d, have %d, %v", s2.Count, sock.Count, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT sock_id AS id").WithArgs(s2.ID).WillReturnRows(sqlmock.NewRows(cols).
+		AddRow(s2.ID, s2.Name, s2.Description, s2.Price, s2.Count, s2.ImageURL_1, s2.ImageURL_2))
+	mock.ExpectQuery("SELECT tag.name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("even"))
+	mock.ExpectQuery("FROM sock_image").WillReturnRows(sqlmock.NewRows(imageCols))
+	mock.ExpectExec("UPDATE sock SET count").WithArgs(40, s2.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO outbox").WithArgs(sqlmock.AnyArg(), EventStockChanged, s2.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	sock, err := w.SetStock(s2.ID, 40)
+	if err != nil || sock.Count != 40 || !reflect.DeepEqual(sock.Tags, []string{"even"}) {
+		t.Errorf("SetStock: want %s with 40 in stock, have %+v, %v", s2.ID, sock, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+	if len(committed) != 1 || committed[0].Type != EventStockChanged {
+		t.Errorf("SetStock: want one %s event, have %+v", EventStockChanged, committed)
+	}
+	if inv := EventInvalidations(committed); inv.Counts || !inv.Listings {
+		t.Errorf("EventInvalidations of a stock change: want listings only, have %+v", inv)
+	}
+}
+
+func TestWriterSetImages(t *testing.T) {
+	var committed []Event
+	w, mock := newMockWriter(t, WithCommitHook(func(events []Event) { committed = append(committed, events...) }))
+	cols := []string{"id", "name", "description", "price", "count", "image_url_1", "image_url_2"}
+
+	if _, err := w.SetImages(s2.ID, []Image{{URL: "/a.jpg", Width: -1}}); AsError(err).Code != CodeInvalidArgument {
+		t.Errorf("SetImages with a negative width: want %s, have %v", CodeInvalidArgument, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT sock_id AS id").WithArgs(s2.ID).WillReturnRows(sqlmock.NewRows(cols).
+		AddRow(s2.ID, s2.Name, s2.Description, s2.Price, s2.Count, s2.ImageURL_1, s2.ImageURL_2))
+	mock.ExpectQuery("SELECT tag.name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("even"))
+	mock.ExpectQuery("FROM sock_image").WillReturnRows(sqlmock.NewRows(imageCols).
+		AddRow(s2.ID, s2.ImageURL_1, "", 0, 0, true, 0))
+	mock.ExpectExec("UPDATE sock SET image_url_1").WithArgs("/front.jpg", "/side.jpg", s2.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM sock_image").WithArgs(s2.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO sock_image").WithArgs(s2.ID, 0, "/front.jpg", "Front", 800, 600, true).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO sock_image").WithArgs(s2.ID, 1, "/side.jpg", "", 0, 0, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO sock_image").WithArgs(s2.ID, 2, "/back.jpg", "", 0, 0, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO outbox").WithArgs(sqlmock.AnyArg(), EventSockUpdated, s2.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	sock, err := w.SetImages(s2.ID, []Image{
+		{URL: "/side.jpg"},
+		{URL: "/front.jpg", Alt: "Front", Width: 800, Height: 600, Primary: true},
+		{URL: "/back.jpg"},
+	})
+	if err != nil {
+		t.Fatalf("SetImages: %v", err)
+	}
+	if want := []string{"/front.jpg", "/side.jpg", "/back.jpg"}; !reflect.DeepEqual(sock.ImageURL, want) {
+		t.Errorf("SetImages: want image URLs %v, have %v", want, sock.ImageURL)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+	if len(committed) != 1 || committed[0].Type != EventSockUpdated {
+		t.Fatalf("SetImages: want one %s event, have %+v", EventSockUpdated, committed)
+	}
+	if inv := EventInvalidations(committed); !reflect.DeepEqual(inv.Products, []string{s2.ID}) {
+		t.Errorf("EventInvalidations of new images: want product %s invalidated, have %+v", s2.ID, inv)
+	}
+}
+
+func TestWriterAddImage(t *testing.T) {
+	w, mock := newMockWriter(t)
+	cols := []string{"id", "name", "description", "price", "count", "image_url_1", "image_url_2"}
+
+	// A sock from before sock_image keeps the images of its columns
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT sock_id AS id").WithArgs(s2.ID).WillReturnRows(sqlmock.NewRows(cols).
+		AddRow(s2.ID, s2.Name, s2.Description, s2.Price, s2.Count, s2.ImageURL_1, s2.ImageURL_2))
+	mock.ExpectQuery("SELECT tag.name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("even"))
+	mock.ExpectQuery("FROM sock_image").WillReturnRows(sqlmock.NewRows(imageCols))
+	mock.ExpectExec("UPDATE sock SET image_url_1").WithArgs("/new.jpg", s2.ImageURL_1, s2.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM sock_image").WithArgs(s2.ID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO sock_image").WithArgs(s2.ID, 0, "/new.jpg", "New", 0, 0, true).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO sock_image").WithArgs(s2.ID, 1, s2.ImageURL_1, "", 0, 0, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO sock_image").WithArgs(s2.ID, 2, s2.ImageURL_2, "", 0, 0, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO outbox").WithArgs(sqlmock.AnyArg(), EventSockUpdated, s2.ID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	sock, err := w.AddImage(s2.ID, Image{URL: "/new.jpg", Alt: "New", Primary: true})
+	if err != nil {
+		t.Fatalf("AddImage: %v", err)
+	}
+	if want := []string{"/new.jpg", s2.ImageURL_1, s2.ImageURL_2}; !reflect.DeepEqual(sock.ImageURL, want) {
+		t.Errorf("AddImage: want image URLs %v, have %v", want, sock.ImageURL)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+// recordingWriter records the socks it is asked to write.
+type recordingWriter struct {
+	written []Sock
+}
+
+func (w *recordingWriter) Create(sock Sock) (Sock, error) {
+	sock.ID = "new"
+	w.written = append(w.written, sock)
+	return sock, nil
+}
+
+func (w *recordingWriter) Update(sock Sock) (Sock, error) {
+	w.written = append(w.written, sock)
+	return sock, nil
+}
+
+func (w *recordingWriter) SetStock(id string, count int) (Sock, error) {
+	if id != s1.ID {
+		return Sock{}, ErrNotFound
+	}
+	sock := s1
+	sock.Count = count
+	w.written = append(w.written, sock)
+	return sock, nil
+}
+
+func (w *recordingWriter) SetImages(id string, images []Image) (Sock, error) {
+	sock := s1
+	sock.ID = id
+	sock.Images = images
+	w.written = append(w.written, sock)
+	return sock, nil
+}
+
+func (w *recordingWriter) AddImage(id string, image Image) (Sock, error) {
+	if id != s1.ID {
+		return Sock{}, ErrNotFound
+	}
+	sock := s1
+	sock.Images = []Image{image}
+	w.written = append(w.written, sock)
+	return sock, nil
+}
+
+func TestWriteRoutes(t *testing.T) {
+	writer := &recordingWriter{}
+	router := MakeHTTPHandler(context.Background(), MakeEndpoints(&stubService{socks: map[string]Sock{s1.ID: s1}}), "", log.NewNopLogger(),
+		WithWriter(MakeWriteEndpoints(writer), "secret"))
+
+	for _, tc := range []struct {
+		method, path, token, body string
+		code                      int
+	}{
+		{"POST", "/catalogue", "", `{"name": "Argyle"}`, 401},
+		{"POST", "/catalogue", "wrong", `{"name": "Argyle"}`, 401},
+		{"POST", "/catalogue", "secret", `{"name": `, 400},
+		{"POST", "/catalogue", "secret", `{"name": "Argyle", "tag": ["blue"]}`, 201},
+		{"PUT", "/catalogue/" + s1.ID, "secret", `{"id": "ignored", "name": "Renamed"}`, 200},
+		{"PUT", "/catalogue/" + s1.ID + "/stock", "secret", `{"count": 7}`, 200},
+		{"PUT", "/catalogue/missing/stock", "secret", `{"count": 7}`, 404},
+		{"PUT", "/catalogue/" + s1.ID + "/images", "", `[]`, 401},
+		{"PUT", "/catalogue/" + s1.ID + "/images", "secret", `{"url": "/a.jpg"}`, 400},
+		{"PUT", "/catalogue/" + s1.ID + "/images", "secret", `[{"url": "/a.jpg", "alt": "Argyle"}]`, 200},
+		{"GET", "/catalogue/" + s1.ID, "", "", 200},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s %s: want %d, have %d: %s", tc.method, tc.path, tc.code, rec.Code, rec.Body)
+		}
+		if tc.code == 201 {
+			if loc := rec.Header().Get("Location"); loc != "/catalogue/new" {
+				t.Errorf("%s %s: want Location /catalogue/new, have %q", tc.method, tc.path, loc)
+			}
+		}
+	}
+	if len(writer.written) != 4 {
+		t.Fatalf("want 4 writes, have %+v", writer.written)
+	}
+	if have := writer.written[1]; have.ID != s1.ID || have.Name != "Renamed" {
+		t.Errorf("PUT /catalogue/{id}: want the ID from the path, have %+v", have)
+	}
+	if have := writer.written[2]; have.Count != 7 {
+		t.Errorf("PUT /catalogue/{id}/stock: want count 7, have %d", have.Count)
+	}
+	if have := writer.written[3]; len(have.Images) != 1 || have.Images[0].Alt != "Argyle" {
+		t.Errorf("PUT /catalogue/{id}/images: want the image from the body, have %+v", have.Images)
+	}
+}